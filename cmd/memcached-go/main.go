@@ -0,0 +1,238 @@
+// Command memcached-go runs the server with the command line of stock memcached, so scripts and init files launching memcached
+// can launch it instead:
+//
+//	memcached-go -p 11211 -m 64 -c 1024 -t 4 -v
+//
+// Options of memcached this server has no counterpart for are accepted and ignored with a warning.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sonicwang/memcached-go-server/server"
+)
+
+// parseSize parses a memcached size: a number of bytes, or of kilobytes, megabytes or gigabytes with a k, m or g suffix.
+func parseSize(s string) (uint64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("missing size")
+	}
+	multiplier := uint64(1)
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		multiplier = 1 << 10
+	case "m":
+		multiplier = 1 << 20
+	case "g":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// extendedOptions maps the -o options of memcached to the options of the server. Every function gets the value following the
+// = sign, empty if there is none.
+var extendedOptions = map[string]func(value string) (server.Option, error){
+	"idle_timeout": func(value string) (server.Option, error) {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("idle_timeout must be a number of seconds")
+		}
+		return func(c *server.Config) { c.IdleTimeout = time.Duration(seconds) * time.Second }, nil
+	},
+	"hot_lru_pct": func(value string) (server.Option, error) {
+		pct, err := strconv.Atoi(value)
+		if err != nil || pct < 1 || pct > 80 {
+			return nil, fmt.Errorf("hot_lru_pct must be from 1 to 80")
+		}
+		return func(c *server.Config) { c.LRUHotPercent = pct }, nil
+	},
+	"warm_lru_pct": func(value string) (server.Option, error) {
+		pct, err := strconv.Atoi(value)
+		if err != nil || pct < 1 || pct > 80 {
+			return nil, fmt.Errorf("warm_lru_pct must be from 1 to 80")
+		}
+		return func(c *server.Config) { c.LRUWarmPercent = pct }, nil
+	},
+	"lru_segmented": func(string) (server.Option, error) {
+		return server.WithEvictionPolicy(server.EvictionSegmented), nil
+	},
+	"modern": func(string) (server.Option, error) {
+		return server.WithEvictionPolicy(server.EvictionSegmented), nil
+	},
+	"no_modern": func(string) (server.Option, error) {
+		return server.WithEvictionPolicy(server.EvictionLRU), nil
+	},
+	"lru_crawler": func(string) (server.Option, error) {
+		return func(c *server.Config) { c.SweepInterval = server.DefaultConfig().SweepInterval }, nil
+	},
+	"no_lru_crawler": func(string) (server.Option, error) {
+		return func(c *server.Config) { c.SweepInterval = 0 }, nil
+	},
+	"item_size_max": func(value string) (server.Option, error) {
+		size, err := parseSize(value)
+		if err != nil {
+			return nil, err
+		}
+		return server.WithMaxRequestSize(int(size)), nil
+	},
+	"ext_path": func(value string) (server.Option, error) {
+		// ext_path=/path/to/file:64m
+		i := strings.LastIndex(value, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("ext_path must be a path followed by :size")
+		}
+		size, err := parseSize(value[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		return func(c *server.Config) { c.ExtstorePath, c.ExtstoreSize = value[:i], size }, nil
+	},
+	"ext_item_size": func(value string) (server.Option, error) {
+		size, err := parseSize(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(c *server.Config) { c.ExtstoreItemSize = int(size) }, nil
+	},
+}
+
+// listeners returns the listeners of the -l interfaces, which may be separated by commas, on port. Interfaces given with a port keep it.
+func listeners(interfaces string, port int) []server.ListenerConfig {
+	var list []server.ListenerConfig
+	for _, host := range strings.Split(interfaces, ",") {
+		addr := host
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			addr = net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+		}
+		list = append(list, server.ListenerConfig{Addr: addr})
+	}
+	return list
+}
+
+func main() {
+	port := flag.Int("p", 11211, "TCP port to listen on, 0 to turn TCP off")
+	udpPort := flag.Int("U", 0, "UDP port to listen on; UDP is not supported, only 0 is")
+	socket := flag.String("s", "", "Unix domain socket path to listen on, which turns TCP off")
+	iface := flag.String("l", "", "interfaces to listen on, separated by commas (default all)")
+	memory := flag.Uint64("m", 64, "item memory in megabytes")
+	conns := flag.Int("c", 1024, "maximum simultaneous connections")
+	threads := flag.Int("t", 4, "number of threads serving connections at once")
+	itemSize := flag.String("I", "1m", "maximum item size, with a k or m suffix")
+	memoryFile := flag.String("e", "", "keep item memory in this memory mapped file to resume after a clean restart")
+	verbose := flag.Bool("v", false, "verbose: log connections and errors")
+	veryVerbose := flag.Bool("vv", false, "very verbose: also log commands")
+	extraVerbose := flag.Bool("vvv", false, "extremely verbose: also log the internal state")
+	version := flag.Bool("V", false, "print the version and exit")
+	daemon := flag.Bool("d", false, "run as a daemon")
+	pidFile := flag.String("P", "", "save the process ID in this file, only with -d")
+	noFlush := flag.Bool("F", false, "disable flush_all")
+	noDump := flag.Bool("X", false, "disable the dump commands")
+	sasl := flag.Bool("S", false, "require SASL authentication against the users file named by $MEMCACHED_SASL_PWDB")
+	var extended []string
+	flag.Func("o", "comma separated extended options, e.g. idle_timeout=60,hot_lru_pct=20; may be repeated", func(s string) error {
+		extended = append(extended, strings.Split(s, ",")...)
+		return nil
+	})
+	flag.Parse()
+	if *version {
+		fmt.Println("memcached", server.Version)
+		return
+	}
+
+	opts := []server.Option{
+		server.WithMaxMemory(*memory * 1024 * 1024),
+		server.WithMaxConns(*conns),
+		server.WithEvictionPolicy(server.EvictionSegmented),
+	}
+	switch {
+	case *socket != "":
+		opts = append(opts, server.WithListeners(server.ListenerConfig{Addr: "unix:" + *socket}))
+	case *port != 0:
+		opts = append(opts, server.WithListeners(listeners(*iface, *port)...))
+	default:
+		fmt.Fprintln(os.Stderr, "nothing to listen on: -p is 0 and -s is not set")
+		os.Exit(2)
+	}
+	if *udpPort != 0 {
+		fmt.Fprintln(os.Stderr, "warning: UDP is not supported, ignoring -U", *udpPort)
+	}
+	size, err := parseSize(*itemSize)
+	if err != nil || size < 1024 {
+		fmt.Fprintln(os.Stderr, "item size must be at least 1k:", *itemSize)
+		os.Exit(2)
+	}
+	opts = append(opts, server.WithMaxRequestSize(int(size)))
+	if *memoryFile != "" {
+		opts = append(opts, func(c *server.Config) { c.MemoryFile = *memoryFile })
+	}
+	level, verbosity := server.LogLevelWarn, server.VerbosityQuiet
+	switch {
+	case *extraVerbose:
+		level, verbosity = server.LogLevelDebug, server.VerbosityCommands
+	case *veryVerbose:
+		level, verbosity = server.LogLevelInfo, server.VerbosityCommands
+	case *verbose:
+		level, verbosity = server.LogLevelInfo, server.VerbosityConnections
+	}
+	opts = append(opts, func(c *server.Config) { c.LogLevel, c.Verbosity = level, verbosity })
+	for _, option := range extended {
+		name, value := option, ""
+		if i := strings.Index(option, "="); i >= 0 {
+			name, value = option[:i], option[i+1:]
+		}
+		parse, ok := extendedOptions[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "warning: ignoring unsupported option -o %s\n", option)
+			continue
+		}
+		opt, err := parse(value)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		opts = append(opts, opt)
+	}
+	if *sasl {
+		users := os.Getenv("MEMCACHED_SASL_PWDB")
+		if users == "" {
+			fmt.Fprintln(os.Stderr, "-S needs MEMCACHED_SASL_PWDB to name the users file")
+			os.Exit(2)
+		}
+		opts = append(opts, func(c *server.Config) { c.SASLUsersFile, c.RequireAuth = users, true })
+	}
+	opts = append(opts, func(c *server.Config) { c.DisableFlush, c.DisableDump = *noFlush, *noDump })
+	if *threads < 1 {
+		fmt.Fprintln(os.Stderr, "number of threads must be greater than 0")
+		os.Exit(2)
+	}
+	runtime.GOMAXPROCS(*threads)
+
+	if *daemon {
+		if *pidFile != "" {
+			if err := server.CheckPidFile(*pidFile); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			opts = append(opts, func(c *server.Config) { c.PidFile = *pidFile })
+		}
+		if err := server.Daemonize(); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to daemon() in order to daemonize:", err)
+			os.Exit(1)
+		}
+	}
+	server.NewServer(opts...).Start()
+}
@@ -1,7 +1,297 @@
 package main
 
-import "github.com/sonicwang/memcached-go-server/server"
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sonicwang/memcached-go-server/server"
+)
+
+// namespaceFlag collects repeated -namespace-quota flags.
+type namespaceFlag map[string]server.NamespaceQuota
+
+func (f namespaceFlag) String() string {
+	return fmt.Sprint(map[string]server.NamespaceQuota(f))
+}
+
+func (f namespaceFlag) Set(s string) error {
+	name, quota, err := server.ParseNamespaceQuota(s)
+	if err != nil {
+		return err
+	}
+	f[name] = quota
+	return nil
+}
+
+// listenFlag collects repeated -listen flags.
+type listenFlag []server.ListenerConfig
+
+func (f *listenFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *listenFlag) Set(s string) error {
+	lc, err := server.ParseListener(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, lc)
+	return nil
+}
+
+// configPath returns the value of the -config flag in args, which is needed before the other flags are parsed so they can override
+// the file.
+func configPath(args []string) string {
+	for i, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		switch {
+		case arg == "--" || !strings.HasPrefix(arg, "-"):
+			return ""
+		case name == "config" && i+1 < len(args):
+			return args[i+1]
+		case strings.HasPrefix(name, "config="):
+			return strings.TrimPrefix(name, "config=")
+		}
+	}
+	return ""
+}
+
+// daemonize detaches the process after checking the pidfile, so a second server fails before leaving the terminal.
+func daemonize(pidFile string) {
+	if pidFile != "" {
+		if err := server.CheckPidFile(pidFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if err := server.Daemonize(); err != nil {
+		fmt.Fprintln(os.Stderr, "error daemonizing:", err)
+		os.Exit(1)
+	}
+}
 
 func main() {
-	server.Start()
+	cfg := server.DefaultConfig()
+	if path := configPath(os.Args[1:]); path != "" {
+		if err := server.LoadConfigFile(path, &cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		cfg.ConfigFile = path
+	}
+	if err := server.LoadEnv(&cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	flag.String("config", "", "read settings from this TOML file; $MEMCACHED_* variables and flags override them")
+	var listeners listenFlag
+	flag.Var(&listeners, "listen", "listen on host:port[/binary|/ascii][,max_conns=<n>][,idle_timeout=<duration>][,auth=required|optional][,tls=true][,client_cert=required|optional][,proxy_protocol=true][,deny=<commands>], may be repeated (default localhost:3333)")
+	flag.StringVar(&cfg.WebSocketAddr, "websocket", cfg.WebSocketAddr, "listen for WebSocket clients on this address, e.g. :8080")
+	flag.Func("websocket-origin", "allow web pages of this origin, e.g. https://app.example.com, to open WebSocket connections, * for any, may be repeated (default the host of the listener)", func(s string) error {
+		cfg.WebSocketOrigins = append(cfg.WebSocketOrigins, s)
+		return nil
+	})
+	flag.StringVar(&cfg.AdminAddr, "admin", cfg.AdminAddr, "serve HTTP admin endpoints such as /metrics and /healthz on this address, e.g. :9150")
+	flag.BoolVar(&cfg.Pprof, "pprof", cfg.Pprof, "serve /debug/pprof on the admin address")
+	flag.DurationVar(&cfg.StatsLogInterval, "stats-log-interval", cfg.StatsLogInterval, "log a summary of the stats this often, 0 to disable")
+	flag.DurationVar(&cfg.SlowLogThreshold, "slow-log", cfg.SlowLogThreshold, "log commands taking at least this long, 0 to disable")
+	flag.StringVar(&cfg.AccessLogPath, "access-log", cfg.AccessLogPath, "append a line per command to this file")
+	flag.IntVar(&cfg.AccessLogSample, "access-log-sample", cfg.AccessLogSample, "log one in this many commands to the access log")
+	flag.BoolVar(&cfg.AccessLogKeys, "access-log-keys", cfg.AccessLogKeys, "write keys to the access log instead of their hashes")
+	flag.StringVar(&cfg.AuditLogPath, "audit-log", cfg.AuditLogPath, "record every mutation as a JSON line in this file")
+	auditSize := flag.Uint64("audit-log-size", 0, "rotate the audit log after this many megabytes, 0 never rotates it")
+	flag.IntVar(&cfg.AuditLogRetain, "audit-log-retain", cfg.AuditLogRetain, "number of audit log files to keep")
+	flag.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", cfg.OTLPEndpoint, "export a trace span per connection and command to this OTLP/HTTP collector, e.g. http://localhost:4318 (needs -tags otel)")
+	flag.StringVar(&cfg.QUICAddr, "quic", cfg.QUICAddr, "listen for QUIC clients on this UDP address (needs -tags quic)")
+	flag.StringVar(&cfg.TLSCertFile, "tls-cert", cfg.TLSCertFile, "PEM certificate file for encrypted listeners")
+	flag.StringVar(&cfg.TLSKeyFile, "tls-key", cfg.TLSKeyFile, "PEM private key file for encrypted listeners")
+	flag.IntVar(&cfg.MaxConnsPerIP, "max-conns-per-ip", cfg.MaxConnsPerIP, "connections served at once per client IP, 0 for no limit")
+	flag.IntVar(&cfg.ConnWorkers, "conn-workers", cfg.ConnWorkers, "serve connections with this many goroutines rather than one each, 0 for one each")
+	flag.IntVar(&cfg.ConnQueue, "conn-queue", cfg.ConnQueue, "accepted connections waiting for a free -conn-workers worker")
+	flag.StringVar(&cfg.ConnOverload, "conn-overload", cfg.ConnOverload, "what connections get when the workers are busy and the queue is full: reject or wait")
+	flag.IntVar(&cfg.ConnOpsPerSec, "conn-ops", cfg.ConnOpsPerSec, "commands a connection may send per second, 0 for no limit")
+	flag.IntVar(&cfg.ConnBytesPerSec, "conn-bytes", cfg.ConnBytesPerSec, "bytes a connection may transfer per second, 0 for no limit")
+	flag.IntVar(&cfg.IPOpsPerSec, "ip-ops", cfg.IPOpsPerSec, "commands the clients of an IP may send per second, 0 for no limit")
+	flag.IntVar(&cfg.IPBytesPerSec, "ip-bytes", cfg.IPBytesPerSec, "bytes the clients of an IP may transfer per second, 0 for no limit")
+	flag.StringVar(&cfg.RateLimitAction, "rate-limit-action", cfg.RateLimitAction, "what clients exceeding a rate limit get: delay, fail or disconnect")
+	flag.Func("allow-ip", "only admit clients in this CIDR block or with this IP, may be repeated", func(s string) error {
+		ipnet, err := server.ParseIPNet(s)
+		cfg.IPAllowlist = append(cfg.IPAllowlist, ipnet)
+		return err
+	})
+	flag.Func("deny-ip", "refuse clients in this CIDR block or with this IP, may be repeated", func(s string) error {
+		ipnet, err := server.ParseIPNet(s)
+		cfg.IPDenylist = append(cfg.IPDenylist, ipnet)
+		return err
+	})
+	flag.StringVar(&cfg.SASLUsersFile, "sasl-users", cfg.SASLUsersFile, "authenticate clients with SASL against this file of user:password-hash lines, see -hash-password")
+	flag.BoolVar(&cfg.PlainNeedsTLS, "plain-needs-tls", cfg.PlainNeedsTLS, "offer and accept SASL PLAIN on TLS connections only")
+	flag.BoolVar(&cfg.IsolateUsers, "isolate-users", cfg.IsolateUsers, "keep the keys of every authenticated user in its own namespace, needs -namespace-separator")
+	flag.Func("user-deny", "refuse commands to a user, as user=commands like app=@write|stats; an empty user means anonymous clients; may be repeated", func(s string) error {
+		user, acl, err := server.ParseUserACL(s)
+		if cfg.UserDeny == nil {
+			cfg.UserDeny = map[string]server.CommandACL{}
+		}
+		cfg.UserDeny[user] = acl
+		return err
+	})
+	flag.DurationVar(&cfg.AuthBackoff, "auth-backoff", cfg.AuthBackoff, "refuse authentications from an IP for this long after a failed one, doubling with every further failure, 0 to disable")
+	flag.IntVar(&cfg.AuthBanThreshold, "auth-ban-threshold", cfg.AuthBanThreshold, "ban an IP after this many failed authentications in a row, 0 to disable")
+	flag.DurationVar(&cfg.AuthBanDuration, "auth-ban-duration", cfg.AuthBanDuration, "how long -auth-ban-threshold bans an IP")
+	flag.BoolVar(&cfg.DisableFlush, "disable-flush", cfg.DisableFlush, "refuse flush_all and the other flush commands")
+	flag.BoolVar(&cfg.DisableDump, "disable-dump", cfg.DisableDump, "refuse the dump, lru_crawler metadump and backup commands")
+	flag.BoolVar(&cfg.RequireAuth, "require-auth", cfg.RequireAuth, "refuse commands of clients that didn't authenticate")
+	flag.StringVar(&cfg.TLSClientCAFile, "tls-client-ca", cfg.TLSClientCAFile, "PEM certificate authorities verifying client certificates of listeners with client_cert set")
+	flag.StringVar(&cfg.TLSIdentity, "tls-identity", cfg.TLSIdentity, "client certificate field naming the user: cn or san")
+	flag.DurationVar(&cfg.TLSReloadInterval, "tls-reload-interval", cfg.TLSReloadInterval, "how often to check the certificate files for changes, 0 to reload them on SIGHUP only")
+	maxMemory := flag.Uint64("m", 0, "item memory limit in megabytes, 0 for unlimited")
+	flag.IntVar(&cfg.MaxItems, "max-items", cfg.MaxItems, "item count limit, 0 for unlimited")
+	flag.Func("eviction", "eviction policy when the memory limit is hit: lru, lfu, tinylfu or segmented (default lru)", func(s string) error {
+		if !server.IsEvictionPolicy(s) {
+			return fmt.Errorf("unknown eviction policy %q", s)
+		}
+		cfg.EvictionPolicy = s
+		return nil
+	})
+	flag.IntVar(&cfg.LRUHotPercent, "lru-hot-percent", cfg.LRUHotPercent, "share of items in the HOT segment of the segmented policy, in percent")
+	flag.IntVar(&cfg.LRUWarmPercent, "lru-warm-percent", cfg.LRUWarmPercent, "share of items in the WARM segment of the segmented policy, in percent")
+	flag.IntVar(&cfg.LFUSamples, "lfu-samples", cfg.LFUSamples, "number of items the lfu policy picks its victim from")
+	flag.IntVar(&cfg.Shards, "shards", cfg.Shards, "number of store shards, rounded up to a power of two (default 4 x GOMAXPROCS)")
+	flag.Func("shard-hash", "hash function picking the shard of a key: fnv, xxhash or crc32-ketama (default fnv)", func(s string) error {
+		if !server.IsShardHash(s) {
+			return fmt.Errorf("unknown shard hash %q", s)
+		}
+		cfg.ShardHash = s
+		return nil
+	})
+	flag.BoolVar(&cfg.Slabs, "slabs", cfg.Slabs, "allocate item memory from slab size classes")
+	flag.StringVar(&cfg.MemoryFile, "e", cfg.MemoryFile, "keep item memory in this memory mapped file to resume after a clean restart (needs -m)")
+	flag.BoolVar(&cfg.OffHeap, "off-heap", cfg.OffHeap, "keep item memory outside the Go heap (needs -m)")
+	flag.DurationVar(&cfg.SlabCompactInterval, "slab-compact-interval", cfg.SlabCompactInterval, "how often to compact slab pages, 0 to disable")
+	flag.IntVar(&cfg.CompressThreshold, "compress-threshold", cfg.CompressThreshold, "gzip compress values of at least this many bytes (0 disables)")
+	flag.StringVar(&cfg.ExtstorePath, "ext-path", cfg.ExtstorePath, "file of the disk tier for values that don't fit in memory")
+	extSize := flag.Uint64("ext-size", 0, "size limit of the disk tier in megabytes, 0 for unlimited")
+	flag.IntVar(&cfg.ExtstoreItemSize, "ext-item-size", cfg.ExtstoreItemSize, "write values of at least this many bytes to the disk tier right away (0: only evicted values)")
+	flag.StringVar(&cfg.SnapshotPath, "snapshot", cfg.SnapshotPath, "file to snapshot the cache to")
+	flag.DurationVar(&cfg.SnapshotInterval, "snapshot-interval", cfg.SnapshotInterval, "how often to write the snapshot, 0 to disable")
+	flag.IntVar(&cfg.SnapshotChanges, "snapshot-changes", cfg.SnapshotChanges, "also write the snapshot after this many mutations, 0 to disable")
+	flag.IntVar(&cfg.SnapshotRetain, "snapshot-retain", cfg.SnapshotRetain, "number of snapshots to keep")
+	flag.BoolVar(&cfg.SnapshotLoad, "snapshot-load", cfg.SnapshotLoad, "load the snapshot at startup")
+	flag.StringVar(&cfg.BoltPath, "bolt", cfg.BoltPath, "keep items durably in this bbolt database (needs -tags bolt)")
+	flag.StringVar(&cfg.AOFPath, "aof", cfg.AOFPath, "append-only log of all mutations, replayed at startup")
+	flag.Func("aof-fsync", "when to sync the append-only log: always, everysec or no (default everysec)", func(s string) error {
+		if !server.IsAOFFsync(s) {
+			return fmt.Errorf("unknown fsync policy %q", s)
+		}
+		cfg.AOFFsync = s
+		return nil
+	})
+	flag.StringVar(&cfg.PersistKeyFile, "persist-key-file", cfg.PersistKeyFile, "AES key file encrypting snapshots and the append-only log (default $"+server.PersistKeyEnv+")")
+	flag.StringVar(&cfg.BackupBucket, "backup-bucket", cfg.BackupBucket, "S3 bucket[/prefix] the backup command uploads snapshots to (credentials from AWS_* variables)")
+	flag.StringVar(&cfg.BackupEndpoint, "backup-endpoint", cfg.BackupEndpoint, "S3 compatible endpoint URL (default AWS S3)")
+	flag.StringVar(&cfg.BackupRegion, "backup-region", cfg.BackupRegion, "region of the backup bucket (default us-east-1)")
+	flag.BoolVar(&cfg.BackupRestore, "backup-restore", cfg.BackupRestore, "load the latest backup at startup")
+	flag.StringVar(&cfg.ImportDump, "import-dump", cfg.ImportDump, "load items from a memcached-tool style dump file at startup")
+	flag.IntVar(&cfg.MaxRequestSize, "max-request-size", cfg.MaxRequestSize, "largest request body in bytes; larger items are built with append")
+	flag.IntVar(&cfg.TopKeysSampleRate, "top-keys-sample", cfg.TopKeysSampleRate, "sample one in this many key accesses for \"stats topkeys\", 0 to disable")
+	flag.DurationVar(&cfg.TopKeysInterval, "top-keys-interval", cfg.TopKeysInterval, "time covered by \"stats topkeys\"")
+	flag.IntVar(&cfg.HotKeySampleRate, "hot-key-sample", cfg.HotKeySampleRate, "sample one in this many key accesses for \"stats hotkeys\", 0 to disable")
+	flag.Func("ttl-jitter", "shorten item expirations randomly by up to this percentage, 0 to disable", func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > 100 {
+			return fmt.Errorf("jitter must be a percentage from 0 to 100")
+		}
+		cfg.TTLJitter = n
+		return nil
+	})
+	flag.Func("log-level", "least severe level logged: debug, info, warn or error (default info)", func(s string) error {
+		if !server.IsLogLevel(s) {
+			return fmt.Errorf("unknown log level %q", s)
+		}
+		cfg.LogLevel = s
+		return nil
+	})
+	flag.IntVar(&cfg.Verbosity, "verbosity", cfg.Verbosity, "log client activity: 0 none, 1 connections, 2 connections and commands")
+	flag.DurationVar(&cfg.LockTimeout, "lock-timeout", cfg.LockTimeout, "default lock time of GETL, 0 disables item locking")
+	flag.DurationVar(&cfg.LeaseTTL, "lease-ttl", cfg.LeaseTTL, "how long a lease-get lease stays valid, 0 to disable leases")
+	flag.Func("key-validation", "key rules: strict (no spaces or control characters) or lenient (any bytes) (default strict)", func(s string) error {
+		if !server.IsKeyValidation(s) {
+			return fmt.Errorf("unknown key validation %q", s)
+		}
+		cfg.KeyValidation = s
+		return nil
+	})
+	flag.StringVar(&cfg.NamespaceSeparator, "namespace-separator", cfg.NamespaceSeparator, "keys up to this separator name their namespace, e.g. \":\" (empty disables namespaces)")
+	namespaces := namespaceFlag{}
+	flag.Var(namespaces, "namespace-quota", "limit a namespace to name=megabytes[,items], may be repeated")
+	flag.DurationVar(&cfg.SweepInterval, "sweep-interval", cfg.SweepInterval, "how often expired items are swept, 0 to disable")
+	flag.DurationVar(&cfg.DrainTimeout, "drain-timeout", cfg.DrainTimeout, "how long a shutdown waits for connections to finish their command, 0 to wait as long as it takes")
+	flag.DurationVar(&cfg.IdleTimeout, "idle-timeout", cfg.IdleTimeout, "close connections idle for this long, 0 to keep them open")
+	flag.IntVar(&cfg.ReadBufferSize, "read-buffer", cfg.ReadBufferSize, "read buffer size of each connection in bytes, which bounds the length of a text command line")
+	flag.BoolVar(&cfg.EventLoop, "event-loop", cfg.EventLoop, "serve plain connections from an epoll event loop instead of a goroutine each, needs -idle-timeout (Linux only)")
+	flag.IntVar(&cfg.EventLoopWorkers, "event-loop-workers", cfg.EventLoopWorkers, "goroutines serving the connections of the event loop, 0 for four per CPU")
+	flag.StringVar(&cfg.PidFile, "pidfile", cfg.PidFile, "write the process ID to this file while serving; refuse to start if it names a running process")
+	daemon := flag.Bool("daemon", false, "detach from the terminal and run in the background")
+	inetd := flag.Bool("inetd", false, "serve a single session over stdin/stdout instead of listening")
+	check := flag.Bool("check", false, "check the settings, report every problem and exit without serving")
+	hashPassword := flag.Bool("hash-password", false, "read a password from stdin, print its hash for the -sasl-users file and exit")
+	hashScheme := flag.String("hash-scheme", server.HashPBKDF2SHA256, "scheme of -hash-password: "+server.HashPBKDF2SHA256+", or "+server.HashPBKDF2SHA1+" for SCRAM-SHA-1 clients")
+	flag.Parse()
+	if *hashPassword {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		hash, err := server.HashPasswordScheme(strings.TrimRight(password, "\r\n"), *hashScheme)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(hash)
+		return
+	}
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if set["m"] {
+		cfg.MaxMemory = *maxMemory * 1024 * 1024
+	}
+	if set["ext-size"] {
+		cfg.ExtstoreSize = *extSize * 1024 * 1024
+	}
+	if set["audit-log-size"] {
+		cfg.AuditLogMaxSize = int64(*auditSize * 1024 * 1024)
+	}
+	if len(namespaces) > 0 {
+		cfg.NamespaceQuotas = namespaces
+	}
+	if len(listeners) > 0 {
+		cfg.Listeners = listeners
+	}
+	if *check {
+		if err := cfg.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("settings OK")
+		return
+	}
+	if *daemon {
+		if *inetd {
+			fmt.Fprintln(os.Stderr, "-daemon can't be combined with -inetd")
+			os.Exit(2)
+		}
+		daemonize(cfg.PidFile)
+	}
+	srv := server.NewServer(server.WithConfig(cfg))
+	if *inetd {
+		srv.ServeStdio()
+		return
+	}
+	srv.Start()
 }
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// accessLogQueue bounds the lines waiting to be written. Lines beyond are dropped rather than slowing down commands.
+const accessLogQueue = 4096
+
+// accessEntry is the access log line of one command.
+type accessEntry struct {
+	time      time.Time
+	conn      uint64
+	op        string
+	key       string
+	status    string // Status of a binary reply in hex, the first word of a text reply, or - if there was none.
+	latency   time.Duration
+	reqBytes  int
+	respBytes int
+}
+
+// accessLog writes a line for one in every commands to a file, from its own goroutine. The lines are buffered
+// and flushed once a second or when the buffer fills.
+type accessLog struct {
+	path    string
+	file    *os.File
+	reopen  chan struct{} // Asks run to reopen the file, see rotateLogs.
+	lines   chan accessEntry
+	every   uint64
+	seq     uint64 // Commands seen, to pick the sampled ones. Updated atomically.
+	keys    bool   // Log keys as sent instead of a hash of them.
+	written uint64 // Updated atomically.
+	dropped uint64 // Lines lost to a full queue. Updated atomically.
+	log     Logger // Receives the errors writing the file.
+}
+
+// openAccessLog opens the access log configured by cfg, appending to its file. Errors writing it go to log.
+func openAccessLog(cfg Config, log Logger) (*accessLog, error) {
+	file, err := os.OpenFile(cfg.AccessLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	sample := uint64(1)
+	if cfg.AccessLogSample > 1 {
+		sample = uint64(cfg.AccessLogSample)
+	}
+	l := &accessLog{path: cfg.AccessLogPath, file: file, reopen: make(chan struct{}, 1), lines: make(chan accessEntry, accessLogQueue),
+		every: sample, keys: cfg.AccessLogKeys, log: log}
+	go l.run()
+	return l, nil
+}
+
+// startAccessLog enables the access log of s, failing if its file can't be opened.
+func (s *Server) startAccessLog() error {
+	l, err := openAccessLog(s.config, s.logger())
+	if err != nil {
+		return fmt.Errorf("opening access log: %v", err)
+	}
+	s.access = l
+	return nil
+}
+
+// sample reports whether the next command is logged. l may be nil if there is no access log.
+func (l *accessLog) sample() bool {
+	return l != nil && atomic.AddUint64(&l.seq, 1)%l.every == 0
+}
+
+// push queues the line of a command.
+func (l *accessLog) push(e accessEntry) {
+	select {
+	case l.lines <- e:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+func (l *accessLog) run() {
+	w := bufio.NewWriter(l.file)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var line []byte
+	for {
+		select {
+		case e := <-l.lines:
+			line = l.format(line[:0], e)
+			if _, err := w.Write(line); err != nil {
+				l.log.Error("error writing access log", "err", err)
+			}
+			atomic.AddUint64(&l.written, 1)
+		case <-ticker.C:
+			if err := w.Flush(); err != nil {
+				l.log.Error("error writing access log", "err", err)
+			}
+		case <-l.reopen:
+			if err := w.Flush(); err != nil {
+				l.log.Error("error writing access log", "err", err)
+			}
+			file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				// Keep writing to the old file rather than losing lines.
+				l.log.Error("error opening access log", "path", l.path, "err", err)
+				continue
+			}
+			l.file.Close()
+			l.file = file
+			w.Reset(file)
+		}
+	}
+}
+
+// format appends the line of e to b, e.g. "2006-01-02T15:04:05.000000Z conn=1 op=get key_hash=af63bd4c8601b7df status=0x0000
+// latency_us=12 req_bytes=25 resp_bytes=33".
+func (l *accessLog) format(b []byte, e accessEntry) []byte {
+	b = e.time.UTC().AppendFormat(b, "2006-01-02T15:04:05.000000Z")
+	b = append(b, " conn="...)
+	b = strconv.AppendUint(b, e.conn, 10)
+	b = append(b, " op="...)
+	b = append(b, e.op...)
+	if e.key == "" {
+		// Keyless command, or the key couldn't be read.
+	} else if l.keys {
+		b = append(b, " key="...)
+		b = strconv.AppendQuote(b, e.key)
+	} else {
+		h := fnv.New64a()
+		h.Write([]byte(e.key))
+		b = append(b, " key_hash="...)
+		b = append(b, fmt.Sprintf("%016x", h.Sum64())...)
+	}
+	b = append(b, " status="...)
+	b = append(b, e.status...)
+	b = append(b, " latency_us="...)
+	b = strconv.AppendInt(b, e.latency.Microseconds(), 10)
+	b = append(b, " req_bytes="...)
+	b = strconv.AppendInt(b, int64(e.reqBytes), 10)
+	b = append(b, " resp_bytes="...)
+	b = strconv.AppendInt(b, int64(e.respBytes), 10)
+	return append(b, '\n')
+}
+
+func (l *accessLog) stats() []Stat {
+	return []Stat{
+		{"access_log_lines", strconv.FormatUint(atomic.LoadUint64(&l.written), 10)},
+		{"access_log_dropped", strconv.FormatUint(atomic.LoadUint64(&l.dropped), 10)},
+	}
+}
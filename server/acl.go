@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrAccessDenied fails the commands a CommandACL denies to the client.
+var ErrAccessDenied = errors.New("Access denied")
+
+// ErrCommandDisabled fails the commands DisableFlush and DisableDump turn off for all clients.
+var ErrCommandDisabled = errors.New("Command disabled")
+
+// flushCommands and dumpCommands are the commands DisableFlush and DisableDump turn off, as aclCommand names them.
+var (
+	flushCommands = map[string]bool{"flush": true, "flush_namespace": true}
+	dumpCommands  = map[string]bool{"dump": true, "lru_crawler": true, "backup": true}
+)
+
+// aclAliases maps the commands of both protocols doing the same to the name ACLs know them by, like the quiet binary
+// commands to the loud ones.
+var aclAliases = map[string]string{
+	"getq": "get", "getk": "get", "getkq": "get", "setq": "set", "addq": "add", "replaceq": "replace", "deleteq": "delete",
+	"incrq": "incr", "decrq": "decr", "appendq": "append", "prependq": "prepend", "gatq": "gat", "flushq": "flush",
+	"flush_all": "flush", "stat": "stats",
+}
+
+// commandClasses are the groups of commands ACLs can name at once, by the name starting with @.
+var commandClasses = map[string]map[string]bool{
+	"@read": {"get": true, "lease-get": true},
+	"@write": {
+		"set": true, "add": true, "replace": true, "append": true, "prepend": true, "delete": true, "incr": true, "decr": true,
+		"touch": true, "gat": true, "swap": true, "getl": true, "unl": true, "lease-set": true, "flush": true,
+		"flush_namespace": true,
+	},
+	"@admin": {
+		"flush": true, "flush_namespace": true, "stats": true, "conns": true, "conn": true, "slabs": true, "backup": true,
+		"dump": true, "lru_crawler": true, "profile": true, "trace_key": true, "config": true, "verbosity": true,
+		"refresh_certs": true,
+	},
+}
+
+// aclCommand returns the name ACLs know the command name by.
+func aclCommand(name string) string {
+	if alias, ok := aclAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+// CommandACL is a set of commands denied to clients, named like in the text protocol or in classes of commands: @read,
+// @write (including flushes) and @admin (stats, flushes, dumps and the other commands changing or inspecting the server).
+// Binary commands are named like their text counterparts, quiet ones like the others.
+type CommandACL map[string]bool
+
+// ParseCommandACL parses a list of command and class names separated by |, like @write|stats. Command names aren't checked,
+// as handlers may be added later; Config.Validate reports unknown ones.
+func ParseCommandACL(s string) (CommandACL, error) {
+	acl := CommandACL{}
+	for _, name := range strings.Split(s, "|") {
+		if _, ok := commandClasses[name]; !ok && (name == "" || strings.HasPrefix(name, "@")) {
+			return nil, fmt.Errorf("unknown command class %q in %q, expected @read, @write or @admin", name, s)
+		}
+		acl[aclCommand(name)] = true
+	}
+	return acl, nil
+}
+
+// unknownCommand returns a name of acl naming neither a command nor a class, empty if there is none.
+func (acl CommandACL) unknownCommand() string {
+	text := textOpHandlers()
+	for name := range acl {
+		if _, ok := commandClasses[name]; ok {
+			continue
+		}
+		if _, ok := text[name]; ok {
+			continue
+		}
+		known := false
+		for _, op := range opcodeNames {
+			known = known || aclCommand(op) == name
+		}
+		if !known {
+			return name
+		}
+	}
+	return ""
+}
+
+func (acl CommandACL) String() string {
+	names := make([]string, 0, len(acl))
+	for name := range acl {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, "|")
+}
+
+// denies reports whether the ACL denies the command name, as returned by aclCommand.
+func (acl CommandACL) denies(name string) bool {
+	if acl[name] {
+		return true
+	}
+	for class := range acl {
+		if commandClasses[class][name] {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseUserACL parses the ACL of a user in the form user=commands, see ParseCommandACL. An empty user name applies to clients
+// that didn't authenticate.
+func ParseUserACL(s string) (string, CommandACL, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return "", nil, fmt.Errorf("expected user=commands in %q", s)
+	}
+	acl, err := ParseCommandACL(s[i+1:])
+	return s[:i], acl, err
+}
+
+func (s *Server) userDeny() map[string]CommandACL {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.config.UserDeny
+}
+
+// checkACL returns ErrCommandDisabled if the settings turn the command name off, or ErrAccessDenied if the listener of the
+// client or its user deny it.
+func (ctx *ConnectionContext) checkACL(name string) error {
+	name = aclCommand(name)
+	if c := &ctx.server.config; c.DisableFlush && flushCommands[name] || c.DisableDump && dumpCommands[name] {
+		return ErrCommandDisabled
+	}
+	if ctx.listener.Deny.denies(name) || ctx.server.userDeny()[ctx.User].denies(name) {
+		atomic.AddUint64(&ctx.server.counters.aclDenied, 1)
+		return ErrAccessDenied
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// startAdmin serves the admin endpoints on addr: /metrics for Prometheus, /debug/vars for expvar, /healthz and /readyz for
+// liveness and readiness probes, and /debug/pprof if enabled. It returns once s is shut down, or with the error the listener
+// failed with.
+func (s *Server) startAdmin(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/debug/vars", s.handleVars)
+	mux.Handle("/healthz", healthHandler(s.liveness))
+	mux.Handle("/readyz", healthHandler(s.readiness))
+	registerPprof(mux, s.config.Pprof)
+	l, err := s.openListener("admin "+addr, func() (net.Listener, error) { return net.Listen("tcp", addr) })
+	if err != nil {
+		return fmt.Errorf("listening on %s: %v", addr, err)
+	}
+	if !s.track(l, false) {
+		return nil
+	}
+	s.logger().Info("serving admin endpoints", "addr", addr)
+	err = http.Serve(l, mux)
+	if s.stopping() {
+		return nil
+	}
+	return fmt.Errorf("serving admin endpoints: %v", err)
+}
@@ -0,0 +1,409 @@
+package server
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Fsync policies of the append-only log.
+const (
+	AOFFsyncAlways   = "always"   // Sync after every mutation.
+	AOFFsyncEverySec = "everysec" // Sync once a second, losing at most a second of mutations on a crash.
+	AOFFsyncNo       = "no"       // Leave syncing to the operating system.
+)
+
+// IsAOFFsync reports whether name is a known fsync policy.
+func IsAOFFsync(name string) bool {
+	return name == AOFFsyncAlways || name == AOFFsyncEverySec || name == AOFFsyncNo
+}
+
+// Append-only log record types. Mutations are journaled by their outcome, so replaying a record twice is harmless.
+const (
+	aofSet    = 's' // Item stored by set, add, replace or incr/decr.
+	aofDelete = 'd'
+	aofTouch  = 't' // New expiration of an item. Carries no value.
+	aofMeta   = 'm' // New flags and expiration of an item. Carries no value.
+	aofFlush  = 'f' // Flush, delayed until the expiration of the record if set. With a key, only that namespace is flushed.
+
+	aofEncrypted = 'e' // Frame holding one of the records above, encrypted with AES-GCM.
+)
+
+// aofLog appends mutation records to a file. A record is the type byte, an item header, key, value and a CRC32 of all of them.
+// With an encryption key configured, each record is written as an encrypted frame instead.
+type aofLog struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	fsync   string
+	size    int64       // Guarded by mutex.
+	dirty   bool        // Written since the last sync. Guarded by mutex.
+	records uint64      // Updated atomically.
+	buf     []byte      // Record being encoded. Guarded by mutex.
+	sealed  []byte      // Encrypted record. Guarded by mutex.
+	aead    cipher.AEAD // Encrypts the records. nil writes them in plaintext.
+}
+
+// openAOF opens the log at path for appending, encrypting the records with aead unless it is nil.
+func openAOF(path, fsync string, aead cipher.AEAD) (*aofLog, error) {
+	l := &aofLog{path: path, fsync: fsync, aead: aead}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	if fsync == AOFFsyncEverySec {
+		go l.syncer()
+	}
+	return l, nil
+}
+
+func (l *aofLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+// append writes one record.
+func (l *aofLog) append(op byte, key string, val SimpleValue) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	b := append(l.buf[:0], op)
+	b = append(b, make([]byte, itemHeaderLen)...)
+	encodeItemHeader(b[1:], key, val)
+	b = append(b, key...)
+	b = append(b, val.RawData...)
+	b = append(b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], crc32.ChecksumIEEE(b[:len(b)-4]))
+	l.buf = b
+	if l.aead != nil {
+		sealed, err := sealFrame(l.aead, append(l.sealed[:0], aofEncrypted), b, nil)
+		if err != nil {
+			return err
+		}
+		l.sealed, b = sealed, sealed
+	}
+	if _, err := l.file.Write(b); err != nil {
+		return err
+	}
+	l.size += int64(len(b))
+	atomic.AddUint64(&l.records, 1)
+	if l.fsync == AOFFsyncAlways {
+		return l.file.Sync()
+	}
+	l.dirty = true
+	return nil
+}
+
+// syncer implements the everysec policy.
+func (l *aofLog) syncer() {
+	for range time.Tick(time.Second) {
+		l.mutex.Lock()
+		if l.dirty {
+			l.file.Sync()
+			l.dirty = false
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// rotatedPath holds the records from before the snapshot in progress.
+func (l *aofLog) rotatedPath() string {
+	return l.path + ".prev"
+}
+
+// rotate starts a new log before a snapshot is taken. Once the snapshot is written, dropRotated deletes the old log.
+// If an earlier snapshot failed and its old log still exists, the current log just keeps growing.
+func (l *aofLog) rotate() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, err := os.Stat(l.rotatedPath()); err == nil {
+		return nil
+	}
+	l.file.Sync()
+	l.file.Close()
+	if err := os.Rename(l.path, l.rotatedPath()); err != nil {
+		l.open()
+		return err
+	}
+	return l.open()
+}
+
+// dropRotated deletes the log rotated away before a now completed snapshot.
+func (l *aofLog) dropRotated() {
+	os.Remove(l.rotatedPath())
+}
+
+func (l *aofLog) stats() []Stat {
+	l.mutex.Lock()
+	size := l.size
+	l.mutex.Unlock()
+	return []Stat{
+		{"aof_fsync", l.fsync},
+		{"aof_bytes", strconv.FormatInt(size, 10)},
+		{"aof_records", strconv.FormatUint(atomic.LoadUint64(&l.records), 10)},
+	}
+}
+
+// ReplayAOF applies the records of the log at path, and of a log rotated away by an unfinished snapshot, to store.
+// A torn record at the end of the log, left by a crash, is cut off. Other damage fails the replay.
+// Encrypted records are read with the key and flushed namespaces split by the separator of Settings.
+func ReplayAOF(store Store, path string) (records int, err error) {
+	aead, err := settingsPersistKey()
+	if err != nil {
+		return 0, err
+	}
+	return replayAOF(store, path, aead, Settings.NamespaceSeparator, configLogger(Settings))
+}
+
+// replayAOF implements ReplayAOF, decrypting the records with aead and logging a cut off end to log.
+func replayAOF(store Store, path string, aead cipher.AEAD, separator string, log Logger) (records int, err error) {
+	l := &aofLog{path: path}
+	n, err := replayAOFFile(store, l.rotatedPath(), false, aead, separator, log)
+	records += n
+	if err != nil && !os.IsNotExist(err) {
+		return records, err
+	}
+	n, err = replayAOFFile(store, path, true, aead, separator, log)
+	return records + n, err
+}
+
+// readAOFRecord reads the next record, decrypting it with aead if needed, and verifies its checksum. n is the number of bytes read.
+func readAOFRecord(r *bufio.Reader, aead cipher.AEAD) (record []byte, n int, err error) {
+	op, err := r.Peek(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	if op[0] == aofEncrypted {
+		if aead == nil {
+			return nil, 0, ErrNoPersistKey
+		}
+		r.Discard(1)
+		record, n, err = openFrame(aead, r, nil)
+		if err == io.EOF {
+			return nil, 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, 0, err
+		}
+		n++
+		if len(record) < 1+itemHeaderLen+4 {
+			return nil, 0, errors.New("Encrypted record too short")
+		}
+	} else {
+		hdr := make([]byte, 1+itemHeaderLen)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		keyLen, valLen, _, _ := decodeItemHeader(hdr[1:])
+		record = append(hdr, make([]byte, keyLen+valLen+4)...)
+		if _, err := io.ReadFull(r, record[len(hdr):]); err != nil {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		n = len(record)
+	}
+	if crc32.ChecksumIEEE(record[:len(record)-4]) != binary.BigEndian.Uint32(record[len(record)-4:]) {
+		return nil, 0, errors.New("Checksum mismatch")
+	}
+	return record, n, nil
+}
+
+func replayAOFFile(store Store, path string, truncate bool, aead cipher.AEAD, separator string, log Logger) (records int, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var good int64
+	for {
+		var record []byte
+		var n int
+		if record, n, err = readAOFRecord(r, aead); err != nil {
+			break
+		}
+		good += int64(n)
+		keyLen, valLen, val, live := decodeItemHeader(record[1:])
+		body := record[1+itemHeaderLen:]
+		if keyLen+valLen+4 != len(body) {
+			err = errors.New("Bad record length")
+			break
+		}
+		key := string(body[:keyLen])
+		val.RawData = body[keyLen : keyLen+valLen]
+		switch {
+		case record[0] == aofFlush && key != "":
+			flushNamespace(store, key, separator)
+		case record[0] == aofFlush:
+			store.Flush(val.TTL)
+		case record[0] == aofDelete || !live:
+			store.Delete(key, 0)
+		case record[0] == aofSet:
+			restoreItem(store, key, val)
+		case record[0] == aofTouch:
+			store.Touch(key, val.TTL)
+		case record[0] == aofMeta:
+			updateMeta(store, key, val.TTL, &val.Flag, 0)
+		}
+		records++
+	}
+	if err == io.EOF {
+		return records, nil
+	}
+	if truncate && err == io.ErrUnexpectedEOF {
+		log.Warn("cutting off damaged end of append-only log", "path", path, "records", records, "offset", good, "err", err)
+		return records, f.Truncate(good)
+	}
+	return records, err
+}
+
+// aofStripes is the number of locks serializing mutations of keys with the same hash, so that their records are logged in the order they were applied.
+const aofStripes = 64
+
+// aofStore journals every successful mutation of the wrapped store to an append-only log.
+type aofStore struct {
+	Store
+	log       *aofLog
+	separator string // NamespaceSeparator of the server.
+	logger    Logger // Logger of the server, receiving the write errors.
+	stripes   [aofStripes]sync.Mutex
+}
+
+func newAOFStore(store Store, log *aofLog, separator string, logger Logger) *aofStore {
+	return &aofStore{Store: store, log: log, separator: separator, logger: logger}
+}
+
+// Unwrap returns the journaled store.
+func (a *aofStore) Unwrap() Store {
+	return a.Store
+}
+
+func (a *aofStore) GetBytes(key []byte) (SimpleValue, bool) {
+	return getBytes(a.Store, key)
+}
+
+func (a *aofStore) stripe(key string) *sync.Mutex {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &a.stripes[h%aofStripes]
+}
+
+func (a *aofStore) record(op byte, key string, val SimpleValue) {
+	if err := a.log.append(op, key, val); err != nil {
+		a.logger.Error("error writing append-only log", "err", err)
+	}
+}
+
+func (a *aofStore) Set(key string, val SimpleValue, cas uint64, replace bool) (SimpleValue, error) {
+	m := a.stripe(key)
+	m.Lock()
+	defer m.Unlock()
+	stored, err := a.Store.Set(key, val, cas, replace)
+	if err == nil {
+		val.CAS = stored.CAS
+		a.record(aofSet, key, val)
+	}
+	return stored, err
+}
+
+func (a *aofStore) Add(key string, val SimpleValue) (SimpleValue, error) {
+	m := a.stripe(key)
+	m.Lock()
+	defer m.Unlock()
+	stored, err := a.Store.Add(key, val)
+	if err == nil {
+		val.CAS = stored.CAS
+		a.record(aofSet, key, val)
+	}
+	return stored, err
+}
+
+func (a *aofStore) Delete(key string, cas uint64) error {
+	m := a.stripe(key)
+	m.Lock()
+	defer m.Unlock()
+	err := a.Store.Delete(key, cas)
+	if err == nil {
+		a.record(aofDelete, key, SimpleValue{})
+	}
+	return err
+}
+
+func (a *aofStore) Touch(key string, ttl int) (SimpleValue, bool) {
+	m := a.stripe(key)
+	m.Lock()
+	defer m.Unlock()
+	val, ok := a.Store.Touch(key, ttl)
+	if ok {
+		a.record(aofTouch, key, SimpleValue{TTL: ttl})
+	}
+	return val, ok
+}
+
+func (a *aofStore) UpdateMeta(key string, ttl int, flags *uint32, cas uint64) (SimpleValue, error) {
+	m := a.stripe(key)
+	m.Lock()
+	defer m.Unlock()
+	val, err := updateMeta(a.Store, key, ttl, flags, cas)
+	switch {
+	case err != nil:
+	case flags == nil:
+		a.record(aofTouch, key, SimpleValue{TTL: ttl})
+	default:
+		a.record(aofMeta, key, SimpleValue{Flag: *flags, TTL: ttl})
+	}
+	return val, err
+}
+
+func (a *aofStore) Incr(key string, delta uint64, decr bool, initial uint64, create bool, ttl int, cas uint64) (SimpleValue, uint64, error) {
+	m := a.stripe(key)
+	m.Lock()
+	defer m.Unlock()
+	val, n, err := a.Store.Incr(key, delta, decr, initial, create, ttl, cas)
+	if err == nil {
+		a.record(aofSet, key, val)
+	}
+	return val, n, err
+}
+
+func (a *aofStore) Flush(at int) {
+	for i := range a.stripes {
+		a.stripes[i].Lock()
+	}
+	a.Store.Flush(at)
+	a.record(aofFlush, "", SimpleValue{TTL: at})
+	for i := range a.stripes {
+		a.stripes[i].Unlock()
+	}
+}
+
+func (a *aofStore) FlushNamespace(name string) {
+	for i := range a.stripes {
+		a.stripes[i].Lock()
+	}
+	flushNamespace(a.Store, name, a.separator)
+	a.record(aofFlush, name, SimpleValue{})
+	for i := range a.stripes {
+		a.stripes[i].Unlock()
+	}
+}
+
+func (a *aofStore) Stats() []Stat {
+	return append(a.Store.Stats(), a.log.stats()...)
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// AuditRecord describes one mutation for the audit log.
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"`             // Command name, e.g. set, delete or flush_all.
+	Key    string    `json:"key,omitempty"`  // Key written, or the namespace of flush_namespace. Empty for flushes of the whole store.
+	Size   int       `json:"size"`           // Bytes of the value written, 0 for commands without a value.
+	Addr   string    `json:"addr"`           // Remote address of the client.
+	User   string    `json:"user,omitempty"` // Authenticated user. Empty for anonymous clients.
+	CAS    uint64    `json:"cas,omitempty"`  // CAS value of the item after the mutation, or the one the client asserted if it failed.
+	Status string    `json:"status"`         // ok, or the error the command failed with.
+}
+
+// AuditSink receives the audit records of all mutations, from the goroutine writing the audit log.
+type AuditSink func(AuditRecord)
+
+// auditQueue bounds the records waiting to be written. Unlike access log lines audit records are never dropped;
+// mutations wait for room instead.
+const auditQueue = 4096
+
+// auditLog writes audit records as JSON lines to a file rotated by size, and passes them to a sink.
+type auditLog struct {
+	records chan AuditRecord
+	path    string
+	maxSize int64
+	retain  int
+	sink    AuditSink
+	file    *os.File
+	out     *bufio.Writer
+	size    int64
+	reopen  chan struct{} // Asks run to reopen the file, see rotateLogs.
+	log     Logger        // Receives the errors writing the file.
+}
+
+// startAudit enables the audit log of s, failing if its file can't be opened.
+func (s *Server) startAudit() error {
+	a := &auditLog{records: make(chan AuditRecord, auditQueue), path: s.config.AuditLogPath, maxSize: s.config.AuditLogMaxSize,
+		retain: s.config.AuditLogRetain, sink: s.config.AuditSink, reopen: make(chan struct{}, 1), log: s.logger()}
+	if a.path != "" {
+		if err := a.open(); err != nil {
+			return fmt.Errorf("opening audit log: %v", err)
+		}
+	}
+	s.auditor = a
+	go a.run()
+	return nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file, a.out, a.size = f, bufio.NewWriter(f), fi.Size()
+	return nil
+}
+
+// rotate moves the current file to path.1, older ones one generation further back, keeping retain files in total.
+func (a *auditLog) rotate() error {
+	if err := a.out.Flush(); err != nil {
+		return err
+	}
+	a.file.Close()
+	a.file, a.out = nil, nil
+	for n := a.retain - 1; n >= 1; n-- {
+		from := a.path
+		if n > 1 {
+			from += "." + strconv.Itoa(n-1)
+		}
+		if err := os.Rename(from, a.path+"."+strconv.Itoa(n)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if a.retain <= 1 {
+		os.Remove(a.path)
+	}
+	return a.open()
+}
+
+func (a *auditLog) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case r := <-a.records:
+			if a.sink != nil {
+				a.sink(r)
+			}
+			if a.path != "" {
+				a.write(r)
+			}
+		case <-ticker.C:
+			if a.out != nil {
+				if err := a.out.Flush(); err != nil {
+					a.log.Error("error writing audit log", "err", err)
+				}
+			}
+		case <-a.reopen:
+			if a.file == nil {
+				continue
+			}
+			if err := a.out.Flush(); err != nil {
+				a.log.Error("error writing audit log", "err", err)
+			}
+			a.file.Close()
+			a.file, a.out = nil, nil
+			// write opens the file again if this fails.
+			if err := a.open(); err != nil {
+				a.log.Error("error opening audit log", "path", a.path, "err", err)
+			}
+		}
+	}
+}
+
+func (a *auditLog) write(r AuditRecord) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		a.log.Error("error encoding audit record", "err", err)
+		return
+	}
+	line = append(line, '\n')
+	if a.file == nil {
+		// A failed rotation left no file open.
+		if err := a.open(); err != nil {
+			a.log.Error("error opening audit log", "path", a.path, "err", err)
+			return
+		}
+	}
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			a.log.Error("error rotating audit log", "err", err)
+			if a.file == nil {
+				return
+			}
+		}
+	}
+	n, err := a.out.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		a.log.Error("error writing audit log", "err", err)
+	}
+}
+
+// auditCAS returns the CAS value recorded for a mutation: the one of the item written, or the one asserted by the client if it failed.
+func auditCAS(stored, asserted uint64, err error) uint64 {
+	if err != nil {
+		return asserted
+	}
+	return stored
+}
+
+// audit records a mutation requested on the connection of ctx, with the error the store returned for it and the user the
+// client authenticated as.
+func audit(ctx *ConnectionContext, op, key string, size int, cas uint64, err error) {
+	if ctx.server.auditor == nil {
+		return
+	}
+	ctx.server.auditFrom(ctx.ConnHandle.RemoteAddr().String(), ctx.User, op, key, size, cas, err)
+}
+
+// auditFrom records a mutation of the store of s requested by the client at addr, authenticated as user if not empty.
+func (s *Server) auditFrom(addr, user, op, key string, size int, cas uint64, err error) {
+	if s.auditor == nil {
+		return
+	}
+	status := "ok"
+	if err != nil {
+		status = err.Error()
+	}
+	s.auditor.records <- AuditRecord{Time: time.Now(), Op: op, Key: key, Size: size, Addr: addr, User: user, CAS: cas, Status: status}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// maxAuthBackoff caps the doubling backoff of AuthBackoff.
+const maxAuthBackoff = time.Minute
+
+// authFailureExpiry is how long the failed authentications of an IP are remembered after its last one.
+const authFailureExpiry = time.Hour
+
+// authFailures are the failed SASL authentications of a remote IP.
+type authFailures struct {
+	count  int       // Failures since the last success or ban.
+	last   time.Time // Time of the last failure.
+	until  time.Time // End of the backoff or ban.
+	banned bool      // Set if until ends a ban rather than a backoff.
+}
+
+// authThrottle tracks the failed authentications of remote IPs for AuthBackoff and AuthBanThreshold. Clients without an IP,
+// like those of Unix domain sockets, aren't tracked.
+type authThrottle struct {
+	mutex   sync.Mutex
+	ips     map[string]*authFailures
+	pruneAt int // Size of ips at which fail drops the IPs it needn't remember anymore.
+}
+
+type authThrottleSettings struct {
+	backoff     time.Duration
+	threshold   int
+	banDuration time.Duration
+}
+
+func (s *Server) authThrottling() authThrottleSettings {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return authThrottleSettings{s.config.AuthBackoff, s.config.AuthBanThreshold, s.config.AuthBanDuration}
+}
+
+// wait returns how long until ip may authenticate again, and whether it is banned until then rather than backing off.
+func (t *authThrottle) wait(ip string) (time.Duration, bool) {
+	if ip == "unix" {
+		return 0, false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	f := t.ips[ip]
+	if f == nil {
+		return 0, false
+	}
+	wait := time.Until(f.until)
+	if wait <= 0 {
+		return 0, false
+	}
+	return wait, f.banned
+}
+
+// fail records a failed authentication of ip. It returns how long the IP has to wait before authenticating again, and whether
+// it is banned for that long after failing AuthBanThreshold times in a row. Otherwise the wait starts at AuthBackoff and
+// doubles with every further failure, up to maxAuthBackoff. ts are the settings of the server.
+func (t *authThrottle) fail(ip string, ts authThrottleSettings) (time.Duration, bool) {
+	if ip == "unix" {
+		return 0, false
+	}
+	now := time.Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	f := t.ips[ip]
+	if f == nil || now.Sub(f.last) > authFailureExpiry && !now.Before(f.until) {
+		if t.ips == nil {
+			t.ips = map[string]*authFailures{}
+		}
+		if len(t.ips) >= t.pruneAt {
+			t.prune(now)
+		}
+		f = &authFailures{}
+		t.ips[ip] = f
+	}
+	f.count++
+	f.last = now
+	if ts.threshold > 0 && f.count >= ts.threshold {
+		f.count, f.until, f.banned = 0, now.Add(ts.banDuration), true
+		return ts.banDuration, true
+	}
+	wait := ts.backoff
+	for i := 1; i < f.count && wait < maxAuthBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxAuthBackoff {
+		wait = maxAuthBackoff
+	}
+	f.until, f.banned = now.Add(wait), false
+	return wait, false
+}
+
+// prune drops the IPs whose failures expired and that don't have to wait, and sets the size for the next pruning.
+func (t *authThrottle) prune(now time.Time) {
+	for ip, f := range t.ips {
+		if now.Sub(f.last) > authFailureExpiry && !now.Before(f.until) {
+			delete(t.ips, ip)
+		}
+	}
+	if t.pruneAt = 2 * len(t.ips); t.pruneAt < 1024 {
+		t.pruneAt = 1024
+	}
+}
+
+// succeed forgets the failures of ip after it authenticated.
+func (t *authThrottle) succeed(ip string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.ips, ip)
+}
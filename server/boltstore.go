@@ -0,0 +1,253 @@
+//go:build bolt
+
+package server
+
+import (
+	"encoding/binary"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("items")
+
+// boltValueHeaderLen is the length of flags, CAS and unix expiration stored in front of every value.
+const boltValueHeaderLen = 4 + 8 + 8
+
+// BoltStore is a durable Store keeping all items in a bbolt database file. Every mutation is committed to disk before it is acknowledged.
+// Expired items are dropped when they are accessed. There is no memory limit or eviction.
+type BoltStore struct {
+	db   *bolt.DB
+	path string
+	cas  casCounter
+}
+
+// NewBoltStore opens or creates the database at path. CAS values continue after the largest one stored.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &BoltStore{db: db, path: path, cas: newCASCounter()}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(boltBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			s.cas.observe(decodeBoltValue(v).CAS)
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// newBoltStore is used by initStore for the BoltPath setting.
+func newBoltStore(path string) (Store, error) {
+	return NewBoltStore(path)
+}
+
+func encodeBoltValue(val SimpleValue) []byte {
+	buf := make([]byte, boltValueHeaderLen+len(val.RawData))
+	binary.BigEndian.PutUint32(buf[0:], val.Flag)
+	binary.BigEndian.PutUint64(buf[4:], val.CAS)
+	binary.BigEndian.PutUint64(buf[12:], uint64(unixExpiration(val.TTL)))
+	copy(buf[boltValueHeaderLen:], val.RawData)
+	return buf
+}
+
+// decodeBoltValue parses a stored value. RawData points into v, which bbolt only keeps valid during the transaction.
+func decodeBoltValue(v []byte) SimpleValue {
+	return SimpleValue{
+		RawData: v[boltValueHeaderLen:],
+		Flag:    binary.BigEndian.Uint32(v[0:]),
+		CAS:     binary.BigEndian.Uint64(v[4:]),
+		TTL:     ttlFromUnix(int64(binary.BigEndian.Uint64(v[12:]))),
+	}
+}
+
+// lookup returns the live item of key, deleting it if expired. Needs a writable transaction.
+func (bs *BoltStore) lookup(b *bolt.Bucket, key []byte) (SimpleValue, bool) {
+	v := b.Get(key)
+	if v == nil {
+		return SimpleValue{}, false
+	}
+	val := decodeBoltValue(v)
+	if val.expired() {
+		b.Delete(key)
+		return SimpleValue{}, false
+	}
+	return val, true
+}
+
+func (bs *BoltStore) Get(key string) (SimpleValue, bool) {
+	var val SimpleValue
+	var ok bool
+	bs.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltBucket).Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		val = decodeBoltValue(v)
+		val.RawData = append([]byte(nil), val.RawData...)
+		ok = !val.expired()
+		return nil
+	})
+	return val, ok
+}
+
+func (bs *BoltStore) Set(key string, val SimpleValue, cas uint64, replace bool) (SimpleValue, error) {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		old, ok := bs.lookup(b, []byte(key))
+		if !ok && replace {
+			return ErrKeyNotFound
+		}
+		if ok && cas != 0 && cas != old.CAS {
+			return ErrKeyExists
+		}
+		val.CAS = bs.cas.next()
+		return b.Put([]byte(key), encodeBoltValue(val))
+	})
+	return val, err
+}
+
+func (bs *BoltStore) Add(key string, val SimpleValue) (SimpleValue, error) {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		if _, ok := bs.lookup(b, []byte(key)); ok {
+			return ErrKeyExists
+		}
+		val.CAS = bs.cas.next()
+		return b.Put([]byte(key), encodeBoltValue(val))
+	})
+	return val, err
+}
+
+func (bs *BoltStore) Delete(key string, cas uint64) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		old, ok := bs.lookup(b, []byte(key))
+		if !ok {
+			return ErrKeyNotFound
+		}
+		if cas != 0 && cas != old.CAS {
+			return ErrKeyExists
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func (bs *BoltStore) Touch(key string, ttl int) (SimpleValue, bool) {
+	var val SimpleValue
+	var ok bool
+	bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		if val, ok = bs.lookup(b, []byte(key)); !ok {
+			return nil
+		}
+		val.TTL = ttl
+		enc := encodeBoltValue(val)
+		val.RawData = enc[boltValueHeaderLen:]
+		return b.Put([]byte(key), enc)
+	})
+	return val, ok
+}
+
+func (bs *BoltStore) Incr(key string, delta uint64, decr bool, initial uint64, create bool, ttl int, cas uint64) (SimpleValue, uint64, error) {
+	var val SimpleValue
+	var n uint64
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		old, ok := bs.lookup(b, []byte(key))
+		if !ok {
+			if !create {
+				return ErrKeyNotFound
+			}
+			val.TTL = ttl
+			n = initial
+		} else {
+			if cas != 0 && cas != old.CAS {
+				return ErrKeyExists
+			}
+			var err error
+			if n, err = strconv.ParseUint(string(old.RawData), 10, 64); err != nil {
+				return ErrNonNumeric
+			}
+			if !decr {
+				n += delta
+			} else if delta > n {
+				n = 0
+			} else {
+				n -= delta
+			}
+			val.Flag, val.TTL = old.Flag, old.TTL
+		}
+		val.RawData = []byte(strconv.FormatUint(n, 10))
+		val.CAS = bs.cas.next()
+		return b.Put([]byte(key), encodeBoltValue(val))
+	})
+	if err != nil {
+		return SimpleValue{}, 0, err
+	}
+	return val, n, nil
+}
+
+// Flush empties the database. A delayed flush runs on a timer; unlike SimpleKV it isn't canceled by a later flush.
+func (bs *BoltStore) Flush(at int) {
+	if delay := at - currentTime(); at != 0 && delay > 0 {
+		time.AfterFunc(time.Duration(delay)*time.Second, func() { bs.Flush(0) })
+		return
+	}
+	bs.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(boltBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(boltBucket)
+		return err
+	})
+}
+
+func (bs *BoltStore) Stats() []Stat {
+	var items int
+	var size int64
+	bs.db.View(func(tx *bolt.Tx) error {
+		items = tx.Bucket(boltBucket).Stats().KeyN
+		size = tx.Size()
+		return nil
+	})
+	return []Stat{
+		{"curr_items", strconv.Itoa(items)},
+		{"backend", "bolt"},
+		{"bolt_path", bs.path},
+		{"bolt_file_bytes", strconv.FormatInt(size, 10)},
+	}
+}
+
+// Iterate runs fn inside one read transaction, which doesn't block writers.
+func (bs *BoltStore) Iterate(fn func(key string, val SimpleValue) bool) {
+	bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			val := decodeBoltValue(v)
+			if val.expired() {
+				continue
+			}
+			val.RawData = append([]byte(nil), val.RawData...)
+			if !fn(string(k), val) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// Close closes the database file.
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
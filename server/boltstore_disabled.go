@@ -0,0 +1,10 @@
+//go:build !bolt
+
+package server
+
+import "errors"
+
+// newBoltStore fails as the bbolt backend is only compiled in with the bolt build tag.
+func newBoltStore(path string) (Store, error) {
+	return nil, errors.New("bolt support is not compiled in, rebuild with -tags bolt")
+}
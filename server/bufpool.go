@@ -0,0 +1,68 @@
+package server
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Buffers are pooled in size classes of powers of two from 1<<minBufferClass to 1<<maxBufferClass bytes. Larger ones are
+// allocated for their request and left to the garbage collector.
+const (
+	minBufferClass = 6
+	maxBufferClass = 24
+)
+
+// bufferPools hold the buffers of every size class, as *[]byte so putting them back doesn't allocate.
+var bufferPools [maxBufferClass - minBufferClass + 1]sync.Pool
+
+// bufferClass returns the index in bufferPools of the smallest class holding size bytes, -1 if size is too large for all.
+func bufferClass(size int) int {
+	if size <= 1<<minBufferClass {
+		return 0
+	}
+	class := bits.Len(uint(size-1)) - minBufferClass
+	if class >= len(bufferPools) {
+		return -1
+	}
+	return class
+}
+
+// getBuffer returns a buffer of size bytes from the pools. Its contents are undefined.
+func getBuffer(size int) *[]byte {
+	class := bufferClass(size)
+	if class < 0 {
+		buf := make([]byte, size)
+		return &buf
+	}
+	if pooled, ok := bufferPools[class].Get().(*[]byte); ok {
+		*pooled = (*pooled)[:size]
+		return pooled
+	}
+	buf := make([]byte, size, 1<<(class+minBufferClass))
+	return &buf
+}
+
+// putBuffer returns a buffer of getBuffer to the pools. Nothing may use it afterwards.
+func putBuffer(buf *[]byte) {
+	size := cap(*buf)
+	if class := bufferClass(size); class >= 0 && size == 1<<(class+minBufferClass) {
+		bufferPools[class].Put(buf)
+	}
+}
+
+// buffer returns a pooled buffer of size bytes, held by the connection until the command being handled is done. Request
+// bodies larger than ReadBuf and scratch space of responses use it, so large values don't pin memory to the connection.
+func (ctx *ConnectionContext) buffer(size int) []byte {
+	buf := getBuffer(size)
+	ctx.buffers = append(ctx.buffers, buf)
+	return *buf
+}
+
+// releaseBuffers returns the buffers of the command done to the pools.
+func (ctx *ConnectionContext) releaseBuffers() {
+	for i, buf := range ctx.buffers {
+		putBuffer(buf)
+		ctx.buffers[i] = nil
+	}
+	ctx.buffers = ctx.buffers[:0]
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// largeChunkSize is the size of the chunks large values are split into, like memcached's slab_chunk_max.
+// Storing them as a chain of chunks avoids both huge contiguous allocations and values too large for any slab class.
+const largeChunkSize = slabPageSize / 2
+
+// valueChunk is one chunk of a large value continuing SimpleValue.RawData.
+type valueChunk struct {
+	data  []byte
+	chunk slabChunk // Slab memory backing data, if slab allocated.
+}
+
+// ownBytes copies data into memory owned by the store, from the slabs if enabled.
+func (kv *SimpleKV) ownBytes(data []byte) ([]byte, slabChunk) {
+	if kv.slabs != nil {
+		if chunk, buf, ok := kv.slabs.alloc(data); ok {
+			return buf, chunk
+		}
+	}
+	return append([]byte(nil), data...), slabChunk{}
+}
+
+// ownChunks copies a value larger than largeChunkSize into a chain of chunks: RawData holds the first, more the rest.
+func (kv *SimpleKV) ownChunks(val SimpleValue) SimpleValue {
+	data := val.RawData
+	val.RawData, val.chunk = kv.ownBytes(data[:largeChunkSize])
+	val.more = nil
+	for data = data[largeChunkSize:]; len(data) > 0; {
+		n := len(data)
+		if n > largeChunkSize {
+			n = largeChunkSize
+		}
+		buf, chunk := kv.ownBytes(data[:n])
+		val.more = append(val.more, valueChunk{data: buf, chunk: chunk})
+		data = data[n:]
+	}
+	return val
+}
+
+// joinChunks reassembles a chunked value into one buffer.
+func joinChunks(val SimpleValue) SimpleValue {
+	size := len(val.RawData)
+	for _, c := range val.more {
+		size += len(c.data)
+	}
+	data := make([]byte, 0, size)
+	data = append(data, val.RawData...)
+	for _, c := range val.more {
+		data = append(data, c.data...)
+	}
+	val.RawData, val.chunk, val.more = data, slabChunk{}, nil
+	return val
+}
+
+// appendValue adds data to the end, or with prepend the start, of the value stored at key, keeping its flags and expiration.
+// A non-zero cas must match the stored one. Otherwise a concurrent change of the item is retried, so no data is lost.
+// As the result is stored with a single Set, this works with any store; items may grow beyond the request size limit this way.
+func appendValue(store Store, key string, data []byte, prepend bool, cas uint64) (SimpleValue, error) {
+	for {
+		old, ok := store.Get(key)
+		if !ok {
+			return SimpleValue{}, ErrNotStored
+		}
+		if cas != 0 && cas != old.CAS {
+			return SimpleValue{}, ErrKeyExists
+		}
+		val := SimpleValue{Flag: old.Flag, TTL: old.TTL}
+		if prepend {
+			val.RawData = append(append(make([]byte, 0, len(data)+len(old.RawData)), data...), old.RawData...)
+		} else {
+			val.RawData = append(old.RawData, data...)
+		}
+		stored, err := store.Set(key, val, old.CAS, true)
+		switch {
+		case err == ErrKeyNotFound:
+			return SimpleValue{}, ErrNotStored
+		case err == ErrKeyExists && cas == 0:
+			continue
+		}
+		return stored, err
+	}
+}
+
+// AppendHandler handles APPEND/APPENDQ/PREPEND/PREPENDQ commands
+var AppendHandler HandleFunc = func(header RequestHeader, ctx *ConnectionContext) error {
+	if header.ExtraLength != 0 || header.KeyLength == 0 {
+		return fmt.Errorf("Append/Prepend commands MUST have key and value only: keylength %d, extralength: %d, totalbodylength: %d",
+			header.KeyLength, header.ExtraLength, header.TotalBodyLength)
+	}
+	buf, err := readBody(header, ctx)
+	if err != nil {
+		return err
+	}
+	if !ctx.server.validKey(buf[:header.KeyLength]) {
+		return writeError(header, ErrInvalidKey, ctx)
+	}
+	prepend := header.Opcode == OpPrepend || header.Opcode == OpPrependQ
+	atomic.AddUint64(&ctx.server.counters.cmdSet, 1)
+	val, err := appendValue(ctx.Store, string(buf[:header.KeyLength]), buf[header.KeyLength:], prepend, header.CAS)
+	if header.CAS != 0 {
+		ctx.server.counters.countCAS(err)
+	}
+	audit(ctx, opcodeName(header.Opcode), string(buf[:header.KeyLength]), len(buf)-int(header.KeyLength), auditCAS(val.CAS, header.CAS, err), err)
+	if err != nil {
+		return writeError(header, err, ctx)
+	}
+	if header.Opcode == OpAppendQ || header.Opcode == OpPrependQ {
+		return nil
+	}
+	respHeader := ResponseHeader{}
+	respHeader.Magic = MagicResponse
+	respHeader.Opcode = header.Opcode
+	respHeader.Opaque = header.Opaque
+	respHeader.Status = CodeNoError
+	respHeader.CAS = val.CAS
+	return writeResponse(respHeader, nil, nil, nil, ctx.RW)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"container/list"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// maxClientIPs bounds the remote IPs "stats clients" keeps counters for. The IP connecting least recently is dropped first.
+const maxClientIPs = 1024
+
+// clientCounters counts the traffic of one remote IP. Updated atomically.
+type clientCounters struct {
+	ip           string
+	conns        uint64
+	commands     uint64
+	bytesRead    uint64
+	bytesWritten uint64
+	errors       uint64     // Protocol errors, see "stats protocol_errors".
+	rate         rateLimits // Rate limits shared by the connections of the IP.
+}
+
+// clientTable holds the clientCounters of the most recently connecting IPs of a server in LRU order.
+// A connection keeps counting into the counters it started with even if its IP was dropped meanwhile.
+type clientTable struct {
+	mutex sync.Mutex
+	lru   list.List // Of *clientCounters, most recently connected first.
+	byIP  map[string]*list.Element
+}
+
+// remoteIP returns the IP of addr without the port. Clients of Unix domain sockets count as "unix".
+func remoteIP(addr net.Addr) string {
+	if addr.Network() == "unix" {
+		return "unix"
+	}
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
+// connect returns the counters of ip for a new connection from it.
+func (t *clientTable) connect(ip string) *clientCounters {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var c *clientCounters
+	if e, ok := t.byIP[ip]; ok {
+		t.lru.MoveToFront(e)
+		c = e.Value.(*clientCounters)
+	} else {
+		if t.byIP == nil {
+			t.byIP = map[string]*list.Element{}
+		}
+		if t.lru.Len() >= maxClientIPs {
+			oldest := t.lru.Back()
+			t.lru.Remove(oldest)
+			delete(t.byIP, oldest.Value.(*clientCounters).ip)
+		}
+		c = &clientCounters{ip: ip}
+		t.byIP[ip] = t.lru.PushFront(c)
+	}
+	atomic.AddUint64(&c.conns, 1)
+	return c
+}
+
+// reset zeroes the counters of all IPs for "stats reset", keeping the IPs tracked.
+func (t *clientTable) reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for e := t.lru.Front(); e != nil; e = e.Next() {
+		c := e.Value.(*clientCounters)
+		for _, n := range []*uint64{&c.conns, &c.commands, &c.bytesRead, &c.bytesWritten, &c.errors} {
+			atomic.StoreUint64(n, 0)
+		}
+	}
+}
+
+// clientStats reports the traffic per remote IP for "stats clients", as <ip>:<counter>. The busiest IPs by commands come first.
+func clientStats(ctx *ConnectionContext) ([]Stat, bool) {
+	clients := &ctx.server.clients
+	clients.mutex.Lock()
+	all := make([]*clientCounters, 0, clients.lru.Len())
+	for e := clients.lru.Front(); e != nil; e = e.Next() {
+		all = append(all, e.Value.(*clientCounters))
+	}
+	clients.mutex.Unlock()
+	commands := make(map[*clientCounters]uint64, len(all))
+	for _, c := range all {
+		commands[c] = atomic.LoadUint64(&c.commands)
+	}
+	sort.SliceStable(all, func(i, j int) bool { return commands[all[i]] > commands[all[j]] })
+	var stats []Stat
+	for _, c := range all {
+		stats = append(stats,
+			Stat{c.ip + ":conns", strconv.FormatUint(atomic.LoadUint64(&c.conns), 10)},
+			Stat{c.ip + ":commands", strconv.FormatUint(commands[c], 10)},
+			Stat{c.ip + ":bytes_read", strconv.FormatUint(atomic.LoadUint64(&c.bytesRead), 10)},
+			Stat{c.ip + ":bytes_written", strconv.FormatUint(atomic.LoadUint64(&c.bytesWritten), 10)},
+			Stat{c.ip + ":errors", strconv.FormatUint(atomic.LoadUint64(&c.errors), 10)},
+		)
+	}
+	return stats, true
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time to the expiration logic: item TTLs, GETL locks and leases. The system clock is used unless Config.Clock
+// plugs in another one, such as a ManualClock making tests of TTLs deterministic.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// clock is the Clock of the process, shared by its servers as item times count from processStart. Replaced by setClock
+// before the store is opened.
+var clock Clock = systemClock{}
+
+// setClock makes c the clock of the process and restarts the expiration times on it. Items stored before would expire at the
+// wrong time, so it must be called before any is.
+func setClock(c Clock) {
+	clock = c
+	processStart = c.Now()
+}
+
+// WithClock makes the server tell the time with c instead of the system clock.
+func WithClock(c Clock) Option {
+	return func(config *Config) { config.Clock = c }
+}
+
+// ManualClock is a Clock standing still until it is moved by Advance, to test or simulate expiration without waiting.
+type ManualClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// NewManualClock returns a ManualClock telling the time start.
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+// Now returns the time the clock was set to.
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	c.mutex.Unlock()
+}
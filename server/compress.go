@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return w
+	},
+}
+
+var gzipReaderPool sync.Pool
+
+// compressValue gzips data. ok is false when compression doesn't make the value smaller.
+func compressValue(data []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	w := gzipWriterPool.Get().(*gzip.Writer)
+	w.Reset(&buf)
+	w.Write(data)
+	w.Close()
+	gzipWriterPool.Put(w)
+	if buf.Len() >= len(data) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// decompressValue restores a value compressed by compressValue. size is the uncompressed length.
+func decompressValue(data []byte, size int) ([]byte, error) {
+	var r *gzip.Reader
+	var err error
+	if pooled, ok := gzipReaderPool.Get().(*gzip.Reader); ok {
+		r = pooled
+		err = r.Reset(bytes.NewReader(data))
+	} else {
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, size)
+	_, err = io.ReadFull(r, out)
+	gzipReaderPool.Put(r)
+	return out, err
+}
+
+// compress replaces the borrowed value bytes by their compressed form if the value is large enough and compresses well.
+func (kv *SimpleKV) compress(val SimpleValue) SimpleValue {
+	val.rawSize = 0
+	if kv.compressMin == 0 || len(val.RawData) < kv.compressMin {
+		return val
+	}
+	if data, ok := compressValue(val.RawData); ok {
+		val.rawSize = len(val.RawData)
+		val.RawData = data
+	}
+	return val
+}
+
+// accountCompression adds (or with removed, subtracts) a stored item to the compression counters.
+func (kv *SimpleKV) accountCompression(val SimpleValue, removed bool) {
+	if val.rawSize == 0 {
+		return
+	}
+	items, stored, raw := uint64(1), uint64(val.dataLen()), uint64(val.rawSize)
+	if removed {
+		items, stored, raw = ^uint64(0), ^(stored - 1), ^(raw - 1)
+	}
+	atomic.AddUint64(&kv.compressedItems, items)
+	atomic.AddUint64(&kv.compressedBytes, stored)
+	atomic.AddUint64(&kv.compressedRawBytes, raw)
+}
+
+// compressionStats reports how much memory compression saves on the items currently stored.
+func (kv *SimpleKV) compressionStats() []Stat {
+	stored := atomic.LoadUint64(&kv.compressedBytes)
+	raw := atomic.LoadUint64(&kv.compressedRawBytes)
+	ratio := "0.00"
+	if stored > 0 {
+		ratio = strconv.FormatFloat(float64(raw)/float64(stored), 'f', 2, 64)
+	}
+	return []Stat{
+		{"compression_threshold", strconv.Itoa(kv.compressMin)},
+		{"compressed_items", strconv.FormatUint(atomic.LoadUint64(&kv.compressedItems), 10)},
+		{"compressed_bytes", strconv.FormatUint(stored, 10)},
+		{"compressed_raw_bytes", strconv.FormatUint(raw, 10)},
+		{"compression_saved_bytes", strconv.FormatUint(raw-stored, 10)},
+		{"compression_ratio", ratio},
+	}
+}
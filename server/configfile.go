@@ -0,0 +1,384 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// configFields maps the setting names of config files, the fields of Config in snake_case such as max_memory, to their field index.
+var configFields = map[string]int{}
+
+func init() {
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := t.Field(i).Name; name != "ConfigFile" {
+			configFields[snakeCase(name)] = i
+		}
+	}
+}
+
+// snakeCase converts a field name like TLSCertFile to tls_cert_file.
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) &&
+			(unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// configChoices are the settings limited to a set of names, with the function telling valid names apart.
+var configChoices = map[string]struct {
+	valid   func(string) bool
+	choices string
+}{
+	"eviction_policy":   {IsEvictionPolicy, "lru, lfu, tinylfu or segmented"},
+	"shard_hash":        {IsShardHash, "fnv, xxhash or crc32-ketama"},
+	"aof_fsync":         {IsAOFFsync, "always, everysec or no"},
+	"key_validation":    {IsKeyValidation, "strict or lenient"},
+	"log_level":         {IsLogLevel, "debug, info, warn or error"},
+	"tls_identity":      {IsTLSIdentity, "cn or san"},
+	"rate_limit_action": {IsRateLimitAction, "delay, fail or disconnect"},
+	"conn_overload":     {IsConnOverload, "reject or wait"},
+}
+
+// LoadConfigFile applies the settings of the config file at path to c. The file is a flat TOML document of settings named like the
+// fields of Config in snake_case:
+//
+//	listeners = ["localhost:11211", "10.0.0.1:11212/binary"]
+//	max_memory = "512MB"
+//	eviction_policy = "segmented"
+//	snapshot_interval = "5m"
+//
+// Sizes are numbers of bytes or strings with a KB, MB or GB suffix, durations strings like "10s". Namespace quotas are given as
+// name=megabytes[,items] strings. Settings holding functions or interfaces, like store or loader, can only be set in code.
+// Errors name the file and line of the offending setting.
+func LoadConfigFile(path string, c *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	line, start := 0, 0
+	var pending string // A setting whose array continues on the next lines.
+	for scanner.Scan() {
+		line++
+		text := stripComment(scanner.Text())
+		if pending == "" {
+			start = line
+			text = strings.TrimSpace(text)
+			if text == "" {
+				continue
+			}
+			if strings.HasPrefix(text, "[") {
+				return fmt.Errorf("%s:%d: tables are not supported, settings are all top level", path, line)
+			}
+		}
+		pending += text + "\n"
+		if !balanced(pending) {
+			continue
+		}
+		if err := applyConfigLine(pending, c); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, start, err)
+		}
+		pending = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if pending != "" {
+		return fmt.Errorf("%s:%d: array not closed", path, start)
+	}
+	return nil
+}
+
+// stripComment removes a # comment outside of strings from a line.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch ch := line[i]; {
+		case quote != 0 && ch == '\\' && quote == '"':
+			i++
+		case quote != 0 && ch == quote:
+			quote = 0
+		case quote == 0 && (ch == '"' || ch == '\''):
+			quote = ch
+		case quote == 0 && ch == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// balanced tells whether the arrays opened in s outside of strings are all closed.
+func balanced(s string) bool {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; {
+		case quote != 0 && ch == '\\' && quote == '"':
+			i++
+		case quote != 0 && ch == quote:
+			quote = 0
+		case quote == 0 && (ch == '"' || ch == '\''):
+			quote = ch
+		case quote == 0 && ch == '[':
+			depth++
+		case quote == 0 && ch == ']':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+// applyConfigLine sets the setting of a name = value line on c.
+func applyConfigLine(text string, c *Config) error {
+	i := strings.Index(text, "=")
+	if i < 0 {
+		return fmt.Errorf("expected name = value")
+	}
+	name, raw := strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:])
+	if _, ok := configFields[name]; !ok {
+		return fmt.Errorf("unknown setting %q", name)
+	}
+	value, rest, err := parseConfigValue(raw)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if strings.TrimSpace(rest) != "" {
+		return fmt.Errorf("%s: unexpected %q after the value", name, strings.TrimSpace(rest))
+	}
+	if err := setConfig(c, name, value); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// setConfig sets the setting name of c to a parsed value, checking it is one of the choices of the setting if it has any.
+func setConfig(c *Config, name string, value interface{}) error {
+	if err := setConfigField(reflect.ValueOf(c).Elem().Field(configFields[name]), value); err != nil {
+		return err
+	}
+	if choice, ok := configChoices[name]; ok && !choice.valid(value.(string)) {
+		return fmt.Errorf("unknown value %q, expected %s", value, choice.choices)
+	}
+	return nil
+}
+
+// parseConfigValue parses the TOML value at the start of s: a string, an integer, a boolean or an array of those.
+// It returns the rest of s following the value.
+func parseConfigValue(s string) (interface{}, string, error) {
+	s = strings.TrimLeft(s, " \t\n")
+	switch {
+	case s == "":
+		return nil, "", fmt.Errorf("missing value")
+	case s[0] == '"':
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == '"' {
+				v, err := strconv.Unquote(s[:i+1])
+				if err != nil {
+					return nil, "", fmt.Errorf("bad string %s", s[:i+1])
+				}
+				return v, s[i+1:], nil
+			}
+		}
+		return nil, "", fmt.Errorf("string not closed")
+	case s[0] == '\'':
+		if i := strings.IndexByte(s[1:], '\''); i >= 0 {
+			return s[1 : i+1], s[i+2:], nil
+		}
+		return nil, "", fmt.Errorf("string not closed")
+	case s[0] == '[':
+		var values []interface{}
+		s = strings.TrimLeft(s[1:], " \t\n")
+		for !strings.HasPrefix(s, "]") {
+			v, rest, err := parseConfigValue(s)
+			if err != nil {
+				return nil, "", err
+			}
+			values = append(values, v)
+			s = strings.TrimLeft(rest, " \t\n")
+			if strings.HasPrefix(s, ",") {
+				s = strings.TrimLeft(s[1:], " \t\n")
+			} else if !strings.HasPrefix(s, "]") {
+				return nil, "", fmt.Errorf("expected , or ] in array")
+			}
+		}
+		return values, s[1:], nil
+	}
+	end := strings.IndexAny(s, " \t\n,]")
+	if end < 0 {
+		end = len(s)
+	}
+	word := s[:end]
+	switch word {
+	case "true":
+		return true, s[end:], nil
+	case "false":
+		return false, s[end:], nil
+	}
+	n, err := strconv.ParseInt(strings.Replace(word, "_", "", -1), 0, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("bad value %q, strings need quotes", word)
+	}
+	return n, s[end:], nil
+}
+
+// parseSize parses a number of bytes with an optional KB, MB or GB suffix.
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	for suffix, m := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(upper, suffix) {
+			upper, multiplier = strings.TrimSpace(strings.TrimSuffix(upper, suffix)), m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// setConfigField stores a parsed config file value into a field of Config.
+func setConfigField(field reflect.Value, value interface{}) error {
+	switch field.Interface().(type) {
+	case []ListenerConfig:
+		var listeners []ListenerConfig
+		for _, s := range stringList(value) {
+			lc, err := ParseListener(s)
+			if err != nil {
+				return err
+			}
+			listeners = append(listeners, lc)
+		}
+		if listeners == nil {
+			return fmt.Errorf("expected a listener or an array of them")
+		}
+		field.Set(reflect.ValueOf(listeners))
+		return nil
+	case IPNets:
+		var nets IPNets
+		for _, s := range stringList(value) {
+			ipnet, err := ParseIPNet(s)
+			if err != nil {
+				return err
+			}
+			nets = append(nets, ipnet)
+		}
+		field.Set(reflect.ValueOf(nets))
+		return nil
+	case map[string]CommandACL:
+		acls := map[string]CommandACL{}
+		for _, s := range stringList(value) {
+			user, acl, err := ParseUserACL(s)
+			if err != nil {
+				return err
+			}
+			acls[user] = acl
+		}
+		field.Set(reflect.ValueOf(acls))
+		return nil
+	case map[string]NamespaceQuota:
+		quotas := map[string]NamespaceQuota{}
+		for _, s := range stringList(value) {
+			name, quota, err := ParseNamespaceQuota(s)
+			if err != nil {
+				return err
+			}
+			quotas[name] = quota
+		}
+		field.Set(reflect.ValueOf(quotas))
+		return nil
+	case []string:
+		list := stringList(value)
+		if list == nil {
+			return fmt.Errorf("expected a string or an array of them")
+		}
+		field.Set(reflect.ValueOf(list))
+		return nil
+	case time.Duration:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected a duration like \"10s\"")
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("bad duration %q", s)
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected a string")
+		}
+		field.SetString(s)
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("expected true or false")
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64, reflect.Uint64:
+		var n int64
+		switch v := value.(type) {
+		case int64:
+			n = v
+		case string:
+			size, err := parseSize(v)
+			if err != nil {
+				return err
+			}
+			n = size
+		default:
+			return fmt.Errorf("expected a number")
+		}
+		if field.Kind() == reflect.Uint64 {
+			if n < 0 {
+				return fmt.Errorf("must not be negative")
+			}
+			field.SetUint(uint64(n))
+		} else {
+			field.SetInt(n)
+		}
+	default:
+		return fmt.Errorf("can only be set in code")
+	}
+	return nil
+}
+
+// stringList returns value as a list of strings if it is a string or an array of strings, nil otherwise.
+func stringList(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil
+			}
+			list = append(list, s)
+		}
+		return list
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// What connections accepted while all ConnWorkers are busy and the queue is full get, see Config.ConnOverload.
+const (
+	ConnOverloadReject = "reject" // Tell the client the server is busy and disconnect it.
+	ConnOverloadWait   = "wait"   // Stop accepting until the queue has room, leaving further clients in the listen backlog.
+)
+
+// IsConnOverload reports whether name is a supported value of Config.ConnOverload.
+func IsConnOverload(name string) bool {
+	return name == ConnOverloadReject || name == ConnOverloadWait
+}
+
+// connJob is a connection accepted on the listener lc, waiting for a worker of the connPool. done is passed on to handleConn.
+type connJob struct {
+	conn net.Conn
+	lc   ListenerConfig
+	done func()
+}
+
+// connPool serves the connections of the accept loops with ConnWorkers goroutines rather than one goroutine each, so a storm of
+// connections can't start an unbounded number of them. Connections accepted while all workers are busy wait in a queue of
+// ConnQueue. A connection holds its worker until it closes, unless the event loop takes it over.
+type connPool struct {
+	jobs    chan connJob
+	stats   *serverStats // Counters of the server, counting the queued connections.
+	stopped sync.Once
+}
+
+// newConnPool starts the workers of s.
+func newConnPool(s *Server) *connPool {
+	p := &connPool{jobs: make(chan connJob, s.config.ConnQueue), stats: &s.counters}
+	for i := 0; i < s.config.ConnWorkers; i++ {
+		go func() {
+			for job := range p.jobs {
+				atomic.AddInt64(&p.stats.queuedConns, -1)
+				s.handleConn(job.conn, job.lc, job.done)
+			}
+		}()
+	}
+	return p
+}
+
+// submit hands a connection to the workers. If none is free and the queue is full, it waits for room until closing is closed
+// if wait is set, and otherwise returns false right away.
+func (p *connPool) submit(job connJob, wait bool, closing <-chan struct{}) bool {
+	atomic.AddInt64(&p.stats.queuedConns, 1)
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+	}
+	if wait {
+		select {
+		case p.jobs <- job:
+			return true
+		case <-closing:
+		}
+	}
+	atomic.AddInt64(&p.stats.queuedConns, -1)
+	return false
+}
+
+// stop lets the workers exit once they served the queued connections. Nothing may be submitted afterwards.
+func (p *connPool) stop() {
+	p.stopped.Do(func() { close(p.jobs) })
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connRegistry holds the live connections of a server by ConnID, so admin commands can inspect and kill them.
+type connRegistry struct {
+	seq   uint64 // Last ConnID handed out. Updated atomically.
+	mutex sync.Mutex
+	conns map[uint64]*ConnectionContext
+}
+
+// nextID returns the ConnID of a new connection.
+func (r *connRegistry) nextID() uint64 {
+	return atomic.AddUint64(&r.seq, 1)
+}
+
+func (r *connRegistry) register(ctx *ConnectionContext) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.conns == nil {
+		r.conns = map[uint64]*ConnectionContext{}
+	}
+	r.conns[ctx.ConnID] = ctx
+}
+
+func (r *connRegistry) unregister(ctx *ConnectionContext) {
+	r.mutex.Lock()
+	delete(r.conns, ctx.ConnID)
+	r.mutex.Unlock()
+}
+
+// live returns the live connections ordered by ConnID.
+func (r *connRegistry) live() []*ConnectionContext {
+	r.mutex.Lock()
+	conns := make([]*ConnectionContext, 0, len(r.conns))
+	for _, ctx := range r.conns {
+		conns = append(conns, ctx)
+	}
+	r.mutex.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ConnID < conns[j].ConnID })
+	return conns
+}
+
+// kill closes the connection with the given ID. The goroutine serving it exits on its next read.
+func (r *connRegistry) kill(id uint64) bool {
+	r.mutex.Lock()
+	ctx, ok := r.conns[id]
+	r.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	ctx.ConnHandle.Close()
+	return true
+}
+
+// TextConnsHandler handles the "conns list" command. One line is written per live connection.
+var TextConnsHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	if len(args) != 2 || args[1] != "list" {
+		return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+	}
+	now := time.Now()
+	for _, c := range ctx.server.conns.live() {
+		proto, seq, last := c.activity()
+		err := writeTextLine(ctx, "CONN %d %s %s connected=%d idle=%d commands=%d",
+			c.ConnID, c.ConnHandle.RemoteAddr().String(), proto, c.StartTime.Unix(), int64(now.Sub(last).Seconds()), seq)
+		if err != nil {
+			return err
+		}
+	}
+	return writeTextLine(ctx, "END")
+}
+
+// connStats reports the live connections for "stats conns", named by ConnID like memcached names them by file descriptor.
+func connStats(ctx *ConnectionContext) ([]Stat, bool) {
+	now := time.Now()
+	var stats []Stat
+	for _, c := range ctx.server.conns.live() {
+		proto, seq, last := c.activity()
+		id := strconv.FormatUint(c.ConnID, 10)
+		stats = append(stats,
+			Stat{id + ":addr", c.ConnHandle.RemoteAddr().Network() + ":" + c.ConnHandle.RemoteAddr().String()},
+			Stat{id + ":protocol", proto.String()},
+			Stat{id + ":connected", strconv.FormatInt(c.StartTime.Unix(), 10)},
+			Stat{id + ":commands", strconv.FormatUint(seq, 10)},
+			Stat{id + ":secs_since_last_cmd", strconv.FormatInt(int64(now.Sub(last).Seconds()), 10)},
+		)
+	}
+	return stats, true
+}
+
+// TextConnHandler handles the "conn kill <id>" command.
+var TextConnHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	if len(args) != 3 || args[1] != "kill" {
+		return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+	}
+	id, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return writeTextLine(ctx, "CLIENT_ERROR bad connection id")
+	}
+	if !ctx.server.conns.kill(id) {
+		return writeTextLine(ctx, "NOT_FOUND")
+	}
+	return writeTextLine(ctx, "OK")
+}
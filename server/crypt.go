@@ -0,0 +1,181 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// PersistKeyEnv names the environment variable holding the hex encoded key for encrypting snapshots and the append-only log.
+const PersistKeyEnv = "MEMCACHED_PERSIST_KEY"
+
+// encryptedMagic starts an encrypted snapshot. The plaintext snapshot follows as a sequence of sealed frames.
+const encryptedMagic = "MCENC01\n"
+
+// encryptedFrameSize is how much plaintext a snapshot frame holds at most.
+const encryptedFrameSize = 64 * 1024
+
+// maxFrameLen bounds the length of a frame read, so a damaged length can't make us allocate huge buffers.
+const maxFrameLen = 1 << 30
+
+// Errors of encrypted persistence files.
+var (
+	ErrPersistKey   = errors.New("Encryption key must be 16, 24 or 32 bytes, raw or hex encoded")
+	ErrNoPersistKey = errors.New("File is encrypted but no encryption key is configured")
+)
+
+// loadPersistKey creates the AES-GCM cipher from the key in keyFile or, if keyFile is empty, the PersistKeyEnv variable.
+// It returns nil if no key is configured.
+func loadPersistKey(keyFile string) (cipher.AEAD, error) {
+	var key []byte
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = data
+		if s := strings.TrimSpace(string(data)); len(s) == 32 || len(s) == 48 || len(s) == 64 {
+			if decoded, err := hex.DecodeString(s); err == nil {
+				key = decoded
+			}
+		}
+	} else if s := os.Getenv(PersistKeyEnv); s != "" {
+		decoded, err := hex.DecodeString(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", PersistKeyEnv, err)
+		}
+		key = decoded
+	} else {
+		return nil, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrPersistKey
+	}
+	return cipher.NewGCM(block)
+}
+
+// settingsPersistKey loads the encryption key of Settings, for the package functions persisting a store outside a Server.
+func settingsPersistKey() (cipher.AEAD, error) {
+	return loadPersistKey(Settings.PersistKeyFile)
+}
+
+// sealFrame appends a frame holding the encrypted plaintext to dst: the sealed length, a random nonce and the sealed data.
+// ad is authenticated along, but not stored.
+func sealFrame(aead cipher.AEAD, dst, plaintext, ad []byte) ([]byte, error) {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(plaintext)+aead.Overhead()))
+	dst = append(dst, l[:]...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce...)
+	return aead.Seal(dst, nonce, plaintext, ad), nil
+}
+
+// openFrame reads and decrypts a frame made by sealFrame. n is the number of bytes read.
+func openFrame(aead cipher.AEAD, r io.Reader, ad []byte) (plaintext []byte, n int, err error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, 0, err
+	}
+	size := int(binary.BigEndian.Uint32(l[:]))
+	if size < aead.Overhead() || size > maxFrameLen {
+		return nil, 0, errors.New("Bad encrypted frame length")
+	}
+	buf := make([]byte, aead.NonceSize()+size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	plaintext, err = aead.Open(buf[aead.NonceSize():aead.NonceSize()], buf[:aead.NonceSize()], buf[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, 0, err
+	}
+	return plaintext, 4 + len(buf), nil
+}
+
+// frameWriter encrypts a stream as a sequence of frames. Frames are numbered through their additional data, so they can't be reordered.
+type frameWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+	seq  uint64
+	out  []byte
+}
+
+func newFrameWriter(w io.Writer, aead cipher.AEAD) *frameWriter {
+	return &frameWriter{w: w, aead: aead, buf: make([]byte, 0, encryptedFrameSize)}
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		c := copy(fw.buf[len(fw.buf):cap(fw.buf)], p)
+		fw.buf = fw.buf[:len(fw.buf)+c]
+		p = p[c:]
+		n += c
+		if len(fw.buf) == cap(fw.buf) {
+			if err := fw.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (fw *frameWriter) flush() error {
+	var ad [8]byte
+	binary.BigEndian.PutUint64(ad[:], fw.seq)
+	out, err := sealFrame(fw.aead, fw.out[:0], fw.buf, ad[:])
+	if err != nil {
+		return err
+	}
+	fw.out = out
+	fw.seq++
+	fw.buf = fw.buf[:0]
+	_, err = fw.w.Write(out)
+	return err
+}
+
+// Close writes the last frame.
+func (fw *frameWriter) Close() error {
+	if len(fw.buf) == 0 {
+		return nil
+	}
+	return fw.flush()
+}
+
+// frameReader decrypts a stream written by frameWriter.
+type frameReader struct {
+	r    io.Reader
+	aead cipher.AEAD
+	buf  []byte
+	seq  uint64
+}
+
+func (fr *frameReader) Read(p []byte) (int, error) {
+	for len(fr.buf) == 0 {
+		var ad [8]byte
+		binary.BigEndian.PutUint64(ad[:], fr.seq)
+		buf, _, err := openFrame(fr.aead, fr.r, ad[:])
+		if err != nil {
+			return 0, err
+		}
+		fr.buf = buf
+		fr.seq++
+	}
+	n := copy(p, fr.buf)
+	fr.buf = fr.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,23 @@
+//go:build !unix
+
+package server
+
+import (
+	"errors"
+	"os"
+)
+
+// Daemonize fails as detaching from the terminal is only supported on unix systems.
+func Daemonize() error {
+	return errors.New("daemonizing is not supported on this platform")
+}
+
+// processAlive reports whether a process with the ID pid runs. FindProcess opens the process outside of unix.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
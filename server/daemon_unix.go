@@ -0,0 +1,49 @@
+//go:build unix
+
+package server
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// daemonEnv marks the process started by Daemonize.
+const daemonEnv = EnvPrefix + "DAEMONIZED"
+
+// Daemonize detaches the process from its terminal. It starts the executable again with the same arguments in a new session,
+// with stdin, stdout and stderr on /dev/null, and exits. In the started process, or one started by Upgrade, it returns nil
+// right away. Call it before starting anything, and set a Logger writing to a file first to keep the log lines.
+func Daemonize() error {
+	if upgrading() {
+		return nil
+	}
+	if os.Getenv(daemonEnv) != "" {
+		os.Unsetenv(daemonEnv)
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer null.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = null, null, null
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
+
+// processAlive reports whether a process with the ID pid runs. Processes of other users count, though they can't be signaled.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
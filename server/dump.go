@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ExportDump writes all live items of store in the format of memcached-tool dump: an "add <key> <flags> <exptime> <bytes>" line followed by the value.
+// Expiration times are absolute unix timestamps, 0 for items that never expire. Feeding the output to a memcached server restores the items.
+func ExportDump(store Store, w io.Writer) (items int, err error) {
+	bw := bufio.NewWriter(w)
+	store.Iterate(func(key string, val SimpleValue) bool {
+		fmt.Fprintf(bw, "add %s %d %d %d\r\n", key, val.Flag, unixExpiration(val.TTL), len(val.RawData))
+		bw.Write(val.RawData)
+		_, err = bw.WriteString("\r\n")
+		items++
+		return err == nil
+	})
+	if err != nil {
+		return items, err
+	}
+	return items, bw.Flush()
+}
+
+// ImportDump stores the items of a dump made by ExportDump or memcached-tool. Lines may use set or add; existing keys are overwritten.
+// Items already expired are skipped.
+func ImportDump(store Store, r io.Reader) (items int, err error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	var buf []byte
+	for line := 1; ; line++ {
+		header, err := br.ReadString('\n')
+		if err == io.EOF && header == "" {
+			return items, nil
+		}
+		if err != nil {
+			return items, fmt.Errorf("Line %d: %v", line, err)
+		}
+		fields := strings.Fields(header)
+		if len(fields) == 1 && fields[0] == "END" {
+			return items, nil
+		}
+		if len(fields) != 5 || fields[0] != "add" && fields[0] != "set" {
+			return items, fmt.Errorf("Line %d: bad item line %q", line, strings.TrimSpace(header))
+		}
+		flags, err1 := strconv.ParseUint(fields[2], 10, 32)
+		exptime, err2 := strconv.ParseUint(fields[3], 10, 32)
+		size, err3 := strconv.Atoi(fields[4])
+		if err1 != nil || err2 != nil || err3 != nil || size < 0 {
+			return items, fmt.Errorf("Line %d: bad item line %q", line, strings.TrimSpace(header))
+		}
+		if cap(buf) < size+2 {
+			buf = make([]byte, size+2)
+		}
+		buf = buf[:size+2]
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return items, fmt.Errorf("Line %d: %v", line, err)
+		}
+		line++
+		if string(buf[size:]) != "\r\n" {
+			return items, fmt.Errorf("Line %d: value not terminated by CRLF", line)
+		}
+		val := SimpleValue{RawData: buf[:size], Flag: uint32(flags), TTL: expiration(uint32(exptime))}
+		if val.expired() {
+			continue
+		}
+		if _, err := store.Set(fields[1], val, 0, false); err != nil {
+			return items, fmt.Errorf("Line %d: %v", line, err)
+		}
+		items++
+	}
+}
+
+// TextLRUCrawlerHandler handles "lru_crawler metadump all", listing the metadata of all items like memcached does.
+var TextLRUCrawlerHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	if len(args) != 3 || args[1] != "metadump" || args[2] != "all" {
+		return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+	}
+	var err error
+	ctx.Store.Iterate(func(key string, val SimpleValue) bool {
+		exp := unixExpiration(val.TTL)
+		if exp == 0 {
+			exp = -1
+		}
+		fetch := "no"
+		if val.Fetches > 0 {
+			fetch = "yes"
+		}
+		err = writeTextLine(ctx, "key=%s exp=%d la=%d cas=%d fetch=%s cls=0 size=%d",
+			url.QueryEscape(key), exp, processStart.Unix()+int64(val.Accessed), val.CAS, fetch, itemSize(key, val))
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return writeTextLine(ctx, "END")
+}
+
+// TextDumpHandler handles the "dump" command, streaming all items in ExportDump format followed by END.
+var TextDumpHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	if len(args) != 1 {
+		return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+	}
+	if _, err := ExportDump(ctx.Store, ctx.RW); err != nil {
+		return err
+	}
+	return writeTextLine(ctx, "END")
+}
+
+// importDumpFile loads the dump file given by the ImportDump setting of s into store at startup.
+func (s *Server) importDumpFile(store Store) error {
+	if s.config.ImportDump == "" {
+		return nil
+	}
+	f, err := os.Open(s.config.ImportDump)
+	if err != nil {
+		return fmt.Errorf("opening dump: %v", err)
+	}
+	defer f.Close()
+	items, err := ImportDump(store, f)
+	if err != nil {
+		return fmt.Errorf("importing dump: %v", err)
+	}
+	s.logger().Info("imported dump", "items", items, "path", s.config.ImportDump)
+	return nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Item is a value stored in the cache, as returned by the embedded API.
+type Item struct {
+	Value []byte
+	Flags uint32
+	CAS   uint64
+}
+
+// embeddedAddr is the client address of the mutations of the embedded API in the audit log.
+const embeddedAddr = "embedded"
+
+// store returns the store of s, opening it on first use. The embedded API shares it with the clients of the server,
+// going through the same decorators, such as write-behind and hot key tracking. It returns an error if the store can't be opened.
+func (s *Server) store() (Store, error) {
+	if err := s.openStore(); err != nil {
+		return nil, err
+	}
+	return s.cache, nil
+}
+
+// ttlExptime converts a TTL into the expiration of a request. 0 never expires.
+func ttlExptime(ttl time.Duration) uint32 {
+	if ttl <= 0 {
+		return 0
+	}
+	seconds := (ttl + time.Second - 1) / time.Second
+	if seconds <= maxRelativeExptime {
+		return uint32(seconds)
+	}
+	return uint32(clock.Now().Add(ttl).Unix())
+}
+
+// Get looks up key in the cache of the server, like a GET of a client. It returns false if the store can't be opened.
+func (s *Server) Get(key string) (Item, bool) {
+	if !s.validKey([]byte(key)) {
+		return Item{}, false
+	}
+	store, err := s.store()
+	if err != nil {
+		return Item{}, false
+	}
+	val, ok := store.Get(key)
+	s.counters.countGet(ok)
+	if !ok {
+		return Item{}, false
+	}
+	return Item{Value: append([]byte(nil), val.RawData...), Flags: val.Flag, CAS: val.CAS}, true
+}
+
+// Set stores value under key for ttl, 0 meaning forever, like a SET of a client. It returns the CAS value of the stored item.
+func (s *Server) Set(key string, value []byte, flags uint32, ttl time.Duration) (uint64, error) {
+	if !s.validKey([]byte(key)) {
+		return 0, ErrInvalidKey
+	}
+	if len(value) > s.maxRequestSize() {
+		return 0, ErrValueTooLarge
+	}
+	store, err := s.store()
+	if err != nil {
+		return 0, err
+	}
+	atomic.AddUint64(&s.counters.cmdSet, 1)
+	val, err := store.Set(key, SimpleValue{RawData: value, Flag: flags, TTL: s.itemExpiration(ttlExptime(ttl))}, 0, false)
+	s.auditFrom(embeddedAddr, "", "set", key, len(value), val.CAS, err)
+	return val.CAS, err
+}
+
+// Delete removes key from the cache of the server. It returns ErrKeyNotFound if there was no such key.
+func (s *Server) Delete(key string) error {
+	if !s.validKey([]byte(key)) {
+		return ErrInvalidKey
+	}
+	store, err := s.store()
+	if err != nil {
+		return err
+	}
+	err = store.Delete(key, 0)
+	countResult(&s.counters.deleteHits, &s.counters.deleteMisses, err)
+	s.auditFrom(embeddedAddr, "", "delete", key, 0, 0, err)
+	return err
+}
+
+// Touch sets a new ttl on key, 0 meaning forever. It returns false if there was no such key, or the store can't be opened.
+func (s *Server) Touch(key string, ttl time.Duration) bool {
+	if !s.validKey([]byte(key)) {
+		return false
+	}
+	store, err := s.store()
+	if err != nil {
+		return false
+	}
+	atomic.AddUint64(&s.counters.cmdTouch, 1)
+	val, ok := store.Touch(key, s.itemExpiration(ttlExptime(ttl)))
+	countHit(&s.counters.touchHits, &s.counters.touchMisses, ok)
+	s.auditFrom(embeddedAddr, "", "touch", key, 0, val.CAS, missing(ok))
+	return ok
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix starts the names of the environment variables read by LoadEnv.
+const EnvPrefix = "MEMCACHED_"
+
+// LoadEnv applies the settings given by environment variables to c. Variables are named like config file settings in upper case
+// after EnvPrefix, e.g. MEMCACHED_MAX_MEMORY=512MB or MEMCACHED_LISTENERS="0.0.0.0:11211 0.0.0.0:11212/binary".
+// Values are written as in a config file without quotes; lists, like listeners and namespace quotas, are separated by spaces
+// and booleans are true or false. Variables with the prefix not naming a setting are ignored, as other tools share the prefix.
+func LoadEnv(c *Config) error {
+	var names []string
+	values := map[string]string{}
+	for _, kv := range os.Environ() {
+		i := strings.Index(kv, "=")
+		if i < 0 || !strings.HasPrefix(kv[:i], EnvPrefix) {
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(kv[:i], EnvPrefix))
+		if _, ok := configFields[name]; ok {
+			names = append(names, name)
+			values[name] = kv[i+1:]
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field := reflect.ValueOf(c).Elem().Field(configFields[name])
+		value, err := envValue(field, values[name])
+		if err == nil {
+			err = setConfig(c, name, value)
+		}
+		if err != nil {
+			return fmt.Errorf("%s%s: %v", EnvPrefix, strings.ToUpper(name), err)
+		}
+	}
+	return nil
+}
+
+// envValue converts the text of an environment variable to the value a config file would hold for field.
+func envValue(field reflect.Value, s string) (interface{}, error) {
+	switch field.Interface().(type) {
+	case []ListenerConfig, map[string]NamespaceQuota, map[string]CommandACL, IPNets, []string:
+		var list []interface{}
+		for _, item := range strings.Fields(s) {
+			list = append(list, item)
+		}
+		return list, nil
+	case time.Duration:
+		return s, nil
+	}
+	if field.Kind() == reflect.Bool {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("expected true or false")
+		}
+		return b, nil
+	}
+	return s, nil
+}
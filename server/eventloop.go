@@ -0,0 +1,349 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// States of an eventConn.
+const (
+	eventIdle    int32 = iota // Armed in the poller, waiting for the client to send something.
+	eventBusy                 // Served by a worker.
+	eventWaiting              // Put aside until the rate limits allow its next command.
+	eventClosed               // Closed, or being closed.
+)
+
+// eventConn is a connection served by the event loop.
+type eventConn struct {
+	ctx     *ConnectionContext
+	raw     syscall.RawConn   // Socket of the connection, watched by the poller.
+	closers connClosers       // What handleConn leaves to be done once the connection closes.
+	state   int32             // eventIdle, eventBusy, eventWaiting or eventClosed. Updated atomically.
+	since   int64             // When the connection went idle last, in Unix nanoseconds. Updated atomically.
+	fresh   bool              // Set until the protocol of the connection was detected.
+	idle    bool              // Whether the idle timeout is armed as a read deadline, while a worker serves the connection.
+	rw      *bufio.ReadWriter // Buffers kept while eventWaiting, which may hold commands read ahead.
+	buf     *[]byte           // ReadBuf kept along with rw.
+	waited  bool              // Set once the connection was put aside for its next command.
+}
+
+// eventLoop serves the connections of plain TCP and Unix listeners for Config.EventLoop. Idle connections wait in a poller,
+// holding neither a goroutine nor buffers. Once a client sends something, one of a few workers lends its connection buffers
+// and serves the commands read, then arms the connection in the poller again. Idle timeouts are enforced by a sweep every
+// second. A client sending a command in parts holds up its worker until the rest arrives or the idle timeout closes it,
+// which is why EventLoop needs IdleTimeout. Connections exceeding their rate limits with RateLimitDelay are put aside with
+// a timer rather than holding up a worker.
+type eventLoop struct {
+	server  *Server
+	poller  *poller
+	ready   chan *eventConn       // Connections the poller found readable, for the workers.
+	done    chan struct{}         // Closed by stop.
+	buffers sync.Pool             // *bufio.ReadWriter lent to the connections served.
+	mutex   sync.Mutex            // Guards conns and stopped.
+	conns   map[uint64]*eventConn // Connections of the loop by ConnID, until they close.
+	stopped bool                  // Set by stop. The poller closes along with the last connection.
+	closed  sync.Once             // Closes the poller.
+}
+
+// newEventLoop starts the event loop of s with its workers. Like Validate, it refuses to keep the connections it serves
+// open for good.
+func newEventLoop(s *Server) (*eventLoop, error) {
+	if err := checkIdleTimeout(&s.config); err != nil {
+		return nil, fmt.Errorf("idle_timeout %v", err)
+	}
+	for _, lc := range s.config.Listeners {
+		if !lc.TLS && lc.IdleTimeout < 0 {
+			return nil, fmt.Errorf("%s: idle_timeout must be positive", lc.Addr)
+		}
+	}
+	p, err := newPoller()
+	if err != nil {
+		return nil, err
+	}
+	l := &eventLoop{server: s, poller: p, ready: make(chan *eventConn), done: make(chan struct{}), conns: map[uint64]*eventConn{}}
+	l.buffers.New = func() interface{} {
+		return bufio.NewReadWriter(bufio.NewReaderSize(nil, s.config.ReadBufferSize), bufio.NewWriter(nil))
+	}
+	workers := s.config.EventLoopWorkers
+	if workers == 0 {
+		workers = 4 * runtime.GOMAXPROCS(0)
+	}
+	for i := 0; i < workers; i++ {
+		go l.work()
+	}
+	go l.run()
+	go l.sweep()
+	return l, nil
+}
+
+// takes reports whether the loop serves the connection conn, accepted on the listener lc. Encrypted connections keep a
+// goroutine, as TLS may have read records ahead that the poller wouldn't tell about.
+func (l *eventLoop) takes(conn net.Conn, lc ListenerConfig) bool {
+	_, ok := conn.(syscall.Conn)
+	return ok && !lc.TLS
+}
+
+// pendingInput reports whether conn holds bytes read from its socket already, which the poller can't tell about.
+func pendingInput(conn net.Conn) bool {
+	pc, ok := conn.(*proxyConn)
+	return ok && pc.r.Buffered() > 0
+}
+
+// add takes over the connection ctx, set up by handleConn on raw, which takes, and the closers left to run once it closes.
+// Its first command is served right away if pending, or else once the client sends it.
+func (l *eventLoop) add(ctx *ConnectionContext, raw net.Conn, closers connClosers, pending bool) {
+	c := &eventConn{ctx: ctx, closers: closers, since: time.Now().UnixNano(), fresh: true}
+	if pending {
+		c.state = eventBusy
+	}
+	var err error
+	if c.raw, err = raw.(syscall.Conn).SyscallConn(); err != nil {
+		l.close(c, err, false)
+		return
+	}
+	l.mutex.Lock()
+	stopped := l.stopped
+	if !stopped {
+		l.conns[ctx.ConnID] = c
+	}
+	l.mutex.Unlock()
+	if stopped {
+		l.close(c, errDraining, false)
+		return
+	}
+	if err := l.control(c, l.poller.add); err != nil {
+		l.close(c, err, false)
+		return
+	}
+	if pending {
+		select {
+		case l.ready <- c:
+		case <-l.done:
+			l.close(c, errDraining, false)
+		}
+	}
+}
+
+// control calls op with the socket of c and its ConnID, failing if the connection was closed.
+func (l *eventLoop) control(c *eventConn, op func(fd int, id uint64) error) error {
+	var err error
+	if cerr := c.raw.Control(func(fd uintptr) { err = op(int(fd), c.ctx.ConnID) }); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// run hands the connections the poller finds readable to the workers until the loop stops.
+func (l *eventLoop) run() {
+	for {
+		ids, err := l.poller.wait(time.Second)
+		select {
+		case <-l.done:
+			return
+		default:
+		}
+		if err != nil {
+			l.server.logger().Error("event loop stopped", "err", err)
+			return
+		}
+		for _, id := range ids {
+			l.mutex.Lock()
+			c := l.conns[id]
+			l.mutex.Unlock()
+			if c == nil || !atomic.CompareAndSwapInt32(&c.state, eventIdle, eventBusy) {
+				continue
+			}
+			select {
+			case l.ready <- c:
+			case <-l.done:
+				return
+			}
+		}
+	}
+}
+
+func (l *eventLoop) work() {
+	for {
+		select {
+		case c := <-l.ready:
+			l.serve(c)
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// serve serves the commands the client of c sent, then arms c in the poller again, or closes it.
+func (l *eventLoop) serve(c *eventConn) {
+	ctx := c.ctx
+	rw, buf := c.rw, c.buf
+	c.rw, c.buf = nil, nil
+	if rw == nil {
+		rw = l.buffers.Get().(*bufio.ReadWriter)
+		rw.Reader.Reset(ctx.ConnHandle)
+		rw.Writer.Reset(ctx.ConnHandle)
+		buf = getBuffer(rw.Reader.Size())
+	}
+	ctx.RW, ctx.ReadBuf = rw, *buf
+	var err error
+	var wait time.Duration
+	if c.fresh {
+		c.fresh = false
+		c.idle = ctx.armTimeout(c.idle)
+		err = detectProtocol(ctx, ctx.listener.Protocol)
+	}
+	for err == nil {
+		if wait = ctx.admitCommand(c.waited); wait > 0 {
+			break
+		}
+		c.waited = false
+		err = ctx.serveCommand(&c.idle)
+		if rw.Reader.Buffered() == 0 {
+			break
+		}
+	}
+	// Connections are closed after their command once a shutdown began, like those having a goroutine.
+	if err == nil && atomic.LoadInt32(&l.server.draining) == 1 {
+		err = errDraining
+	}
+	rw.Flush()
+	ctx.RW, ctx.ReadBuf = nil, nil
+	if err == nil && wait > 0 {
+		l.putAside(c, rw, buf, wait)
+		return
+	}
+	l.release(rw, buf)
+	if err != nil {
+		l.close(c, err, c.idle)
+		return
+	}
+	atomic.StoreInt64(&c.since, time.Now().UnixNano())
+	atomic.StoreInt32(&c.state, eventIdle)
+	if err := l.control(c, l.poller.arm); err != nil && atomic.CompareAndSwapInt32(&c.state, eventIdle, eventClosed) {
+		l.close(c, err, false)
+	}
+}
+
+// putAside puts c aside for wait along with its buffers, then hands it to the workers again.
+func (l *eventLoop) putAside(c *eventConn, rw *bufio.ReadWriter, buf *[]byte, wait time.Duration) {
+	c.rw, c.buf, c.waited = rw, buf, true
+	atomic.StoreInt32(&c.state, eventWaiting)
+	time.AfterFunc(wait, func() {
+		if !atomic.CompareAndSwapInt32(&c.state, eventWaiting, eventBusy) {
+			return
+		}
+		select {
+		case l.ready <- c:
+		case <-l.done:
+			l.close(c, errDraining, false)
+		}
+	})
+}
+
+// release returns the buffers of a connection to the pools.
+func (l *eventLoop) release(rw *bufio.ReadWriter, buf *[]byte) {
+	rw.Reader.Reset(nil)
+	rw.Writer.Reset(nil)
+	l.buffers.Put(rw)
+	putBuffer(buf)
+}
+
+// close closes c, which was taken from the poller and the workers, logging err as the reason like handleConn. idle tells
+// whether the idle timeout was armed.
+func (l *eventLoop) close(c *eventConn, err error, idle bool) {
+	atomic.StoreInt32(&c.state, eventClosed)
+	if c.rw != nil {
+		l.release(c.rw, c.buf)
+		c.rw, c.buf = nil, nil
+	}
+	c.ctx.logClose(err, idle)
+	c.closers.run()
+	l.mutex.Lock()
+	_, ok := l.conns[c.ctx.ConnID]
+	delete(l.conns, c.ctx.ConnID)
+	last := ok && l.stopped && len(l.conns) == 0
+	l.mutex.Unlock()
+	if last {
+		l.closePoller()
+	}
+}
+
+func (l *eventLoop) closePoller() {
+	l.closed.Do(l.poller.close)
+}
+
+// connections returns the connections of the loop.
+func (l *eventLoop) connections() []*eventConn {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	conns := make([]*eventConn, 0, len(l.conns))
+	for _, c := range l.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// sweep closes the connections idling for longer than their idle timeout until the loop stops.
+func (l *eventLoop) sweep() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case now := <-ticker.C:
+			for _, c := range l.connections() {
+				timeout := c.ctx.idleTimeout()
+				if timeout <= 0 || now.Sub(time.Unix(0, atomic.LoadInt64(&c.since))) < timeout {
+					continue
+				}
+				if atomic.CompareAndSwapInt32(&c.state, eventIdle, eventClosed) {
+					l.close(c, os.ErrDeadlineExceeded, true)
+				}
+			}
+		}
+	}
+}
+
+// closeIdle closes the idle connections and those put aside by their rate limits for a shutdown, but those that didn't send
+// a command yet unless all is set.
+func (l *eventLoop) closeIdle(all bool) {
+	for _, c := range l.connections() {
+		if _, commands, _ := c.ctx.activity(); !all && commands == 0 {
+			continue
+		}
+		if atomic.CompareAndSwapInt32(&c.state, eventIdle, eventClosed) || atomic.CompareAndSwapInt32(&c.state, eventWaiting, eventClosed) {
+			l.close(c, errDraining, false)
+		}
+	}
+}
+
+// drain closes the idle connections for Shutdown, which sets a read deadline on the others. New connections get drainGrace
+// to send their first command.
+func (l *eventLoop) drain() {
+	l.closeIdle(false)
+	time.AfterFunc(drainGrace, func() { l.closeIdle(true) })
+}
+
+// stop stops the loop once Shutdown is done waiting for the connections, closing those still idle. The poller closes once
+// the busy ones are closed too.
+func (l *eventLoop) stop() {
+	l.mutex.Lock()
+	l.stopped = true
+	close(l.done)
+	l.mutex.Unlock()
+	l.closeIdle(true)
+	l.mutex.Lock()
+	empty := len(l.conns) == 0
+	l.mutex.Unlock()
+	if empty {
+		l.closePoller()
+	}
+}
@@ -0,0 +1,63 @@
+//go:build linux
+
+package server
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// eventLoopSupported tells whether Config.EventLoop can be turned on.
+const eventLoopSupported = true
+
+// poller waits for sockets to become readable with epoll. A socket is armed for a single event, telling the ConnID of its
+// connection, and is armed again once the connection was served. Closing a socket removes it.
+type poller struct {
+	epfd   int
+	events []syscall.EpollEvent
+	ids    []uint64
+}
+
+func newPoller() (*poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("epoll_create1", err)
+	}
+	return &poller{epfd: epfd, events: make([]syscall.EpollEvent, 256), ids: make([]uint64, 256)}, nil
+}
+
+// pollEvent returns the event arming a socket for the connection id.
+func pollEvent(id uint64) *syscall.EpollEvent {
+	return &syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT, Fd: int32(id), Pad: int32(id >> 32)}
+}
+
+// add adds the socket fd of the connection id, armed.
+func (p *poller) add(fd int, id uint64) error {
+	return os.NewSyscallError("epoll_ctl", syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, pollEvent(id)))
+}
+
+// arm arms the socket fd of the connection id again.
+func (p *poller) arm(fd int, id uint64) error {
+	return os.NewSyscallError("epoll_ctl", syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, fd, pollEvent(id)))
+}
+
+// wait returns the connections whose sockets became readable or were hung up, waiting up to timeout for one. The result is
+// only valid until the next call.
+func (p *poller) wait(timeout time.Duration) ([]uint64, error) {
+	n, err := syscall.EpollWait(p.epfd, p.events, int(timeout/time.Millisecond))
+	if err == syscall.EINTR {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("epoll_wait", err)
+	}
+	for i, ev := range p.events[:n] {
+		p.ids[i] = uint64(uint32(ev.Fd)) | uint64(uint32(ev.Pad))<<32
+	}
+	return p.ids[:n], nil
+}
+
+func (p *poller) close() {
+	syscall.Close(p.epfd)
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+// eventLoopSupported tells whether Config.EventLoop can be turned on. The poller needs epoll.
+const eventLoopSupported = false
+
+var errNoPoller = errors.New("the event loop is only supported on Linux")
+
+type poller struct{}
+
+func newPoller() (*poller, error) {
+	return nil, errNoPoller
+}
+
+func (p *poller) add(fd int, id uint64) error {
+	return errNoPoller
+}
+
+func (p *poller) arm(fd int, id uint64) error {
+	return errNoPoller
+}
+
+func (p *poller) wait(timeout time.Duration) ([]uint64, error) {
+	return nil, errNoPoller
+}
+
+func (p *poller) close() {}
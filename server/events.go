@@ -0,0 +1,103 @@
+package server
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// ItemHook is called with the key and metadata, but not the value, of an item removed from the store.
+type ItemHook func(key string, val SimpleValue)
+
+// Kinds of store events.
+const (
+	eventEvict = iota
+	eventExpire
+	eventFlush
+)
+
+// storeEvent is a removal or flush waiting for its hook to be called. For flushes key is the namespace, empty for the whole store.
+type storeEvent struct {
+	kind int
+	key  string
+	val  SimpleValue
+}
+
+// eventQueue calls the OnEvict, OnExpire and OnFlush hooks from its own goroutine, so evictions, the sweeper and flushes only pay
+// for a channel send. Events are dropped while the queue is full rather than blocking the store.
+type eventQueue struct {
+	onEvict  ItemHook
+	onExpire ItemHook
+	onFlush  func(namespace string)
+	events   chan storeEvent
+	log      Logger // Reports panicking hooks.
+	dropped  uint64 // Events lost to a full queue. Updated atomically.
+}
+
+// newEventQueue starts calling the hooks of cfg until done is closed. It returns nil if there are no hooks.
+func newEventQueue(cfg Config, done <-chan struct{}) *eventQueue {
+	if cfg.OnEvict == nil && cfg.OnExpire == nil && cfg.OnFlush == nil {
+		return nil
+	}
+	size := cfg.EventQueueSize
+	if size <= 0 {
+		size = 1
+	}
+	q := &eventQueue{onEvict: cfg.OnEvict, onExpire: cfg.OnExpire, onFlush: cfg.OnFlush, events: make(chan storeEvent, size),
+		log: configLogger(cfg)}
+	go q.run(done)
+	return q
+}
+
+func (q *eventQueue) run(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case e := <-q.events:
+			q.dispatch(e)
+		}
+	}
+}
+
+// dispatch calls the hook of an event. A panicking hook is logged and doesn't stop the queue.
+func (q *eventQueue) dispatch(e storeEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			q.log.Error("panic in store event hook", "panic", r)
+		}
+	}()
+	switch e.kind {
+	case eventEvict:
+		q.onEvict(e.key, e.val)
+	case eventExpire:
+		q.onExpire(e.key, e.val)
+	case eventFlush:
+		q.onFlush(e.key)
+	}
+}
+
+// push queues an event unless it has no hook. q may be nil if there are no hooks at all.
+func (q *eventQueue) push(e storeEvent) {
+	if q == nil || (e.kind == eventEvict && q.onEvict == nil) || (e.kind == eventExpire && q.onExpire == nil) || (e.kind == eventFlush && q.onFlush == nil) {
+		return
+	}
+	select {
+	case q.events <- e:
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+	}
+}
+
+func (q *eventQueue) stats() []Stat {
+	return []Stat{
+		{"event_queue_length", strconv.Itoa(len(q.events))},
+		{"events_dropped", strconv.FormatUint(atomic.LoadUint64(&q.dropped), 10)},
+	}
+}
+
+// notify queues an eviction or expiration event for the item of entry, carrying its metadata but not its value.
+func (kv *SimpleKV) notify(kind int, entry *simpleEntry) {
+	if kv.events != nil {
+		kv.events.push(storeEvent{kind: kind, key: entry.key, val: entry.meta()})
+	}
+}
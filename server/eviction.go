@@ -0,0 +1,191 @@
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"sync/atomic"
+)
+
+// Eviction policies selectable through Config.EvictionPolicy.
+const (
+	EvictionLRU     = "lru"     // Evict the least recently used item.
+	EvictionLFU     = "lfu"     // Evict the least frequently used among a random sample of items.
+	EvictionTinyLFU = "tinylfu" // LRU eviction, but new keys only displace items they are more popular than.
+)
+
+// evictionPolicy decides which item of a shard is evicted when the memory limit is hit.
+// Every shard owns its policy. touched and missed run under the shard's read lock plus lruMutex, or under its write lock;
+// insert, victim and admit run under the write lock.
+type evictionPolicy interface {
+	// insert links a new item into the shard's lists.
+	insert(s *simpleShard, entry *simpleEntry) *list.Element
+	// touched records a read of a resident item.
+	touched(s *simpleShard, elem *list.Element)
+	// missed records a read of a key that is not resident.
+	missed(key string)
+	// victim returns the element to evict next. The shard is not empty.
+	victim(s *simpleShard) *list.Element
+	// admit reports whether a new key may displace victim.
+	admit(key string, victim *list.Element) bool
+}
+
+// IsEvictionPolicy reports whether name is a known eviction policy.
+func IsEvictionPolicy(name string) bool {
+	return name == EvictionLRU || name == EvictionLFU || name == EvictionTinyLFU || name == EvictionSegmented
+}
+
+// policyTuning holds the settings of the eviction policies of a store that change at runtime. Shared by its shards.
+// Updated atomically.
+type policyTuning struct {
+	hotPercent, warmPercent int32 // Shares of the HOT and WARM segments of the segmented LRU.
+	lfuSamples              int32 // Items the lfu policy samples for a victim.
+}
+
+// newEvictionPolicy creates the policy for one shard.
+func newEvictionPolicy(name string) (evictionPolicy, error) {
+	switch name {
+	case EvictionLRU, "":
+		return lruPolicy{}, nil
+	case EvictionLFU:
+		return lfuPolicy{}, nil
+	case EvictionTinyLFU:
+		return &tinyLFUPolicy{sketch: newCountMinSketch(4096)}, nil
+	case EvictionSegmented:
+		return segmentedPolicy{}, nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy %q", name)
+}
+
+type lruPolicy struct{}
+
+func (lruPolicy) insert(s *simpleShard, entry *simpleEntry) *list.Element {
+	return s.lru.PushFront(entry)
+}
+
+func (lruPolicy) touched(s *simpleShard, elem *list.Element) { s.lru.MoveToFront(elem) }
+func (lruPolicy) missed(key string)                          {}
+func (lruPolicy) victim(s *simpleShard) *list.Element        { return s.lru.Back() }
+func (lruPolicy) admit(string, *list.Element) bool           { return true }
+
+// lfuPolicy counts hits per item. Every sampled candidate loses a hit, so formerly popular items age out.
+type lfuPolicy struct{}
+
+func (lfuPolicy) insert(s *simpleShard, entry *simpleEntry) *list.Element {
+	return s.lru.PushFront(entry)
+}
+
+func (lfuPolicy) touched(s *simpleShard, elem *list.Element) {
+	entry := elem.Value.(*simpleEntry)
+	if entry.hits < 255 {
+		entry.hits++
+	}
+	s.lru.MoveToFront(elem)
+}
+
+func (lfuPolicy) missed(key string) {}
+
+func (lfuPolicy) victim(s *simpleShard) *list.Element {
+	var victim *list.Element
+	i, samples := 0, int(atomic.LoadInt32(&s.tuning.lfuSamples))
+	// Map iteration starts at a random position, which makes for a cheap random sample.
+	for _, elem := range s.items {
+		entry := elem.Value.(*simpleEntry)
+		if victim == nil || entry.hits < victim.Value.(*simpleEntry).hits {
+			victim = elem
+		}
+		if entry.hits > 0 {
+			entry.hits--
+		}
+		if i++; i == samples {
+			break
+		}
+	}
+	return victim
+}
+
+func (lfuPolicy) admit(string, *list.Element) bool { return true }
+
+// tinyLFUPolicy evicts like LRU but keeps a frequency sketch of all requested keys, resident or not.
+// A new key is only admitted if it was requested more often than the item it would evict, which keeps one-off scans from flushing the cache.
+type tinyLFUPolicy struct {
+	sketch *countMinSketch
+}
+
+func (p *tinyLFUPolicy) insert(s *simpleShard, entry *simpleEntry) *list.Element {
+	return s.lru.PushFront(entry)
+}
+
+func (p *tinyLFUPolicy) touched(s *simpleShard, elem *list.Element) {
+	p.sketch.increment(elem.Value.(*simpleEntry).key)
+	s.lru.MoveToFront(elem)
+}
+
+func (p *tinyLFUPolicy) missed(key string) {
+	p.sketch.increment(key)
+}
+
+func (p *tinyLFUPolicy) victim(s *simpleShard) *list.Element {
+	return s.lru.Back()
+}
+
+func (p *tinyLFUPolicy) admit(key string, victim *list.Element) bool {
+	p.sketch.increment(key)
+	return p.sketch.estimate(key) > p.sketch.estimate(victim.Value.(*simpleEntry).key)
+}
+
+// countMinSketch estimates access frequencies in fixed memory. All counters are halved periodically so the estimate follows recent traffic.
+type countMinSketch struct {
+	rows      [4][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+// newCountMinSketch creates a sketch with width counters per row. width must be a power of two.
+func newCountMinSketch(width int) *countMinSketch {
+	cms := &countMinSketch{mask: uint64(width - 1), resetAt: 10 * width}
+	for i := range cms.rows {
+		cms.rows[i] = make([]uint8, width)
+	}
+	return cms
+}
+
+// hashes returns two independent hashes of key, combined per row as h1 + i*h2.
+func (cms *countMinSketch) hashes(key string) (uint64, uint64) {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h, (h >> 32) | 1
+}
+
+func (cms *countMinSketch) increment(key string) {
+	h1, h2 := cms.hashes(key)
+	for i := range cms.rows {
+		idx := (h1 + uint64(i)*h2) & cms.mask
+		if cms.rows[i][idx] < 255 {
+			cms.rows[i][idx]++
+		}
+	}
+	cms.additions++
+	if cms.additions >= cms.resetAt {
+		for i := range cms.rows {
+			for j := range cms.rows[i] {
+				cms.rows[i][j] /= 2
+			}
+		}
+		cms.additions /= 2
+	}
+}
+
+func (cms *countMinSketch) estimate(key string) uint8 {
+	h1, h2 := cms.hashes(key)
+	min := uint8(255)
+	for i := range cms.rows {
+		if c := cms.rows[i][(h1+uint64(i)*h2)&cms.mask]; c < min {
+			min = c
+		}
+	}
+	return min
+}
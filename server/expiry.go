@@ -0,0 +1,70 @@
+package server
+
+import (
+	"math/rand"
+	"time"
+)
+
+// maxRelativeExptime is the largest expiration taken as seconds from now. Larger values are absolute unix timestamps, as in memcached.
+const maxRelativeExptime = 60 * 60 * 24 * 30 // 30 days
+
+// processStart anchors item expiration times. It carries a monotonic clock reading, so wall clock jumps don't expire items early or late.
+var processStart = clock.Now()
+
+// currentTime returns the seconds elapsed since the process started, measured on the monotonic clock.
+func currentTime() int {
+	return int(clock.Now().Sub(processStart) / time.Second)
+}
+
+// expiration converts the expiration of a request into the TTL stored with an item:
+// 0 never expires, up to 30 days is relative to now, anything larger is an absolute unix timestamp.
+func expiration(exptime uint32) int {
+	if exptime == 0 {
+		return 0
+	}
+	if exptime <= maxRelativeExptime {
+		return currentTime() + int(exptime)
+	}
+	rel := int64(exptime) - clock.Now().Unix()
+	if rel <= 0 {
+		// Already in the past. Any non-zero TTL not after the current time is expired.
+		return -1
+	}
+	return currentTime() + int(rel)
+}
+
+// itemExpiration is expiration for the TTL of stored items, shortened by a random part of up to TTLJitter percent.
+// Keys stored together with the same expiration then don't all expire in the same second and hit the backing store at once.
+func (s *Server) itemExpiration(exptime uint32) int {
+	ttl := expiration(exptime)
+	jitter := s.ttlJitter()
+	if jitter <= 0 || ttl <= 0 {
+		return ttl
+	}
+	now := currentTime()
+	if max := (ttl - now) * jitter / 100; max > 0 {
+		ttl -= rand.Intn(max + 1)
+	}
+	return ttl
+}
+
+// unixExpiration converts a TTL into a unix timestamp, so persisted items expire correctly after a restart. 0 stays 0.
+func unixExpiration(ttl int) int64 {
+	if ttl == 0 {
+		return 0
+	}
+	return processStart.Unix() + int64(ttl)
+}
+
+// ttlFromUnix converts a timestamp made by unixExpiration back into a TTL.
+func ttlFromUnix(exptime int64) int {
+	if exptime == 0 {
+		return 0
+	}
+	return int(exptime - processStart.Unix())
+}
+
+// expired reports whether the item's TTL has passed.
+func (val SimpleValue) expired() bool {
+	return val.TTL != 0 && val.TTL <= currentTime()
+}
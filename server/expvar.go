@@ -0,0 +1,35 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// handleVars serves /debug/vars of the admin listener like expvar.Handler, with the stats of s under "memcached" next to the
+// variables of the process, like cmdline and memstats. Numeric values are published as numbers.
+func (s *Server) handleVars(w http.ResponseWriter, r *http.Request) {
+	vars := map[string]interface{}{}
+	for _, stat := range s.generalStats(s.cache) {
+		if n, err := strconv.ParseInt(stat.Value, 10, 64); err == nil {
+			vars[stat.Name] = n
+		} else if f, err := strconv.ParseFloat(stat.Value, 64); err == nil {
+			vars[stat.Name] = f
+		} else {
+			vars[stat.Name] = stat.Value
+		}
+	}
+	stats, err := json.Marshal(vars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n%q: %s", "memcached", stats)
+	expvar.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, ",\n%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
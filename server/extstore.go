@@ -0,0 +1,266 @@
+package server
+
+import (
+	"container/list"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrExtstoreFull is returned when the disk tier reached its size limit.
+var ErrExtstoreFull = errors.New("Extstore full")
+
+// extCompactMin is the dead bytes below which compacting the disk tier isn't worth it.
+const extCompactMin = 1 << 20
+
+// extFile is one file of the disk tier.
+type extFile struct {
+	file *os.File
+	path string
+	end  int64  // Where the next value is appended. Guarded by extStore.mutex.
+	live uint64 // Bytes of values still referenced. Guarded by extStore.mutex.
+}
+
+// extLoc locates a value kept in the disk tier. A zero size means the value is in memory.
+type extLoc struct {
+	file *extFile
+	off  int64
+	size int
+}
+
+// extStore is the disk tier of SimpleKV, an append-only flat file of values.
+// Space of replaced or deleted values is reclaimed once no value lives in the file anymore, or by compaction once they
+// outweigh the live ones: values are then appended to a new file, alternating between the path and the path suffixed
+// with .1, the live values move over and the old file is removed.
+type extStore struct {
+	mutex      sync.Mutex
+	path       string
+	cur        *extFile // File values are appended to. Guarded by mutex.
+	old        *extFile // File being compacted, until nothing lives in it anymore. Guarded by mutex.
+	compacting bool     // Guarded by mutex.
+	compact    func()   // Moves the live values off the old file, set by the store.
+	maxSize    uint64   // Size limit of the files together in bytes, 0 means no limit.
+	log        Logger   // Reports failed compactions, set by the store.
+
+	writes, reads, readErrors, compactions uint64 // Updated atomically.
+}
+
+// newExtStore creates or truncates the disk tier file at path. Its contents don't survive a restart.
+func newExtStore(path string, maxSize uint64) (*extStore, error) {
+	os.Remove(path + ".1")
+	f, err := openExtFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &extStore{path: path, cur: f, maxSize: maxSize}, nil
+}
+
+func openExtFile(path string) (*extFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &extFile{file: f, path: path}, nil
+}
+
+// write appends data to the current file.
+func (e *extStore) write(data []byte) (extLoc, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.maxSize > 0 && e.size()+uint64(len(data)) > e.maxSize {
+		e.startCompaction()
+		return extLoc{}, ErrExtstoreFull
+	}
+	return e.append(data)
+}
+
+// size is the bytes taken by the files together. Lock must be held.
+func (e *extStore) size() uint64 {
+	size := uint64(e.cur.end)
+	if e.old != nil {
+		size += uint64(e.old.end)
+	}
+	return size
+}
+
+// append writes data at the end of the current file. Lock must be held.
+func (e *extStore) append(data []byte) (extLoc, error) {
+	f := e.cur
+	if _, err := f.file.WriteAt(data, f.end); err != nil {
+		return extLoc{}, err
+	}
+	loc := extLoc{file: f, off: f.end, size: len(data)}
+	f.end += int64(len(data))
+	f.live += uint64(len(data))
+	atomic.AddUint64(&e.writes, 1)
+	return loc, nil
+}
+
+// read faults a value back into memory.
+func (e *extStore) read(loc extLoc) ([]byte, error) {
+	buf := make([]byte, loc.size)
+	if _, err := loc.file.file.ReadAt(buf, loc.off); err != nil {
+		atomic.AddUint64(&e.readErrors, 1)
+		return nil, err
+	}
+	atomic.AddUint64(&e.reads, 1)
+	return buf, nil
+}
+
+// release marks the space of a value as unused. Once nothing lives in the current file, it is rewound; once nothing lives
+// in a compacted one, it is removed.
+func (e *extStore) release(loc extLoc) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	f := loc.file
+	f.live -= uint64(loc.size)
+	switch {
+	case f != e.cur:
+		if f.live == 0 && !e.compacting {
+			e.removeOld()
+		}
+	case f.live == 0:
+		f.end = 0
+		f.file.Truncate(0)
+	default:
+		e.startCompaction()
+	}
+}
+
+// startCompaction compacts the current file in the background once its dead bytes outweigh the live ones. Lock must be held.
+func (e *extStore) startCompaction() {
+	if e.compact == nil || e.compacting || e.old != nil {
+		return
+	}
+	if dead := uint64(e.cur.end) - e.cur.live; dead < extCompactMin || dead < e.cur.live {
+		return
+	}
+	path := e.path
+	if e.cur.path == path {
+		path += ".1"
+	}
+	f, err := openExtFile(path)
+	if err != nil {
+		e.log.Error("error compacting extstore", "err", err)
+		return
+	}
+	e.old, e.cur, e.compacting = e.cur, f, true
+	go e.compact()
+}
+
+// move copies a value of the compacted file to the current one and returns its new location.
+func (e *extStore) move(loc extLoc) (extLoc, error) {
+	data := make([]byte, loc.size)
+	if _, err := loc.file.file.ReadAt(data, loc.off); err != nil {
+		return loc, err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	moved, err := e.append(data)
+	if err != nil {
+		return loc, err
+	}
+	loc.file.live -= uint64(loc.size)
+	return moved, nil
+}
+
+// compacted ends a compaction. Values that couldn't move keep the old file until they are released.
+func (e *extStore) compacted() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.compacting = false
+	atomic.AddUint64(&e.compactions, 1)
+	if e.old.live == 0 {
+		e.removeOld()
+	}
+}
+
+// removeOld closes and removes the compacted file. Lock must be held.
+func (e *extStore) removeOld() {
+	e.old.file.Close()
+	os.Remove(e.old.path)
+	e.old = nil
+}
+
+// close closes the files of the disk tier.
+func (e *extStore) close() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.cur.file.Close()
+	if e.old != nil {
+		e.old.file.Close()
+	}
+}
+
+func (e *extStore) stats() []Stat {
+	e.mutex.Lock()
+	end, live := e.size(), e.cur.live
+	if e.old != nil {
+		live += e.old.live
+	}
+	e.mutex.Unlock()
+	return []Stat{
+		{"extstore_limit_maxbytes", strconv.FormatUint(e.maxSize, 10)},
+		{"extstore_bytes_written", strconv.FormatUint(end, 10)},
+		{"extstore_bytes_used", strconv.FormatUint(live, 10)},
+		{"extstore_bytes_fragmented", strconv.FormatUint(end-live, 10)},
+		{"extstore_objects_written", strconv.FormatUint(atomic.LoadUint64(&e.writes), 10)},
+		{"extstore_objects_read", strconv.FormatUint(atomic.LoadUint64(&e.reads), 10)},
+		{"extstore_read_errors", strconv.FormatUint(atomic.LoadUint64(&e.readErrors), 10)},
+		{"extstore_compactions", strconv.FormatUint(atomic.LoadUint64(&e.compactions), 10)},
+	}
+}
+
+// compactExtstore moves the values living in the compacted file of the disk tier to the current one, shard by shard.
+func (kv *SimpleKV) compactExtstore() {
+	old := kv.ext.old
+	for _, s := range kv.shards {
+		s.mutex.Lock()
+		for _, elem := range s.items {
+			val := &elem.Value.(*simpleEntry).val
+			if val.ext.file == old {
+				val.ext, _ = kv.ext.move(val.ext)
+			}
+		}
+		s.mutex.Unlock()
+	}
+	kv.ext.compacted()
+}
+
+// dataLen is the stored length of the value bytes, wherever they live.
+func (val SimpleValue) dataLen() int {
+	if val.ext.size != 0 {
+		return val.ext.size
+	}
+	n := len(val.RawData)
+	for _, c := range val.more {
+		n += len(c.data)
+	}
+	return n
+}
+
+// offload moves the value of an item to the disk tier, leaving only its metadata in memory.
+// It reports false if the value can't be moved, e.g. as it's already on disk. Write lock must be held.
+func (kv *SimpleKV) offload(s *simpleShard, elem *list.Element) bool {
+	entry := elem.Value.(*simpleEntry)
+	if kv.ext == nil || entry.val.ext.size != 0 || len(entry.val.RawData) == 0 || len(entry.val.more) > 0 {
+		return false
+	}
+	loc, err := kv.ext.write(entry.val.RawData)
+	if err != nil {
+		return false
+	}
+	atomic.AddUint64(&kv.bytes, ^(uint64(len(entry.val.RawData)) - 1))
+	if entry.ns != nil {
+		atomic.AddUint64(&entry.ns.bytes, ^(uint64(len(entry.val.RawData)) - 1))
+	}
+	if entry.val.chunk.page != nil {
+		kv.slabs.release(entry.val.chunk)
+	}
+	entry.val.RawData, entry.val.chunk, entry.val.ext = nil, slabChunk{}, loc
+	// Requeue the item so the next victims are values still in memory. It ages out from disk later.
+	s.segment(entry.seg).MoveToFront(elem)
+	return true
+}
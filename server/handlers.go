@@ -1,10 +1,13 @@
 package server
 
 import (
+	"bufio"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"time"
+	"net"
+	"sync/atomic"
 )
 
 // Handler is the interface for all command handling functions.
@@ -20,6 +23,109 @@ func (f HandleFunc) Handle(header RequestHeader, ctx *ConnectionContext) error {
 	return f(header, ctx)
 }
 
+// readBody reads the body of a request into the connection's read buffer, or a pooled one if it doesn't fit. Requests larger
+// than MaxRequestSize fail with a protocol error. All handlers reading a body go through it.
+func readBody(header RequestHeader, ctx *ConnectionContext) ([]byte, error) {
+	buf := ctx.ReadBuf
+	if header.TotalBodyLength > uint32(len(ctx.ReadBuf)) {
+		if max := ctx.server.maxRequestSize(); int64(header.TotalBodyLength) > int64(max) {
+			return nil, protocolErrorf(protoOversize, "request size %d is too large than %d", header.TotalBodyLength, max)
+		}
+		buf = ctx.buffer(int(header.TotalBodyLength))
+	}
+	buf = buf[:header.TotalBodyLength]
+	if _, err := io.ReadFull(ctx.RW, buf); err != nil {
+		return nil, err
+	}
+	ctx.trace.readKey(header, buf)
+	return buf, nil
+}
+
+// writeResponse writes a response header followed by extras, key and value. Length fields of the header are filled in from them.
+func writeResponse(respHeader ResponseHeader, extras, key, value []byte, rw *bufio.ReadWriter) error {
+	respHeader.ExtraLength = uint8(len(extras))
+	respHeader.KeyLength = uint16(len(key))
+	respHeader.TotalBodyLength = uint32(len(extras) + len(key) + len(value))
+	err := writeResponseHeader(respHeader, rw)
+	if err != nil {
+		return err
+	}
+	for _, part := range [][]byte{extras, key, value} {
+		if _, err = rw.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buffersWriter is implemented by the connection wrappers, like countingConn, passing vectored writes on to the connection they
+// wrap. net.Buffers only writes TCP and Unix domain sockets with a single writev, not wrappers of them.
+type buffersWriter interface {
+	writeBuffers(bufs *net.Buffers) (int64, error)
+}
+
+// writeBuffers writes bufs to w, with a single writev if w is a socket or wraps one.
+func writeBuffers(w io.Writer, bufs *net.Buffers) (int64, error) {
+	if bw, ok := w.(buffersWriter); ok {
+		return bw.writeBuffers(bufs)
+	}
+	return bufs.WriteTo(w)
+}
+
+// writeValueResponse writes a response like writeResponse. A value at least as large as the write buffer is written with the
+// header, extras and key in front of it in a single vectored write, after flushing the buffered responses, rather than in
+// pieces through the buffer.
+func (ctx *ConnectionContext) writeValueResponse(respHeader ResponseHeader, extras, key, value []byte) error {
+	if len(value) < ctx.RW.Writer.Size() {
+		return writeResponse(respHeader, extras, key, value, ctx.RW)
+	}
+	if err := ctx.RW.Flush(); err != nil {
+		return err
+	}
+	respHeader.ExtraLength = uint8(len(extras))
+	respHeader.KeyLength = uint16(len(key))
+	respHeader.TotalBodyLength = uint32(len(extras) + len(key) + len(value))
+	buf := appendResponseHeader(ctx.buffer(24 + len(extras) + len(key))[:0], respHeader)
+	bufs := net.Buffers{append(append(buf, extras...), key...), value}
+	_, err := writeBuffers(ctx.ConnHandle, &bufs)
+	return err
+}
+
+// writeError writes the response for a failed store operation, carrying the error message as value.
+func writeError(header RequestHeader, storeErr error, ctx *ConnectionContext) error {
+	respHeader := ResponseHeader{}
+	respHeader.Magic = MagicResponse
+	respHeader.Opcode = header.Opcode
+	respHeader.Opaque = header.Opaque
+	switch storeErr {
+	case ErrKeyNotFound:
+		respHeader.Status = CodeKeyNotFound
+	case ErrKeyExists:
+		respHeader.Status = CodeKeyExists
+	case ErrValueTooLarge:
+		respHeader.Status = CodeValueTooLarge
+	case ErrNonNumeric:
+		respHeader.Status = CodeNonNumeric
+	case ErrInvalidKey:
+		respHeader.Status = CodeInvalidArguments
+	case ErrNotStored:
+		respHeader.Status = CodeNotStored
+	case ErrOutOfMemory:
+		respHeader.Status = CodeOutOfMemory
+	case ErrLocked, ErrRateLimited:
+		respHeader.Status = CodeTemporaryFailure
+	case ErrNotSupported, ErrCommandDisabled:
+		respHeader.Status = CodeNotSupported
+	case ErrAuth:
+		respHeader.Status = CodeAuthError
+	case ErrAccessDenied:
+		respHeader.Status = CodeAccessDenied
+	default:
+		respHeader.Status = CodeInternalError
+	}
+	return writeResponse(respHeader, nil, nil, []byte(storeErr.Error()), ctx.RW)
+}
+
 // GetHandler handles GET/GETQ/GETK/GETKQ commands
 var GetHandler HandleFunc = func(header RequestHeader, ctx *ConnectionContext) error {
 	if header.ExtraLength > 0 {
@@ -31,28 +137,19 @@ var GetHandler HandleFunc = func(header RequestHeader, ctx *ConnectionContext) e
 	if header.TotalBodyLength != uint32(header.KeyLength)+uint32(header.ExtraLength) {
 		return fmt.Errorf("Get must NOT have value: total: %d keylength %d extralength %d", header.TotalBodyLength, header.KeyLength, header.ExtraLength)
 	}
-	if header.TotalBodyLength > uint32(len(ctx.ReadBuf)) {
-		if header.TotalBodyLength > MaxReqLen {
-			return fmt.Errorf("request size %d is too large than %d", header.TotalBodyLength, MaxReqLen)
-		}
-		nsize := len(ctx.ReadBuf)
-		for nsize < int(header.TotalBodyLength) {
-			nsize *= 2
-		}
-		ctx.ReadBuf = make([]byte, nsize)
+	buf, err := readBody(header, ctx)
+	if err != nil {
+		return err
 	}
-	buf := ctx.ReadBuf[:header.TotalBodyLength]
-	readLen := 0
-	for readLen < int(header.TotalBodyLength) {
-		reqLen, err := ctx.RW.Read(buf[readLen:])
-		if err != nil {
-			return err
-		}
-		readLen += reqLen
+
+	if !ctx.server.validKey(buf) {
+		return writeError(header, ErrInvalidKey, ctx)
 	}
 
 	// k/v storage access
-	val, ok := GetFromSimpleKV(string(buf))
+	val, ok := getBytes(ctx.Store, buf)
+	ctx.server.counters.countGet(ok)
+	defer val.Release()
 
 	respHeader := ResponseHeader{}
 	respHeader.Magic = MagicResponse
@@ -66,59 +163,21 @@ var GetHandler HandleFunc = func(header RequestHeader, ctx *ConnectionContext) e
 		}
 		respHeader.Status = CodeKeyNotFound
 		respHeader.TotalBodyLength = uint32(len("Not found"))
-		err := writeResponseHeader(respHeader, ctx.RW)
-		if err != nil {
+		if err := writeResponseHeader(respHeader, ctx.RW); err != nil {
 			return err
 		}
-		for _, c := range []byte("Not found") {
-			err = ctx.RW.WriteByte(c)
-			if err != nil {
-				return err
-			}
-		}
-	} else {
-		// found
-		respHeader.Status = CodeNoError
-		respHeader.ExtraLength = 0x04
-		if header.Opcode == OpGetK || header.Opcode == OpGetKQ {
-			respHeader.KeyLength = uint16(len(buf))
-		}
-		respHeader.TotalBodyLength = uint32(len(val.RawData)) + uint32(respHeader.ExtraLength) + uint32(respHeader.KeyLength)
-		respHeader.CAS = val.CAS
-		err := writeResponseHeader(respHeader, ctx.RW)
-		if err != nil {
-			return err
-		}
-		for pos := 0; pos < 4; pos++ {
-			err = ctx.RW.WriteByte(GetNthByteFromUint32(val.Flag, pos))
-			if err != nil {
-				return err
-			}
-		}
-		if respHeader.KeyLength > 0 {
-			writeLen := 0
-			l := len(buf)
-			for writeLen < l {
-				n, err := ctx.RW.Write(buf)
-				if err != nil {
-					return err
-				}
-				writeLen += n
-				buf = buf[n:]
-			}
-		}
-		buf := val.RawData
-		writeLen := 0
-		for writeLen < len(val.RawData) {
-			n, err := ctx.RW.Write(buf)
-			if err != nil {
-				return err
-			}
-			writeLen += n
-			buf = buf[n:]
-		}
+		_, err := ctx.RW.WriteString("Not found")
+		return err
 	}
-	return nil
+	respHeader.Status = CodeNoError
+	respHeader.CAS = val.CAS
+	flags := ctx.buffer(4)
+	binary.BigEndian.PutUint32(flags, val.Flag)
+	var key []byte
+	if header.Opcode == OpGetK || header.Opcode == OpGetKQ {
+		key = buf
+	}
+	return ctx.writeValueResponse(respHeader, flags, key, val.RawData)
 }
 
 // SetHandler handles SET/SETQ/ADD/ADDQ/REPLACE/REPLACEQ commands
@@ -127,103 +186,221 @@ var SetHandler HandleFunc = func(header RequestHeader, ctx *ConnectionContext) e
 		return fmt.Errorf("Set/Add/Replace commands MUST have key and extra : keylength %d, extralength: %d, totalbodylength: %d",
 			header.KeyLength, header.ExtraLength, header.TotalBodyLength)
 	}
-	if header.TotalBodyLength > uint32(len(ctx.ReadBuf)) {
-		if header.TotalBodyLength > MaxReqLen {
-			return fmt.Errorf("request size %d is too large than %d", header.TotalBodyLength, MaxReqLen)
-		}
-		nsize := len(ctx.ReadBuf)
-		for nsize < int(header.TotalBodyLength) {
-			nsize *= 2
-		}
-		ctx.ReadBuf = make([]byte, nsize)
-	}
-	buf := ctx.ReadBuf[:header.TotalBodyLength]
-	readLen := 0
-	for readLen < int(header.TotalBodyLength) {
-		reqLen, err := ctx.RW.Read(buf[readLen:])
-		if err != nil {
-			return err
-		}
-		readLen += reqLen
+	buf, err := readBody(header, ctx)
+	if err != nil {
+		return err
 	}
 	newFlag := GetUint32(buf)
-	ttl := int(GetUint32(buf[4:]))
-	if ttl > 0 {
-		ttl += time.Now().Second()
+	ttl := ctx.server.itemExpiration(GetUint32(buf[4:]))
+	if !ctx.server.validKey(buf[8 : 8+header.KeyLength]) {
+		return writeError(header, ErrInvalidKey, ctx)
 	}
 	key := string(buf[8 : 8+header.KeyLength])
-	buf = buf[8+header.KeyLength:]
-	newBuf := make([]byte, len(buf))
-	copy(newBuf, buf)
 	newVal := SimpleValue{
-		RawData: newBuf,
+		RawData: buf[8+header.KeyLength:], // The store copies the value out of the read buffer.
 		Flag:    newFlag,
 		CAS:     0,
 		TTL:     ttl,
 	}
 
-	shouldFail := false
-	responseCode := CodeNoError
-	responseCAS := uint64(0)
-
 	// k/v storage access
+	atomic.AddUint64(&ctx.server.counters.cmdSet, 1)
 	if header.Opcode == OpAdd || header.Opcode == OpAddQ {
-		newVal, ok := AddToSimpleKV(key, newVal)
-		if !ok {
-			shouldFail = true
-			responseCode = CodeKeyExists
-			goto output
-		}
-		responseCAS = newVal.CAS
+		newVal, err = ctx.Store.Add(key, newVal)
 	} else {
-		newVal, notfound, ok := SetToSimpleKV(key, newVal, header.CAS, header.Opcode == OpReplace || header.Opcode == OpReplaceQ)
-		if notfound {
-			shouldFail = true
-			responseCode = CodeKeyNotFound
-			goto output
-		}
-		if !ok {
-			shouldFail = true
-			responseCode = CodeKeyExists
-			goto output
-		}
-		responseCAS = newVal.CAS
+		newVal, err = ctx.Store.Set(key, newVal, header.CAS, header.Opcode == OpReplace || header.Opcode == OpReplaceQ)
+	}
+	if header.CAS != 0 {
+		ctx.server.counters.countCAS(err)
+	}
+	audit(ctx, opcodeName(header.Opcode), key, len(newVal.RawData), auditCAS(newVal.CAS, header.CAS, err), err)
+	if err != nil {
+		return writeError(header, err, ctx)
+	}
+	// Q commands don't have response unless there's a failure
+	if header.Opcode == OpAddQ || header.Opcode == OpReplaceQ || header.Opcode == OpSetQ {
+		return nil
+	}
+	respHeader := ResponseHeader{}
+	respHeader.Magic = MagicResponse
+	respHeader.Opcode = header.Opcode
+	respHeader.Opaque = header.Opaque
+	respHeader.Status = CodeNoError
+	respHeader.CAS = newVal.CAS
+	return writeResponse(respHeader, nil, nil, nil, ctx.RW)
+}
+
+// DeleteHandler handles DELETE/DELETEQ commands
+var DeleteHandler HandleFunc = func(header RequestHeader, ctx *ConnectionContext) error {
+	if header.ExtraLength > 0 || header.KeyLength == 0 || header.TotalBodyLength != uint32(header.KeyLength) {
+		return fmt.Errorf("Delete command MUST have key only: keylength %d, extralength: %d, totalbodylength: %d",
+			header.KeyLength, header.ExtraLength, header.TotalBodyLength)
+	}
+	buf, err := readBody(header, ctx)
+	if err != nil {
+		return err
+	}
+	if !ctx.server.validKey(buf) {
+		return writeError(header, ErrInvalidKey, ctx)
+	}
+	key := string(buf)
+	err = ctx.Store.Delete(key, header.CAS)
+	countResult(&ctx.server.counters.deleteHits, &ctx.server.counters.deleteMisses, err)
+	audit(ctx, opcodeName(header.Opcode), key, 0, header.CAS, err)
+	if err != nil {
+		return writeError(header, err, ctx)
+	}
+	if header.Opcode == OpDeleteQ {
+		return nil
 	}
-output:
 	respHeader := ResponseHeader{}
 	respHeader.Magic = MagicResponse
 	respHeader.Opcode = header.Opcode
 	respHeader.Opaque = header.Opaque
 	respHeader.Status = CodeNoError
-	respHeader.CAS = responseCAS
-	var errStr string
+	return writeResponse(respHeader, nil, nil, nil, ctx.RW)
+}
 
-	if shouldFail {
-		respHeader.Status = uint16(responseCode)
-		if responseCode == CodeKeyNotFound {
-			respHeader.TotalBodyLength = uint32(len("Not found"))
-			errStr = "Not found"
-		} else if responseCode == CodeKeyExists {
-			respHeader.TotalBodyLength = uint32(len("Data exists for key."))
-			errStr = "Data exists for key."
-		}
+// FlushHandler handles FLUSH/FLUSHQ commands. The optional extras hold an expiration delaying the flush.
+var FlushHandler HandleFunc = func(header RequestHeader, ctx *ConnectionContext) error {
+	if header.KeyLength != 0 || (header.ExtraLength != 0 && header.ExtraLength != 4) || header.TotalBodyLength != uint32(header.ExtraLength) {
+		return fmt.Errorf("Flush command MUST have no key and optional 4 byte extra only: keylength %d, extralength: %d, totalbodylength: %d",
+			header.KeyLength, header.ExtraLength, header.TotalBodyLength)
+	}
+	buf, err := readBody(header, ctx)
+	if err != nil {
+		return err
+	}
+	var exptime uint32
+	if header.ExtraLength == 4 {
+		exptime = GetUint32(buf)
+	}
+	ctx.Store.Flush(expiration(exptime))
+	audit(ctx, opcodeName(header.Opcode), "", 0, 0, nil)
+	if header.Opcode == OpFlushQ {
+		return nil
+	}
+	respHeader := ResponseHeader{}
+	respHeader.Magic = MagicResponse
+	respHeader.Opcode = header.Opcode
+	respHeader.Opaque = header.Opaque
+	respHeader.Status = CodeNoError
+	return writeResponse(respHeader, nil, nil, nil, ctx.RW)
+}
+
+// IncrHandler handles INCREMENT/INCREMENTQ/DECREMENT/DECREMENTQ commands
+var IncrHandler HandleFunc = func(header RequestHeader, ctx *ConnectionContext) error {
+	if header.ExtraLength != 20 || header.KeyLength == 0 || header.TotalBodyLength != uint32(header.KeyLength)+20 {
+		return fmt.Errorf("Incr/Decr commands MUST have key and extra only: keylength %d, extralength: %d, totalbodylength: %d",
+			header.KeyLength, header.ExtraLength, header.TotalBodyLength)
+	}
+	buf, err := readBody(header, ctx)
+	if err != nil {
+		return err
+	}
+	delta := GetUint64(buf)
+	initial := GetUint64(buf[8:])
+	exptime := GetUint32(buf[16:])
+	if !ctx.server.validKey(buf[20:]) {
+		return writeError(header, ErrInvalidKey, ctx)
+	}
+	key := string(buf[20:])
+	decr := header.Opcode == OpDecrement || header.Opcode == OpDecrementQ
+
+	// An expiration of all one bits means the key must not be created when missing.
+	val, n, err := ctx.Store.Incr(key, delta, decr, initial, exptime != 0xffffffff, ctx.server.itemExpiration(exptime), header.CAS)
+	if decr {
+		countResult(&ctx.server.counters.decrHits, &ctx.server.counters.decrMisses, err)
 	} else {
-		// Q commands don't have response unless there's a failure
-		if header.Opcode == OpAddQ || header.Opcode == OpReplaceQ || header.Opcode == OpSetQ {
-			return nil
-		}
+		countResult(&ctx.server.counters.incrHits, &ctx.server.counters.incrMisses, err)
 	}
-	err := writeResponseHeader(respHeader, ctx.RW)
+	audit(ctx, opcodeName(header.Opcode), key, 0, auditCAS(val.CAS, header.CAS, err), err)
+	if err != nil {
+		return writeError(header, err, ctx)
+	}
+	if header.Opcode == OpIncrementQ || header.Opcode == OpDecrementQ {
+		return nil
+	}
+	respHeader := ResponseHeader{}
+	respHeader.Magic = MagicResponse
+	respHeader.Opcode = header.Opcode
+	respHeader.Opaque = header.Opaque
+	respHeader.Status = CodeNoError
+	respHeader.CAS = val.CAS
+	value := ctx.buffer(8)
+	for pos := 0; pos < 4; pos++ {
+		value[pos] = GetNthByteFromUint32(uint32(n>>32), pos)
+		value[4+pos] = GetNthByteFromUint32(uint32(n), pos)
+	}
+	return writeResponse(respHeader, nil, nil, value, ctx.RW)
+}
+
+// TouchHandler handles TOUCH/GAT/GATQ commands. TOUCH updates the item in place without reading its value, and with 8 bytes of
+// extras also replaces its flags with the second 4 bytes.
+var TouchHandler HandleFunc = func(header RequestHeader, ctx *ConnectionContext) error {
+	extras := uint8(4)
+	if header.Opcode == OpTouch && header.ExtraLength == 8 {
+		extras = 8
+	}
+	if header.ExtraLength != extras || header.KeyLength == 0 || header.TotalBodyLength != uint32(header.KeyLength)+uint32(extras) {
+		return fmt.Errorf("Touch/GAT commands MUST have key and extra only: keylength %d, extralength: %d, totalbodylength: %d",
+			header.KeyLength, header.ExtraLength, header.TotalBodyLength)
+	}
+	buf, err := readBody(header, ctx)
 	if err != nil {
 		return err
 	}
-	for _, c := range []byte(errStr) {
-		err = ctx.RW.WriteByte(c)
+	if !ctx.server.validKey(buf[extras:]) {
+		return writeError(header, ErrInvalidKey, ctx)
+	}
+	atomic.AddUint64(&ctx.server.counters.cmdTouch, 1)
+	if header.Opcode == OpTouch {
+		var flags *uint32
+		if extras == 8 {
+			f := GetUint32(buf[4:])
+			flags = &f
+		}
+		key := string(buf[extras:])
+		val, err := updateMeta(ctx.Store, key, ctx.server.itemExpiration(GetUint32(buf)), flags, header.CAS)
+		countResult(&ctx.server.counters.touchHits, &ctx.server.counters.touchMisses, err)
+		audit(ctx, opcodeName(header.Opcode), key, 0, auditCAS(val.CAS, header.CAS, err), err)
 		if err != nil {
-			return err
+			return writeError(header, err, ctx)
 		}
+		respHeader := ResponseHeader{}
+		respHeader.Magic = MagicResponse
+		respHeader.Opcode = header.Opcode
+		respHeader.Opaque = header.Opaque
+		respHeader.Status = CodeNoError
+		respHeader.CAS = val.CAS
+		return writeResponse(respHeader, nil, nil, nil, ctx.RW)
 	}
-	return nil
+	key := string(buf[4:])
+	val, ok := ctx.Store.Touch(key, ctx.server.itemExpiration(GetUint32(buf)))
+	countHit(&ctx.server.counters.touchHits, &ctx.server.counters.touchMisses, ok)
+	if ok {
+		audit(ctx, opcodeName(header.Opcode), key, 0, val.CAS, nil)
+	} else {
+		audit(ctx, opcodeName(header.Opcode), key, 0, 0, ErrKeyNotFound)
+	}
+	if !ok {
+		if header.Opcode == OpGATQ {
+			//Q commands don't send responses upon cache miss
+			return nil
+		}
+		return writeError(header, ErrKeyNotFound, ctx)
+	}
+	respHeader := ResponseHeader{}
+	respHeader.Magic = MagicResponse
+	respHeader.Opcode = header.Opcode
+	respHeader.Opaque = header.Opaque
+	respHeader.Status = CodeNoError
+	respHeader.CAS = val.CAS
+	flags := ctx.buffer(4)
+	for pos := 0; pos < 4; pos++ {
+		flags[pos] = GetNthByteFromUint32(val.Flag, pos)
+	}
+	return writeResponse(respHeader, flags, nil, val.RawData, ctx.RW)
 }
 
 // VersionHandler handles VERSION command
@@ -237,12 +414,12 @@ var VersionHandler HandleFunc = func(header RequestHeader, ctx *ConnectionContex
 	respHeader.Opcode = header.Opcode
 	respHeader.Opaque = header.Opaque
 	respHeader.Status = CodeNoError
-	respHeader.TotalBodyLength = uint32(len("1.4.24")) // We fake a valid version
+	respHeader.TotalBodyLength = uint32(len(Version))
 	err := writeResponseHeader(respHeader, ctx.RW)
 	if err != nil {
 		return err
 	}
-	buf := []byte("1.4.24")
+	buf := []byte(Version)
 	writeLen := 0
 	for writeLen < len(buf) {
 		n, err := ctx.RW.Write(buf)
@@ -291,21 +468,44 @@ var QuitHandler HandleFunc = func(header RequestHeader, ctx *ConnectionContext)
 	return io.EOF
 }
 
-// OpHandler if the map from op -> command handler
-// (TODO) Add more commands such as delete / incr/decr
-var OpHandler = map[uint8]Handler{
-
-	OpSet:      SetHandler,
-	OpSetQ:     SetHandler,
-	OpAdd:      SetHandler,
-	OpAddQ:     SetHandler,
-	OpReplace:  SetHandler,
-	OpReplaceQ: SetHandler,
-	OpGet:      GetHandler,
-	OpGetQ:     GetHandler,
-	OpGetK:     GetHandler,
-	OpGetKQ:    GetHandler,
-	OpVersion:  VersionHandler,
-	OpNoOp:     NoOpHandler,
-	OpQuit:     QuitHandler,
+// opHandlers returns the map from op -> command handler a Server starts with.
+func opHandlers() map[uint8]Handler {
+	return map[uint8]Handler{
+		OpSet:           SetHandler,
+		OpSetQ:          SetHandler,
+		OpAdd:           SetHandler,
+		OpAddQ:          SetHandler,
+		OpReplace:       SetHandler,
+		OpReplaceQ:      SetHandler,
+		OpGet:           GetHandler,
+		OpGetQ:          GetHandler,
+		OpGetK:          GetHandler,
+		OpGetKQ:         GetHandler,
+		OpDelete:        DeleteHandler,
+		OpDeleteQ:       DeleteHandler,
+		OpIncrement:     IncrHandler,
+		OpIncrementQ:    IncrHandler,
+		OpDecrement:     IncrHandler,
+		OpDecrementQ:    IncrHandler,
+		OpFlush:         FlushHandler,
+		OpFlushQ:        FlushHandler,
+		OpAppend:        AppendHandler,
+		OpAppendQ:       AppendHandler,
+		OpPrepend:       AppendHandler,
+		OpPrependQ:      AppendHandler,
+		OpStat:          StatHandler,
+		OpSwap:          SwapHandler,
+		OpGetLocked:     GetLockedHandler,
+		OpUnlockKey:     UnlockHandler,
+		OpTouch:         TouchHandler,
+		OpGAT:           TouchHandler,
+		OpGATQ:          TouchHandler,
+		OpVersion:       VersionHandler,
+		OpNoOp:          NoOpHandler,
+		OpVerbosity:     VerbosityHandler,
+		OpSASLListMechs: SASLListMechsHandler,
+		OpSASLAuth:      SASLAuthHandler,
+		OpSASLStep:      SASLAuthHandler,
+		OpQuit:          QuitHandler,
+	}
 }
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// healthTimeout bounds every check of a health probe.
+const healthTimeout = 2 * time.Second
+
+// healthKey is looked up in the store to tell whether it answers. Clients can't use it as it holds a control character.
+const healthKey = "\x00health"
+
+// serving returns why s isn't serving clients, nil if it is.
+func (s *Server) serving() error {
+	select {
+	case <-s.closing:
+		return errors.New("shutting down")
+	default:
+	}
+	select {
+	case <-s.ready:
+		return nil
+	default:
+		return errors.New("not listening yet")
+	}
+}
+
+// checkStore returns an error unless a lookup in the store completes within healthTimeout. The lookup skips the decorators of
+// the store, so it doesn't count as a key access or reach the loader.
+func (s *Server) checkStore() error {
+	done := make(chan struct{})
+	go func() {
+		baseStore(s.cache).Get(healthKey)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(healthTimeout):
+		return fmt.Errorf("store didn't answer within %v", healthTimeout)
+	}
+}
+
+// checkListeners returns an error unless every listener accepts a connection that answers a NOOP, or a version command on
+// ASCII listeners, within healthTimeout. Listeners the probe can't talk to count as up once bound, see probeable.
+func (s *Server) checkListeners() error {
+	for i, addr := range s.Addrs() {
+		if !s.probeable(s.config.Listeners[i], addr) {
+			continue
+		}
+		if err := probeListener(addr, s.config.Listeners[i].Protocol); err != nil {
+			return fmt.Errorf("listener %s: %v", addr, err)
+		}
+	}
+	return nil
+}
+
+// probeable reports whether the probe can talk to the listener of lc bound to addr: in plain text, without a PROXY protocol
+// header, and from an address its IP rules admit. The probe connects from the address of the listener, or from loopback if it
+// listens on all addresses.
+func (s *Server) probeable(lc ListenerConfig, addr net.Addr) bool {
+	if lc.TLS || lc.ProxyProtocol {
+		return false
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return true
+	}
+	switch {
+	case ip.IsUnspecified() && ip.To4() != nil:
+		ip = net.IPv4(127, 0, 0, 1)
+	case ip.IsUnspecified():
+		ip = net.IPv6loopback
+	}
+	allow, deny := s.ipRules()
+	return !deny.contains(ip) && (len(allow) == 0 || allow.contains(ip))
+}
+
+// probeListener connects to addr and sends a command that every server answers in the protocol.
+func probeListener(addr net.Addr, protocol Protocol) error {
+	conn, err := net.DialTimeout(addr.Network(), addr.String(), healthTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(healthTimeout))
+	if protocol == ProtocolASCII {
+		if _, err := io.WriteString(conn, "version\r\n"); err != nil {
+			return err
+		}
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, "VERSION ") {
+			return fmt.Errorf("unexpected reply %q", strings.TrimSpace(line))
+		}
+		return nil
+	}
+	req := make([]byte, 24)
+	req[0], req[1] = MagicRequest, OpNoOp
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	resp := make([]byte, 24)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != MagicResponse || resp[1] != OpNoOp {
+		return fmt.Errorf("unexpected reply % x", resp[:2])
+	}
+	return nil
+}
+
+// liveness returns why s is broken and should be restarted, nil if it works. A server starting up or shutting down is live.
+func (s *Server) liveness() error {
+	if err := s.checkStore(); err != nil {
+		return err
+	}
+	if s.serving() != nil {
+		return nil
+	}
+	return s.checkListeners()
+}
+
+// readiness returns why s can't take clients, nil if it can.
+func (s *Server) readiness() error {
+	if err := s.serving(); err != nil {
+		return err
+	}
+	if err := s.checkStore(); err != nil {
+		return err
+	}
+	return s.checkListeners()
+}
+
+// healthHandler answers probes with 200 if check passes and 503 with the problem otherwise.
+func healthHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := check(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// TextHealthHandler handles the "health" command. It answers OK if the server serves clients and its store answers lookups,
+// without probing the listeners like /readyz does, as the command came through one.
+var TextHealthHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	if len(args) != 1 {
+		return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+	}
+	err := ctx.server.serving()
+	if err == nil {
+		err = ctx.server.checkStore()
+	}
+	if err != nil {
+		return writeTextLine(ctx, "SERVER_ERROR %v", err)
+	}
+	return writeTextLine(ctx, "OK")
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// Hooks intercept the connections and commands of a server, for custom auth, metrics or request shaping. Every hook is optional.
+// Hooks run on the goroutine serving the connection, so a slow hook delays its client. The embedded API doesn't run them.
+type Hooks struct {
+	// OnConnect is called with every new connection before it is served. An error closes the connection.
+	OnConnect func(conn ConnInfo) error
+	// OnDisconnect is called once a connection that got past OnConnect closed.
+	OnDisconnect func(conn ConnInfo)
+	// BeforeCommand is called before a command is handled. An error rejects the command: a binary command gets the error reply
+	// of the error, like a store error such as ErrNotSupported, a text command gets SERVER_ERROR with its message.
+	BeforeCommand func(cmd CommandInfo) error
+	// AfterCommand is called once the reply of a command was sent, with its status and latency.
+	AfterCommand func(cmd CommandInfo)
+}
+
+// ConnInfo describes a client connection to hooks.
+type ConnInfo struct {
+	ID         uint64 // ConnID of the connection, as listed by "conns list".
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	User       string // Name the client authenticated as, empty until it did.
+}
+
+// CommandInfo describes a command to hooks.
+type CommandInfo struct {
+	Conn    ConnInfo
+	Name    string        // Name of the binary opcode, like get or setq, or the text command.
+	Header  RequestHeader // Header of a binary command. Zero for text commands.
+	Args    []string      // Words of the command line of a text command, starting with its name. nil for binary commands.
+	Latency time.Duration // Time from reading the command to sending its reply. Set for AfterCommand.
+	Status  string        // Status of the reply: the hex status of a binary reply, e.g. 0x0001, or the first word of a text reply, e.g. OK. "-" if there was none. Set for AfterCommand.
+	Err     error         // Error closing the connection while handling the command, if any. Set for AfterCommand.
+}
+
+// WithHooks intercepts the connections and commands of the server with hooks.
+func WithHooks(hooks Hooks) Option {
+	return func(c *Config) { c.Hooks = hooks }
+}
+
+// hooked reports whether hooks follow the commands of connections, which needs their replies traced.
+func (h *Hooks) hooked() bool {
+	return h.BeforeCommand != nil || h.AfterCommand != nil
+}
+
+// textDataCommands are the text commands followed by a data block, which can't be skipped when they are rejected.
+var textDataCommands = map[string]bool{"lease-set": true}
+
+// beforeCommand runs the BeforeCommand hook for cmd and remembers cmd for AfterCommand.
+func (ctx *ConnectionContext) beforeCommand(cmd CommandInfo) error {
+	hooks := &ctx.server.config.Hooks
+	if !hooks.hooked() {
+		return nil
+	}
+	cmd.Conn = ctx.connInfo()
+	ctx.command, ctx.commandStart = &cmd, time.Now()
+	if hooks.BeforeCommand == nil {
+		return nil
+	}
+	return hooks.BeforeCommand(cmd)
+}
+
+// afterCommand runs the AfterCommand hook for the command handled last, if any.
+func (ctx *ConnectionContext) afterCommand(status string, err error) {
+	cmd := ctx.command
+	if cmd == nil {
+		return
+	}
+	ctx.command = nil
+	if hook := ctx.server.config.Hooks.AfterCommand; hook != nil {
+		cmd.Latency, cmd.Status, cmd.Err = time.Since(ctx.commandStart), status, err
+		hook(*cmd)
+	}
+}
+
+func (ctx *ConnectionContext) connInfo() ConnInfo {
+	return ConnInfo{ID: ctx.ConnID, RemoteAddr: ctx.ConnHandle.RemoteAddr(), LocalAddr: ctx.ConnHandle.LocalAddr(), User: ctx.User}
+}
+
+// rejectCommand replies to a binary command rejected by a hook, skipping its body.
+func rejectCommand(header RequestHeader, reason error, ctx *ConnectionContext) error {
+	if _, err := io.CopyN(io.Discard, ctx.RW, int64(header.TotalBodyLength)); err != nil {
+		return err
+	}
+	return writeError(header, reason, ctx)
+}
+
+// rejectTextCommand replies to a text command rejected by a hook, for want of authentication, by an ACL or as disabled. Commands followed by
+// a data block close the connection.
+func rejectTextCommand(args []string, reason error, ctx *ConnectionContext) error {
+	var err error
+	switch reason {
+	case ErrAuth:
+		err = writeTextLine(ctx, "CLIENT_ERROR unauthenticated")
+	case ErrAccessDenied:
+		err = writeTextLine(ctx, "CLIENT_ERROR access denied")
+	case ErrCommandDisabled:
+		err = writeTextLine(ctx, "CLIENT_ERROR %s not allowed", args[0])
+	default:
+		err = writeTextLine(ctx, "SERVER_ERROR %v", reason)
+	}
+	if err != nil {
+		return err
+	}
+	if textDataCommands[args[0]] {
+		return io.EOF
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hot key detection settings. Accesses are counted in buckets covering hotKeyWindow/hotKeyBuckets each; the report covers the last
+// hotKeyBuckets of them.
+const (
+	hotKeyWindow   = time.Minute
+	hotKeyBuckets  = 6
+	hotKeyCounters = 256 // Keys tracked per bucket.
+	hotKeysTop     = 10  // Keys listed by "stats hotkeys".
+)
+
+// hotKeyCounter estimates the accesses of one key. err is how much the count may be overestimated.
+type hotKeyCounter struct {
+	count, err uint64
+}
+
+// hotKeyBucketSummary counts the keys sampled during one bucket of time with the Space-Saving algorithm:
+// a key not tracked yet replaces the one with the lowest count, inheriting that count as error. So frequent keys are never missed.
+type hotKeyBucketSummary struct {
+	start    int64 // Number of the time bucket counted, the unix time divided by the bucket duration.
+	counters map[string]*hotKeyCounter
+}
+
+func (b *hotKeyBucketSummary) add(key string) {
+	if c, ok := b.counters[key]; ok {
+		c.count++
+		return
+	}
+	if len(b.counters) < hotKeyCounters {
+		b.counters[key] = &hotKeyCounter{count: 1}
+		return
+	}
+	var minKey string
+	var min *hotKeyCounter
+	for k, c := range b.counters {
+		if min == nil || c.count < min.count {
+			minKey, min = k, c
+		}
+	}
+	delete(b.counters, minKey)
+	b.counters[key] = &hotKeyCounter{count: min.count + 1, err: min.count}
+}
+
+// hotKeyTracker samples key accesses into a sliding window of bucket summaries.
+type hotKeyTracker struct {
+	rate    uint64        // One in rate accesses is sampled.
+	bucket  time.Duration // Time counted by each bucket.
+	seq     uint64        // Accesses seen. Updated atomically.
+	mutex   sync.Mutex
+	buckets [hotKeyBuckets]hotKeyBucketSummary // Guarded by mutex.
+}
+
+// newHotKeyTracker returns a tracker sampling one in rate accesses and reporting on the last window of time.
+func newHotKeyTracker(rate int, window time.Duration) *hotKeyTracker {
+	bucket := window / hotKeyBuckets
+	if bucket <= 0 {
+		bucket = 1
+	}
+	t := &hotKeyTracker{rate: uint64(rate), bucket: bucket}
+	for i := range t.buckets {
+		t.buckets[i].counters = map[string]*hotKeyCounter{}
+	}
+	return t
+}
+
+// record notes an access of key, if sampled.
+func (t *hotKeyTracker) record(key string) {
+	if atomic.AddUint64(&t.seq, 1)%t.rate != 0 {
+		return
+	}
+	now := time.Now().UnixNano() / int64(t.bucket)
+	t.mutex.Lock()
+	b := &t.buckets[now%hotKeyBuckets]
+	if b.start != now {
+		b.start = now
+		b.counters = make(map[string]*hotKeyCounter, len(b.counters))
+	}
+	b.add(key)
+	t.mutex.Unlock()
+}
+
+// hotKey is a key of the report with its estimated accesses over the window and per second.
+type hotKey struct {
+	key   string
+	count uint64
+	qps   float64
+}
+
+// top returns the n keys accessed most over the window, most accessed first.
+func (t *hotKeyTracker) top(n int) []hotKey {
+	now := time.Now().UnixNano() / int64(t.bucket)
+	counts := map[string]uint64{}
+	t.mutex.Lock()
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		if now-b.start >= hotKeyBuckets {
+			continue
+		}
+		for key, c := range b.counters {
+			counts[key] += c.count - c.err
+		}
+	}
+	t.mutex.Unlock()
+	keys := make([]hotKey, 0, len(counts))
+	window := (hotKeyBuckets * t.bucket).Seconds()
+	for key, count := range counts {
+		keys = append(keys, hotKey{key, count * t.rate, float64(count*t.rate) / window})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].qps != keys[j].qps {
+			return keys[i].qps > keys[j].qps
+		}
+		return keys[i].key < keys[j].key
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// hotKeyStore feeds the keys of all requests to the wrapped store into a hotKeyTracker.
+type hotKeyStore struct {
+	Store
+	tracker *hotKeyTracker
+}
+
+// Unwrap returns the tracked store.
+func (h *hotKeyStore) Unwrap() Store {
+	return h.Store
+}
+
+func (h *hotKeyStore) Get(key string) (SimpleValue, bool) {
+	h.tracker.record(key)
+	return h.Store.Get(key)
+}
+
+func (h *hotKeyStore) Set(key string, val SimpleValue, cas uint64, replace bool) (SimpleValue, error) {
+	h.tracker.record(key)
+	return h.Store.Set(key, val, cas, replace)
+}
+
+func (h *hotKeyStore) Add(key string, val SimpleValue) (SimpleValue, error) {
+	h.tracker.record(key)
+	return h.Store.Add(key, val)
+}
+
+func (h *hotKeyStore) Delete(key string, cas uint64) error {
+	h.tracker.record(key)
+	return h.Store.Delete(key, cas)
+}
+
+func (h *hotKeyStore) Touch(key string, ttl int) (SimpleValue, bool) {
+	h.tracker.record(key)
+	return h.Store.Touch(key, ttl)
+}
+
+func (h *hotKeyStore) UpdateMeta(key string, ttl int, flags *uint32, cas uint64) (SimpleValue, error) {
+	h.tracker.record(key)
+	return updateMeta(h.Store, key, ttl, flags, cas)
+}
+
+func (h *hotKeyStore) Incr(key string, delta uint64, decr bool, initial uint64, create bool, ttl int, cas uint64) (SimpleValue, uint64, error) {
+	h.tracker.record(key)
+	return h.Store.Incr(key, delta, decr, initial, create, ttl, cas)
+}
+
+// trackHotKeys wraps store to sample key accesses if enabled by HotKeySampleRate.
+func (s *Server) trackHotKeys(store Store) Store {
+	if s.config.HotKeySampleRate <= 0 {
+		return store
+	}
+	s.hotKeys = newHotKeyTracker(s.config.HotKeySampleRate, hotKeyWindow)
+	return &hotKeyStore{Store: store, tracker: s.hotKeys}
+}
+
+// hotKeyStats reports the hottest keys of the last minute for "stats hotkeys", with their estimated requests per second.
+func hotKeyStats(ctx *ConnectionContext) ([]Stat, bool) {
+	hotKeys := ctx.server.hotKeys
+	if hotKeys == nil {
+		return nil, false
+	}
+	var stats []Stat
+	for _, k := range hotKeys.top(hotKeysTop) {
+		if key, ok := ctx.ownKey(k.key); ok {
+			stats = append(stats, Stat{key, strconv.FormatFloat(k.qps, 'f', 1, 64)})
+		}
+	}
+	return stats, true
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// IPNets is a list of IP networks, written as CIDR blocks or single addresses separated by spaces.
+type IPNets []*net.IPNet
+
+// ParseIPNet parses a CIDR block like 10.0.0.0/8, or a single IPv4 or IPv6 address.
+func ParseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad CIDR block %q", s)
+		}
+		return ipnet, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("bad IP address %q", s)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func (n IPNets) String() string {
+	list := make([]string, len(n))
+	for i, ipnet := range n {
+		list[i] = ipnet.String()
+	}
+	return strings.Join(list, " ")
+}
+
+// contains reports whether ip is in one of the networks.
+func (n IPNets) contains(ip net.IP) bool {
+	for _, ipnet := range n {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) ipRules() (allow, deny IPNets) {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.config.IPAllowlist, s.config.IPDenylist
+}
+
+// addrIP returns the IP of a TCP or UDP address, nil for others like Unix domain socket addresses.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// admitIP reports whether the client at addr may connect per IPAllowlist and IPDenylist: it must not be in IPDenylist, and be in
+// IPAllowlist unless that is empty. Clients of Unix domain sockets have no IP and are always admitted, unless a PROXY protocol
+// header told theirs.
+func (s *Server) admitIP(addr net.Addr) bool {
+	allow, deny := s.ipRules()
+	if len(allow) == 0 && len(deny) == 0 {
+		return true
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return true
+	}
+	if deny.contains(ip) {
+		atomic.AddUint64(&s.counters.ipDenyMatches, 1)
+		return false
+	}
+	if len(allow) == 0 {
+		return true
+	}
+	if allow.contains(ip) {
+		atomic.AddUint64(&s.counters.ipAllowMatches, 1)
+		return true
+	}
+	atomic.AddUint64(&s.counters.ipUnlisted, 1)
+	return false
+}
+
+func (s *Server) maxConnsPerIP() int {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.config.MaxConnsPerIP
+}
+
+// ipConns counts the open connections of every remote IP, limited by MaxConnsPerIP. They are counted even without a limit,
+// so one set by a reload applies to the connections open already.
+type ipConns struct {
+	mutex sync.Mutex
+	open  map[string]int
+}
+
+// acquire counts a new connection from addr and reports whether it is within max, the MaxConnsPerIP of the server, counting none if it isn't.
+// Clients without an IP, like those of Unix domain sockets, aren't limited. Every admitted connection must be released.
+func (c *ipConns) acquire(addr net.Addr, max int) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return true
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if max > 0 && c.open[ip.String()] >= max {
+		return false
+	}
+	if c.open == nil {
+		c.open = map[string]int{}
+	}
+	c.open[ip.String()]++
+	return true
+}
+
+// release uncounts a connection from addr admitted by acquire.
+func (c *ipConns) release(addr net.Addr) {
+	ip := addrIP(addr)
+	if ip == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.open[ip.String()]--; c.open[ip.String()] <= 0 {
+		delete(c.open, ip.String())
+	}
+}
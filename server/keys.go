@@ -0,0 +1,36 @@
+package server
+
+import "errors"
+
+// MaxKeyLength is the longest key memcached accepts.
+const MaxKeyLength = 250
+
+// Key validation modes.
+const (
+	KeyValidationStrict  = "strict"  // Keys follow the ASCII protocol rules: no spaces or control characters.
+	KeyValidationLenient = "lenient" // Any bytes are allowed, as in memcached's binary protocol. Only the length is checked.
+)
+
+// ErrInvalidKey is reported for keys breaking the key rules.
+var ErrInvalidKey = errors.New("Invalid arguments")
+
+// IsKeyValidation reports whether name is a known key validation mode.
+func IsKeyValidation(name string) bool {
+	return name == KeyValidationStrict || name == KeyValidationLenient
+}
+
+// validKey checks a key against MaxKeyLength and, in strict mode, the ASCII protocol rules, so keys can later be shown by metadump and the text protocol.
+func (s *Server) validKey(key []byte) bool {
+	if len(key) == 0 || len(key) > MaxKeyLength {
+		return false
+	}
+	if s.keyValidation() == KeyValidationLenient {
+		return true
+	}
+	for _, c := range key {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxKeyTrace bounds how long "trace_key" may trace keys, so a forgotten trace doesn't flood the log.
+const maxKeyTrace = time.Hour
+
+// keyTraceRule selects the keys whose operations are logged, by prefix or regular expression, until a deadline.
+type keyTraceRule struct {
+	prefix string
+	re     *regexp.Regexp
+	until  time.Time
+}
+
+func (r *keyTraceRule) match(key string) bool {
+	if r.re != nil {
+		return r.re.MatchString(key)
+	}
+	return strings.HasPrefix(key, r.prefix)
+}
+
+// keyTracer holds the "trace_key" rule of a server.
+type keyTracer struct {
+	active int32 // Whether a rule is set, so untraced operations skip the mutex. Updated atomically.
+	mutex  sync.Mutex
+	rule   *keyTraceRule // Guarded by mutex.
+	log    Logger        // Logger of the server, set by wrapStore.
+}
+
+func (t *keyTracer) set(rule *keyTraceRule) {
+	t.mutex.Lock()
+	t.rule = rule
+	if rule != nil {
+		atomic.StoreInt32(&t.active, 1)
+	} else {
+		atomic.StoreInt32(&t.active, 0)
+	}
+	t.mutex.Unlock()
+}
+
+// traced tells whether operations on key are to be logged, ending the trace once it expired.
+func (t *keyTracer) traced(key string) bool {
+	if atomic.LoadInt32(&t.active) == 0 {
+		return false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.rule == nil {
+		return false
+	}
+	if time.Now().After(t.rule.until) {
+		t.rule = nil
+		atomic.StoreInt32(&t.active, 0)
+		t.log.Info("key trace ended")
+		return false
+	}
+	return t.rule.match(key)
+}
+
+// logOp logs an operation on a traced key with the CAS and size of the item it returned.
+func (t *keyTracer) logOp(op, key string, val SimpleValue, err error) {
+	status := "ok"
+	if err != nil {
+		status = err.Error()
+	}
+	t.log.Info("key trace", "op", op, "key", key, "cas", val.CAS, "size", len(val.RawData), "status", status)
+}
+
+// keyTraceStore logs the operations on the keys selected by the "trace_key" rule of tracer.
+type keyTraceStore struct {
+	Store
+	tracer *keyTracer
+}
+
+// Unwrap returns the traced store.
+func (t *keyTraceStore) Unwrap() Store {
+	return t.Store
+}
+
+func (t *keyTraceStore) Get(key string) (SimpleValue, bool) {
+	val, ok := t.Store.Get(key)
+	if t.tracer.traced(key) {
+		t.tracer.logOp("get", key, val, missing(ok))
+	}
+	return val, ok
+}
+
+func (t *keyTraceStore) GetBytes(key []byte) (SimpleValue, bool) {
+	val, ok := getBytes(t.Store, key)
+	if t.tracer.traced(borrowString(key)) {
+		t.tracer.logOp("get", string(key), val, missing(ok))
+	}
+	return val, ok
+}
+
+func (t *keyTraceStore) Set(key string, val SimpleValue, cas uint64, replace bool) (SimpleValue, error) {
+	stored, err := t.Store.Set(key, val, cas, replace)
+	if t.tracer.traced(key) {
+		if err != nil {
+			stored = SimpleValue{RawData: val.RawData, CAS: cas}
+		}
+		t.tracer.logOp("set", key, stored, err)
+	}
+	return stored, err
+}
+
+func (t *keyTraceStore) Add(key string, val SimpleValue) (SimpleValue, error) {
+	stored, err := t.Store.Add(key, val)
+	if t.tracer.traced(key) {
+		if err != nil {
+			stored = SimpleValue{RawData: val.RawData}
+		}
+		t.tracer.logOp("add", key, stored, err)
+	}
+	return stored, err
+}
+
+func (t *keyTraceStore) Delete(key string, cas uint64) error {
+	err := t.Store.Delete(key, cas)
+	if t.tracer.traced(key) {
+		t.tracer.logOp("delete", key, SimpleValue{CAS: cas}, err)
+	}
+	return err
+}
+
+func (t *keyTraceStore) Touch(key string, ttl int) (SimpleValue, bool) {
+	val, ok := t.Store.Touch(key, ttl)
+	if t.tracer.traced(key) {
+		t.tracer.logOp("touch", key, val, missing(ok))
+	}
+	return val, ok
+}
+
+func (t *keyTraceStore) UpdateMeta(key string, ttl int, flags *uint32, cas uint64) (SimpleValue, error) {
+	val, err := updateMeta(t.Store, key, ttl, flags, cas)
+	if t.tracer.traced(key) {
+		t.tracer.logOp("update_meta", key, val, err)
+	}
+	return val, err
+}
+
+func (t *keyTraceStore) Incr(key string, delta uint64, decr bool, initial uint64, create bool, ttl int, cas uint64) (SimpleValue, uint64, error) {
+	val, n, err := t.Store.Incr(key, delta, decr, initial, create, ttl, cas)
+	if t.tracer.traced(key) {
+		op := "incr"
+		if decr {
+			op = "decr"
+		}
+		t.tracer.logOp(op, key, val, err)
+	}
+	return val, n, err
+}
+
+// missing returns ErrKeyNotFound for a lookup that found nothing.
+func missing(ok bool) error {
+	if !ok {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// TextTraceKeyHandler handles the "trace_key prefix <prefix> <seconds>", "trace_key regex <regexp> <seconds>" and "trace_key off"
+// commands. Every operation on a matching key is logged with its CAS and size until the time is up, at most maxKeyTrace.
+var TextTraceKeyHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	if len(args) == 2 && args[1] == "off" {
+		ctx.server.keyTrace.set(nil)
+		return writeTextLine(ctx, "OK")
+	}
+	if len(args) != 4 || (args[1] != "prefix" && args[1] != "regex") {
+		return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+	}
+	seconds, err := strconv.Atoi(args[3])
+	if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxKeyTrace {
+		return writeTextLine(ctx, "CLIENT_ERROR bad trace duration")
+	}
+	rule := &keyTraceRule{prefix: args[2], until: time.Now().Add(time.Duration(seconds) * time.Second)}
+	if args[1] == "regex" {
+		if rule.re, err = regexp.Compile(args[2]); err != nil {
+			return writeTextLine(ctx, "CLIENT_ERROR bad regular expression")
+		}
+	}
+	ctx.server.keyTrace.set(rule)
+	ctx.logger().Info("key trace started", args[1], args[2], "seconds", seconds)
+	return writeTextLine(ctx, "OK")
+}
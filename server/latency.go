@@ -0,0 +1,175 @@
+package server
+
+import (
+	"math/bits"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// hdrSubBits sets the precision of hdrHistogram: every power of two is split into 2^hdrSubBits buckets, which bounds
+// the error of a reported quantile to about 3%.
+const hdrSubBits = 5
+
+// hdrMax is the largest latency in nanoseconds told apart by hdrHistogram, about 69 seconds. Slower commands count as this.
+const hdrMax = 1<<36 - 1
+
+// hdrBuckets is the number of buckets needed for latencies up to hdrMax.
+const hdrBuckets = (36-hdrSubBits)<<hdrSubBits + 1<<hdrSubBits
+
+// hdrHistogram records latencies in nanoseconds into log-linear buckets, like an HDR histogram, to report quantiles
+// from a fixed amount of memory.
+type hdrHistogram struct {
+	counts [hdrBuckets]uint64 // Updated atomically.
+	count  uint64             // Updated atomically.
+	sum    uint64             // Total latency in nanoseconds. Updated atomically.
+}
+
+// hdrIndex returns the bucket of a latency of v nanoseconds.
+func hdrIndex(v uint64) int {
+	if v < 1<<hdrSubBits {
+		return int(v)
+	}
+	shift := bits.Len64(v) - hdrSubBits - 1
+	return (shift+1)<<hdrSubBits + int(v>>uint(shift)) - 1<<hdrSubBits
+}
+
+// hdrUpper returns the largest latency in nanoseconds counted by bucket i.
+func hdrUpper(i int) uint64 {
+	if i < 1<<hdrSubBits {
+		return uint64(i)
+	}
+	shift := uint(i>>hdrSubBits - 1)
+	mantissa := uint64(i&(1<<hdrSubBits-1) + 1<<hdrSubBits)
+	return (mantissa+1)<<shift - 1
+}
+
+// record counts a command taking d. h may be nil for commands without a histogram.
+func (h *hdrHistogram) record(d time.Duration) {
+	if h == nil {
+		return
+	}
+	ns := uint64(d)
+	if d < 0 {
+		ns = 0
+	} else if ns > hdrMax {
+		ns = hdrMax
+	}
+	atomic.AddUint64(&h.counts[hdrIndex(ns)], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, ns)
+}
+
+// quantiles returns the latencies in nanoseconds below which the fractions qs of the recorded commands finished. qs must be ascending.
+func (h *hdrHistogram) quantiles(qs []float64) []uint64 {
+	values := make([]uint64, len(qs))
+	total := atomic.LoadUint64(&h.count)
+	if total == 0 {
+		return values
+	}
+	var seen uint64
+	q := 0
+	for i := range h.counts {
+		seen += atomic.LoadUint64(&h.counts[i])
+		for q < len(qs) && float64(seen) >= qs[q]*float64(total) {
+			values[q] = hdrUpper(i)
+			q++
+		}
+		if q == len(qs) {
+			break
+		}
+	}
+	for ; q < len(qs); q++ {
+		// Commands recorded while scanning may leave the highest quantiles unreached.
+		values[q] = hdrMax
+	}
+	return values
+}
+
+func (h *hdrHistogram) reset() {
+	for i := range h.counts {
+		atomic.StoreUint64(&h.counts[i], 0)
+	}
+	atomic.StoreUint64(&h.count, 0)
+	atomic.StoreUint64(&h.sum, 0)
+}
+
+// latencyQuantiles are the quantiles reported by "stats latency" and /metrics, with the suffix of their stat names.
+var latencyQuantiles = []float64{0.5, 0.95, 0.99, 0.999}
+var latencyQuantileNames = []string{"p50", "p95", "p99", "p999"}
+
+// latencies holds the latency histograms of a server: of all commands, and of the binary opcodes and text commands with a handler.
+type latencies struct {
+	command latencyHistogram // Time taken by all commands, from reading the request to buffering the response.
+	binary  [256]*hdrHistogram
+	text    map[string]*hdrHistogram
+}
+
+// newLatencies returns the histograms of the commands of handlers and textHandlers.
+func newLatencies(handlers map[uint8]Handler, textHandlers map[string]TextHandler) *latencies {
+	l := &latencies{text: map[string]*hdrHistogram{}}
+	for op := range handlers {
+		l.binary[op] = &hdrHistogram{}
+	}
+	for name := range textHandlers {
+		l.text[name] = &hdrHistogram{}
+	}
+	return l
+}
+
+// commands returns the latency histograms of the commands handled so far by name. Binary opcodes and text commands
+// sharing a name, like version, are reported separately with the text ones prefixed by "text_".
+func (l *latencies) commands() map[string]*hdrHistogram {
+	histograms := map[string]*hdrHistogram{}
+	for op, h := range l.binary {
+		if h != nil && atomic.LoadUint64(&h.count) > 0 {
+			histograms[opcodeName(uint8(op))] = h
+		}
+	}
+	for name, h := range l.text {
+		if atomic.LoadUint64(&h.count) > 0 {
+			histograms["text_"+name] = h
+		}
+	}
+	return histograms
+}
+
+// reset clears the histograms of the commands for "stats reset". The histogram of all commands, exported as
+// a Prometheus counter, keeps counting.
+func (l *latencies) reset() {
+	for _, h := range l.binary {
+		if h != nil {
+			h.reset()
+		}
+	}
+	for _, h := range l.text {
+		h.reset()
+	}
+}
+
+// latencyStats reports the count and latency quantiles in microseconds of every command handled so far for "stats latency".
+func latencyStats(ctx *ConnectionContext) ([]Stat, bool) {
+	histograms := ctx.server.latency.commands()
+	names := make([]string, 0, len(histograms))
+	for name := range histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var stats []Stat
+	for _, name := range names {
+		h := histograms[name]
+		stats = append(stats, Stat{name + ":count", strconv.FormatUint(atomic.LoadUint64(&h.count), 10)})
+		for i, v := range h.quantiles(latencyQuantiles) {
+			stats = append(stats, Stat{name + ":" + latencyQuantileNames[i] + "_us", strconv.FormatFloat(float64(v)/1e3, 'f', 3, 64)})
+		}
+	}
+	return stats, true
+}
+
+// logSlowCommand logs a command that took at least SlowLogThreshold.
+func logSlowCommand(ctx *ConnectionContext, command string, took time.Duration) {
+	if threshold := ctx.server.slowLogThreshold(); threshold > 0 && took >= threshold {
+		ctx.logger().Warn("slow command", "command", command, "took", took)
+	}
+}
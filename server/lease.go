@@ -0,0 +1,207 @@
+package server
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hotMissToken is the lease token telling a client that another one holds the lease and will fill the key soon, as in mcrouter.
+// The client should retry the lease-get shortly instead of hitting the backing store.
+const hotMissToken = 1
+
+// lease is a right to fill a missing key, granted to the first client missing it.
+type lease struct {
+	token   uint64
+	expires time.Time
+}
+
+// leaseTable keeps the leases of missing keys, so only one client at a time recomputes a value after a miss.
+type leaseTable struct {
+	ttl    time.Duration
+	seq    uint64 // Last token handed out. Updated atomically.
+	count  int64  // Number of leases held, so mutations can skip the table while it's empty. Updated atomically.
+	mutex  sync.Mutex
+	leases map[string]lease // Guarded by mutex.
+}
+
+func newLeaseTable(ttl time.Duration) *leaseTable {
+	return &leaseTable{ttl: ttl, seq: uint64(time.Now().UnixNano()), leases: map[string]lease{}}
+}
+
+// grant returns a new token for key, or hotMissToken while another client holds a lease on it.
+func (t *leaseTable) grant(key string) uint64 {
+	now := clock.Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if l, ok := t.leases[key]; ok && now.Before(l.expires) {
+		return hotMissToken
+	}
+	if len(t.leases) >= 1024 && len(t.leases)%1024 == 0 {
+		for k, l := range t.leases {
+			if !now.Before(l.expires) {
+				delete(t.leases, k)
+			}
+		}
+	}
+	token := atomic.AddUint64(&t.seq, 1)
+	if token <= hotMissToken {
+		token = atomic.AddUint64(&t.seq, hotMissToken+1)
+	}
+	t.leases[key] = lease{token: token, expires: now.Add(t.ttl)}
+	atomic.StoreInt64(&t.count, int64(len(t.leases)))
+	return token
+}
+
+// redeem ends the lease on key if token is valid for it, reporting whether it was.
+func (t *leaseTable) redeem(key string, token uint64) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	l, ok := t.leases[key]
+	if !ok || l.token != token || !clock.Now().Before(l.expires) {
+		return false
+	}
+	delete(t.leases, key)
+	atomic.StoreInt64(&t.count, int64(len(t.leases)))
+	return true
+}
+
+// invalidate drops the lease on key, as its value changed. A value computed under the lease might be stale now.
+func (t *leaseTable) invalidate(key string) {
+	if atomic.LoadInt64(&t.count) == 0 {
+		return
+	}
+	t.mutex.Lock()
+	delete(t.leases, key)
+	atomic.StoreInt64(&t.count, int64(len(t.leases)))
+	t.mutex.Unlock()
+}
+
+// leaseStore invalidates the leases of keys changed in the wrapped store by anything but lease-set.
+type leaseStore struct {
+	Store
+	table *leaseTable
+}
+
+// Unwrap returns the store leases are granted for.
+func (l *leaseStore) Unwrap() Store {
+	return l.Store
+}
+
+func (l *leaseStore) GetBytes(key []byte) (SimpleValue, bool) {
+	return getBytes(l.Store, key)
+}
+
+func (l *leaseStore) Set(key string, val SimpleValue, cas uint64, replace bool) (SimpleValue, error) {
+	l.table.invalidate(key)
+	return l.Store.Set(key, val, cas, replace)
+}
+
+func (l *leaseStore) Add(key string, val SimpleValue) (SimpleValue, error) {
+	l.table.invalidate(key)
+	return l.Store.Add(key, val)
+}
+
+func (l *leaseStore) Delete(key string, cas uint64) error {
+	l.table.invalidate(key)
+	return l.Store.Delete(key, cas)
+}
+
+func (l *leaseStore) UpdateMeta(key string, ttl int, flags *uint32, cas uint64) (SimpleValue, error) {
+	return updateMeta(l.Store, key, ttl, flags, cas)
+}
+
+func (l *leaseStore) Incr(key string, delta uint64, decr bool, initial uint64, create bool, ttl int, cas uint64) (SimpleValue, uint64, error) {
+	l.table.invalidate(key)
+	return l.Store.Incr(key, delta, decr, initial, create, ttl, cas)
+}
+
+// enableLeases wraps store for lease-get and lease-set if enabled by LeaseTTL.
+func (s *Server) enableLeases(store Store) Store {
+	if s.config.LeaseTTL <= 0 {
+		return store
+	}
+	s.leases = newLeaseTable(s.config.LeaseTTL)
+	return &leaseStore{Store: store, table: s.leases}
+}
+
+// TextLeaseGetHandler handles the "lease-get <key>" command. A hit is answered like get. A miss grants the client a lease token with
+// "LVALUE <key> <token> <flags> 0", which lease-set needs to fill the key. Until then other clients get the hot miss token 1.
+var TextLeaseGetHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	if len(args) != 2 || !ctx.server.validKey([]byte(args[1])) {
+		return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+	}
+	leases := ctx.server.leases
+	if leases == nil {
+		return writeTextLine(ctx, "ERROR")
+	}
+	key := args[1]
+	val, ok := ctx.Store.Get(key)
+	ctx.server.counters.countGet(ok)
+	if ok {
+		if err := writeTextLine(ctx, "VALUE %s %d %d", key, val.Flag, len(val.RawData)); err != nil {
+			return err
+		}
+		if _, err := ctx.RW.Write(val.RawData); err != nil {
+			return err
+		}
+		if err := writeTextLine(ctx, ""); err != nil {
+			return err
+		}
+		return writeTextLine(ctx, "END")
+	}
+	if err := writeTextLine(ctx, "LVALUE %s %d 0 0", key, leases.grant(ctx.storeKey(key))); err != nil {
+		return err
+	}
+	if err := writeTextLine(ctx, ""); err != nil {
+		return err
+	}
+	return writeTextLine(ctx, "END")
+}
+
+// TextLeaseSetHandler handles the "lease-set <key> <token> <flags> <exptime> <bytes> [noreply]" command followed by the data block.
+// The value is only stored if the token is the key's current lease; otherwise, e.g. after the key was deleted meanwhile, it's NOT_STORED.
+var TextLeaseSetHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	noreply := len(args) == 7 && args[6] == "noreply"
+	if len(args) != 6 && !noreply {
+		return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+	}
+	token, err1 := strconv.ParseUint(args[2], 10, 64)
+	flags, err2 := strconv.ParseUint(args[3], 10, 32)
+	exptime, err3 := strconv.ParseUint(args[4], 10, 32)
+	size, err4 := strconv.Atoi(args[5])
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || size < 0 || !ctx.server.validKey([]byte(args[1])) {
+		return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+	}
+	if size > ctx.server.maxRequestSize() {
+		// The data block can't be skipped reliably, so the connection is closed like for an oversized binary request.
+		writeTextLine(ctx, "SERVER_ERROR object too large for cache")
+		return io.EOF
+	}
+	data := ctx.buffer(size + 2)
+	if _, err := io.ReadFull(ctx.RW, data); err != nil {
+		return err
+	}
+	if string(data[size:]) != "\r\n" {
+		return writeTextLine(ctx, "CLIENT_ERROR bad data chunk")
+	}
+	atomic.AddUint64(&ctx.server.counters.cmdSet, 1)
+	reply := "NOT_STORED"
+	err := ErrNotStored
+	if leases := ctx.server.leases; leases != nil && leases.redeem(ctx.storeKey(args[1]), token) {
+		val := SimpleValue{RawData: data[:size], Flag: uint32(flags), TTL: ctx.server.itemExpiration(uint32(exptime))}
+		// Add, as a plain set meanwhile takes precedence over the value computed under the lease.
+		if val, err = ctx.Store.Add(args[1], val); err == nil {
+			reply = "STORED"
+		}
+		audit(ctx, args[0], args[1], size, val.CAS, err)
+	} else {
+		audit(ctx, args[0], args[1], size, 0, err)
+	}
+	if noreply {
+		return nil
+	}
+	return writeTextLine(ctx, reply)
+}
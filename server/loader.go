@@ -0,0 +1,101 @@
+package server
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Loader fetches the value of a key missing from the cache, e.g. from a database, for read-through caching. ok is false if the key doesn't exist there either.
+// The TTL of the returned value is given like the expiration of a request: seconds from now, a unix timestamp or 0 for never.
+// A Loader is called concurrently for different keys, but only once at a time per key.
+type Loader func(key string) (val SimpleValue, ok bool, err error)
+
+// loadCall is a load in progress. Concurrent misses of the same key wait for it instead of calling the Loader again.
+type loadCall struct {
+	done chan struct{}
+	val  SimpleValue
+	ok   bool
+}
+
+// loaderStore answers GET misses of the wrapped store with values from a Loader, storing them on the way.
+type loaderStore struct {
+	Store
+	load   Loader
+	server *Server // Server whose TTLJitter applies to loaded values and whose logger reports failed loads.
+	mutex  sync.Mutex
+	calls  map[string]*loadCall // Guarded by mutex.
+	loads  uint64               // Loader calls. Updated atomically.
+	hits   uint64               // Loads that found the key. Updated atomically.
+	errors uint64               // Loads that failed. Updated atomically.
+}
+
+func newLoaderStore(store Store, s *Server) *loaderStore {
+	return &loaderStore{Store: store, load: s.config.Loader, server: s, calls: map[string]*loadCall{}}
+}
+
+// Unwrap returns the store loaded into.
+func (l *loaderStore) Unwrap() Store {
+	return l.Store
+}
+
+func (l *loaderStore) Get(key string) (SimpleValue, bool) {
+	if val, ok := l.Store.Get(key); ok {
+		return val, true
+	}
+	l.mutex.Lock()
+	call, loading := l.calls[key]
+	if !loading {
+		call = &loadCall{done: make(chan struct{})}
+		l.calls[key] = call
+	}
+	l.mutex.Unlock()
+	if loading {
+		<-call.done
+		return call.val, call.ok
+	}
+	call.val, call.ok = l.fill(key)
+	l.mutex.Lock()
+	delete(l.calls, key)
+	l.mutex.Unlock()
+	close(call.done)
+	return call.val, call.ok
+}
+
+// fill calls the Loader for key and stores what it found. A value stored by a client meanwhile takes precedence over the loaded one.
+func (l *loaderStore) fill(key string) (SimpleValue, bool) {
+	atomic.AddUint64(&l.loads, 1)
+	val, ok, err := l.load(key)
+	if err != nil {
+		atomic.AddUint64(&l.errors, 1)
+		l.server.logger().Error("error loading key", "key", key, "err", err)
+		return SimpleValue{}, false
+	}
+	if !ok {
+		return SimpleValue{}, false
+	}
+	atomic.AddUint64(&l.hits, 1)
+	val.TTL = l.server.itemExpiration(uint32(val.TTL))
+	stored, err := l.Store.Add(key, val)
+	if err == ErrKeyExists {
+		return l.Store.Get(key)
+	}
+	if err != nil {
+		// Not cacheable, e.g. too large. The client still gets the value.
+		return val, true
+	}
+	stored.RawData = val.RawData
+	return stored, true
+}
+
+func (l *loaderStore) UpdateMeta(key string, ttl int, flags *uint32, cas uint64) (SimpleValue, error) {
+	return updateMeta(l.Store, key, ttl, flags, cas)
+}
+
+func (l *loaderStore) Stats() []Stat {
+	return append(l.Store.Stats(),
+		Stat{"loader_calls", strconv.FormatUint(atomic.LoadUint64(&l.loads), 10)},
+		Stat{"loader_hits", strconv.FormatUint(atomic.LoadUint64(&l.hits), 10)},
+		Stat{"loader_errors", strconv.FormatUint(atomic.LoadUint64(&l.errors), 10)},
+	)
+}
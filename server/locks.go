@@ -0,0 +1,292 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Errors of item locking.
+var (
+	ErrLocked       = errors.New("Temporary failure") // A change of an item locked by GETL by anyone but the lock holder.
+	ErrNotSupported = errors.New("Not supported")     // Item locking is disabled.
+)
+
+// maxLockTime bounds the lock time a GETL request may ask for, as in Couchbase.
+const maxLockTime = 30 * time.Second
+
+// lockedCAS is the CAS reported for locked items to everyone but the lock holder, so their CAS operations fail.
+const lockedCAS = math.MaxUint64
+
+// itemLock is a lock taken by GETL on the item with the given CAS.
+type itemLock struct {
+	cas     uint64
+	expires time.Time
+}
+
+// lockTable keeps the locks of items locked by GETL until they are changed by the holder, unlocked or the lock times out.
+type lockTable struct {
+	count int64 // Number of locks held, so operations can skip the table while it's empty. Updated atomically.
+	mutex sync.Mutex
+	locks map[string]itemLock // Guarded by mutex.
+}
+
+func newLockTable() *lockTable {
+	return &lockTable{locks: map[string]itemLock{}}
+}
+
+// lock locks key, holding the item with cas, for d. It fails with ErrLocked while another lock on key is valid.
+func (t *lockTable) lock(key string, cas uint64, d time.Duration) error {
+	now := clock.Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if l, ok := t.locks[key]; ok && now.Before(l.expires) {
+		return ErrLocked
+	}
+	if len(t.locks) >= 1024 && len(t.locks)%1024 == 0 {
+		for k, l := range t.locks {
+			if !now.Before(l.expires) {
+				delete(t.locks, k)
+			}
+		}
+	}
+	t.locks[key] = itemLock{cas: cas, expires: now.Add(d)}
+	atomic.StoreInt64(&t.count, int64(len(t.locks)))
+	return nil
+}
+
+// held returns the CAS key is locked with, and false if it isn't locked.
+func (t *lockTable) held(key string) (uint64, bool) {
+	if atomic.LoadInt64(&t.count) == 0 {
+		return 0, false
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	l, ok := t.locks[key]
+	if !ok || !clock.Now().Before(l.expires) {
+		return 0, false
+	}
+	return l.cas, true
+}
+
+// unlock releases the lock on key if it was taken with cas, reporting whether it was.
+func (t *lockTable) unlock(key string, cas uint64) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	l, ok := t.locks[key]
+	if !ok || l.cas != cas || !clock.Now().Before(l.expires) {
+		return false
+	}
+	delete(t.locks, key)
+	atomic.StoreInt64(&t.count, int64(len(t.locks)))
+	return true
+}
+
+// lockStore refuses changes of locked items unless made with the CAS handed to the lock holder, which also releases the lock.
+// Reads of locked items report lockedCAS.
+type lockStore struct {
+	Store
+	table *lockTable
+}
+
+// Unwrap returns the store whose items are locked.
+func (l *lockStore) Unwrap() Store {
+	return l.Store
+}
+
+// check fails with ErrLocked if key is locked and cas isn't the lock's. It reports whether the change is made by the lock holder.
+func (l *lockStore) check(key string, cas uint64) (bool, error) {
+	lockCAS, ok := l.table.held(key)
+	if !ok {
+		return false, nil
+	}
+	if cas != lockCAS {
+		return false, ErrLocked
+	}
+	return true, nil
+}
+
+// done releases the lock after a change by the lock holder. A CAS mismatch means the item changed before it was locked,
+// so the lock can never be used and is released as well.
+func (l *lockStore) done(key string, cas uint64, err error) {
+	if err == nil || err == ErrKeyExists || err == ErrKeyNotFound {
+		l.table.unlock(key, cas)
+	}
+}
+
+func (l *lockStore) Get(key string) (SimpleValue, bool) {
+	val, ok := l.Store.Get(key)
+	if ok {
+		if _, locked := l.table.held(key); locked {
+			val.CAS = lockedCAS
+		}
+	}
+	return val, ok
+}
+
+func (l *lockStore) GetBytes(key []byte) (SimpleValue, bool) {
+	val, ok := getBytes(l.Store, key)
+	if ok {
+		if _, locked := l.table.held(borrowString(key)); locked {
+			val.CAS = lockedCAS
+		}
+	}
+	return val, ok
+}
+
+func (l *lockStore) Set(key string, val SimpleValue, cas uint64, replace bool) (SimpleValue, error) {
+	holder, err := l.check(key, cas)
+	if err != nil {
+		return SimpleValue{}, err
+	}
+	val, err = l.Store.Set(key, val, cas, replace)
+	if holder {
+		l.done(key, cas, err)
+	}
+	return val, err
+}
+
+func (l *lockStore) Delete(key string, cas uint64) error {
+	holder, err := l.check(key, cas)
+	if err != nil {
+		return err
+	}
+	err = l.Store.Delete(key, cas)
+	if holder {
+		l.done(key, cas, err)
+	}
+	return err
+}
+
+func (l *lockStore) Incr(key string, delta uint64, decr bool, initial uint64, create bool, ttl int, cas uint64) (SimpleValue, uint64, error) {
+	holder, err := l.check(key, cas)
+	if err != nil {
+		return SimpleValue{}, 0, err
+	}
+	val, n, err := l.Store.Incr(key, delta, decr, initial, create, ttl, cas)
+	if holder {
+		l.done(key, cas, err)
+	}
+	return val, n, err
+}
+
+// UpdateMeta changes the TTL of locked items like Touch, but their flags only for the lock holder.
+func (l *lockStore) UpdateMeta(key string, ttl int, flags *uint32, cas uint64) (SimpleValue, error) {
+	holder := false
+	if flags != nil || cas != 0 {
+		var err error
+		if holder, err = l.check(key, cas); err != nil {
+			return SimpleValue{}, err
+		}
+	}
+	val, err := updateMeta(l.Store, key, ttl, flags, cas)
+	if holder {
+		l.done(key, cas, err)
+	} else if _, locked := l.table.held(key); locked && err == nil {
+		val.CAS = lockedCAS
+	}
+	return val, err
+}
+
+func (l *lockStore) Touch(key string, ttl int) (SimpleValue, bool) {
+	val, ok := l.Store.Touch(key, ttl)
+	if ok {
+		if _, locked := l.table.held(key); locked {
+			val.CAS = lockedCAS
+		}
+	}
+	return val, ok
+}
+
+// enableItemLocks wraps store for GETL and UNLOCK if enabled by LockTimeout.
+func (s *Server) enableItemLocks(store Store) Store {
+	if s.config.LockTimeout <= 0 {
+		return store
+	}
+	s.locks = newLockTable()
+	return &lockStore{Store: store, table: s.locks}
+}
+
+// GetLockedHandler handles the Couchbase GETL command: a get that locks the item for the lock time in seconds given by the optional
+// extras, LockTimeout if 0. Until the holder changes the item with the returned CAS, calls UNLOCK or the lock times out, others
+// can't change it and GETL fails with a temporary failure.
+var GetLockedHandler HandleFunc = func(header RequestHeader, ctx *ConnectionContext) error {
+	if (header.ExtraLength != 0 && header.ExtraLength != 4) || header.KeyLength == 0 ||
+		header.TotalBodyLength != uint32(header.KeyLength)+uint32(header.ExtraLength) {
+		return fmt.Errorf("GETL must have key and optional extra only: keylength %d, extralength: %d, totalbodylength: %d",
+			header.KeyLength, header.ExtraLength, header.TotalBodyLength)
+	}
+	buf, err := readBody(header, ctx)
+	if err != nil {
+		return err
+	}
+	key := buf[header.ExtraLength:]
+	if !ctx.server.validKey(key) {
+		return writeError(header, ErrInvalidKey, ctx)
+	}
+	itemLocks := ctx.server.locks
+	if itemLocks == nil {
+		return writeError(header, ErrNotSupported, ctx)
+	}
+	d := ctx.server.config.LockTimeout
+	if header.ExtraLength == 4 && GetUint32(buf) > 0 {
+		d = time.Duration(GetUint32(buf)) * time.Second
+	}
+	if d > maxLockTime {
+		d = maxLockTime
+	}
+	// An item locked already reports lockedCAS, but then taking the lock fails anyway.
+	val, ok := ctx.Store.Get(string(key))
+	ctx.server.counters.countGet(ok)
+	if !ok {
+		return writeError(header, ErrKeyNotFound, ctx)
+	}
+	if err := itemLocks.lock(ctx.storeKey(string(key)), val.CAS, d); err != nil {
+		return writeError(header, err, ctx)
+	}
+	respHeader := ResponseHeader{}
+	respHeader.Magic = MagicResponse
+	respHeader.Opcode = header.Opcode
+	respHeader.Opaque = header.Opaque
+	respHeader.Status = CodeNoError
+	respHeader.CAS = val.CAS
+	flags := ctx.buffer(4)
+	for pos := 0; pos < 4; pos++ {
+		flags[pos] = GetNthByteFromUint32(val.Flag, pos)
+	}
+	return writeResponse(respHeader, flags, nil, val.RawData, ctx.RW)
+}
+
+// UnlockHandler handles the Couchbase UNLOCK command, releasing a lock taken by GETL. The CAS of the request must be the one GETL returned.
+var UnlockHandler HandleFunc = func(header RequestHeader, ctx *ConnectionContext) error {
+	if header.ExtraLength != 0 || header.KeyLength == 0 || header.TotalBodyLength != uint32(header.KeyLength) {
+		return fmt.Errorf("UNLOCK must have key only: keylength %d, extralength: %d, totalbodylength: %d",
+			header.KeyLength, header.ExtraLength, header.TotalBodyLength)
+	}
+	key, err := readBody(header, ctx)
+	if err != nil {
+		return err
+	}
+	if !ctx.server.validKey(key) {
+		return writeError(header, ErrInvalidKey, ctx)
+	}
+	itemLocks := ctx.server.locks
+	if itemLocks == nil {
+		return writeError(header, ErrNotSupported, ctx)
+	}
+	if !itemLocks.unlock(ctx.storeKey(string(key)), header.CAS) {
+		if _, ok := ctx.Store.Get(string(key)); !ok {
+			return writeError(header, ErrKeyNotFound, ctx)
+		}
+		return writeError(header, ErrLocked, ctx)
+	}
+	respHeader := ResponseHeader{}
+	respHeader.Magic = MagicResponse
+	respHeader.Opcode = header.Opcode
+	respHeader.Opaque = header.Opaque
+	respHeader.Status = CodeNoError
+	return writeResponse(respHeader, nil, nil, nil, ctx.RW)
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger receives the log lines of the server. keyvals are alternating keys and values adding context to msg,
+// e.g. Error("error reading", "err", err). Lines about a connection carry its ID as conn and its address as remote.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+/*
+Levels of the default logger, from the most verbose.
+*/
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+var logLevels = map[string]int{LogLevelDebug: 0, LogLevelInfo: 1, LogLevelWarn: 2, LogLevelError: 3}
+
+// IsLogLevel reports whether name is a supported value of Config.LogLevel.
+func IsLogLevel(name string) bool {
+	_, ok := logLevels[name]
+	return ok
+}
+
+// configLogger returns the logger of cfg for code running without a server, like the package functions and a store created
+// by NewSimpleKV: Logger, or the default one writing to logOutput the lines of LogLevel and above.
+func configLogger(cfg Config) Logger {
+	if cfg.Logger != nil {
+		return cfg.Logger
+	}
+	level := cfg.LogLevel
+	return &textLogger{level: func() string { return level }}
+}
+
+// logger returns the logger of s: Logger, or the default one writing to logOutput.
+func (s *Server) logger() Logger {
+	if s.config.Logger != nil {
+		return s.config.Logger
+	}
+	return s.log
+}
+
+// logMutex keeps the lines of concurrent connections, of every server, from interleaving.
+var logMutex sync.Mutex
+
+// textLogger writes lines like "2006-01-02T15:04:05.000Z07:00 INFO msg key=value" to logOutput, dropping those below the
+// LogLevel level returns: the one of the settings, or of the server it logs for.
+type textLogger struct {
+	level func() string
+}
+
+func (l *textLogger) Debug(msg string, keyvals ...interface{}) { l.log(LogLevelDebug, msg, keyvals) }
+func (l *textLogger) Info(msg string, keyvals ...interface{})  { l.log(LogLevelInfo, msg, keyvals) }
+func (l *textLogger) Warn(msg string, keyvals ...interface{})  { l.log(LogLevelWarn, msg, keyvals) }
+func (l *textLogger) Error(msg string, keyvals ...interface{}) { l.log(LogLevelError, msg, keyvals) }
+
+func (l *textLogger) log(level, msg string, keyvals []interface{}) {
+	if logLevels[level] < logLevels[l.level()] {
+		return
+	}
+	var line bytes.Buffer
+	line.WriteString(time.Now().Format("2006-01-02T15:04:05.000Z07:00"))
+	line.WriteByte(' ')
+	line.WriteString(strings.ToUpper(level))
+	line.WriteByte(' ')
+	line.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		line.WriteByte(' ')
+		line.WriteString(fmt.Sprint(keyvals[i]))
+		line.WriteByte('=')
+		if i+1 < len(keyvals) {
+			line.WriteString(logValue(keyvals[i+1]))
+		}
+	}
+	line.WriteByte('\n')
+	logMutex.Lock()
+	logOutput.Write(line.Bytes())
+	logMutex.Unlock()
+}
+
+// logValue formats a value of a log line, quoting it if it is empty or would be ambiguous unquoted.
+func logValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case error:
+		s = v.Error()
+	case time.Time:
+		s = v.Format(time.RFC3339)
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " \"=\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// fieldLogger adds fields to every line of the logger it wraps.
+type fieldLogger struct {
+	Logger
+	fields []interface{}
+}
+
+// withFields returns a logger adding the key-value pairs in fields to the lines of l.
+func withFields(l Logger, fields ...interface{}) Logger {
+	return fieldLogger{l, fields}
+}
+
+func (l fieldLogger) with(keyvals []interface{}) []interface{} {
+	return append(append(make([]interface{}, 0, len(l.fields)+len(keyvals)), l.fields...), keyvals...)
+}
+
+func (l fieldLogger) Debug(msg string, keyvals ...interface{}) {
+	l.Logger.Debug(msg, l.with(keyvals)...)
+}
+
+func (l fieldLogger) Info(msg string, keyvals ...interface{}) {
+	l.Logger.Info(msg, l.with(keyvals)...)
+}
+
+func (l fieldLogger) Warn(msg string, keyvals ...interface{}) {
+	l.Logger.Warn(msg, l.with(keyvals)...)
+}
+
+func (l fieldLogger) Error(msg string, keyvals ...interface{}) {
+	l.Logger.Error(msg, l.with(keyvals)...)
+}
+
+// logger returns the logger for lines about the connection, adding its ID and remote address.
+func (ctx *ConnectionContext) logger() Logger {
+	return withFields(ctx.server.logger(), "conn", ctx.ConnID, "remote", ctx.ConnHandle.RemoteAddr())
+}
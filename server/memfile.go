@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+)
+
+// memFileMagic starts the metadata file written next to a memory file on clean shutdown.
+const memFileMagic = "MCMEM01\n"
+
+// memFileItemLen is the fixed part of an item in the metadata: item header, page number, offset in the page and uncompressed length.
+const memFileItemLen = itemHeaderLen + 4 + 4 + 4
+
+// ErrMemFileMeta is returned when the metadata doesn't match the memory file.
+var ErrMemFileMeta = errors.New("Memory file metadata is damaged or doesn't match")
+
+func memFileMetaPath(path string) string {
+	return path + ".meta"
+}
+
+// openMemoryFile maps the memory file as the slab arena and restores the items saved by the last clean shutdown.
+// The metadata is deleted once loaded, as the file contents change from then on; after a crash the cache starts empty.
+func (kv *SimpleKV) openMemoryFile(path string, size uint64) error {
+	if size == 0 {
+		return errors.New("a memory file needs a memory limit")
+	}
+	pages := int((size + slabPageSize - 1) / slabPageSize)
+	arena, err := mapFile(path, pages*slabPageSize)
+	if err != nil {
+		return err
+	}
+	kv.slabs.arena = arena
+	kv.memFile = path
+	meta, err := os.ReadFile(memFileMetaPath(path))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	os.Remove(memFileMetaPath(path))
+	if err != nil {
+		return err
+	}
+	items, err := kv.restoreMemoryFile(meta)
+	if err != nil {
+		return err
+	}
+	kv.log.Info("restored memory file", "items", items, "path", path)
+	return nil
+}
+
+// restoreMemoryFile rebuilds the slab pages and items described by meta.
+func (kv *SimpleKV) restoreMemoryFile(meta []byte) (int, error) {
+	a := kv.slabs
+	if len(meta) < len(memFileMagic)+8 || string(meta[:len(memFileMagic)]) != memFileMagic ||
+		crc32.ChecksumIEEE(meta[:len(meta)-4]) != binary.BigEndian.Uint32(meta[len(meta)-4:]) {
+		return 0, ErrMemFileMeta
+	}
+	r := meta[len(memFileMagic) : len(meta)-4]
+	pageCount := int(binary.BigEndian.Uint32(r))
+	r = r[4:]
+	if pageCount*slabPageSize > len(a.arena) || len(r) < 2*pageCount {
+		return 0, ErrMemFileMeta
+	}
+	for i := 0; i < pageCount; i++ {
+		id := int(binary.BigEndian.Uint16(r[2*i:]))
+		if id < 1 || id > len(a.classes) {
+			return 0, ErrMemFileMeta
+		}
+		page := a.newPage()
+		a.classes[id-1].carve(page)
+	}
+	r = r[2*pageCount:]
+
+	type savedItem struct {
+		key string
+		val SimpleValue
+	}
+	var items []savedItem
+	used := map[slabChunk]bool{}
+	for {
+		if len(r) < memFileItemLen {
+			return 0, ErrMemFileMeta
+		}
+		keyLen, valLen, val, live := decodeItemHeader(r)
+		if keyLen == 0 {
+			break
+		}
+		index := int(binary.BigEndian.Uint32(r[itemHeaderLen:]))
+		off := int(binary.BigEndian.Uint32(r[itemHeaderLen+4:]))
+		val.rawSize = int(binary.BigEndian.Uint32(r[itemHeaderLen+8:]))
+		r = r[memFileItemLen:]
+		if len(r) < keyLen || index >= pageCount || off+valLen > slabPageSize {
+			return 0, ErrMemFileMeta
+		}
+		key := string(r[:keyLen])
+		r = r[keyLen:]
+		if !live {
+			continue
+		}
+		page := a.arenaPages[index]
+		val.chunk = slabChunk{page: page, off: off}
+		val.RawData = page.mem[off : off+valLen]
+		used[val.chunk] = true
+		items = append(items, savedItem{key, val})
+	}
+
+	// Take the chunks of restored items off the free lists.
+	for _, c := range a.classes {
+		free := c.free[:0]
+		for _, chunk := range c.free {
+			if used[chunk] {
+				chunk.page.free--
+				c.used++
+				*chunk.refs() = 1
+			} else {
+				free = append(free, chunk)
+			}
+		}
+		c.free = free
+	}
+	for _, item := range items {
+		kv.cas.observe(item.val.CAS)
+		s := kv.shardFor(item.key)
+		s.mutex.Lock()
+		if elem, ok := s.items[item.key]; ok {
+			kv.remove(s, elem)
+		}
+		kv.store(s, item.key, item.val)
+		s.mutex.Unlock()
+	}
+	return len(items), nil
+}
+
+// SaveMemoryFile writes the metadata of all items living in the memory file, so the next start can resume with them.
+// All shards stay locked afterwards, as the metadata must match the file contents when the process exits. The store must not be used anymore.
+func (kv *SimpleKV) SaveMemoryFile() error {
+	if kv.memFile == "" {
+		return nil
+	}
+	for _, s := range kv.shards {
+		s.mutex.Lock()
+	}
+	a := kv.slabs
+	a.arenaMutex.Lock()
+	var buf bytes.Buffer
+	buf.WriteString(memFileMagic)
+	var b [memFileItemLen]byte
+	binary.BigEndian.PutUint32(b[:], uint32(len(a.arenaPages)))
+	buf.Write(b[:4])
+	for _, page := range a.arenaPages {
+		binary.BigEndian.PutUint16(b[:], uint16(page.class.id))
+		buf.Write(b[:2])
+	}
+	a.arenaMutex.Unlock()
+	for _, s := range kv.shards {
+		for key, elem := range s.items {
+			val := elem.Value.(*simpleEntry).val
+			if val.chunk.page == nil || val.chunk.page.index < 0 || len(val.more) > 0 {
+				continue // Not (entirely) in the memory file.
+			}
+			encodeItemHeader(b[:], key, val)
+			binary.BigEndian.PutUint32(b[itemHeaderLen:], uint32(val.chunk.page.index))
+			binary.BigEndian.PutUint32(b[itemHeaderLen+4:], uint32(val.chunk.off))
+			binary.BigEndian.PutUint32(b[itemHeaderLen+8:], uint32(val.rawSize))
+			buf.Write(b[:])
+			buf.WriteString(key)
+		}
+	}
+	buf.Write(make([]byte, memFileItemLen))
+	binary.BigEndian.PutUint32(b[:], crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(b[:4])
+	if err := unmapFile(a.arena); err != nil {
+		return err
+	}
+	tmp := memFileMetaPath(kv.memFile) + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, memFileMetaPath(kv.memFile))
+}
+
+// saveMemoryFile saves the memory file metadata, if the store of s keeps its items in a memory file, once s was shut down.
+func (s *Server) saveMemoryFile() {
+	kv, ok := baseStore(s.cache).(*SimpleKV)
+	if !ok || kv.memFile == "" {
+		return
+	}
+	if err := kv.SaveMemoryFile(); err != nil {
+		s.logger().Error("error saving memory file", "err", err)
+		return
+	}
+	s.logger().Info("saved memory file", "path", kv.memFile)
+}
@@ -0,0 +1,43 @@
+package server
+
+// metaUpdater is implemented by stores and decorators that change item metadata in place, without copying the value.
+type metaUpdater interface {
+	// UpdateMeta sets the TTL of an existing item, and its flags unless flags is nil. A non-zero cas must match the stored one.
+	// Changing the flags assigns a new CAS. The returned item carries no data.
+	UpdateMeta(key string, ttl int, flags *uint32, cas uint64) (SimpleValue, error)
+}
+
+// updateMeta sets the TTL, and unless nil the flags, of the item at key. Stores without UpdateMeta get a Touch, or a CAS checked Set
+// of the whole item to change the flags.
+func updateMeta(store Store, key string, ttl int, flags *uint32, cas uint64) (SimpleValue, error) {
+	if mu, ok := store.(metaUpdater); ok {
+		return mu.UpdateMeta(key, ttl, flags, cas)
+	}
+	if flags == nil && cas == 0 {
+		val, ok := store.Touch(key, ttl)
+		if !ok {
+			return SimpleValue{}, ErrKeyNotFound
+		}
+		val.RawData = nil
+		return val, nil
+	}
+	for {
+		old, ok := store.Get(key)
+		if !ok {
+			return SimpleValue{}, ErrKeyNotFound
+		}
+		if cas != 0 && cas != old.CAS {
+			return SimpleValue{}, ErrKeyExists
+		}
+		old.TTL = ttl
+		if flags != nil {
+			old.Flag = *flags
+		}
+		val, err := store.Set(key, old, old.CAS, true)
+		if err == ErrKeyExists && cas == 0 {
+			continue
+		}
+		val.RawData = nil
+		return val, err
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the command latency histogram.
+var latencyBuckets = []time.Duration{
+	50 * time.Microsecond, 100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond, time.Second,
+}
+
+// latencyHistogram counts command latencies into latencyBuckets, plus one bucket for anything slower.
+type latencyHistogram struct {
+	counts [14]uint64 // Updated atomically.
+	sum    uint64     // Total latency in nanoseconds. Updated atomically.
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+}
+
+// total returns the number of commands observed.
+func (h *latencyHistogram) total() uint64 {
+	var n uint64
+	for i := range h.counts {
+		n += atomic.LoadUint64(&h.counts[i])
+	}
+	return n
+}
+
+// handleMetrics serves the counters of s, memory and item usage, the command latency histogram and the latency quantiles of
+// every command in the Prometheus text format.
+// Metric names follow the memcached exporter, so existing dashboards work.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+	metric := func(name, kind, help string, samples ...string) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for i := 0; i+1 < len(samples); i += 2 {
+			fmt.Fprintf(out, "%s%s %s\n", name, samples[i], samples[i+1])
+		}
+	}
+	load := func(v *uint64) string { return strconv.FormatUint(atomic.LoadUint64(v), 10) }
+	stats := map[string]string{}
+	counters := &s.counters
+	for _, stat := range s.generalStats(s.cache) {
+		stats[stat.Name] = stat.Value
+	}
+	gauge := func(name string) string {
+		if v, ok := stats[name]; ok {
+			return v
+		}
+		return "0"
+	}
+
+	metric("memcached_up", "gauge", "Whether the server is up.", "", "1")
+	metric("memcached_uptime_seconds", "counter", "Seconds since the server started.", "", strconv.Itoa(currentTime()))
+	metric("memcached_commands_total", "counter", "Commands handled, by command and result.",
+		`{command="get",status="hit"}`, load(&counters.getHits),
+		`{command="get",status="miss"}`, load(&counters.getMisses),
+		`{command="set",status="hit"}`, load(&counters.cmdSet),
+		`{command="touch",status="hit"}`, load(&counters.touchHits),
+		`{command="touch",status="miss"}`, load(&counters.touchMisses),
+		`{command="delete",status="hit"}`, load(&counters.deleteHits),
+		`{command="delete",status="miss"}`, load(&counters.deleteMisses),
+		`{command="incr",status="hit"}`, load(&counters.incrHits),
+		`{command="incr",status="miss"}`, load(&counters.incrMisses),
+		`{command="decr",status="hit"}`, load(&counters.decrHits),
+		`{command="decr",status="miss"}`, load(&counters.decrMisses),
+		`{command="cas",status="hit"}`, load(&counters.casHits),
+		`{command="cas",status="miss"}`, load(&counters.casMisses),
+		`{command="cas",status="badval"}`, load(&counters.casBadval))
+	metric("memcached_hit_ratio", "gauge", "Share of retrievals that found the key.", "", strconv.FormatFloat(counters.hitRatio(), 'f', 4, 64))
+	metric("memcached_items_evicted_unfetched_total", "counter", "Items evicted without ever being read.", "", gauge("evicted_unfetched"))
+	metric("memcached_items_expired_unfetched_total", "counter", "Expired items removed without ever being read.", "", gauge("expired_unfetched"))
+	metric("memcached_read_bytes_total", "counter", "Bytes read from clients.", "", load(&counters.bytesRead))
+	metric("memcached_written_bytes_total", "counter", "Bytes sent to clients.", "", load(&counters.bytesWritten))
+	metric("memcached_current_bytes", "gauge", "Bytes of item memory in use.", "", gauge("bytes"))
+	metric("memcached_limit_bytes", "gauge", "Bytes of item memory the server may use, 0 for no limit.", "", gauge("limit_maxbytes"))
+	metric("memcached_current_items", "gauge", "Items currently stored.", "", gauge("curr_items"))
+	metric("memcached_items_total", "counter", "Items ever stored.", "", gauge("total_items"))
+	metric("memcached_items_evicted_total", "counter", "Items evicted to honor a memory, item or namespace limit.", "", gauge("evictions"))
+	metric("memcached_items_expired_total", "counter", "Expired items removed.", "", gauge("expired"))
+	metric("memcached_current_connections", "gauge", "Open client connections.", "", strconv.FormatInt(atomic.LoadInt64(&counters.currConns), 10))
+	metric("memcached_connections_total", "counter", "Client connections ever accepted.", "", load(&counters.totalConns))
+
+	fmt.Fprintf(out, "# HELP memcached_command_duration_seconds Time taken by commands.\n# TYPE memcached_command_duration_seconds histogram\n")
+	var total uint64
+	for i, bound := range latencyBuckets {
+		total += atomic.LoadUint64(&s.latency.command.counts[i])
+		fmt.Fprintf(out, "memcached_command_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(bound.Seconds(), 'g', -1, 64), total)
+	}
+	total += atomic.LoadUint64(&s.latency.command.counts[len(latencyBuckets)])
+	fmt.Fprintf(out, "memcached_command_duration_seconds_bucket{le=\"+Inf\"} %d\n", total)
+	fmt.Fprintf(out, "memcached_command_duration_seconds_sum %s\n", strconv.FormatFloat(time.Duration(atomic.LoadUint64(&s.latency.command.sum)).Seconds(), 'f', -1, 64))
+	fmt.Fprintf(out, "memcached_command_duration_seconds_count %d\n", total)
+
+	fmt.Fprintf(out, "# HELP memcached_command_latency_seconds Latency quantiles by command.\n# TYPE memcached_command_latency_seconds summary\n")
+	histograms := s.latency.commands()
+	names := make([]string, 0, len(histograms))
+	for name := range histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h := histograms[name]
+		for i, v := range h.quantiles(latencyQuantiles) {
+			fmt.Fprintf(out, "memcached_command_latency_seconds{command=\"%s\",quantile=\"%s\"} %s\n", name,
+				strconv.FormatFloat(latencyQuantiles[i], 'g', -1, 64), strconv.FormatFloat(float64(v)/1e9, 'f', -1, 64))
+		}
+		fmt.Fprintf(out, "memcached_command_latency_seconds_sum{command=\"%s\"} %s\n", name, strconv.FormatFloat(float64(atomic.LoadUint64(&h.sum))/1e9, 'f', -1, 64))
+		fmt.Fprintf(out, "memcached_command_latency_seconds_count{command=\"%s\"} %d\n", name, atomic.LoadUint64(&h.count))
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package server
+
+import "errors"
+
+// mapFile fails as memory mapped files are only supported on unix systems.
+func mapFile(path string, size int) ([]byte, error) {
+	return nil, errors.New("memory files are not supported on this platform")
+}
+
+// mapAnon fails as anonymous mappings are only supported on unix systems.
+func mapAnon(size int) ([]byte, error) {
+	return nil, errors.New("off-heap memory is not supported on this platform")
+}
+
+func unmapFile(mem []byte) error {
+	return nil
+}
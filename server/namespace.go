@@ -0,0 +1,230 @@
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// NamespaceQuota limits the items of one namespace, independently of the other namespaces sharing the store. Zero fields mean no limit.
+type NamespaceQuota struct {
+	MaxMemory uint64 // Bytes of item memory the namespace may use. Its least recently used items are evicted beyond that.
+	MaxItems  int    // Number of items the namespace may hold.
+}
+
+// ParseNamespaceQuota parses a quota in the form name=megabytes[,items].
+func ParseNamespaceQuota(s string) (string, NamespaceQuota, error) {
+	var quota NamespaceQuota
+	i := strings.LastIndex(s, "=")
+	if i <= 0 {
+		return "", quota, fmt.Errorf("missing namespace name in quota %q", s)
+	}
+	limits := strings.SplitN(s[i+1:], ",", 2)
+	mb, err := strconv.ParseUint(limits[0], 10, 64)
+	if err != nil {
+		return "", quota, fmt.Errorf("bad memory limit in quota %q", s)
+	}
+	quota.MaxMemory = mb * 1024 * 1024
+	if len(limits) == 2 {
+		if quota.MaxItems, err = strconv.Atoi(limits[1]); err != nil || quota.MaxItems < 0 {
+			return "", quota, fmt.Errorf("bad item limit in quota %q", s)
+		}
+	}
+	return s[:i], quota, nil
+}
+
+// namespaceOf returns the namespace of key: the part before the first separator. Keys without separator belong to the default namespace "".
+// With IsolateUsers the keys of authenticated clients are in the namespace of their user, see userStore.
+func namespaceOf(key, separator string) string {
+	if separator == "" {
+		return ""
+	}
+	if i := strings.Index(key, separator); i > 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+// namespace keeps the usage of a namespace with a quota.
+type namespace struct {
+	name      string
+	quota     NamespaceQuota
+	bytes     uint64 // Bytes charged by the namespace's items. Updated atomically.
+	items     int64  // Updated atomically.
+	evictions uint64 // Items evicted to honor the quota. Updated atomically.
+	epoch     uint32 // Flush epoch of the namespace, see SimpleKV.epoch. Updated atomically.
+}
+
+// over reports whether adding an item of size bytes would break the quota.
+func (ns *namespace) over(size uint64) bool {
+	if ns.quota.MaxMemory > 0 && atomic.LoadUint64(&ns.bytes)+size > ns.quota.MaxMemory {
+		return true
+	}
+	return ns.quota.MaxItems > 0 && atomic.LoadInt64(&ns.items) >= int64(ns.quota.MaxItems)
+}
+
+// charge accounts an item of size bytes being added to the namespace, or removed with a negative count.
+func (ns *namespace) charge(size uint64, count int64) {
+	if count < 0 {
+		size = ^(size - 1)
+	}
+	atomic.AddUint64(&ns.bytes, size)
+	atomic.AddInt64(&ns.items, count)
+}
+
+// namespaceFor returns the namespace key belongs to, or nil if that namespace has no quota.
+func (kv *SimpleKV) namespaceFor(key string) *namespace {
+	if len(kv.namespaces) == 0 {
+		return nil
+	}
+	return kv.namespaces[namespaceOf(key, kv.nsSeparator)]
+}
+
+// namespaceScan bounds how many items namespaceVictim examines, so a namespace with few items in a shard doesn't stall it.
+const namespaceScan = 1000
+
+// namespaceVictim returns the least recently used item of namespace ns in shard s, starting with the coldest segment. Write lock must be held.
+// It returns nil if none is found among the first namespaceScan items.
+func (kv *SimpleKV) namespaceVictim(s *simpleShard, ns *namespace) *list.Element {
+	n := 0
+	for _, l := range []*list.List{s.lru, s.warm, s.hot} {
+		for elem := l.Back(); elem != nil && n < namespaceScan; elem = elem.Prev() {
+			if elem.Value.(*simpleEntry).ns == ns {
+				return elem
+			}
+			n++
+		}
+	}
+	return nil
+}
+
+// evictFromNamespace evicts victim, an item of namespace ns in shard s, to make room under the quota. Write lock must be held.
+func (kv *SimpleKV) evictFromNamespace(s *simpleShard, ns *namespace, victim *list.Element) {
+	if atomic.LoadUint32(&victim.Value.(*simpleEntry).fetches) == 0 {
+		s.evictedUnfetched++
+	}
+	kv.notify(eventEvict, victim.Value.(*simpleEntry))
+	kv.remove(s, victim)
+	s.evictions++
+	atomic.AddUint64(&ns.evictions, 1)
+}
+
+// makeRoom evicts items of the namespace of key from all shards, one shard at a time, until an item of size bytes fits its quota.
+// store only evicts from the shard of the key, which may hold none of the namespace's items. The item of key itself isn't evicted,
+// as storing it replaces it anyway. No shard lock may be held.
+func (kv *SimpleKV) makeRoom(key string, size uint64) {
+	ns := kv.namespaceFor(key)
+	for _, s := range kv.shards {
+		if ns == nil || !ns.over(size) {
+			return
+		}
+		s.mutex.Lock()
+		for ns.over(size) {
+			victim := kv.namespaceVictim(s, ns)
+			if victim == nil || victim.Value.(*simpleEntry).key == key {
+				break
+			}
+			kv.evictFromNamespace(s, ns, victim)
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// FlushNamespace removes all items of a namespace. For a namespace with a quota it moves on to a new namespace epoch, like Flush.
+// Other namespaces are flushed by removing their items shard by shard.
+func (kv *SimpleKV) FlushNamespace(name string) {
+	kv.events.push(storeEvent{kind: eventFlush, key: name})
+	if ns, ok := kv.namespaces[name]; ok {
+		atomic.AddUint32(&ns.epoch, 1)
+		return
+	}
+	for _, s := range kv.shards {
+		s.mutex.Lock()
+		for key, elem := range s.items {
+			if namespaceOf(key, kv.nsSeparator) == name {
+				kv.remove(s, elem)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// NamespaceStats reports usage and limits of the namespaces with a quota for "stats namespaces".
+func (kv *SimpleKV) NamespaceStats() []Stat {
+	names := make([]string, 0, len(kv.namespaces))
+	for name := range kv.namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var stats []Stat
+	for _, name := range names {
+		ns := kv.namespaces[name]
+		stats = append(stats,
+			Stat{name + ":curr_items", strconv.FormatInt(atomic.LoadInt64(&ns.items), 10)},
+			Stat{name + ":bytes", strconv.FormatUint(atomic.LoadUint64(&ns.bytes), 10)},
+			Stat{name + ":limit_maxbytes", strconv.FormatUint(ns.quota.MaxMemory, 10)},
+			Stat{name + ":limit_items", strconv.Itoa(ns.quota.MaxItems)},
+			Stat{name + ":evictions", strconv.FormatUint(atomic.LoadUint64(&ns.evictions), 10)},
+		)
+	}
+	return stats
+}
+
+func namespaceStats(ctx *ConnectionContext) ([]Stat, bool) {
+	s, ok := baseStore(ctx.Store).(interface{ NamespaceStats() []Stat })
+	if !ok {
+		return nil, false
+	}
+	stats := s.NamespaceStats()
+	if u, ok := ctx.Store.(*userStore); ok {
+		// Isolated users only see their own namespace.
+		own := stats[:0]
+		for _, stat := range stats {
+			if strings.HasPrefix(stat.Name, u.user+":") {
+				own = append(own, stat)
+			}
+		}
+		stats = own
+	}
+	return stats, true
+}
+
+// flushNamespace removes all items of a namespace from store, separated by sep. Stores and decorators implementing
+// FlushNamespace do it themselves; for others the items are looked up and deleted one by one.
+func flushNamespace(store Store, name, sep string) {
+	if f, ok := store.(interface{ FlushNamespace(name string) }); ok {
+		f.FlushNamespace(name)
+		return
+	}
+	var keys []string
+	store.Iterate(func(key string, val SimpleValue) bool {
+		if namespaceOf(key, sep) == name {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	for _, key := range keys {
+		store.Delete(key, 0)
+	}
+}
+
+// TextFlushNamespaceHandler handles the "flush_namespace <name> [noreply]" command
+var TextFlushNamespaceHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	noreply := len(args) == 3 && args[2] == "noreply"
+	if len(args) != 2 && !noreply {
+		return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+	}
+	sep := ctx.server.config.NamespaceSeparator
+	if sep == "" {
+		return writeTextLine(ctx, "CLIENT_ERROR namespaces not enabled")
+	}
+	flushNamespace(ctx.Store, args[1], sep)
+	audit(ctx, args[0], args[1], 0, 0, nil)
+	if noreply {
+		return nil
+	}
+	return writeTextLine(ctx, "OK")
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+// openOffHeap maps an anonymous arena of size bytes the slab pages are carved from. Values stored in it are referenced by
+// page and offset only, so the Go heap stays small and the garbage collector never scans them, however much is cached.
+// The mapping lives as long as the process. Freed chunks return to the free lists of their class, and compaction empties
+// sparsely used pages so any class can reuse them.
+func (kv *SimpleKV) openOffHeap(size uint64) error {
+	if size == 0 {
+		return errors.New("off-heap memory needs a memory limit")
+	}
+	pages := int((size + slabPageSize - 1) / slabPageSize)
+	arena, err := mapAnon(pages * slabPageSize)
+	if err != nil {
+		return err
+	}
+	kv.slabs.arena = arena
+	return nil
+}
+
+// CompactSlabs moves the items off the emptiest page of every slab class with enough free chunks elsewhere, turning those pages
+// into spare pages any class can carve. It returns the number of pages being emptied. Items stored concurrently may keep a page
+// draining until they are removed.
+func (kv *SimpleKV) CompactSlabs() int {
+	if kv.slabs == nil {
+		return 0
+	}
+	pages := kv.slabs.drain()
+	if len(pages) == 0 {
+		return 0
+	}
+	for _, s := range kv.shards {
+		s.mutex.Lock()
+		for _, elem := range s.items {
+			val := &elem.Value.(*simpleEntry).val
+			if pages[val.chunk.page] {
+				val.chunk, val.RawData, _ = kv.slabs.move(val.chunk, val.RawData)
+			}
+			for i := range val.more {
+				c := &val.more[i]
+				if pages[c.chunk.page] {
+					c.chunk, c.data, _ = kv.slabs.move(c.chunk, c.data)
+				}
+			}
+		}
+		s.mutex.Unlock()
+	}
+	return len(pages)
+}
+
+// slabCompactor compacts the slab pages every interval until Close is called.
+func (kv *SimpleKV) slabCompactor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-kv.done:
+			return
+		case <-ticker.C:
+			kv.CompactSlabs()
+		}
+	}
+}
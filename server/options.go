@@ -0,0 +1,155 @@
+package server
+
+import (
+	"crypto/cipher"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Server is a memcached server configured by NewServer. Every server has its own listeners, connections, store, settings and
+// stats, so several servers can run in one process.
+type Server struct {
+	config         Config                  // Runtime settings change while serving, see settings.
+	settings       sync.RWMutex            // Guards the runtime settings of config, changed by Reload and "config set".
+	handlers       map[uint8]Handler       // Handlers of the binary opcodes.
+	textHandlers   map[string]TextHandler  // Handlers of the text commands.
+	counters       serverStats             // Counters of "stats".
+	latency        *latencies              // Latency histograms of the commands of handlers and textHandlers.
+	clients        clientTable             // Counters of "stats clients".
+	userCounts     userCounterTable        // Counters of "stats users".
+	protocolErrors protocolErrorCounts     // Counts of "stats protocol_errors".
+	snapshots      snapshotStatus          // Outcome of the scheduled snapshots, for "stats snapshots".
+	persistKey     cipher.AEAD             // Encrypts snapshots, backups and the append-only log, nil if they are written in plaintext. Set up by setup.
+	access         *accessLog              // Access log, nil unless AccessLogPath is set. Set up by setup.
+	auditor        *auditLog               // Audit log, nil unless AuditLogPath or AuditSink is set. Set up by setup.
+	keyTrace       keyTracer               // Rule of "trace_key".
+	cache          Store                   // Store wrapped by the decorators the settings ask for. Set up by setup.
+	locks          *lockTable              // Item locks of GETL and UNLOCK, nil unless LockTimeout is set. Set up by setup.
+	leases         *leaseTable             // Leases of lease-get and lease-set, nil unless LeaseTTL is set. Set up by setup.
+	hotKeys        *hotKeyTracker          // Tracker of "stats hotkeys", nil unless HotKeySampleRate is set. Set up by setup.
+	topKeys        *topKeyStore            // Sampling store of "stats topkeys", nil unless TopKeysSampleRate is set. Set up by setup.
+	log            *textLogger             // Logger of the connections unless Logger is set, dropping lines below the LogLevel of the server.
+	certs          *certReloader           // Certificate of the encrypted listeners, if TLSCertFile is set. Set up by Serve.
+	users          atomic.Value            // userTable of SASLUsersFile, replaced on SIGHUP. Set up by Serve.
+	conns          connRegistry            // Live connections.
+	open           int64                   // Connections accepted by the accept loops and not closed yet, limited by MaxConns. Updated atomically.
+	ipOpen         ipConns                 // Connections of the accept loops per remote IP, limited by MaxConnsPerIP.
+	authFails      authThrottle            // Failed authentications per remote IP, for AuthBackoff and AuthBanThreshold.
+	events         *eventLoop              // Serves the connections of plain listeners if EventLoop is set. Set up by Serve.
+	pool           *connPool               // Workers serving the connections of the accept loops if ConnWorkers is set. Set up by Serve.
+	draining       int32                   // Set once Shutdown began, telling connections to close after their current command. Updated atomically.
+	mutex          sync.Mutex              // Guards listeners, handover and upgrading.
+	listeners      []net.Listener          // TCP listeners opened by Serve.
+	services       []service               // WebSocket, QUIC and admin listeners opened by Serve.
+	handover       map[string]net.Listener // Listeners passed to the process replacing this one by Upgrade, by name.
+	upgrading      bool                    // Set while Upgrade starts a new process.
+	upgraded       chan struct{}           // Closed by Upgrade once the new process serves.
+	loops          sync.WaitGroup          // Running accept loops.
+	active         sync.WaitGroup          // Connections accepted by the accept loops.
+	closing        chan struct{}           // Closed by Shutdown.
+	ready          chan struct{}           // Closed by Serve once all listeners are open.
+	closeOnce      sync.Once
+	saveOnce       sync.Once // Saves the memory file after the first shutdown.
+	setupOnce      sync.Once // Opens the store for Serve or the embedded API, whichever comes first.
+	setupErr       error     // Error opening the store. Set by setupOnce.
+	loaded         *Config   // Settings of ConfigFile and the environment when last read, telling what a reload changed. Guarded by mutex.
+}
+
+// Option changes a setting of a Server created by NewServer.
+type Option func(*Config)
+
+// NewServer returns a server with the settings of DefaultConfig changed by opts, applied in order.
+func NewServer(opts ...Option) *Server {
+	s := &Server{config: DefaultConfig(), handlers: opHandlers(), textHandlers: textOpHandlers(), closing: make(chan struct{}),
+		ready: make(chan struct{}), handover: map[string]net.Listener{}, upgraded: make(chan struct{})}
+	s.latency = newLatencies(s.handlers, s.textHandlers)
+	s.log = &textLogger{level: s.logLevel}
+	for _, opt := range opts {
+		opt(&s.config)
+	}
+	return s
+}
+
+// WithConfig replaces all settings by c. Options following it change c further.
+func WithConfig(c Config) Option {
+	return func(config *Config) { *config = c }
+}
+
+// WithAddr makes the server listen on the single TCP address addr, detecting the protocol of every connection.
+func WithAddr(addr string) Option {
+	return func(c *Config) { c.Listeners = []ListenerConfig{{Addr: addr}} }
+}
+
+// WithListeners makes the server listen on the given TCP listeners.
+func WithListeners(listeners ...ListenerConfig) Option {
+	return func(c *Config) { c.Listeners = listeners }
+}
+
+// WithMaxConns limits the connections served at once to max. 0 means no limit.
+func WithMaxConns(max int) Option {
+	return func(c *Config) { c.MaxConns = max }
+}
+
+// WithMaxMemory limits the item memory to bytes, evicting items beyond. 0 means no limit.
+func WithMaxMemory(bytes uint64) Option {
+	return func(c *Config) { c.MaxMemory = bytes }
+}
+
+// WithEvictionPolicy picks the items evicted when the memory limit is hit: lru, lfu, tinylfu or segmented.
+func WithEvictionPolicy(policy string) Option {
+	return func(c *Config) { c.EvictionPolicy = policy }
+}
+
+// WithStore serves the items of store instead of creating a store from the settings.
+func WithStore(store Store) Option {
+	return func(c *Config) { c.Store = store }
+}
+
+// WithLogger sends the log lines of the server to logger.
+func WithLogger(logger Logger) Option {
+	return func(c *Config) { c.Logger = logger }
+}
+
+// WithReadBufferSize sets the read buffer of every connection to size bytes, which also bounds the length of a text command line.
+func WithReadBufferSize(size int) Option {
+	return func(c *Config) { c.ReadBufferSize = size }
+}
+
+// WithMaxRequestSize sets the largest request body accepted in bytes.
+func WithMaxRequestSize(size int) Option {
+	return func(c *Config) { c.MaxRequestSize = size }
+}
+
+// Ready returns a channel closed once Serve opened all listeners, so Addr can tell where to connect. It stays open if Serve
+// fails to listen.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Addr returns the address of the first listener, with the port picked by the system when listening on port 0.
+// It is nil while the server isn't listening yet, see Ready.
+func (s *Server) Addr() net.Addr {
+	if addrs := s.Addrs(); len(addrs) > 0 {
+		return addrs[0]
+	}
+	return nil
+}
+
+// Addrs returns the addresses of the listeners opened by Serve so far, in the order of the Listeners setting.
+func (s *Server) Addrs() []net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, l := range s.listeners {
+		addrs[i] = l.Addr()
+	}
+	return addrs
+}
+
+// Config returns the settings of the server.
+func (s *Server) Config() Config {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.config
+}
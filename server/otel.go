@@ -0,0 +1,72 @@
+//go:build otel
+
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// otelSpan is a traceSpan recorded by an OpenTelemetry tracer.
+type otelSpan struct {
+	ctx    context.Context
+	span   trace.Span
+	tracer trace.Tracer
+}
+
+func (s otelSpan) child(name string) traceSpan {
+	ctx, span := s.tracer.Start(s.ctx, name, trace.WithSpanKind(trace.SpanKindInternal))
+	return otelSpan{ctx, span, s.tracer}
+}
+
+func (s otelSpan) set(key string, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		s.span.SetAttributes(attribute.String(key, v))
+	case bool:
+		s.span.SetAttributes(attribute.Bool(key, v))
+	case int:
+		s.span.SetAttributes(attribute.Int(key, v))
+	case uint64:
+		s.span.SetAttributes(attribute.Int64(key, int64(v)))
+	}
+}
+
+func (s otelSpan) fail(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s otelSpan) end() {
+	s.span.End()
+}
+
+// startTracing exports the spans of connections and commands to the OTLP/HTTP collector at endpoint, in batches, logging
+// to log. The tracer is shared by the servers of the process; the last one started picks the endpoint.
+func startTracing(endpoint string, log Logger) error {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return fmt.Errorf("starting tracing: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "memcached-go-server"),
+			attribute.String("service.version", Version),
+		)),
+	)
+	tracer := provider.Tracer("github.com/sonicwang/memcached-go-server/server")
+	startTraceSpan = func(name string) traceSpan {
+		ctx, span := tracer.Start(context.Background(), name, trace.WithSpanKind(trace.SpanKindServer))
+		return otelSpan{ctx, span, tracer}
+	}
+	log.Info("exporting traces", "endpoint", endpoint)
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !otel
+
+package server
+
+import "errors"
+
+// startTracing fails as OpenTelemetry support is only compiled in with the otel build tag.
+func startTracing(endpoint string, log Logger) error {
+	return errors.New("starting tracing: OpenTelemetry support is not compiled in, rebuild with -tags otel")
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// passwordSchemes verify the password hashes of the users file, by the prefix naming their scheme. The built-in schemes are
+// PBKDF2-HMAC-SHA256 and PBKDF2-HMAC-SHA1, written as $pbkdf2-sha256$<iterations>$<salt>$<key> or $pbkdf2-sha1$... with
+// unpadded base64 salt and key. Their keys are the salted passwords of SCRAM-SHA-256 and SCRAM-SHA-1. The xcrypto build tag
+// adds bcrypt ($2a$, $2b$, $2y$) and argon2id ($argon2id$) hashes, which only PLAIN can verify. It needs golang.org/x/crypto,
+// which isn't vendored, so default builds refuse users files holding such hashes.
+var passwordSchemes = map[string]func(hash, password string) (bool, error){
+	"$pbkdf2-sha256$": verifyPBKDF2,
+	"$pbkdf2-sha1$":   verifyPBKDF2,
+}
+
+// pbkdf2Digests are the hash functions of PBKDF2 hashes, by the name following pbkdf2- in their prefix.
+var pbkdf2Digests = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha1":   sha1.New,
+}
+
+// Password hash schemes made by HashPassword.
+const (
+	HashPBKDF2SHA256 = "pbkdf2-sha256" // Verifies PLAIN and SCRAM-SHA-256.
+	HashPBKDF2SHA1   = "pbkdf2-sha1"   // Verifies PLAIN and SCRAM-SHA-1, for clients lacking SCRAM-SHA-256.
+)
+
+// pbkdf2Iterations is the iteration count of hashes made by HashPassword.
+const pbkdf2Iterations = 100000
+
+// unknownUserHash is verified against the passwords of unknown users, which takes as long as for the users made by
+// HashPassword.
+var unknownUserHash = fmt.Sprintf("$%s$%d$%s$%s", HashPBKDF2SHA256, pbkdf2Iterations,
+	base64.RawStdEncoding.EncodeToString(make([]byte, 16)), base64.RawStdEncoding.EncodeToString(make([]byte, sha256.Size)))
+
+// HashPassword returns a hash of password for the users file, with PBKDF2-HMAC-SHA256 and a random salt.
+func HashPassword(password string) (string, error) {
+	return HashPasswordScheme(password, HashPBKDF2SHA256)
+}
+
+// HashPasswordScheme returns a hash of password for the users file with scheme, HashPBKDF2SHA256 or HashPBKDF2SHA1, and a
+// random salt.
+func HashPasswordScheme(password, scheme string) (string, error) {
+	digest, ok := pbkdf2Digests[strings.TrimPrefix(scheme, "pbkdf2-")]
+	if !ok || !strings.HasPrefix(scheme, "pbkdf2-") {
+		return "", fmt.Errorf("unknown password hash scheme %q, expected %s or %s", scheme, HashPBKDF2SHA256, HashPBKDF2SHA1)
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(digest, password, salt, pbkdf2Iterations, digest().Size())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$%s$%d$%s$%s", scheme, pbkdf2Iterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// passwordScheme returns the function verifying hash, or an error if its scheme isn't supported.
+func passwordScheme(hash string) (func(hash, password string) (bool, error), error) {
+	for prefix, verify := range passwordSchemes {
+		if strings.HasPrefix(hash, prefix) {
+			return verify, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported password hash; bcrypt and argon2id hashes need the xcrypto build tag")
+}
+
+// pbkdf2Hash is a parsed PBKDF2 hash.
+type pbkdf2Hash struct {
+	digest     string // Name of the hash function, a key of pbkdf2Digests.
+	iterations int
+	salt, key  []byte
+}
+
+func parsePBKDF2(hash string) (pbkdf2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[0] != "" || !strings.HasPrefix(parts[1], "pbkdf2-") {
+		return pbkdf2Hash{}, fmt.Errorf("malformed pbkdf2 hash")
+	}
+	scheme := parts[1]
+	h := pbkdf2Hash{digest: strings.TrimPrefix(scheme, "pbkdf2-")}
+	if _, ok := pbkdf2Digests[h.digest]; !ok {
+		return pbkdf2Hash{}, fmt.Errorf("unsupported %s hash", scheme)
+	}
+	var err error
+	if h.iterations, err = strconv.Atoi(parts[2]); err != nil || h.iterations < 1 {
+		return pbkdf2Hash{}, fmt.Errorf("malformed %s iteration count", scheme)
+	}
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil {
+		return pbkdf2Hash{}, fmt.Errorf("malformed %s salt", scheme)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil || len(h.key) == 0 {
+		return pbkdf2Hash{}, fmt.Errorf("malformed %s key", scheme)
+	}
+	return h, nil
+}
+
+func verifyPBKDF2(hash, password string) (bool, error) {
+	h, err := parsePBKDF2(hash)
+	if err != nil {
+		return false, err
+	}
+	key, err := pbkdf2.Key(pbkdf2Digests[h.digest], password, h.salt, h.iterations, len(h.key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, h.key) == 1, nil
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// CheckPidFile returns an error if the pidfile at path holds the ID of a running process other than this one. A missing file,
+// or one left behind by a process that died, passes.
+func CheckPidFile(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading pidfile: %v", err)
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(data)))
+	if err != nil || pid <= 0 {
+		// Not written by a server, e.g. truncated by a crash while writing it.
+		return nil
+	}
+	if pid == os.Getppid() && upgrading() {
+		// Written by the process this one replaces.
+		return nil
+	}
+	if pid != os.Getpid() && processAlive(pid) {
+		return fmt.Errorf("pidfile %s: process %d is running", path, pid)
+	}
+	return nil
+}
+
+// writePidFile writes the ID of the process to path, unless the file names another running process.
+func writePidFile(path string) error {
+	if err := CheckPidFile(path); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return fmt.Errorf("writing pidfile: %v", err)
+	}
+	return nil
+}
+
+// removePidFile removes the pidfile at path if it still holds the ID of the process, so a server started since keeps its file.
+// An error removing it is logged to log.
+func removePidFile(path string, log Logger) {
+	data, err := os.ReadFile(path)
+	if err != nil || string(bytes.TrimSpace(data)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		log.Warn("error removing pidfile", "path", path, "err", err)
+	}
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// pprofEnabled tells whether the admin listener serves /debug/pprof. It is set from Config.Pprof and toggled by "profile http".
+// Updated atomically.
+var pprofEnabled int32
+
+// cpuProfile is the file the running CPU profile is written to, nil if none is running.
+var (
+	cpuProfile      *os.File
+	cpuProfileMutex sync.Mutex
+)
+
+// registerPprof adds the net/http/pprof handlers to the admin listener, turning pprof on if enabled. They answer 404 while
+// pprof is turned off. Like the profiles, the switch is shared by the servers of the process.
+func registerPprof(mux *http.ServeMux, enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&pprofEnabled, 1)
+	}
+	mux.HandleFunc("/debug/pprof/", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&pprofEnabled) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		switch strings.TrimPrefix(r.URL.Path, "/debug/pprof/") {
+		case "cmdline":
+			pprof.Cmdline(w, r)
+		case "profile":
+			pprof.Profile(w, r)
+		case "symbol":
+			pprof.Symbol(w, r)
+		case "trace":
+			pprof.Trace(w, r)
+		default:
+			pprof.Index(w, r)
+		}
+	})
+}
+
+// startCPUProfile starts writing a CPU profile to path.
+func startCPUProfile(path string) error {
+	cpuProfileMutex.Lock()
+	defer cpuProfileMutex.Unlock()
+	if cpuProfile != nil {
+		return errors.New("CPU profile already running")
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := runtimepprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	cpuProfile = f
+	return nil
+}
+
+// stopCPUProfile stops the running CPU profile and closes its file.
+func stopCPUProfile() error {
+	cpuProfileMutex.Lock()
+	defer cpuProfileMutex.Unlock()
+	if cpuProfile == nil {
+		return errors.New("no CPU profile running")
+	}
+	runtimepprof.StopCPUProfile()
+	err := cpuProfile.Close()
+	cpuProfile = nil
+	return err
+}
+
+// writeHeapProfile writes a heap profile of the live objects to path.
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	runtime.GC()
+	if err := runtimepprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// TextProfileHandler handles the "profile cpu start <path>", "profile cpu stop", "profile heap <path>" and "profile http on|off" commands.
+// Paths are files on the server.
+var TextProfileHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	var err error
+	switch {
+	case len(args) == 4 && args[1] == "cpu" && args[2] == "start":
+		err = startCPUProfile(args[3])
+	case len(args) == 3 && args[1] == "cpu" && args[2] == "stop":
+		err = stopCPUProfile()
+	case len(args) == 3 && args[1] == "heap":
+		err = writeHeapProfile(args[2])
+	case len(args) == 3 && args[1] == "http" && (args[2] == "on" || args[2] == "off"):
+		if args[2] == "on" {
+			atomic.StoreInt32(&pprofEnabled, 1)
+		} else {
+			atomic.StoreInt32(&pprofEnabled, 0)
+		}
+	default:
+		return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+	}
+	if err != nil {
+		return writeTextLine(ctx, "SERVER_ERROR %s", err.Error())
+	}
+	return writeTextLine(ctx, "OK")
+}
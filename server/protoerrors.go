@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Categories of protocol errors, as reported by "stats protocol_errors".
+const (
+	protoBadMagic       = "bad_magic"       // Binary request not starting with the request magic byte.
+	protoUnknownOpcode  = "unknown_opcode"  // Binary request with an opcode there is no handler for.
+	protoBadHeader      = "bad_header"      // Binary request header with inconsistent lengths or an unknown data type.
+	protoOversize       = "oversize_body"   // Request body larger than Config.MaxRequestSize.
+	protoShortRead      = "short_read"      // Client went away in the middle of a request.
+	protoLineTooLong    = "line_too_long"   // Text command line not fitting the read buffer.
+	protoUnknownCommand = "unknown_command" // Text command there is no handler for.
+	protoWrongProtocol  = "wrong_protocol"  // Client speaking a protocol its listener doesn't serve.
+)
+
+// protocolError is an error caused by a client violating the protocol.
+type protocolError struct {
+	kind string
+	msg  string
+}
+
+func (e *protocolError) Error() string {
+	return e.msg
+}
+
+func protocolErrorf(kind, format string, args ...interface{}) error {
+	return &protocolError{kind, fmt.Sprintf(format, args...)}
+}
+
+// maxProtocolErrorIPs bounds the remote IPs protocol errors are counted for, so a port scan can't grow the table without limit.
+// Errors of further IPs are counted under "other".
+const maxProtocolErrorIPs = 1024
+
+// protocolErrorCounts counts the protocol errors of a server by category, per listener and per remote IP.
+type protocolErrorCounts struct {
+	mutex      sync.Mutex
+	total      uint64
+	byListener map[string]map[string]uint64
+	byIP       map[string]map[string]uint64
+}
+
+// countProtocolError counts a protocol error of the given category on the connection of ctx.
+func countProtocolError(ctx *ConnectionContext, kind string) {
+	listener := ctx.ConnHandle.LocalAddr().String()
+	ip := remoteIP(ctx.ConnHandle.RemoteAddr())
+	atomic.AddUint64(&ctx.client.errors, 1)
+	p := &ctx.server.protocolErrors
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.total++
+	if p.byListener == nil {
+		p.byListener, p.byIP = map[string]map[string]uint64{}, map[string]map[string]uint64{}
+	}
+	if p.byListener[listener] == nil {
+		p.byListener[listener] = map[string]uint64{}
+	}
+	p.byListener[listener][kind]++
+	if p.byIP[ip] == nil {
+		if len(p.byIP) >= maxProtocolErrorIPs {
+			ip = "other"
+		}
+		if p.byIP[ip] == nil {
+			p.byIP[ip] = map[string]uint64{}
+		}
+	}
+	p.byIP[ip][kind]++
+}
+
+// countConnError counts the error ending a connection if the client caused it by breaking the protocol.
+func countConnError(ctx *ConnectionContext, err error) {
+	if perr, ok := err.(*protocolError); ok {
+		countProtocolError(ctx, perr.kind)
+	} else if err == io.ErrUnexpectedEOF {
+		countProtocolError(ctx, protoShortRead)
+	}
+}
+
+// reset zeroes the protocol error counts for "stats reset".
+func (p *protocolErrorCounts) reset() {
+	p.mutex.Lock()
+	p.total = 0
+	p.byListener, p.byIP = nil, nil
+	p.mutex.Unlock()
+}
+
+func (p *protocolErrorCounts) totalCount() uint64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.total
+}
+
+// protocolErrorStats reports the protocol errors for "stats protocol_errors", as listener:<addr>:<category> and ip:<ip>:<category>.
+func protocolErrorStats(ctx *ConnectionContext) ([]Stat, bool) {
+	p := &ctx.server.protocolErrors
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var stats []Stat
+	for _, group := range []struct {
+		prefix string
+		counts map[string]map[string]uint64
+	}{{"listener", p.byListener}, {"ip", p.byIP}} {
+		for name, kinds := range group.counts {
+			for kind, n := range kinds {
+				stats = append(stats, Stat{group.prefix + ":" + name + ":" + kind, strconv.FormatUint(n, 10)})
+			}
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats, true
+}
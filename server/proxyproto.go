@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a connection of a listener with ProxyProtocol set may take to send its PROXY header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts the headers of version 2 of the PROXY protocol.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection whose client address was told by a load balancer in a PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader // Holds the bytes read past the header.
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *proxyConn) writeBuffers(bufs *net.Buffers) (int64, error) {
+	return writeBuffers(c.Conn, bufs)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader reads the PROXY protocol header, version 1 or 2, that load balancers like HAProxy send ahead of the traffic
+// of the client, and returns conn reporting the address of the client as its remote address. Headers of health checks
+// (LOCAL, UNKNOWN) and of protocols other than TCP keep the address of the load balancer.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	r := bufio.NewReaderSize(conn, 256)
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %v", err)
+	}
+	var remote net.Addr
+	if bytes.Equal(start, proxyV2Signature) {
+		remote, err = readProxyV2(r)
+	} else {
+		remote, err = readProxyV1(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, r: r, remote: remote}, nil
+}
+
+// readProxyV1 reads a text header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 11211\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, errors.New("reading PROXY header: no header")
+	}
+	if len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("malformed PROXY header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("missing PROXY header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, errors.New("malformed PROXY header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.New("malformed PROXY header")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header: the signature, the version and command, the address family and protocol, the length
+// of the addresses and TLVs following, and those.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %v", err)
+	}
+	versionCommand, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("reading PROXY header: %v", err)
+	}
+	if versionCommand>>4 != 2 {
+		return nil, errors.New("unsupported PROXY header version")
+	}
+	if versionCommand&0xf == 0 {
+		// LOCAL, sent by the load balancer on its own behalf.
+		return nil, nil
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("malformed PROXY header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("malformed PROXY header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
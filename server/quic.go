@@ -0,0 +1,72 @@
+//go:build quic
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicStreamConn exposes a QUIC stream as a net.Conn so it can be served by handleConn.
+type quicStreamConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (c quicStreamConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c quicStreamConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// encrypted tells handleConn that QUIC streams are encrypted with TLS already.
+func (c quicStreamConn) encrypted() bool { return true }
+
+// startQUIC listens for QUIC connections on addr. Every stream opened by a client carries its own binary protocol session.
+// It returns once s is shut down, or with the error the listener failed with.
+func (s *Server) startQUIC(addr string) error {
+	if s.certs == nil {
+		return errors.New("QUIC needs a TLS certificate")
+	}
+	tlsConf := &tls.Config{
+		GetCertificate: s.certs.getCertificate,
+		NextProtos:     []string{"memcached"},
+		MinVersion:     tls.VersionTLS13,
+	}
+	l, err := quic.ListenAddr(addr, tlsConf, &quic.Config{})
+	if err != nil {
+		return fmt.Errorf("listening on %s: %v", addr, err)
+	}
+	// Closing the listener ends its connections, so Shutdown closes it once they are done. Meanwhile neither connections
+	// nor streams are accepted anymore.
+	if !s.track(l, true) {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-s.closing
+		cancel()
+	}()
+	s.logger().Info("listening", "addr", addr, "protocol", "quic")
+	for {
+		conn, err := l.Accept(ctx)
+		if err != nil {
+			if s.stopping() {
+				return nil
+			}
+			return fmt.Errorf("accepting on %s: %v", addr, err)
+		}
+		go func() {
+			for {
+				stream, err := conn.AcceptStream(ctx)
+				if err != nil {
+					// Connection closed or timed out.
+					return
+				}
+				go s.handleConn(quicStreamConn{Stream: stream, conn: conn}, ListenerConfig{Addr: addr, Protocol: ProtocolBinary}, nil)
+			}
+		}()
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !quic
+
+package server
+
+import "errors"
+
+// startQUIC fails as QUIC support is only compiled in with the quic build tag.
+func (s *Server) startQUIC(addr string) error {
+	return errors.New("listening: QUIC support is not compiled in, rebuild with -tags quic")
+}
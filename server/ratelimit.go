@@ -0,0 +1,186 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Responses to clients exceeding a rate limit, see Config.RateLimitAction.
+const (
+	RateLimitDelay      = "delay"      // Wait until the client is within its limits again, then serve the command.
+	RateLimitFail       = "fail"       // Fail the command with a temporary failure, 0x0086 in the binary protocol.
+	RateLimitDisconnect = "disconnect" // Close the connection.
+)
+
+// IsRateLimitAction reports whether name is a supported value of Config.RateLimitAction.
+func IsRateLimitAction(name string) bool {
+	return name == RateLimitDelay || name == RateLimitFail || name == RateLimitDisconnect
+}
+
+// ErrRateLimited fails the commands of clients exceeding a rate limit with RateLimitFail.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// errRateLimitClose ends the connections of clients exceeding a rate limit with RateLimitDisconnect.
+var errRateLimitClose = errors.New("closed for exceeding the rate limit")
+
+// tokenBucket holds the tokens of a rate limit. It refills at the rate of the limit, up to one second worth of tokens.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time // Last refill, zero for a full bucket.
+}
+
+func (b *tokenBucket) refill(rate int, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else if b.tokens += now.Sub(b.last).Seconds() * float64(rate); b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.last = now
+}
+
+// take takes n tokens if the bucket holds them after refilling at rate per second. Otherwise it takes none and returns how
+// long until it could.
+func (b *tokenBucket) take(n float64, rate int) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill(rate, time.Now())
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0
+	}
+	return time.Duration((n - b.tokens) / float64(rate) * float64(time.Second))
+}
+
+// owe takes n tokens even if the bucket runs into debt, for bytes that were transferred already.
+func (b *tokenBucket) owe(n float64, rate int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill(rate, time.Now())
+	b.tokens -= n
+}
+
+// rateLimits are the buckets of one connection or one remote IP.
+type rateLimits struct {
+	ops, bytes tokenBucket
+	charged    uint64 // Bytes charged to the bytes bucket so far. Updated atomically.
+}
+
+// charge charges the bytes transferred since the last call, traffic being the bytes transferred in total.
+func (r *rateLimits) charge(traffic uint64, rate int) {
+	if rate <= 0 {
+		atomic.StoreUint64(&r.charged, traffic)
+		return
+	}
+	if charged := atomic.SwapUint64(&r.charged, traffic); traffic > charged {
+		r.bytes.owe(float64(traffic-charged), rate)
+	}
+}
+
+// wait returns how long until the limits allow another command, taking an op token if they do right away.
+func (r *rateLimits) wait(opsRate, bytesRate int) time.Duration {
+	if bytesRate > 0 {
+		if wait := r.bytes.take(0, bytesRate); wait > 0 {
+			return wait
+		}
+	}
+	if opsRate > 0 {
+		return r.ops.take(1, opsRate)
+	}
+	return 0
+}
+
+type rateSettings struct {
+	connOps, connBytes, ipOps, ipBytes int
+	action                             string
+}
+
+func (s *Server) rateLimitSettings() rateSettings {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return rateSettings{s.config.ConnOpsPerSec, s.config.ConnBytesPerSec, s.config.IPOpsPerSec, s.config.IPBytesPerSec,
+		s.config.RateLimitAction}
+}
+
+func (rs rateSettings) limited() bool {
+	return rs.connOps > 0 || rs.connBytes > 0 || rs.ipOps > 0 || rs.ipBytes > 0
+}
+
+// rateWait charges the bytes transferred since the last call to the rate limits of the connection and of its remote IP,
+// then returns how long until they allow another command, taking its op tokens if they do right away.
+func (ctx *ConnectionContext) rateWait(rs rateSettings) time.Duration {
+	ctx.rate.charge(atomic.LoadUint64(&ctx.rate.traffic), rs.connBytes)
+	ip := &ctx.client.rate
+	ip.charge(atomic.LoadUint64(&ctx.client.bytesRead)+atomic.LoadUint64(&ctx.client.bytesWritten), rs.ipBytes)
+	wait := ctx.rate.wait(rs.connOps, rs.connBytes)
+	if wait == 0 {
+		if wait = ip.wait(rs.ipOps, rs.ipBytes); wait > 0 && rs.connOps > 0 {
+			// Give back the token of the connection, the command waits or fails.
+			ctx.rate.ops.take(-1, rs.connOps)
+		}
+	}
+	return wait
+}
+
+// admitCommand is rateLimit for the event loop, which calls it before reading a command so that a worker doesn't wait
+// for the client to be within its limits with RateLimitDelay. It returns how long to put the connection aside before
+// trying again, or 0 once rateLimit is to let the next command through, throttled telling whether the connection was
+// put aside already for it. Other actions are left to rateLimit.
+func (ctx *ConnectionContext) admitCommand(throttled bool) time.Duration {
+	rs := ctx.server.rateLimitSettings()
+	if ctx.rate.admitted || !rs.limited() || rs.action != RateLimitDelay {
+		return 0
+	}
+	wait := ctx.rateWait(rs)
+	if wait == 0 {
+		ctx.rate.admitted = true
+	} else if !throttled {
+		atomic.AddUint64(&ctx.server.counters.rateLimited, 1)
+	}
+	return wait
+}
+
+// rateLimit charges a command to the rate limits of the connection and of its remote IP. Bytes count as transferred once
+// they were read or written, so a command exceeding the bytes limit holds up the next one. If a limit is exceeded it waits
+// for the client to be within its limits again, or returns ErrRateLimited or errRateLimitClose, per RateLimitAction.
+func (ctx *ConnectionContext) rateLimit() error {
+	if ctx.rate.admitted {
+		ctx.rate.admitted = false
+		return nil
+	}
+	rs := ctx.server.rateLimitSettings()
+	if !rs.limited() {
+		return nil
+	}
+	for limited := false; ; limited = true {
+		wait := ctx.rateWait(rs)
+		if wait == 0 {
+			return nil
+		}
+		if !limited {
+			atomic.AddUint64(&ctx.server.counters.rateLimited, 1)
+		}
+		switch rs.action {
+		case RateLimitFail:
+			return ErrRateLimited
+		case RateLimitDisconnect:
+			return errRateLimitClose
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.server.closing:
+			timer.Stop()
+			return errDraining
+		}
+	}
+}
+
+// connRateLimits are the rate limits of a connection.
+type connRateLimits struct {
+	rateLimits
+	traffic  uint64 // Bytes read and written by the connection. Updated atomically.
+	admitted bool   // Set by admitCommand for the next command, whose op tokens were taken already.
+}
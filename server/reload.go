@@ -0,0 +1,314 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// runtimeSettings are the settings changed while serving, by Reload or the "config set" command. Changes of the others are only
+// logged by Reload, as they need a restart. The function, if any, checks a new value and puts it into effect beyond the
+// settings, given those of the server with the new value and the store of the server.
+var runtimeSettings = map[string]func(c *Config) error{
+	"log_level":          nil,
+	"max_request_size":   nil,
+	"key_validation":     nil,
+	"ttl_jitter":         nil,
+	"idle_timeout":       checkIdleTimeout,
+	"slow_log_threshold": nil,
+	"max_memory":         applyLimits,
+	"max_items":          applyLimits,
+	"lru_hot_percent":    applySegments,
+	"lru_warm_percent":   applySegments,
+	"lfu_samples":        applySamples,
+	"verbosity":          checkVerbosity,
+	"max_conns_per_ip":   nil,
+	"auth_backoff":       nil,
+	"auth_ban_threshold": nil,
+	"auth_ban_duration":  nil,
+	"conn_ops_per_sec":   nil,
+	"conn_bytes_per_sec": nil,
+	"ip_ops_per_sec":     nil,
+	"ip_bytes_per_sec":   nil,
+	"rate_limit_action":  nil,
+	"user_deny":          nil,
+	"ip_allowlist":       nil,
+	"ip_denylist":        nil,
+}
+
+// applyLimits changes the memory and item limits of the store.
+func applyLimits(c *Config) error {
+	kv, ok := baseStore(c.Store).(interface{ SetLimits(uint64, int) error })
+	if !ok {
+		return fmt.Errorf("the store has no memory limits")
+	}
+	return kv.SetLimits(c.MaxMemory, c.MaxItems)
+}
+
+func checkSegments(c *Config) error {
+	if c.LRUHotPercent < 1 || c.LRUWarmPercent < 1 || c.LRUHotPercent+c.LRUWarmPercent >= 100 {
+		return fmt.Errorf("the HOT and WARM segments need a share each and must leave some for COLD")
+	}
+	return nil
+}
+
+// applySegments and applySamples change the tuning of the eviction policies of the store. Stores without eviction policies
+// ignore it.
+func applySegments(c *Config) error {
+	if err := checkSegments(c); err != nil {
+		return err
+	}
+	applyTuning(c)
+	return nil
+}
+
+func applySamples(c *Config) error {
+	if err := checkSamples(c); err != nil {
+		return err
+	}
+	applyTuning(c)
+	return nil
+}
+
+func applyTuning(c *Config) {
+	if kv, ok := baseStore(c.Store).(interface{ SetEvictionTuning(int, int, int) }); ok {
+		kv.SetEvictionTuning(c.LRUHotPercent, c.LRUWarmPercent, c.LFUSamples)
+	}
+}
+
+// checkIdleTimeout refuses to keep connections open for good with EventLoop, whose workers wait for the rest of a command
+// sent in parts until the idle timeout.
+func checkIdleTimeout(c *Config) error {
+	if c.EventLoop && c.IdleTimeout <= 0 {
+		return fmt.Errorf("must be positive with event_loop")
+	}
+	return nil
+}
+
+func checkSamples(c *Config) error {
+	if c.LFUSamples < 1 {
+		return fmt.Errorf("at least one item must be sampled")
+	}
+	return nil
+}
+
+// setRuntimeSetting changes the runtime setting name of s to value, returning the value it had. The settings are left as they
+// were if the new value is refused.
+func (s *Server) setRuntimeSetting(name string, value reflect.Value) (old string, err error) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	current := reflect.ValueOf(&s.config).Elem().Field(configFields[name])
+	old = fmt.Sprint(current.Interface())
+	if apply := runtimeSettings[name]; apply != nil {
+		next := s.config
+		next.Store = s.cache
+		reflect.ValueOf(&next).Elem().Field(configFields[name]).Set(value)
+		if err := apply(&next); err != nil {
+			return old, err
+		}
+	}
+	current.Set(value)
+	return old, nil
+}
+
+// The runtime settings of a server are read through the methods below.
+
+func (s *Server) logLevel() string {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.config.LogLevel
+}
+
+func (s *Server) maxRequestSize() int {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.config.MaxRequestSize
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.config.IdleTimeout
+}
+
+func (s *Server) verbosity() int {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.config.Verbosity
+}
+
+func (s *Server) slowLogThreshold() time.Duration {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.config.SlowLogThreshold
+}
+
+func (s *Server) keyValidation() string {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.config.KeyValidation
+}
+
+func (s *Server) ttlJitter() int {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.config.TTLJitter
+}
+
+// loadConfigSources returns the settings of the config file and the environment variables on top of the defaults.
+func loadConfigSources(path string) (Config, error) {
+	c := DefaultConfig()
+	if err := LoadConfigFile(path, &c); err != nil {
+		return c, err
+	}
+	return c, LoadEnv(&c)
+}
+
+// Reload re-reads the config file of the server and applies the runtime settings changed in it, or in the environment,
+// since it was last read. Settings given otherwise, like by flags, keep their value unless the file changes them.
+// Every change is logged. Connections are not affected.
+func (s *Server) Reload() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.config.ConfigFile == "" {
+		return fmt.Errorf("no config file to reload")
+	}
+	fresh, err := loadConfigSources(s.config.ConfigFile)
+	if err != nil {
+		return err
+	}
+	if s.loaded == nil {
+		// Serve didn't get to read the file.
+		s.loaded = &fresh
+	}
+	var names []string
+	for name := range configFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		old := reflect.ValueOf(s.loaded).Elem().Field(configFields[name])
+		now := reflect.ValueOf(&fresh).Elem().Field(configFields[name])
+		if reflect.DeepEqual(old.Interface(), now.Interface()) {
+			continue
+		}
+		if _, ok := runtimeSettings[name]; !ok {
+			s.logger().Warn("setting changed, restart to apply it", "setting", name)
+			continue
+		}
+		was, err := s.setRuntimeSetting(name, now)
+		if err != nil {
+			s.logger().Error("error reloading setting", "setting", name, "value", fmt.Sprint(now.Interface()), "err", err)
+			continue
+		}
+		s.logger().Info("setting reloaded", "setting", name, "old", was, "new", fmt.Sprint(now.Interface()))
+	}
+	s.loaded = &fresh
+	return nil
+}
+
+// TextConfigHandler handles the "config set <name> <value>" command changing a runtime setting, like max_memory or
+// slow_log_threshold, while serving. Values are written as in environment variables. The change is logged and shows in
+// "stats settings", but is lost on restart or when a reload of the config file changes the setting.
+var TextConfigHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	if len(args) != 4 || args[1] != "set" {
+		return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+	}
+	name := args[2]
+	if _, ok := runtimeSettings[name]; !ok {
+		if _, ok := configFields[name]; ok {
+			return writeTextLine(ctx, "CLIENT_ERROR %s can't change while serving", name)
+		}
+		return writeTextLine(ctx, "CLIENT_ERROR unknown setting")
+	}
+	var c Config
+	value, err := envValue(reflect.ValueOf(&c).Elem().Field(configFields[name]), args[3])
+	if err == nil {
+		err = setConfig(&c, name, value)
+	}
+	if err != nil {
+		return writeTextLine(ctx, "CLIENT_ERROR %v", err)
+	}
+	now := reflect.ValueOf(c).Field(configFields[name])
+	was, err := ctx.server.setRuntimeSetting(name, now)
+	if err != nil {
+		return writeTextLine(ctx, "CLIENT_ERROR %v", err)
+	}
+	ctx.logger().Info("setting changed", "setting", name, "old", was, "new", fmt.Sprint(now.Interface()))
+	return writeTextLine(ctx, "OK")
+}
+
+// reloadOnHangup reloads the config file, the users file and the TLS certificate whenever the process receives SIGHUP, until the server is shut down.
+func (s *Server) reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+			if s.config.ConfigFile != "" {
+				s.logger().Info("reloading config file", "path", s.config.ConfigFile)
+				if err := s.Reload(); err != nil {
+					s.logger().Error("error reloading config file", "err", err)
+				}
+			}
+			if s.config.SASLUsersFile != "" {
+				if err := s.loadUsers(); err != nil {
+					s.logger().Error("error reloading users", "err", err)
+				} else {
+					s.logger().Info("reloaded users", "path", s.config.SASLUsersFile, "users", len(s.userTable()))
+				}
+			}
+			if s.certs != nil {
+				if err := s.certs.reload(); err != nil {
+					s.logger().Error("error reloading TLS certificate", "err", err)
+				} else {
+					s.logger().Info("reloaded TLS certificate", "path", s.config.TLSCertFile)
+				}
+			}
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// rotateLogs makes the access and audit logs of s reopen their files, so they continue in new files once the old ones were moved away.
+func (s *Server) rotateLogs() {
+	var reopen []chan struct{}
+	if s.access != nil {
+		reopen = append(reopen, s.access.reopen)
+	}
+	if s.auditor != nil && s.auditor.path != "" {
+		reopen = append(reopen, s.auditor.reopen)
+	}
+	for _, reopen := range reopen {
+		select {
+		case reopen <- struct{}{}:
+		default:
+			// A reopen is pending already.
+		}
+	}
+}
+
+// rotateLogsOnSignal reopens the log files whenever the process receives one of rotateSignals, until the server is shut down.
+func (s *Server) rotateLogsOnSignal() {
+	if len(rotateSignals) == 0 {
+		return
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, rotateSignals...)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case <-sig:
+			s.logger().Info("reopening log files")
+			s.rotateLogs()
+		case <-s.closing:
+			return
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupTimeFormat names backups so that sorting their keys sorts them by time.
+const backupTimeFormat = "20060102T150405Z"
+
+// s3Client is a minimal client of the S3 object API, just enough to upload, download and list snapshots.
+// Requests are signed with AWS Signature Version 4 and use path style URLs, so S3 compatible stores work as well.
+type s3Client struct {
+	endpoint  string // e.g. https://s3.us-east-1.amazonaws.com
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	token     string // Session token of temporary credentials, may be empty.
+	http      *http.Client
+}
+
+// newBackupClient creates the client for the Backup settings of cfg, taking credentials from the standard AWS environment variables.
+// BackupBucket may carry a key prefix after the bucket name.
+func newBackupClient(cfg Config) (*s3Client, string, error) {
+	if cfg.BackupBucket == "" {
+		return nil, "", fmt.Errorf("No backup bucket configured")
+	}
+	bucket, prefix := cfg.BackupBucket, ""
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		bucket, prefix = bucket[:i], strings.Trim(bucket[i+1:], "/")+"/"
+	}
+	c := &s3Client{
+		endpoint:  strings.TrimSuffix(cfg.BackupEndpoint, "/"),
+		region:    cfg.BackupRegion,
+		bucket:    bucket,
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		http:      &http.Client{Timeout: 10 * time.Minute},
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if c.endpoint == "" {
+		c.endpoint = "https://s3." + c.region + ".amazonaws.com"
+	}
+	return c, prefix, nil
+}
+
+// uriEncode percent-encodes s as required by Signature Version 4. Slashes are kept unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds the Signature Version 4 authorization to req. All headers set on req are signed, plus host.
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, stringToSign)))
+}
+
+// do signs and sends a request, turning error responses into errors.
+func (c *s3Client) do(method, key string, query url.Values, body io.ReadSeeker) (*http.Response, error) {
+	u, err := url.Parse(c.endpoint + "/" + c.bucket + "/" + key)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = query.Encode()
+	payloadHash := hex.EncodeToString(sha256.New().Sum(nil))
+	var size int64
+	if body != nil {
+		h := sha256.New()
+		if size, err = io.Copy(h, body); err != nil {
+			return nil, err
+		}
+		if _, err = body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		payloadHash = hex.EncodeToString(h.Sum(nil))
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	c.sign(req, payloadHash, time.Now())
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s: %s %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// list returns the keys of all objects starting with prefix.
+func (c *s3Client) list(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := c.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range result.Contents {
+			keys = append(keys, obj.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// BackupSnapshot writes a snapshot of store and uploads it to the backup bucket of Settings. It returns the key of the new object.
+func BackupSnapshot(store Store) (string, error) {
+	aead, err := settingsPersistKey()
+	if err != nil {
+		return "", err
+	}
+	return backupSnapshot(store, Settings, aead)
+}
+
+// backupSnapshot implements BackupSnapshot for the Backup settings of cfg, encrypting the snapshot with aead unless it is nil.
+func backupSnapshot(store Store, cfg Config, aead cipher.AEAD) (string, error) {
+	c, prefix, err := newBackupClient(cfg)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp("", "memcached-backup")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if _, err := writeSnapshot(store, f.Name(), aead, nil); err != nil {
+		return "", err
+	}
+	f, err = os.Open(f.Name())
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	key := prefix + "snapshot-" + time.Now().UTC().Format(backupTimeFormat) + ".snap"
+	resp, err := c.do(http.MethodPut, key, nil, f)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return key, nil
+}
+
+// RestoreLatestBackup downloads the newest snapshot from the backup bucket of Settings and loads it into store.
+func RestoreLatestBackup(store Store) (key string, items int, err error) {
+	aead, err := settingsPersistKey()
+	if err != nil {
+		return "", 0, err
+	}
+	return restoreLatestBackup(store, Settings, aead)
+}
+
+// restoreLatestBackup implements RestoreLatestBackup for the Backup settings of cfg, decrypting the snapshot with aead.
+func restoreLatestBackup(store Store, cfg Config, aead cipher.AEAD) (key string, items int, err error) {
+	c, prefix, err := newBackupClient(cfg)
+	if err != nil {
+		return "", 0, err
+	}
+	keys, err := c.list(prefix + "snapshot-")
+	if err != nil {
+		return "", 0, err
+	}
+	if len(keys) == 0 {
+		return "", 0, fmt.Errorf("No backup found in %s", cfg.BackupBucket)
+	}
+	sort.Strings(keys)
+	key = keys[len(keys)-1]
+	resp, err := c.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	f, err := os.CreateTemp("", "memcached-restore")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	items, err = loadSnapshot(store, f.Name(), aead)
+	return key, items, err
+}
+
+// TextBackupHandler handles the "backup" command, uploading a snapshot of the whole store to the backup bucket. Isolated users
+// are refused, as the backup holds the keys of all users.
+var TextBackupHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	if len(args) != 1 {
+		return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+	}
+	if _, ok := ctx.Store.(*userStore); ok {
+		return writeTextLine(ctx, "CLIENT_ERROR access denied")
+	}
+	key, err := backupSnapshot(ctx.Store, ctx.server.config, ctx.server.persistKey)
+	if err != nil {
+		return writeTextLine(ctx, "SERVER_ERROR %s", err.Error())
+	}
+	return writeTextLine(ctx, "OK %s", key)
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrAuth fails commands of clients that didn't authenticate, and authentications that failed.
+var ErrAuth = errors.New("Auth failure.")
+
+// ErrAuthThrottled fails the authentications of remote IPs backing off or banned after failed ones, see AuthBackoff.
+var ErrAuthThrottled = errors.New("Too many failed authentications, try again later.")
+
+// Listener authentication policies, see ListenerConfig.Auth.
+const (
+	AuthRequired = "required"
+	AuthOptional = "optional"
+)
+
+// authFreeOps are the binary opcodes clients may send before authenticating: the SASL commands, and the ones health probes use.
+var authFreeOps = map[uint8]bool{
+	OpSASLListMechs: true, OpSASLAuth: true, OpSASLStep: true, OpNoOp: true, OpVersion: true, OpQuit: true,
+}
+
+// authFreeTextCommands are the text commands clients may send before authenticating.
+var authFreeTextCommands = map[string]bool{"version": true, "quit": true}
+
+// userTable holds the password hashes of the users in Config.SASLUsersFile, by name.
+type userTable map[string]string
+
+// loadUsers reads a users file. Every line holds a user name and the hash of its password separated by a colon, like
+// app:$pbkdf2-sha256$100000$..., see HashPassword. Empty lines and lines starting with # are skipped.
+func loadUsers(path string) (userTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := userTable{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(line, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:password-hash", path, n)
+		}
+		if _, err := passwordScheme(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		users[name] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// verify reports whether password is the one of user, failing with an error if the stored hash of user can't be checked.
+// Unknown users take as long to fail as known ones, so clients can't tell which users exist.
+func (t userTable) verify(user, password string) (bool, error) {
+	hash, ok := t[user]
+	if !ok {
+		verifyPBKDF2(unknownUserHash, password)
+		return false, nil
+	}
+	verify, err := passwordScheme(hash)
+	if err != nil {
+		return false, nil
+	}
+	return verify(hash, password)
+}
+
+// isolatable returns an error if a user name contains separator, which would put the keys of that user in the namespace
+// of another with IsolateUsers.
+func (t userTable) isolatable(separator string) error {
+	for name := range t {
+		if strings.Contains(name, separator) {
+			return fmt.Errorf("user %q contains the namespace separator %q", name, separator)
+		}
+	}
+	return nil
+}
+
+// loadUsers reads the users file of the settings, replacing the users clients authenticate as.
+func (s *Server) loadUsers() error {
+	users, err := loadUsers(s.config.SASLUsersFile)
+	if err == nil && s.config.IsolateUsers {
+		err = users.isolatable(s.config.NamespaceSeparator)
+	}
+	if err != nil {
+		return fmt.Errorf("loading users: %v", err)
+	}
+	s.users.Store(users)
+	return nil
+}
+
+// userTable returns the users clients authenticate as, nil if SASL is off.
+func (s *Server) userTable() userTable {
+	users, _ := s.users.Load().(userTable)
+	return users
+}
+
+// saslSession authenticates a client with a SASL mechanism, over the SASL Auth command and the SASL Step commands following it.
+type saslSession interface {
+	// step handles the data sent by the client. While the mechanism needs another step it returns the challenge to send back,
+	// and once done the name of the authenticated user and optionally final data for the client, like a server signature.
+	// An error fails the authentication.
+	step(data []byte) (challenge []byte, user string, done bool, err error)
+}
+
+// saslMechanisms start a session of the SASL mechanisms offered to clients, by name.
+var saslMechanisms = map[string]func(users userTable) saslSession{
+	"PLAIN":         func(users userTable) saslSession { return plainSession{users} },
+	"SCRAM-SHA-1":   func(users userTable) saslSession { return newSCRAMSession(users, "sha1") },
+	"SCRAM-SHA-256": func(users userTable) saslSession { return newSCRAMSession(users, "sha256") },
+}
+
+// plainSession authenticates with the PLAIN mechanism of RFC 4616, which sends the password in the clear.
+type plainSession struct {
+	users userTable
+}
+
+func (p plainSession) step(data []byte) ([]byte, string, bool, error) {
+	// [authzid] NUL authcid NUL passwd
+	parts := bytes.Split(data, []byte{0})
+	if len(parts) != 3 {
+		return nil, "", false, ErrAuth
+	}
+	authz, user, password := string(parts[0]), string(parts[1]), string(parts[2])
+	if authz != "" && authz != user {
+		return nil, user, false, ErrAuth
+	}
+	if ok, err := p.users.verify(user, password); err != nil {
+		return nil, user, false, fmt.Errorf("error verifying password: %v", err)
+	} else if !ok {
+		return nil, user, false, ErrAuth
+	}
+	return nil, user, true, nil
+}
+
+// offersMechanism reports whether the client may authenticate with the SASL mechanism name: PLAIN needs an encrypted
+// connection unless PlainNeedsTLS is off.
+func (ctx *ConnectionContext) offersMechanism(name string) bool {
+	return name != "PLAIN" || ctx.encrypted || !ctx.server.config.PlainNeedsTLS
+}
+
+// authRequired reports whether the client must authenticate before sending other commands, per its listener or the settings.
+func (ctx *ConnectionContext) authRequired() bool {
+	switch ctx.listener.Auth {
+	case AuthRequired:
+		return true
+	case AuthOptional:
+		return false
+	}
+	return ctx.server.config.RequireAuth
+}
+
+// writeAuthResponse replies to a SASL command with status and value.
+func writeAuthResponse(header RequestHeader, status uint16, value []byte, ctx *ConnectionContext) error {
+	respHeader := ResponseHeader{}
+	respHeader.Magic = MagicResponse
+	respHeader.Opcode = header.Opcode
+	respHeader.Opaque = header.Opaque
+	respHeader.Status = status
+	return writeResponse(respHeader, nil, nil, value, ctx.RW)
+}
+
+// SASLListMechsHandler handles the SASL LIST MECHS command, answering the mechanisms separated by spaces.
+var SASLListMechsHandler HandleFunc = func(header RequestHeader, ctx *ConnectionContext) error {
+	if header.KeyLength > 0 || header.ExtraLength > 0 || header.TotalBodyLength > 0 {
+		return fmt.Errorf("SASL list mechs command should have NO key, extra or value: keylength %d, extralength: %d, totalbodylength: %d",
+			header.KeyLength, header.ExtraLength, header.TotalBodyLength)
+	}
+	if ctx.server.userTable() == nil {
+		return writeError(header, ErrNotSupported, ctx)
+	}
+	var names []string
+	for name := range saslMechanisms {
+		if ctx.offersMechanism(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return writeAuthResponse(header, CodeNoError, []byte(strings.Join(names, " ")), ctx)
+}
+
+// SASLAuthHandler handles the SASL AUTH and SASL STEP commands. The key names the mechanism, the value holds its data.
+// AUTH starts a new authentication, dropping the identity of the client; STEP continues the one in progress.
+var SASLAuthHandler HandleFunc = func(header RequestHeader, ctx *ConnectionContext) error {
+	if header.KeyLength == 0 || header.ExtraLength > 0 {
+		return fmt.Errorf("SASL auth commands MUST have key and optional value only: keylength %d, extralength: %d, totalbodylength: %d",
+			header.KeyLength, header.ExtraLength, header.TotalBodyLength)
+	}
+	buf, err := readBody(header, ctx)
+	if err != nil {
+		return err
+	}
+	users := ctx.server.userTable()
+	if users == nil {
+		return writeError(header, ErrNotSupported, ctx)
+	}
+	atomic.AddUint64(&ctx.server.counters.authCmds, 1)
+	mechanism, data := string(buf[:header.KeyLength]), buf[header.KeyLength:]
+	if header.Opcode == OpSASLAuth {
+		ctx.User, ctx.Store, ctx.sasl, ctx.saslMechanism = "", ctx.server.cache, nil, ""
+		ctx.userCounts = nil
+		if start, ok := saslMechanisms[mechanism]; ok && ctx.offersMechanism(mechanism) {
+			ctx.sasl, ctx.saslMechanism = start(users), mechanism
+		}
+	}
+	if wait, banned := ctx.server.authFails.wait(ctx.client.ip); wait > 0 {
+		ctx.sasl, ctx.saslMechanism = nil, ""
+		atomic.AddUint64(&ctx.server.counters.authThrottled, 1)
+		ctx.logger().Debug("authentication throttled", "mechanism", mechanism, "wait", wait, "banned", banned)
+		return writeAuthResponse(header, CodeAuthError, []byte(ErrAuthThrottled.Error()), ctx)
+	}
+	if ctx.sasl == nil || ctx.saslMechanism != mechanism {
+		return ctx.authFailed(header, mechanism, "", ErrAuth)
+	}
+	challenge, user, done, err := ctx.sasl.step(data)
+	if err != nil {
+		return ctx.authFailed(header, mechanism, user, err)
+	}
+	if !done {
+		return writeAuthResponse(header, CodeAuthContinue, challenge, ctx)
+	}
+	ctx.User, ctx.sasl, ctx.saslMechanism = user, nil, ""
+	ctx.authenticated()
+	ctx.server.authFails.succeed(ctx.client.ip)
+	if ctx.server.config.IsolateUsers {
+		ctx.Store = newUserStore(ctx.server.cache, user, ctx.server.config.NamespaceSeparator)
+	}
+	ctx.logConn("authenticated", "user", user, "mechanism", mechanism)
+	if challenge == nil {
+		challenge = []byte("Authenticated")
+	}
+	return writeAuthResponse(header, CodeNoError, challenge, ctx)
+}
+
+// authFailed ends the authentication in progress, throttles the remote IP and tells the client.
+func (ctx *ConnectionContext) authFailed(header RequestHeader, mechanism, user string, err error) error {
+	ctx.sasl, ctx.saslMechanism = nil, ""
+	atomic.AddUint64(&ctx.server.counters.authErrors, 1)
+	ctx.logger().Warn("authentication failed", "mechanism", mechanism, "user", user, "err", err)
+	if wait, banned := ctx.server.authFails.fail(ctx.client.ip, ctx.server.authThrottling()); banned {
+		atomic.AddUint64(&ctx.server.counters.authBans, 1)
+		ctx.logger().Warn("IP banned for failed authentications", "ip", ctx.client.ip, "duration", wait)
+	}
+	return writeAuthResponse(header, CodeAuthError, []byte(ErrAuth.Error()), ctx)
+}
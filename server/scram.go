@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// scramSaltKey keys the made-up salts of unknown users, so each gets the same one every time within the process.
+var scramSaltKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// scramFakeSalt returns the made-up salt of user for the mechanism hashing with digest.
+func scramFakeSalt(digest, user string) []byte {
+	return scramHMAC(sha256.New, scramSaltKey, []byte(digest+"\x00"+user))[:16]
+}
+
+// scramSession authenticates with the SCRAM mechanisms of RFC 5802 and RFC 7677, which prove the client knows the password
+// without sending it. It takes two steps: the SASL Auth command carries the client-first message and is answered with the
+// salt and iteration count, the SASL Step command carries the proof and is answered with the server signature.
+// The salted password is the key of a PBKDF2 hash of the users file using the hash function of the mechanism; users with
+// other hashes can only authenticate with PLAIN. Channel binding, the -PLUS mechanisms, isn't supported.
+type scramSession struct {
+	users  userTable
+	digest string // Hash function of the mechanism, a key of pbkdf2Digests.
+
+	user        string
+	gs2Header   string // Header of the client-first message, echoed base64 encoded by the client-final message.
+	clientFirst string // Client-first message without gs2Header.
+	serverFirst string
+	nonce       string // Client nonce followed by the server nonce.
+	salted      []byte // Salted password, nil for unknown users, who fail the proof.
+}
+
+func newSCRAMSession(users userTable, digest string) saslSession {
+	return &scramSession{users: users, digest: digest}
+}
+
+func (s *scramSession) step(data []byte) ([]byte, string, bool, error) {
+	if s.serverFirst == "" {
+		return s.first(string(data))
+	}
+	return s.final(string(data))
+}
+
+// first answers the client-first message: gs2-header client-first-bare, like n,,n=user,r=nonce.
+func (s *scramSession) first(msg string) ([]byte, string, bool, error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 || parts[0] != "n" && parts[0] != "y" {
+		// p= asks for channel binding.
+		return nil, "", false, ErrAuth
+	}
+	s.gs2Header, s.clientFirst = parts[0]+","+parts[1]+",", parts[2]
+	attrs := strings.Split(s.clientFirst, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") || len(attrs[1]) == 2 {
+		return nil, "", false, ErrAuth
+	}
+	user, ok := scramUnescape(attrs[0][2:])
+	if !ok {
+		return nil, "", false, ErrAuth
+	}
+	s.user = user
+	if authz := parts[1]; authz != "" && authz != "a="+attrs[0][2:] {
+		return nil, user, false, ErrAuth
+	}
+
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, user, false, err
+	}
+	s.nonce = attrs[1][2:] + base64.RawStdEncoding.EncodeToString(serverNonce)
+	salt, iterations := scramFakeSalt(s.digest, user), pbkdf2Iterations
+	if hash, ok := s.users[user]; ok {
+		if h, err := parsePBKDF2(hash); err == nil && h.digest == s.digest && len(h.key) == pbkdf2Digests[s.digest]().Size() {
+			salt, iterations, s.salted = h.salt, h.iterations, h.key
+		}
+	}
+	// Users without a usable hash get a made-up salt, the same on every attempt, and fail the proof, so clients can't tell
+	// which users exist.
+	s.serverFirst = "r=" + s.nonce + ",s=" + base64.StdEncoding.EncodeToString(salt) + ",i=" + strconv.Itoa(iterations)
+	return []byte(s.serverFirst), user, false, nil
+}
+
+// final checks the client-final message, c=channel-binding,r=nonce,p=proof, and answers the server signature.
+func (s *scramSession) final(msg string) ([]byte, string, bool, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, s.user, false, ErrAuth
+	}
+	withoutProof := msg[:i]
+	proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+	if err != nil {
+		return nil, s.user, false, ErrAuth
+	}
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || attrs[0] != "c="+base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) || attrs[1] != "r="+s.nonce {
+		return nil, s.user, false, ErrAuth
+	}
+	if s.salted == nil {
+		return nil, s.user, false, ErrAuth
+	}
+
+	digest := pbkdf2Digests[s.digest]
+	authMessage := []byte(s.clientFirst + "," + s.serverFirst + "," + withoutProof)
+	clientKey := scramHMAC(digest, s.salted, []byte("Client Key"))
+	storedKey := scramHash(digest, clientKey)
+	signature := scramHMAC(digest, storedKey, authMessage)
+	if len(proof) != len(signature) {
+		return nil, s.user, false, ErrAuth
+	}
+	for i := range proof {
+		proof[i] ^= signature[i]
+	}
+	if subtle.ConstantTimeCompare(scramHash(digest, proof), storedKey) != 1 {
+		return nil, s.user, false, ErrAuth
+	}
+	serverKey := scramHMAC(digest, s.salted, []byte("Server Key"))
+	serverSignature := scramHMAC(digest, serverKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), s.user, true, nil
+}
+
+// scramUnescape decodes a SCRAM user name, in which =2C stands for a comma and =3D for an equals sign.
+func scramUnescape(name string) (string, bool) {
+	if strings.Contains(strings.NewReplacer("=2C", "", "=3D", "").Replace(name), "=") || name == "" {
+		return "", false
+	}
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name), true
+}
+
+func scramHMAC(digest func() hash.Hash, key, data []byte) []byte {
+	mac := hmac.New(digest, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func scramHash(digest func() hash.Hash, data []byte) []byte {
+	h := digest()
+	h.Write(data)
+	return h.Sum(nil)
+}
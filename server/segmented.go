@@ -0,0 +1,142 @@
+package server
+
+import (
+	"container/list"
+	"sync/atomic"
+	"time"
+)
+
+// EvictionSegmented is memcached's segmented LRU, selectable through Config.EvictionPolicy.
+const EvictionSegmented = "segmented"
+
+// Segments of the segmented LRU. The other policies keep all items in segCold, which is the shard's lru list.
+const (
+	segCold uint8 = iota
+	segWarm
+	segHot
+)
+
+// lruMaintainerInterval is how often the background maintainer rebalances the segments of every shard.
+const lruMaintainerInterval = 100 * time.Millisecond
+
+// segment returns the list holding items of a segment.
+func (s *simpleShard) segment(seg uint8) *list.List {
+	switch seg {
+	case segHot:
+		return s.hot
+	case segWarm:
+		return s.warm
+	}
+	return s.lru
+}
+
+// unlink removes elem from its segment. The sweeper's cursor moves on to the next element to examine if it was on elem, as
+// a removed element still holds its entry. Write lock must be held.
+func (s *simpleShard) unlink(elem *list.Element) {
+	if s.sweepCursor == elem {
+		s.sweepCursor = elem.Prev()
+	}
+	s.segment(elem.Value.(*simpleEntry).seg).Remove(elem)
+}
+
+// moveTo moves elem to the front of segment seg.
+func (s *simpleShard) moveTo(elem *list.Element, seg uint8) {
+	entry := elem.Value.(*simpleEntry)
+	s.unlink(elem)
+	entry.seg = seg
+	s.items[entry.key] = s.segment(seg).PushFront(entry)
+}
+
+// segmentedPolicy implements the HOT/WARM/COLD segmented LRU of memcached 1.5.
+// New items enter HOT. Reads only set the item's active bit, so the read path never reorders lists. Like in memcached, the first fetch of an item doesn't count.
+// Items flowing out of HOT or WARM go to WARM when active and to COLD otherwise; active items reaching the COLD tail get a second chance in WARM.
+type segmentedPolicy struct{}
+
+func (segmentedPolicy) insert(s *simpleShard, entry *simpleEntry) *list.Element {
+	entry.seg = segHot
+	return s.hot.PushFront(entry)
+}
+
+func (segmentedPolicy) touched(s *simpleShard, elem *list.Element) {
+	if entry := elem.Value.(*simpleEntry); atomic.LoadUint32(&entry.fetches) > 1 {
+		entry.active = true
+	}
+}
+
+func (segmentedPolicy) missed(key string) {}
+
+func (p segmentedPolicy) victim(s *simpleShard) *list.Element {
+	p.balance(s)
+	for tries := 0; tries < 5; tries++ {
+		elem := s.lru.Back()
+		if elem == nil {
+			break
+		}
+		entry := elem.Value.(*simpleEntry)
+		if !entry.active {
+			return elem
+		}
+		entry.active = false
+		s.moveTo(elem, segWarm)
+	}
+	if elem := s.lru.Back(); elem != nil {
+		return elem
+	}
+	if elem := s.warm.Back(); elem != nil {
+		return elem
+	}
+	return s.hot.Back()
+}
+
+func (segmentedPolicy) admit(string, *list.Element) bool { return true }
+
+// balance moves items off the tails of HOT and WARM until both are within their share of the shard. Write lock must be held.
+func (segmentedPolicy) balance(s *simpleShard) {
+	total := len(s.items)
+	hotPercent, warmPercent := int(atomic.LoadInt32(&s.tuning.hotPercent)), int(atomic.LoadInt32(&s.tuning.warmPercent))
+	for s.hot.Len() > total*hotPercent/100 {
+		elem := s.hot.Back()
+		entry := elem.Value.(*simpleEntry)
+		if entry.active {
+			entry.active = false
+			s.moveTo(elem, segWarm)
+		} else {
+			s.moveTo(elem, segCold)
+		}
+	}
+	// Active items get bumped within WARM once; the second time they reach the tail inactive they go COLD.
+	for bumps := s.warm.Len(); s.warm.Len() > total*warmPercent/100; {
+		elem := s.warm.Back()
+		entry := elem.Value.(*simpleEntry)
+		if entry.active && bumps > 0 {
+			entry.active = false
+			s.warm.MoveToFront(elem)
+			bumps--
+		} else {
+			s.moveTo(elem, segCold)
+		}
+	}
+}
+
+// lruMaintainer rebalances the segments of every shard in the background, so SETs rarely have to, and drops expired items met at the segment tails.
+func (kv *SimpleKV) lruMaintainer() {
+	ticker := time.NewTicker(lruMaintainerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-kv.done:
+			return
+		case <-ticker.C:
+			for _, s := range kv.shards {
+				s.mutex.Lock()
+				for _, seg := range []uint8{segHot, segWarm, segCold} {
+					for elem := s.segment(seg).Back(); elem != nil && kv.dead(elem.Value.(*simpleEntry)); elem = s.segment(seg).Back() {
+						kv.removeDead(s, elem)
+					}
+				}
+				segmentedPolicy{}.balance(s)
+				s.mutex.Unlock()
+			}
+		}
+	}
+}
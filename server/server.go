@@ -2,22 +2,19 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
-	"time"
-	//	"github.com/pkg/profile" //uncomment to enable
+	"os/signal"
+	"sync"
 	"sync/atomic"
-)
-
-/*
-Constants for server connection.
-*/
-const (
-	ConnHost = "localhost"
-	ConnPort = "3333"
-	ConnType = "tcp"
+	"syscall"
+	"time"
 )
 
 // RequestHeader is for representing a request header structure in Binary protocol.
@@ -49,13 +46,44 @@ type ResponseHeader struct {
 // ConnectionContext is used as a context object during the life time of a connection.
 // It contains re-usable buffer across commands, keeps track of connection information, and provided access to read/write network channel.
 type ConnectionContext struct {
-	RW          *bufio.ReadWriter
-	ConnHandle  net.Conn
-	ConnID      uint64 // Internal debug purpose
-	StartTime   time.Time
-	LastReqTime time.Time // For measuring how long a connection has been idle.
-	CommandSeq  uint64    // Every connection starts counting command from 0
-	ReadBuf     []byte    // Local to the goroutine handling a connection. Better utilizing memory.
+	RW            *bufio.ReadWriter
+	ConnHandle    net.Conn
+	ConnID        uint64 // Internal debug purpose
+	StartTime     time.Time
+	LastReqTime   time.Time       // For measuring how long a connection has been idle.
+	CommandSeq    uint64          // Every connection starts counting command from 0
+	ReadBuf       []byte          // Local to the goroutine handling a connection, or lent by the event loop while it serves it, from the buffer pools. Larger request bodies get a pooled buffer of their own.
+	Protocol      Protocol        // Binary or ASCII, detected from the first byte sent by the client.
+	Store         Store           // k/v storage the commands of this connection operate on.
+	User          string          // Name the client authenticated as, with SASL or a client certificate. Empty for anonymous clients.
+	encrypted     bool            // Whether the connection is encrypted, with TLS or QUIC.
+	sasl          saslSession     // Authentication in progress, continued by SASL Step.
+	saslMechanism string          // Mechanism of sasl.
+	server        *Server         // Server the connection was accepted by.
+	listener      ListenerConfig  // Listener the connection was accepted by. WebSocket, QUIC and stdio connections get one of their own.
+	command       *CommandInfo    // Command being handled, while hooks follow commands.
+	commandStart  time.Time       // When the command being handled was read.
+	trace         *connTrace      // Spans of the connection and its current command. nil while tracing is off.
+	client        *clientCounters // Counters of the remote IP for "stats clients".
+	userCounts    *userCounters   // Counters of User for "stats users", nil for anonymous clients.
+	rate          *connRateLimits // Rate limits of the connection.
+	buffers       []*[]byte       // Pooled buffers of the command being handled, see buffer.
+	mu            sync.Mutex      // Guards Protocol, CommandSeq and LastReqTime, which admin commands read from other connections.
+}
+
+// countCommand records the arrival of a new command.
+func (ctx *ConnectionContext) countCommand() {
+	ctx.mu.Lock()
+	ctx.CommandSeq++
+	ctx.LastReqTime = time.Now()
+	ctx.mu.Unlock()
+}
+
+// activity returns the protocol, the number of commands handled and the arrival time of the last one.
+func (ctx *ConnectionContext) activity() (Protocol, uint64, time.Time) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.Protocol, ctx.CommandSeq, ctx.LastReqTime
 }
 
 /*
@@ -67,8 +95,9 @@ type ConnectionContext struct {
 0x0005	Item not stored
 0x0006	Incr/Decr on non-numeric value.
 0x0007	The vbucket belongs to another server
-0x0008	Authentication error
-0x0009	Authentication continue
+0x0020	Authentication error
+0x0021	Authentication continue
+0x0024	Access denied
 0x0081	Unknown command
 0x0082	Out of memory
 0x0083	Not supported
@@ -77,9 +106,20 @@ type ConnectionContext struct {
 0x0086	Temporary failure
 */
 const (
-	CodeNoError     = 0x0000
-	CodeKeyNotFound = 0x0001
-	CodeKeyExists   = 0X0002
+	CodeNoError          = 0x0000
+	CodeKeyNotFound      = 0x0001
+	CodeKeyExists        = 0X0002
+	CodeValueTooLarge    = 0x0003
+	CodeInvalidArguments = 0x0004
+	CodeNotStored        = 0x0005
+	CodeNonNumeric       = 0x0006
+	CodeAuthError        = 0x0020
+	CodeAuthContinue     = 0x0021
+	CodeAccessDenied     = 0x0024
+	CodeOutOfMemory      = 0x0082
+	CodeNotSupported     = 0x0083
+	CodeInternalError    = 0x0084
+	CodeTemporaryFailure = 0x0086
 )
 
 /*
@@ -114,6 +154,7 @@ const (
 0x1c	Touch *
 0x1d	GAT *
 0x1e	GATQ *
+0x1f	Swap (extension: set returning the old item)
 0x20	SASL list mechs
 0x21	SASL Auth
 0x22	SASL Step
@@ -141,21 +182,46 @@ const (
 0x45	TAP VBucket Set *
 0x46	TAP Checkpoint Start *
 0x47	TAP Checkpoint End *
+0x94	Get locked (Couchbase)
+0x95	Unlock key (Couchbase)
 */
 const (
-	OpGet      = 0x00
-	OpSet      = 0x01
-	OpAdd      = 0x02
-	OpReplace  = 0x03
-	OpQuit     = 0x07
-	OpGetQ     = 0x09
-	OpNoOp     = 0x0a
-	OpVersion  = 0x0b
-	OpGetK     = 0x0c
-	OpGetKQ    = 0x0d
-	OpSetQ     = 0x11
-	OpAddQ     = 0x12
-	OpReplaceQ = 0x13
+	OpGet           = 0x00
+	OpSet           = 0x01
+	OpAdd           = 0x02
+	OpReplace       = 0x03
+	OpDelete        = 0x04
+	OpIncrement     = 0x05
+	OpDecrement     = 0x06
+	OpQuit          = 0x07
+	OpFlush         = 0x08
+	OpGetQ          = 0x09
+	OpNoOp          = 0x0a
+	OpVersion       = 0x0b
+	OpGetK          = 0x0c
+	OpGetKQ         = 0x0d
+	OpAppend        = 0x0e
+	OpPrepend       = 0x0f
+	OpStat          = 0x10
+	OpSetQ          = 0x11
+	OpAddQ          = 0x12
+	OpReplaceQ      = 0x13
+	OpDeleteQ       = 0x14
+	OpIncrementQ    = 0x15
+	OpDecrementQ    = 0x16
+	OpAppendQ       = 0x19
+	OpPrependQ      = 0x1a
+	OpFlushQ        = 0x18
+	OpVerbosity     = 0x1b
+	OpTouch         = 0x1c
+	OpGAT           = 0x1d
+	OpGATQ          = 0x1e
+	OpSwap          = 0x1f
+	OpSASLListMechs = 0x20
+	OpSASLAuth      = 0x21
+	OpSASLStep      = 0x22
+	OpGetLocked     = 0x94
+	OpUnlockKey     = 0x95
 )
 
 /*
@@ -168,11 +234,11 @@ const (
 	MagicResponse = 0x81
 )
 
-// MaxReqLen is the max body length of a request.
-const MaxReqLen = 1024 * 1024 * 1024 // 1MB max request size
+// Version is the version reported to clients. We fake a valid memcached version.
+const Version = "1.4.24"
 
-var connSeq uint64
-var casID uint64
+// logOutput receives the lines of the default logger. Stdio mode moves it to stderr as stdout carries the protocol.
+var logOutput io.Writer = os.Stdout
 
 /*
    Byte/     0       |       1       |       2       |       3       |
@@ -198,15 +264,11 @@ func parseRequestHeader(bufHeader []byte) (RequestHeader, error) {
 
 	ret.Magic = uint8(buf[0])
 	if ret.Magic != MagicRequest {
-		return RequestHeader{}, fmt.Errorf("Magic byte is not 0x80: %x", ret.Magic)
+		return RequestHeader{}, protocolErrorf(protoBadMagic, "Magic byte is not 0x80: %x", ret.Magic)
 	}
 	buf = buf[1:]
 
 	ret.Opcode = uint8(buf[0])
-	_, ok := OpHandler[ret.Opcode]
-	if !ok {
-		return RequestHeader{}, fmt.Errorf("Opcode byte is not recognized: %x", ret.Opcode)
-	}
 	buf = buf[1:]
 
 	ret.KeyLength = GetUint16(buf)
@@ -217,7 +279,7 @@ func parseRequestHeader(bufHeader []byte) (RequestHeader, error) {
 
 	ret.DataType = uint8(buf[0])
 	if ret.DataType != 0x00 {
-		return RequestHeader{}, fmt.Errorf("DataType byte is supposed to be 0x00: %x", ret.DataType)
+		return RequestHeader{}, protocolErrorf(protoBadHeader, "DataType byte is supposed to be 0x00: %x", ret.DataType)
 	}
 	buf = buf[1:]
 
@@ -226,7 +288,7 @@ func parseRequestHeader(bufHeader []byte) (RequestHeader, error) {
 
 	ret.TotalBodyLength = GetUint32(buf)
 	if uint64(ret.TotalBodyLength) < uint64(ret.KeyLength)+uint64(ret.ExtraLength) {
-		return RequestHeader{}, fmt.Errorf("TotaoBodyLength is supposed to be no less than KeyLength + ExtraLength: total: %d key: %d extra %d", ret.TotalBodyLength, ret.KeyLength, ret.ExtraLength)
+		return RequestHeader{}, protocolErrorf(protoBadHeader, "TotaoBodyLength is supposed to be no less than KeyLength + ExtraLength: total: %d key: %d extra %d", ret.TotalBodyLength, ret.KeyLength, ret.ExtraLength)
 	}
 	buf = buf[4:]
 
@@ -257,152 +319,667 @@ func parseRequestHeader(bufHeader []byte) (RequestHeader, error) {
      Total 24 bytes
 */
 func writeResponseHeader(header ResponseHeader, rw *bufio.ReadWriter) error {
-	err := rw.WriteByte(header.Magic)
-	if err != nil {
-		return err
+	// Serialize into the free space of the write buffer and write it in one go, which doesn't allocate.
+	if rw.Available() < 24 {
+		if err := rw.Flush(); err != nil {
+			return err
+		}
 	}
+	_, err := rw.Write(appendResponseHeader(rw.AvailableBuffer(), header))
+	return err
+}
 
-	err = rw.WriteByte(header.Opcode)
-	if err != nil {
-		return err
-	}
+// appendResponseHeader appends the 24 bytes of header to buf.
+func appendResponseHeader(buf []byte, header ResponseHeader) []byte {
+	buf = append(buf, header.Magic, header.Opcode)
+	buf = binary.BigEndian.AppendUint16(buf, header.KeyLength)
+	buf = append(buf, header.ExtraLength, header.DataType)
+	buf = binary.BigEndian.AppendUint16(buf, header.Status)
+	buf = binary.BigEndian.AppendUint32(buf, header.TotalBodyLength)
+	buf = binary.BigEndian.AppendUint32(buf, header.Opaque)
+	return binary.BigEndian.AppendUint64(buf, header.CAS)
+}
 
-	err = rw.WriteByte(GetNthByteFromUint16(header.KeyLength, 0))
-	if err != nil {
+func handleCommand(context *ConnectionContext) error {
+	// Make a buffer to hold incoming data.
+	bufHeader := context.ReadBuf[:24]
+	if _, err := io.ReadFull(context.RW, bufHeader); err != nil {
 		return err
 	}
-	err = rw.WriteByte(GetNthByteFromUint16(header.KeyLength, 1))
+	context.countCommand()
+	// fmt.Printf("Request header: %v\n", bufHeader)
+	reqHeader, err := parseRequestHeader(bufHeader)
+	handler, ok := context.server.handlers[reqHeader.Opcode]
+	if err == nil && !ok {
+		err = protocolErrorf(protoUnknownOpcode, "Opcode byte is not recognized: %x", reqHeader.Opcode)
+	}
 	if err != nil {
+		context.logger().Warn("error parsing header", "err", err, "header", fmt.Sprintf("% x", bufHeader))
+		fmt.Fprintf(context.RW, "Error %s\n", err)
 		return err
 	}
 
-	err = rw.WriteByte(header.ExtraLength)
-	if err != nil {
-		return err
+	context.trace.startCommand(opcodeName(reqHeader.Opcode), true, int(reqHeader.KeyLength), len(bufHeader)+int(reqHeader.TotalBodyLength))
+	context.logCommand(reqHeader)
+	start := time.Now()
+	reason := context.beforeCommand(CommandInfo{Name: opcodeName(reqHeader.Opcode), Header: reqHeader})
+	if reason == nil && context.User == "" && !authFreeOps[reqHeader.Opcode] && context.authRequired() {
+		reason = ErrAuth
+	}
+	if reason == nil {
+		reason = context.checkACL(opcodeName(reqHeader.Opcode))
 	}
+	if reason == nil {
+		reason = context.rateLimit()
+	}
+	if reason == errRateLimitClose || reason == errDraining {
+		return reason
+	}
+	if reason != nil {
+		err = rejectCommand(reqHeader, reason, context)
+	} else {
+		err = handler.Handle(reqHeader, context)
+	}
+	context.releaseBuffers()
+	took := time.Since(start)
+	context.server.latency.command.observe(took)
+	context.server.latency.binary[reqHeader.Opcode].record(took)
+	logSlowCommand(context, opcodeName(reqHeader.Opcode), took)
+	if err == io.EOF && reqHeader.Opcode != OpQuit {
+		// The client went away in the middle of the request. Quit ends the connection with io.EOF on purpose.
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
 
-	err = rw.WriteByte(header.DataType)
+// detectProtocol peeks at the first byte sent by the client and checks the protocol against the ones allowed on the listener.
+// Clients speaking a protocol that is not allowed get an error in their own protocol before the connection is closed.
+func detectProtocol(context *ConnectionContext, allowed Protocol) error {
+	first, err := context.RW.Peek(1)
 	if err != nil {
 		return err
 	}
-
-	err = rw.WriteByte(GetNthByteFromUint16(header.Status, 0))
-	if err != nil {
+	detected := ProtocolASCII
+	if first[0] == MagicRequest {
+		detected = ProtocolBinary
+	}
+	context.mu.Lock()
+	context.Protocol = detected
+	context.mu.Unlock()
+	if allowed == ProtocolAny || allowed == context.Protocol {
+		return nil
+	}
+	if context.Protocol == ProtocolASCII {
+		fmt.Fprintf(context.RW, "SERVER_ERROR %s protocol only on this port\r\n", allowed)
+		return protocolErrorf(protoWrongProtocol, "rejected ascii protocol on %s only listener", allowed)
+	}
+	bufHeader := context.ReadBuf[:24]
+	if _, err := io.ReadFull(context.RW, bufHeader); err != nil {
 		return err
 	}
-	err = rw.WriteByte(GetNthByteFromUint16(header.Status, 1))
-	if err != nil {
+	respHeader := ResponseHeader{}
+	respHeader.Magic = MagicResponse
+	respHeader.Opcode = bufHeader[1]
+	respHeader.Opaque = GetUint32(bufHeader[12:])
+	respHeader.Status = CodeNotSupported
+	respHeader.TotalBodyLength = uint32(len("Not supported"))
+	if err := writeResponseHeader(respHeader, context.RW); err != nil {
 		return err
 	}
+	context.RW.WriteString("Not supported")
+	return protocolErrorf(protoWrongProtocol, "rejected binary protocol on %s only listener", allowed)
+}
+
+// errDraining ends the connections being drained by Shutdown.
+var errDraining = errors.New("server shutting down")
+
+// isTimeout tells whether err is a timeout of a network operation.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// connClosers are what has to be done once a connection closes, run last to first like deferred calls. Unlike those they can
+// be handed over with the connection to the event loop.
+type connClosers []func()
+
+func (c *connClosers) add(fn func()) {
+	*c = append(*c, fn)
+}
+
+// run runs the closers and forgets them.
+func (c *connClosers) run() {
+	for i := len(*c) - 1; i >= 0; i-- {
+		(*c)[i]()
+	}
+	*c = nil
+}
 
-	for pos := 0; pos < 4; pos++ {
-		err = rw.WriteByte(GetNthByteFromUint32(header.TotalBodyLength, pos))
+// encryptedConn is implemented by connections encrypted before handleConn gets them, like QUIC streams.
+type encryptedConn interface {
+	encrypted() bool
+}
+
+// Handles incoming requests on a connection accepted by the listener lc, whose settings apply to it. done is called once the
+// connection closed, unless nil.
+func (s *Server) handleConn(conn net.Conn, lc ListenerConfig, done func()) {
+	var closers connClosers
+	defer func() { closers.run() }()
+	if done != nil {
+		closers.add(done)
+	}
+	raw := conn
+	closers.add(func() { raw.Close() })
+	atomic.AddInt64(&s.counters.currConns, 1)
+	atomic.AddUint64(&s.counters.totalConns, 1)
+	closers.add(func() { atomic.AddInt64(&s.counters.currConns, -1) })
+	if lc.ProxyProtocol {
+		proxied, err := readProxyHeader(conn)
 		if err != nil {
-			return err
+			atomic.AddUint64(&s.counters.proxyErrors, 1)
+			s.logger().Debug("bad PROXY header", "remote", conn.RemoteAddr(), "err", err)
+			return
+		}
+		conn = proxied
+	}
+	if !s.admitIP(conn.RemoteAddr()) {
+		s.logger().Debug("connection refused by IP rules", "remote", conn.RemoteAddr())
+		return
+	}
+	remote := conn.RemoteAddr()
+	if _, banned := s.authFails.wait(remoteIP(remote)); banned {
+		atomic.AddUint64(&s.counters.authBannedConns, 1)
+		s.logger().Debug("connection refused for failed authentications", "remote", remote)
+		return
+	}
+	if !s.ipOpen.acquire(remote, s.maxConnsPerIP()) {
+		atomic.AddUint64(&s.counters.ipConnsRejected, 1)
+		conn.Write([]byte("ERROR Too many open connections\r\n"))
+		s.logger().Debug("connection refused by max_conns_per_ip", "remote", remote)
+		return
+	}
+	closers.add(func() { s.ipOpen.release(remote) })
+	var user string
+	ec, encrypted := raw.(encryptedConn)
+	encrypted = encrypted && ec.encrypted() || lc.TLS
+	if lc.TLS {
+		tc := tls.Server(conn, s.tlsConfig(lc))
+		conn = tc
+		var err error
+		if user, err = s.tlsHandshake(tc); err != nil {
+			atomic.AddUint64(&s.counters.sslHandshakeErrors, 1)
+			s.logger().Debug("TLS handshake failed", "remote", conn.RemoteAddr(), "err", err)
+			return
+		}
+	}
+	store := s.cache
+	if user != "" && s.config.IsolateUsers {
+		store = newUserStore(s.cache, user, s.config.NamespaceSeparator)
+	}
+	id := s.conns.nextID()
+	client := s.clients.connect(remoteIP(conn.RemoteAddr()))
+	rate := &connRateLimits{}
+	// Connections of the event loop get their buffers while they have commands to serve.
+	evented := s.events != nil && s.events.takes(raw, lc)
+	input := conn
+	conn, trace := traceConn(countingConn{conn, &s.counters, client, &rate.traffic}, id, s.access, s.config.Hooks.hooked())
+	var rw *bufio.ReadWriter
+	var readBuf []byte
+	if !evented {
+		rw = bufio.NewReadWriter(bufio.NewReaderSize(conn, s.config.ReadBufferSize), bufio.NewWriter(conn))
+		buf := getBuffer(rw.Reader.Size())
+		closers.add(func() { putBuffer(buf) })
+		readBuf = *buf
+	}
+	context := &ConnectionContext{
+		ConnID:      id,
+		ConnHandle:  conn,
+		StartTime:   time.Now(),
+		LastReqTime: time.Now(),
+		CommandSeq:  0,
+		RW:          rw,
+		ReadBuf:     readBuf,
+		Store:       store,
+		User:        user,
+		encrypted:   encrypted,
+		server:      s,
+		listener:    lc,
+		trace:       trace,
+		client:      client,
+		rate:        rate,
+	}
+	context.authenticated()
+	closers.add(func() { trace.end(context) })
+	if rw != nil {
+		closers.add(func() { rw.Flush() })
+	}
+	s.conns.register(context)
+	closers.add(func() { s.conns.unregister(context) })
+	if hook := s.config.Hooks.OnConnect; hook != nil {
+		if err := hook(context.connInfo()); err != nil {
+			context.logger().Debug("connection rejected by hook", "err", err)
+			return
 		}
 	}
+	if hook := s.config.Hooks.OnDisconnect; hook != nil {
+		info := context.connInfo()
+		closers.add(func() { hook(info) })
+	}
+	context.logConn("new connection", "listener", lc.Addr)
+	if evented {
+		s.events.add(context, raw, closers, pendingInput(input))
+		closers = nil
+		return
+	}
+	idle := context.armTimeout(false)
+	err := detectProtocol(context, lc.Protocol)
+	for err == nil {
+		err = context.serveCommand(&idle)
+	}
+	context.logClose(err, idle)
+}
 
-	for pos := 0; pos < 4; pos++ {
-		err = rw.WriteByte(GetNthByteFromUint32(header.Opaque, pos))
-		if err != nil {
-			return err
+// serveCommand handles the next command of the connection, arming its idle timeout first, which idle tells is armed.
+func (ctx *ConnectionContext) serveCommand(idle *bool) error {
+	// Arm the timeout before checking for a shutdown, which sets a deadline of its own.
+	*idle = ctx.armTimeout(*idle)
+	// New connections get their first command served, as their client couldn't know that the server was shutting down.
+	if atomic.LoadInt32(&ctx.server.draining) == 1 && ctx.CommandSeq > 0 {
+		return errDraining
+	}
+	var err error
+	if ctx.Protocol == ProtocolASCII {
+		err = handleTextCommand(ctx)
+	} else {
+		err = handleCommand(ctx)
+	}
+	if err == nil {
+		// force sending down a response
+		ctx.RW.Flush()
+		atomic.AddUint64(&ctx.client.commands, 1)
+		if ctx.userCounts != nil {
+			atomic.AddUint64(&ctx.userCounts.commands, 1)
 		}
 	}
+	ctx.afterCommand(ctx.trace.endCommand(err), err)
+	return err
+}
+
+// logClose logs why the connection is closing, err being the error that ended it and idle whether its idle timeout was armed.
+func (ctx *ConnectionContext) logClose(err error, idle bool) {
+	switch {
+	case err == io.EOF:
+		ctx.logConn("client closed connection", "connected", ctx.StartTime, "commands", ctx.CommandSeq)
+	case atomic.LoadInt32(&ctx.server.draining) == 1 && (err == errDraining || isTimeout(err)):
+		ctx.logConn("closed connection for shutdown", "connected", ctx.StartTime, "commands", ctx.CommandSeq)
+	case idle && isTimeout(err):
+		atomic.AddUint64(&ctx.server.counters.idleKicks, 1)
+		ctx.logConn("closed idle connection", "connected", ctx.StartTime, "commands", ctx.CommandSeq)
+	case err == errRateLimitClose:
+		ctx.logger().Warn("closed connection exceeding the rate limit", "commands", ctx.CommandSeq)
+	default:
+		countConnError(ctx, err)
+		ctx.logger().Warn("error reading", "err", err)
+	}
+}
+
+// idleTimeout returns the IdleTimeout of the connection: the one of its listener if set, or else the one of the settings.
+func (ctx *ConnectionContext) idleTimeout() time.Duration {
+	if timeout := ctx.listener.IdleTimeout; timeout != 0 {
+		return timeout
+	}
+	return ctx.server.idleTimeout()
+}
+
+// armTimeout arms the idle timeout of the connection with armIdleTimeout. Once a shutdown began, a connection that didn't send
+// a command yet gets drainGrace to send one instead, like those Shutdown found waiting for their first command.
+func (ctx *ConnectionContext) armTimeout(armed bool) bool {
+	if atomic.LoadInt32(&ctx.server.draining) == 1 && ctx.CommandSeq == 0 {
+		ctx.ConnHandle.SetReadDeadline(time.Now().Add(drainGrace))
+		return true
+	}
+	return armIdleTimeout(ctx.ConnHandle, ctx.idleTimeout(), armed)
+}
+
+// armIdleTimeout sets a read deadline closing conn once it idles for timeout, or clears the deadline if it was armed and
+// the timeout was turned off since. It returns whether the deadline is armed.
+func armIdleTimeout(conn net.Conn, timeout time.Duration, armed bool) bool {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		return true
+	}
+	if armed {
+		conn.SetReadDeadline(time.Time{})
+	}
+	return false
+}
 
-	l := uint32(header.CAS >> 32)
-	r := uint32(header.CAS & 0x00000000ffffffff)
-	for pos := 0; pos < 4; pos++ {
-		err = rw.WriteByte(GetNthByteFromUint32(l, pos))
+// listen opens the listener described by lc. A Unix domain socket left behind by a server that didn't shut down is replaced.
+func listen(lc ListenerConfig) (net.Listener, error) {
+	network, addr := lc.network()
+	if network == "unix" {
+		if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial(network, addr); err == nil {
+				conn.Close()
+			} else {
+				os.Remove(addr)
+			}
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+// acceptLoop accepts connections on l, opened for lc, until Shutdown closes it.
+func (s *Server) acceptLoop(l net.Listener, lc ListenerConfig) error {
+	defer s.loops.Done()
+	var open int64 // Connections of this listener, limited by lc.MaxConns. Updated atomically.
+	for {
+		// Listen for an incoming connection.
+		conn, err := l.Accept()
 		if err != nil {
+			select {
+			case <-s.closing:
+				return nil
+			default:
+				return fmt.Errorf("accepting on %s: %v", l.Addr(), err)
+			}
+		}
+		if max := s.config.MaxConns; max > 0 && atomic.LoadInt64(&s.open) >= int64(max) ||
+			lc.MaxConns > 0 && atomic.LoadInt64(&open) >= int64(lc.MaxConns) {
+			atomic.AddUint64(&s.counters.rejectedConns, 1)
+			conn.Write([]byte("ERROR Too many open connections\r\n"))
+			conn.Close()
+			continue
+		}
+		atomic.AddInt64(&s.open, 1)
+		atomic.AddInt64(&open, 1)
+		s.active.Add(1)
+		done := func() {
+			atomic.AddInt64(&open, -1)
+			atomic.AddInt64(&s.open, -1)
+			s.active.Done()
+		}
+		if s.pool == nil {
+			// Handle connections in a new goroutine.
+			go s.handleConn(conn, lc, done)
+		} else if !s.pool.submit(connJob{conn, lc, done}, s.config.ConnOverload == ConnOverloadWait, s.closing) {
+			atomic.AddUint64(&s.counters.busyConns, 1)
+			conn.Write([]byte("ERROR Too many open connections\r\n"))
+			conn.Close()
+			done()
+		}
+	}
+}
+
+// Start serves Settings like NewServer(WithConfig(Settings)).Start().
+//
+// Deprecated: Use NewServer.
+func Start() {
+	NewServer(WithConfig(Settings)).Start()
+}
+
+// Start serves until the process receives SIGINT or SIGTERM, then shuts the server down gracefully, waiting up to DrainTimeout for
+// the connections. SIGUSR2 upgrades the process, see Upgrade. It exits the process if serving fails.
+func (s *Server) Start() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go s.upgradeOnSignal()
+	if err := s.Serve(ctx); err != nil {
+		s.logger().Error("error serving", "err", err)
+		os.Exit(1)
+	}
+}
+
+// drainContext returns the context bounding a shutdown by DrainTimeout.
+func (s *Server) drainContext() (context.Context, context.CancelFunc) {
+	if s.config.DrainTimeout > 0 {
+		return context.WithTimeout(context.Background(), s.config.DrainTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// setup opens the store of s and the logs its settings ask for, before serving or the first call of the embedded API.
+func (s *Server) setup() error {
+	if s.config.Clock != nil {
+		setClock(s.config.Clock)
+	}
+	store, err := s.initStore()
+	if err != nil {
+		return err
+	}
+	if store, err = s.startPersistence(store); err != nil {
+		return err
+	}
+	if err := s.importDumpFile(store); err != nil {
+		return err
+	}
+	s.cache = s.wrapStore(store)
+	if s.config.OTLPEndpoint != "" {
+		if err := startTracing(s.config.OTLPEndpoint, s.logger()); err != nil {
 			return err
 		}
 	}
-	for pos := 0; pos < 4; pos++ {
-		err = rw.WriteByte(GetNthByteFromUint32(r, pos))
-		if err != nil {
+	if s.config.AccessLogPath != "" {
+		if err := s.startAccessLog(); err != nil {
+			return err
+		}
+	}
+	if s.config.AuditLogPath != "" || s.config.AuditSink != nil {
+		if err := s.startAudit(); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func handleCommand(context *ConnectionContext) error {
-	// Make a buffer to hold incoming data.
-	bufHeader := context.ReadBuf[:24]
-	readLen := 0
-	for readLen < len(bufHeader) {
-		reqLen, err := context.RW.Read(bufHeader[readLen:])
+// openStore runs setup once, returning its error to every caller.
+func (s *Server) openStore() error {
+	s.setupOnce.Do(func() { s.setupErr = s.setup() })
+	return s.setupErr
+}
+
+// Serve starts the memcache server listening on TCP with Binary and ASCII protocol support. It returns once the server
+// was shut down by Shutdown or by cancelling ctx, which drains the connections like Shutdown for up to DrainTimeout.
+// Serve returns an error if the store or a listener fails, after shutting down the others.
+func (s *Server) Serve(ctx context.Context) error {
+	if s.config.TLSCertFile != "" {
+		certs, err := newCertReloader(s.config.TLSCertFile, s.config.TLSKeyFile, s.config.TLSClientCAFile)
 		if err != nil {
 			return err
 		}
-		readLen += reqLen
+		s.certs = certs
 	}
-	context.CommandSeq++
-	context.LastReqTime = time.Now()
-	// fmt.Printf("Request header: %v\n", bufHeader)
-	reqHeader, err := parseRequestHeader(bufHeader)
-	if err != nil {
-		fmt.Printf("Error parsing header: %s | % 20x\n", err, bufHeader)
-		fmt.Fprintf(context.RW, "Error %s\n", err)
+	if s.config.SASLUsersFile != "" {
+		if err := s.loadUsers(); err != nil {
+			return err
+		}
+	}
+	if s.config.PidFile != "" {
+		if err := writePidFile(s.config.PidFile); err != nil {
+			return err
+		}
+		defer removePidFile(s.config.PidFile, s.logger())
+	}
+	if err := s.openStore(); err != nil {
+		s.Shutdown(context.Background())
 		return err
 	}
+	if s.config.EventLoop {
+		events, err := newEventLoop(s)
+		if err != nil {
+			return fmt.Errorf("starting the event loop: %v", err)
+		}
+		s.events = events
+	}
+	if s.config.ConnWorkers > 0 {
+		s.pool = newConnPool(s)
+	}
+	// Listen for incoming connections. The accept loops and the services started below report their failure on errs.
+	errs := make(chan error, len(s.config.Listeners)+3)
+	for _, lc := range s.config.Listeners {
+		lc := lc
+		l, err := s.openListener(lc.Addr, func() (net.Listener, error) { return listen(lc) })
+		if err != nil {
+			s.Shutdown(context.Background())
+			return fmt.Errorf("listening on %s: %v", lc.Addr, err)
+		}
+		s.mutex.Lock()
+		select {
+		case <-s.closing:
+			s.mutex.Unlock()
+			l.Close()
+			return nil
+		default:
+		}
+		s.listeners = append(s.listeners, l)
+		s.loops.Add(1)
+		s.mutex.Unlock()
+		s.logger().Info("listening", "addr", l.Addr(), "protocol", lc.Protocol, "tls", lc.TLS)
+		go func(l net.Listener, lc ListenerConfig) {
+			errs <- s.acceptLoop(l, lc)
+		}(l, lc)
+	}
+	close(s.ready)
+	upgraded()
+	if s.config.WebSocketAddr != "" {
+		go func() { errs <- s.startWebSocket(s.config.WebSocketAddr) }()
+	}
+	if s.config.QUICAddr != "" {
+		go func() { errs <- s.startQUIC(s.config.QUICAddr) }()
+	}
+	if s.config.AdminAddr != "" {
+		go func() { errs <- s.startAdmin(s.config.AdminAddr) }()
+	}
+	if s.config.StatsLogInterval > 0 {
+		go s.logStats(s.config.StatsLogInterval)
+	}
+	if s.config.ConfigFile != "" {
+		if loaded, err := loadConfigSources(s.config.ConfigFile); err == nil {
+			s.mutex.Lock()
+			s.loaded = &loaded
+			s.mutex.Unlock()
+		}
+	}
+	if s.config.ConfigFile != "" || s.certs != nil || s.config.SASLUsersFile != "" {
+		go s.reloadOnHangup()
+	}
+	if s.certs != nil && s.config.TLSReloadInterval > 0 {
+		go s.watchCertificates()
+	}
+	if s.config.AccessLogPath != "" || s.config.AuditLogPath != "" {
+		go s.rotateLogsOnSignal()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			s.logger().Info("shutting down", "drain_timeout", s.config.DrainTimeout)
+			shutdownCtx, cancel := s.drainContext()
+			defer cancel()
+			return s.Shutdown(shutdownCtx)
+		case <-s.upgraded:
+			shutdownCtx, cancel := s.drainContext()
+			defer cancel()
+			return s.Shutdown(shutdownCtx)
+		case <-s.closing:
+			return nil
+		case err := <-errs:
+			if err != nil {
+				s.Shutdown(context.Background())
+				return err
+			}
+		}
+	}
+}
 
-	err = OpHandler[reqHeader.Opcode].Handle(reqHeader, context)
-	return err
+// service is a listener Serve opens besides the TCP ones, for Shutdown to close.
+type service struct {
+	io.Closer
+	last bool // Close once the connections are done, as closing ends them, like those of QUIC.
 }
 
-// Handles incoming requests.
-func handleRequest(conn net.Conn) {
-	defer conn.Close()
-	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-	context := &ConnectionContext{
-		ConnID:      atomic.AddUint64(&connSeq, 1),
-		ConnHandle:  conn,
-		StartTime:   time.Now(),
-		LastReqTime: time.Now(),
-		CommandSeq:  0,
-		RW:          rw,
-		ReadBuf:     make([]byte, 4096), // 4KB initial read buffer
+// track registers l, opened by Serve besides the TCP listeners, for Shutdown to close: right away like the TCP listeners, or
+// once done waiting for the connections if last is set. It returns false, closing l, if the shutdown began already.
+func (s *Server) track(l io.Closer, last bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopping() {
+		l.Close()
+		return false
 	}
-	defer rw.Flush()
-	for {
-		err := handleCommand(context)
-		switch err {
-		case nil:
-			break
-		case io.EOF:
-			fmt.Printf("Client %s closed connection %d: connected at %s, handled %d commands.\n",
-				context.ConnHandle.RemoteAddr().String(), context.ConnID, context.StartTime.String(), context.CommandSeq)
-			return
-		default:
-			fmt.Println("Error reading:", err.Error())
-			return
+	s.services = append(s.services, service{l, last})
+	return true
+}
+
+// stopping reports whether Shutdown began.
+func (s *Server) stopping() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeServices closes the listeners registered by track that are closed last, or else the others.
+func (s *Server) closeServices(last bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, l := range s.services {
+		if l.last == last {
+			l.Close()
 		}
-		// force sending down a response
-		rw.Flush()
 	}
 }
 
-// Start starts the memcache server listening on TCP with Binary protocol support
-func Start() {
-	//	defer profile.Start().Stop() // uncomment to enable profiler
-	// Listen for incoming connections.
-	l, err := net.Listen(ConnType, ConnHost+":"+ConnPort)
-	if err != nil {
-		fmt.Println("Error listening:", err.Error())
-		os.Exit(1)
+// drainGrace is how long a shutdown waits for the first command of connections accepted just before.
+const drainGrace = time.Second
+
+// Shutdown closes the listeners and waits for the connections to finish the command they are handling and close.
+// Idle connections close right away. Once ctx is done, the remaining connections are closed and ctx.Err() is returned.
+// The WebSocket and admin listeners close along with the TCP ones, the QUIC listener once the connections are done. The memory
+// file of the store is saved last.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.closeOnce.Do(func() { close(s.closing) })
+	for _, l := range s.listeners {
+		l.Close()
 	}
-	// Close the listener when the application closes.
-	defer l.Close()
-	fmt.Println("Listening on " + ConnHost + ":" + ConnPort)
-	for {
-		// Listen for an incoming connection.
-		conn, err := l.Accept()
-		if err != nil {
-			fmt.Println("Error accepting: ", err.Error())
-			os.Exit(1)
+	s.mutex.Unlock()
+	s.closeServices(false)
+	s.loops.Wait()
+	if s.pool != nil {
+		s.pool.stop()
+	}
+	atomic.StoreInt32(&s.draining, 1)
+	for _, c := range s.conns.live() {
+		// Wakes up connections waiting for their next command. New connections get drainGrace to send their first one.
+		deadline := time.Now()
+		if _, commands, _ := c.activity(); commands == 0 {
+			deadline = deadline.Add(drainGrace)
+		}
+		c.ConnHandle.SetReadDeadline(deadline)
+	}
+	if s.events != nil {
+		s.events.drain()
+	}
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		for _, c := range s.conns.live() {
+			c.ConnHandle.Close()
 		}
-		// Handle connections in a new goroutine.
-		go handleRequest(conn)
+		err = ctx.Err()
+	}
+	s.closeServices(true)
+	if s.events != nil {
+		s.events.stop()
 	}
+	s.saveOnce.Do(s.saveMemoryFile)
+	return err
 }
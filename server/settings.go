@@ -0,0 +1,337 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Protocol selects the wire protocols accepted by a listener.
+type Protocol int
+
+/*
+Protocols a listener can be restricted to. ProtocolAny detects the protocol from the first byte of every connection.
+*/
+const (
+	ProtocolAny Protocol = iota
+	ProtocolBinary
+	ProtocolASCII
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolBinary:
+		return "binary"
+	case ProtocolASCII:
+		return "ascii"
+	default:
+		return "any"
+	}
+}
+
+// ListenerConfig describes one TCP or Unix domain socket listener. Its settings override the ones of Config for the connections
+// accepted by the listener, e.g. to lock down a public listener while an internal one stays permissive.
+type ListenerConfig struct {
+	Addr          string // host:port, or unix: followed by the path of a Unix domain socket.
+	Protocol      Protocol
+	MaxConns      int           // Connections served at once on this listener, within Config.MaxConns. 0 means no limit of its own.
+	IdleTimeout   time.Duration // Replaces Config.IdleTimeout on this listener. 0 keeps Config.IdleTimeout, negative keeps connections open.
+	Auth          string        // AuthRequired or AuthOptional replaces Config.RequireAuth on this listener. Empty keeps it.
+	TLS           bool          // Encrypt connections with Config.TLSCertFile.
+	Deny          CommandACL    // Commands refused on this listener, e.g. @write on a read-only port, on top of Config.UserDeny.
+	ProxyProtocol bool          // Connections start with a PROXY protocol header, version 1 or 2, telling the address of the client behind a load balancer. Connections without are closed.
+	ClientCert    string        // ClientCertRequired or ClientCertOptional verifies client certificates of a TLS listener against Config.TLSClientCAFile; the user a certificate names authenticates its client. Empty asks for none.
+}
+
+// unixPrefix starts the addresses of listeners on Unix domain sockets.
+const unixPrefix = "unix:"
+
+// network returns the network and address to listen on for lc.
+func (lc ListenerConfig) network() (network, addr string) {
+	if strings.HasPrefix(lc.Addr, unixPrefix) {
+		return "unix", strings.TrimPrefix(lc.Addr, unixPrefix)
+	}
+	return "tcp", lc.Addr
+}
+
+func (lc ListenerConfig) String() string {
+	s := lc.Addr
+	if lc.Protocol != ProtocolAny {
+		s += "/" + lc.Protocol.String()
+	}
+	if lc.MaxConns != 0 {
+		s += ",max_conns=" + strconv.Itoa(lc.MaxConns)
+	}
+	if lc.IdleTimeout != 0 {
+		s += ",idle_timeout=" + lc.IdleTimeout.String()
+	}
+	if lc.Auth != "" {
+		s += ",auth=" + lc.Auth
+	}
+	if lc.TLS {
+		s += ",tls=true"
+	}
+	if lc.ClientCert != "" {
+		s += ",client_cert=" + lc.ClientCert
+	}
+	if lc.ProxyProtocol {
+		s += ",proxy_protocol=true"
+	}
+	if len(lc.Deny) > 0 {
+		s += ",deny=" + lc.Deny.String()
+	}
+	return s
+}
+
+// ParseListener parses a listener in the form host:port[/binary|/ascii] or unix:path[/binary|/ascii], optionally followed by
+// settings of the listener separated by commas: max_conns=<n>, idle_timeout=<duration>, auth=required|optional, tls=true|false
+// client_cert=required|optional, proxy_protocol=true|false and deny=<commands> (see ParseCommandACL), e.g. 0.0.0.0:11211/binary,max_conns=500,idle_timeout=30s,auth=required.
+func ParseListener(s string) (ListenerConfig, error) {
+	var options []string
+	if i := strings.Index(s, ","); i >= 0 {
+		s, options = s[:i], strings.Split(s[i+1:], ",")
+	}
+	lc := ListenerConfig{Addr: s}
+	if i := strings.LastIndex(s, "/"); i >= 0 {
+		lc.Addr = s[:i]
+		switch s[i+1:] {
+		case "binary":
+			lc.Protocol = ProtocolBinary
+		case "ascii":
+			lc.Protocol = ProtocolASCII
+		case "any":
+			lc.Protocol = ProtocolAny
+		default:
+			if strings.HasPrefix(s, unixPrefix) {
+				// The slash belongs to the socket path.
+				lc.Addr = s
+				break
+			}
+			return ListenerConfig{}, fmt.Errorf("unknown protocol %q in listener %q", s[i+1:], s)
+		}
+	}
+	if lc.Addr == "" || lc.Addr == unixPrefix {
+		return ListenerConfig{}, fmt.Errorf("missing address in listener %q", s)
+	}
+	for _, option := range options {
+		name, value, _ := strings.Cut(option, "=")
+		var err error
+		switch name {
+		case "max_conns":
+			lc.MaxConns, err = strconv.Atoi(value)
+			if err == nil && lc.MaxConns < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "idle_timeout":
+			lc.IdleTimeout, err = time.ParseDuration(value)
+		case "auth":
+			lc.Auth = value
+			if value != AuthRequired && value != AuthOptional {
+				err = fmt.Errorf("expected %s or %s", AuthRequired, AuthOptional)
+			}
+		case "tls":
+			lc.TLS, err = strconv.ParseBool(value)
+		case "proxy_protocol":
+			lc.ProxyProtocol, err = strconv.ParseBool(value)
+		case "deny":
+			lc.Deny, err = ParseCommandACL(value)
+		case "client_cert":
+			lc.ClientCert = value
+			if value != ClientCertRequired && value != ClientCertOptional {
+				err = fmt.Errorf("expected %s or %s", ClientCertRequired, ClientCertOptional)
+			}
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			return ListenerConfig{}, fmt.Errorf("%s in listener %q: %v", name, s, err)
+		}
+	}
+	return lc, nil
+}
+
+// Config holds the tunable settings of the server.
+type Config struct {
+	Listeners            []ListenerConfig          // TCP and Unix domain socket listeners serving the binary and/or ASCII protocol.
+	MaxConns             int                       // Connections served at once. Further clients are told so and disconnected. 0 means no limit.
+	MaxConnsPerIP        int                       // Connections served at once per remote IP, told by a PROXY header if any. Further clients are told so and disconnected. 0 means no limit.
+	ConnWorkers          int                       // Serve the connections of the listeners with this many goroutines rather than one each. A connection holds its worker until it closes, unless EventLoop takes it over. 0 starts a goroutine per connection.
+	ConnQueue            int                       // Accepted connections waiting for a free ConnWorkers worker.
+	ConnOverload         string                    // What connections accepted while ConnWorkers are busy and ConnQueue is full get: "reject" tells them so and disconnects them, "wait" stops accepting until the queue has room.
+	ConnOpsPerSec        int                       // Commands a connection may send per second, in bursts of up to a second worth. 0 means no limit.
+	ConnBytesPerSec      int                       // Bytes a connection may read and write per second. 0 means no limit.
+	IPOpsPerSec          int                       // Commands the connections of a remote IP may send per second together. 0 means no limit.
+	IPBytesPerSec        int                       // Bytes the connections of a remote IP may read and write per second together. 0 means no limit.
+	RateLimitAction      string                    // What clients exceeding a rate limit get: "delay" holds their commands, "fail" fails them with a temporary failure, "disconnect" closes the connection.
+	IPAllowlist          IPNets                    // Only clients with an IP in these networks may connect. Empty allows all. Unix domain socket clients have no IP unless told by a PROXY header.
+	IPDenylist           IPNets                    // Clients with an IP in these networks are disconnected right away, even if in IPAllowlist.
+	WebSocketAddr        string                    // Address of the optional WebSocket listener. Empty disables it.
+	WebSocketOrigins     []string                  // Origins of the web pages allowed to open WebSocket connections, like https://app.example.com, or * for any. Empty only allows pages of the host the listener is reached at. Clients sending no Origin, which browsers always send, are allowed.
+	QUICAddr             string                    // Address of the experimental QUIC listener. Requires the quic build tag.
+	StatsLogInterval     time.Duration             // How often a one line summary of the stats is logged. 0 disables it.
+	SlowLogThreshold     time.Duration             // Commands taking at least this long are logged as slow. 0 disables it.
+	AccessLogPath        string                    // File a line per command is appended to, with its connection, key hash, status, latency and size. Empty disables it.
+	AccessLogSample      int                       // Log one in this many commands, bounding the cost of the access log on busy servers.
+	AccessLogKeys        bool                      // Log keys as sent instead of a hash of them. Keys may hold user data.
+	AuditLogPath         string                    // File every mutation is recorded to as a JSON line, with its key, size, client and CAS value. Empty disables it.
+	AuditLogMaxSize      int64                     // Bytes after which the audit log is rotated to AuditLogPath.1, .2, ... 0 never rotates it.
+	AuditLogRetain       int                       // Number of audit log files kept, including the current one.
+	AuditSink            AuditSink                 // Also called with every audit record, to ship them to an external system. nil disables it.
+	OTLPEndpoint         string                    // OTLP/HTTP collector URL, e.g. http://localhost:4318, receiving a span per connection and command. Requires the otel build tag.
+	AdminAddr            string                    // Address of the HTTP listener serving Prometheus metrics on /metrics, expvar on /debug/vars and health probes on /healthz and /readyz. Empty disables it.
+	Pprof                bool                      // Serve net/http/pprof on /debug/pprof of the admin listener. "profile http on|off" toggles it at runtime.
+	TLSCertFile          string                    // PEM certificate used by encrypted listeners.
+	TLSKeyFile           string                    // PEM private key matching TLSCertFile.
+	SASLUsersFile        string                    // Users clients authenticate as with SASL, one user:password-hash per line, see HashPassword; bcrypt and argon2id hashes need the xcrypto build tag. Re-read on SIGHUP. Empty disables SASL.
+	PlainNeedsTLS        bool                      // Neither offer nor accept the SASL mechanism PLAIN, which sends the password in the clear, on connections without TLS. On by default.
+	IsolateUsers         bool                      // Keep the keys of authenticated clients in the namespace named after their user, limited by its quota in NamespaceQuotas and flushed on its own. Requires NamespaceSeparator.
+	UserDeny             map[string]CommandACL     // Commands refused to users, e.g. @write for read-only users. The entry of the empty name applies to clients that didn't authenticate.
+	DisableFlush         bool                      // Refuse flush_all, FLUSH and flush_namespace, like memcached -F. Binary clients get 0x0083 Not supported.
+	DisableDump          bool                      // Refuse the commands listing or copying out items, dump, lru_crawler metadump and backup, like memcached -X. Binary clients get 0x0083 Not supported.
+	RequireAuth          bool                      // Refuse commands of clients that didn't authenticate with SASL, except version, noop and quit. Listeners may override it.
+	AuthBackoff          time.Duration             // After a failed SASL authentication the remote IP can't authenticate for this long, doubled with every further failure up to a minute. 0 disables it.
+	AuthBanThreshold     int                       // Failed SASL authentications in a row after which the remote IP is banned for AuthBanDuration, its connections refused. 0 disables bans.
+	AuthBanDuration      time.Duration             // How long AuthBanThreshold bans an IP.
+	TLSClientCAFile      string                    // PEM certificate authorities verifying the client certificates of listeners with ClientCert set.
+	TLSIdentity          string                    // Field of verified client certificates naming the user of their client: "cn" for the subject common name, or "san" for the first DNS name, e-mail address or URI.
+	TLSReloadInterval    time.Duration             // How often TLSCertFile and TLSKeyFile are checked for changes, which are loaded for new handshakes. 0 only reloads them on SIGHUP or "refresh_certs".
+	MaxMemory            uint64                    // Bytes of item memory before items get evicted. 0 means no limit.
+	MaxItems             int                       // Number of items before items get evicted by the same policy, for caches of tiny values. 0 means no limit.
+	EvictionPolicy       string                    // Which items to evict when MaxMemory is hit: lru, lfu, tinylfu or segmented.
+	LRUHotPercent        int                       // Share of a shard's items the HOT segment of the segmented policy holds, in percent.
+	LRUWarmPercent       int                       // Share of a shard's items the WARM segment of the segmented policy holds, in percent.
+	LFUSamples           int                       // Number of randomly sampled items the lfu policy picks its victim from.
+	Shards               int                       // Number of independently locked store shards, rounded up to a power of two. 0 picks one from GOMAXPROCS.
+	ShardHash            string                    // Hash function picking the shard of a key: fnv, xxhash or crc32-ketama.
+	Slabs                bool                      // Allocate item memory from slab size classes instead of one heap allocation per item.
+	MemoryFile           string                    // Keep slab pages in this memory mapped file, so a restart after a clean shutdown resumes with the cached items. Needs MaxMemory.
+	OffHeap              bool                      // Keep slab pages in anonymous memory outside the Go heap, so GC pauses stay flat however much is cached. Needs MaxMemory, implies Slabs.
+	SlabCompactInterval  time.Duration             // How often sparsely used slab pages are emptied for reuse by other classes. 0 only compacts on "slabs compact".
+	CompressThreshold    int                       // Values of at least this many bytes are stored gzip compressed, transparently to clients. 0 disables compression.
+	ExtstorePath         string                    // File of the disk tier holding values that don't fit in memory. Empty disables it.
+	ExtstoreSize         uint64                    // Size limit of the disk tier files together in bytes. 0 means no limit.
+	ExtstoreItemSize     int                       // Values of at least this many bytes are written to disk right away. 0 only moves items that would be evicted.
+	SnapshotPath         string                    // File the store is snapshotted to. Empty disables snapshots.
+	SnapshotInterval     time.Duration             // How often a snapshot is written. 0 disables periodic snapshots.
+	SnapshotChanges      int                       // Also write a snapshot after this many mutations. 0 disables it.
+	SnapshotRetain       int                       // Number of snapshots kept: the current one at SnapshotPath and older ones at SnapshotPath.1, .2, ...
+	SnapshotLoad         bool                      // Load SnapshotPath at startup, so a restart begins with a warm cache. Implied by AOFPath.
+	AOFPath              string                    // Append-only log of all mutations, replayed at startup after loading the snapshot. Empty disables it.
+	AOFFsync             string                    // When the append-only log is synced to disk: always, everysec or no.
+	PersistKeyFile       string                    // AES key (16, 24 or 32 bytes, raw or hex) encrypting snapshots and the append-only log. Empty uses $MEMCACHED_PERSIST_KEY if set.
+	BackupBucket         string                    // S3 bucket, optionally followed by /prefix, snapshots are backed up to by the backup command.
+	BackupEndpoint       string                    // S3 compatible endpoint URL. Empty uses AWS S3 in BackupRegion.
+	BackupRegion         string                    // Region requests are signed for. Empty means us-east-1.
+	BackupRestore        bool                      // Load the latest backup at startup, to warm up a fresh node.
+	ImportDump           string                    // Dump file in memcached-tool format loaded at startup.
+	SweepInterval        time.Duration             // How often the background sweeper looks for expired items. 0 disables it.
+	SweepBatch           int                       // Items the sweeper examines per shard and run, bounding the time a shard stays locked.
+	BoltPath             string                    // Keep items durably in this bbolt database instead of memory. Requires the bolt build tag.
+	NamespaceSeparator   string                    // Keys up to the first occurrence of this separator name their namespace, e.g. "tenant:" for the key "tenant:user:1". Empty disables namespaces.
+	NamespaceQuotas      map[string]NamespaceQuota // Memory and item limits of individual namespaces. Requires NamespaceSeparator.
+	DrainTimeout         time.Duration             // How long a shutdown waits for connections to finish their command before closing them. 0 waits as long as it takes.
+	IdleTimeout          time.Duration             // Connections not sending a command for this long are closed. 0 keeps them open.
+	ReadBufferSize       int                       // Bytes buffered when reading from a connection, which also bounds the length of a text command line.
+	EventLoop            bool                      // Serve the connections of plain TCP and Unix listeners from an epoll event loop, so idle ones hold neither a goroutine nor buffers. Needs IdleTimeout. Linux only.
+	EventLoopWorkers     int                       // Goroutines serving the connections of EventLoop that have commands. 0 means four per CPU.
+	MaxRequestSize       int                       // Largest request body accepted, like memcached's item size limit. Larger items can be built with append and prepend.
+	HotKeySampleRate     int                       // Sample one in this many key accesses to report the hottest keys in "stats hotkeys". 0 disables hot key detection.
+	TopKeysSampleRate    int                       // Sample one in this many key accesses to report the keys read and written most in "stats topkeys". 0 disables it.
+	TopKeysInterval      time.Duration             // Time covered by "stats topkeys".
+	LeaseTTL             time.Duration             // How long a lease granted by lease-get on a miss stays valid. 0 disables leases.
+	LockTimeout          time.Duration             // How long GETL locks an item unless the request asks for a lock time, which is at most 30s. 0 disables item locking.
+	TTLJitter            int                       // Shorten the expiration of stored items by a random part of up to this percentage, spreading the expiry of keys set together. 0 disables it.
+	KeyValidation        string                    // Which keys are accepted: strict (ASCII protocol rules) or lenient (any bytes). Keys are never longer than MaxKeyLength.
+	WriteBehind          WriteBehind               // Called with batches of mutations to persist them to a backing store for write-behind caching. nil disables it.
+	NamespaceWriteBehind map[string]WriteBehind    // Write-behind hooks of individual namespaces, replacing WriteBehind for their keys. A nil hook excludes a namespace.
+	WriteBehindBatch     int                       // Most mutations passed to a write-behind hook at once.
+	WriteBehindDelay     time.Duration             // How long mutations are collected before a batch is written, unless it fills up earlier.
+	Loader               Loader                    // Called on GET misses to fetch values from a backing store for read-through caching. nil disables it.
+	OnEvict              ItemHook                  // Called with the metadata, but not the value, of items evicted to honor a memory, item or namespace limit.
+	OnExpire             ItemHook                  // Called with the metadata of expired items as they are removed, by the sweeper or when accessed.
+	OnFlush              func(namespace string)    // Called when the store is flushed, or with its name when a namespace is.
+	EventQueueSize       int                       // Events waiting for the hooks above, which run on their own goroutine. Events beyond are dropped.
+	Hooks                Hooks                     // Intercept connections and commands, e.g. for custom auth, metrics or request shaping.
+	Logger               Logger                    // Receives the log lines of the server. nil writes them as text to stdout, or stderr when serving stdio.
+	LogLevel             string                    // Least severe level written by the default logger: debug, info, warn or error.
+	Verbosity            int                       // Client activity logged at info level, like memcached's -v: 0 none, 1 connections opening and closing, 2 also every command. Changed by the verbosity command.
+	PidFile              string                    // File the process ID is written to while serving, removed at shutdown. Serving fails if it holds the ID of a running process.
+	ConfigFile           string                    // Config file the settings were loaded from, re-read on SIGHUP to apply changed runtime settings. Empty disables reloading.
+	Clock                Clock                     // Tells the time to the expiration logic, for tests and simulations. nil uses the system clock. Shared by the servers of the process.
+	Store                Store                     // Storage backend. nil creates a BoltStore if BoltPath is set, or a SimpleKV from the settings above.
+}
+
+// initStore returns the store plugged into the settings of s, or creates the default one.
+func (s *Server) initStore() (Store, error) {
+	if s.config.Store != nil {
+		return s.config.Store, nil
+	}
+	if s.config.BoltPath == "" {
+		cfg := s.config
+		cfg.Logger = s.logger()
+		return NewSimpleKV(cfg), nil
+	}
+	store, err := newBoltStore(s.config.BoltPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening bolt database: %v", err)
+	}
+	return store, nil
+}
+
+// wrapStore returns store with the decorators serving the client requests of s: read-through loading, write-behind, leases,
+// item locks, hot key tracking, top keys sampling and key tracing.
+// Unlike the persistence decorators, they don't see the items loaded at startup. Neither are loaded items written behind.
+func (s *Server) wrapStore(store Store) Store {
+	if s.config.Loader != nil {
+		store = newLoaderStore(store, s)
+	}
+	if s.config.WriteBehind != nil || len(s.config.NamespaceWriteBehind) > 0 {
+		store = newWriteBehindStore(store, s.config, s.logger())
+	}
+	store = s.enableLeases(store)
+	store = s.enableItemLocks(store)
+	store = s.trackHotKeys(store)
+	store = s.trackTopKeys(store)
+	s.keyTrace.log = s.logger()
+	return &keyTraceStore{store, &s.keyTrace}
+}
+
+// DefaultConfig returns the settings NewServer starts from.
+func DefaultConfig() Config {
+	return Config{
+		Listeners:         []ListenerConfig{{Addr: "localhost:3333"}},
+		ReadBufferSize:    4096,
+		DrainTimeout:      10 * time.Second,
+		AuthBanDuration:   15 * time.Minute,
+		EvictionPolicy:    EvictionLRU,
+		LRUHotPercent:     20,
+		LRUWarmPercent:    40,
+		LFUSamples:        5,
+		ShardHash:         ShardHashFNV,
+		SweepInterval:     time.Second,
+		SweepBatch:        1000,
+		AOFFsync:          AOFFsyncEverySec,
+		SnapshotRetain:    1,
+		KeyValidation:     KeyValidationStrict,
+		MaxRequestSize:    1024 * 1024,
+		WriteBehindBatch:  100,
+		LeaseTTL:          10 * time.Second,
+		TopKeysInterval:   time.Minute,
+		LockTimeout:       15 * time.Second,
+		WriteBehindDelay:  time.Second,
+		EventQueueSize:    1024,
+		AccessLogSample:   1,
+		AuditLogRetain:    10,
+		LogLevel:          LogLevelInfo,
+		TLSIdentity:       TLSIdentityCN,
+		RateLimitAction:   RateLimitDelay,
+		ConnQueue:         1024,
+		ConnOverload:      ConnOverloadReject,
+		TLSReloadInterval: time.Minute,
+		PlainNeedsTLS:     true,
+	}
+}
+
+// Settings is the configuration served by the package functions Start and ServeStdio. A Server keeps its own.
+var Settings = DefaultConfig()
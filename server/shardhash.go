@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"math/bits"
+	"sort"
+	"strconv"
+)
+
+// Key hash functions selecting the store shard of a key, selectable through Config.ShardHash.
+const (
+	ShardHashFNV    = "fnv"          // 32 bit FNV-1a, modulo the shard count.
+	ShardHashXXHash = "xxhash"       // 64 bit xxHash (XXH64, seed 0), modulo the shard count.
+	ShardHashKetama = "crc32-ketama" // CRC32 of the key on a consistent hashing ring, so changing the shard count moves few keys.
+)
+
+// ketamaPoints is the number of points every shard has on the ketama ring, as in libmemcached.
+const ketamaPoints = 160
+
+// IsShardHash reports whether name is a known shard hash function.
+func IsShardHash(name string) bool {
+	return name == ShardHashFNV || name == ShardHashXXHash || name == ShardHashKetama
+}
+
+// newShardSelector returns the function mapping keys to one of count shards, which is a power of two.
+func newShardSelector(name string, count int) func(key string) int {
+	mask := uint64(count - 1)
+	switch name {
+	case ShardHashXXHash:
+		return func(key string) int { return int(xxhash64(key) & mask) }
+	case ShardHashKetama:
+		return newKetamaRing(count).shard
+	default:
+		return func(key string) int { return int(uint64(fnv32a(key)) & mask) }
+	}
+}
+
+// ketamaRing places ketamaPoints points per shard on a ring of CRC32 values. A key belongs to the shard of the first point at or after its hash.
+type ketamaRing struct {
+	points []uint32
+	shards []int
+}
+
+func newKetamaRing(count int) *ketamaRing {
+	type point struct {
+		hash  uint32
+		shard int
+	}
+	points := make([]point, 0, count*ketamaPoints)
+	for shard := 0; shard < count; shard++ {
+		for i := 0; i < ketamaPoints; i++ {
+			points = append(points, point{crc32.ChecksumIEEE([]byte(strconv.Itoa(shard) + "-" + strconv.Itoa(i))), shard})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].shard < points[j].shard
+	})
+	r := &ketamaRing{points: make([]uint32, len(points)), shards: make([]int, len(points))}
+	for i, p := range points {
+		r.points[i], r.shards[i] = p.hash, p.shard
+	}
+	return r
+}
+
+func (r *ketamaRing) shard(key string) int {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.shards[i]
+}
+
+// xxHash primes.
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxhash64 returns the XXH64 hash of key with seed 0, matching the reference implementation.
+func xxhash64(key string) uint64 {
+	b := []byte(key)
+	n := len(b)
+	var h uint64
+	if n >= 32 {
+		p1, p2 := xxPrime1, xxPrime2 // Variables, as the seeds wrap around.
+		v1, v2, v3, v4 := p1+p2, p2, uint64(0), -p1
+		for ; len(b) >= 32; b = b[32:] {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(b))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(b[8:]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(b[16:]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(b[24:]))
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMerge(h, v1)
+		h = xxMerge(h, v2)
+		h = xxMerge(h, v3)
+		h = xxMerge(h, v4)
+	} else {
+		h = xxPrime5
+	}
+	h += uint64(n)
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMerge(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package server
+
+import "os"
+
+// rotateSignals are the signals making the server reopen its log files. There is no SIGUSR1 outside of unix.
+var rotateSignals []os.Signal
+
+// upgradeSignals are the signals making the server hand its listeners over to a new process. Other systems can't pass on sockets.
+var upgradeSignals []os.Signal
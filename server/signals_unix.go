@@ -0,0 +1,14 @@
+//go:build unix
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// rotateSignals are the signals making the server reopen its log files, after logrotate moved them away.
+var rotateSignals = []os.Signal{syscall.SIGUSR1}
+
+// upgradeSignals are the signals making the server hand its listeners over to a new process, see Server.Upgrade.
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
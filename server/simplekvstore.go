@@ -1,85 +1,827 @@
 package server
 
 import (
+	"container/list"
+	"errors"
+	"runtime"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-// SimpleValue structure for the k/v storage. Not optimized for space saving. No LRU.
+// SimpleValue structure for the k/v storage. Not optimized for space saving.
 type SimpleValue struct {
 	RawData []byte
 	Flag    uint32
 	CAS     uint64
-	TTL     int
+	TTL     int // Expiration in seconds since process start (see currentTime). 0 means never.
+	// Access metadata, filled in by the store when handing out an item and ignored when storing one. Times are seconds since process start.
+	Stored   int          // When the item was stored.
+	Accessed int          // When the item was last read or touched. Equals Stored if it never was.
+	Fetches  uint32       // How often the item was read.
+	chunk    slabChunk    // Slab memory backing RawData, if slab allocated.
+	rawSize  int          // Uncompressed length when the store keeps RawData gzip compressed, 0 otherwise.
+	ext      extLoc       // Where the value lives in the disk tier. RawData is nil then.
+	more     []valueChunk // Further chunks of a value larger than largeChunkSize, following RawData.
 }
 
-// Simple storage for all k/v pairs. Uses a RWMutex for concurrency control.
-var simplekvMap = map[string]SimpleValue{}
-var simplekvMutex sync.RWMutex
+// Release gives back the slab memory a value of ByteKeyStore.GetBytes may share with the store, so it can be reused once the
+// item was replaced or removed. RawData must not be used afterwards. Values that share nothing have nothing to give back.
+func (val SimpleValue) Release() {
+	if val.chunk.page != nil {
+		val.chunk.page.class.slabs.release(val.chunk)
+	}
+}
+
+// simpleEntry is an element of a shard's LRU list. The most recently used entry is at the front.
+type simpleEntry struct {
+	key      string
+	val      SimpleValue
+	epoch    uint32     // Flush epoch of the store when the item was stored. The item is dead once the epoch moved on.
+	ns       *namespace // Namespace of the item if it has a quota, nil otherwise.
+	nsEpoch  uint32     // Flush epoch of ns when the item was stored.
+	hits     uint8      // Access counter of the lfu eviction policy.
+	seg      uint8      // Segment of the segmented LRU holding the item.
+	active   bool       // Temperature bit of the segmented LRU, set when the item is read again after its first fetch.
+	accessed uint32     // Time of the last read or touch in seconds since process start. Updated atomically.
+	fetches  uint32     // Number of reads. Updated atomically.
+}
+
+// itemOverhead approximates the bookkeeping bytes (map slot, list element, headers) each item costs besides key and value.
+const itemOverhead = 64
+
+// itemSize is the number of bytes an item is charged against the memory limit.
+func itemSize(key string, val SimpleValue) uint64 {
+	size := len(key) + len(val.RawData) + itemOverhead
+	for _, c := range val.more {
+		size += len(c.data)
+	}
+	return uint64(size)
+}
+
+// simpleShard holds the k/v pairs whose key hashes to it. Uses a RWMutex for concurrency control.
+// LRU bumps on reads only hold the read lock, so the list and the eviction policy are additionally guarded by lruMutex.
+type simpleShard struct {
+	mutex            sync.RWMutex
+	lruMutex         sync.Mutex
+	items            map[string]*list.Element
+	lru              *list.List // Recency order of all items, or the COLD segment of the segmented LRU.
+	hot              *list.List // HOT and WARM segments, only used by the segmented LRU.
+	warm             *list.List
+	policy           evictionPolicy
+	tuning           *policyTuning // Settings of the policy, those of the store.
+	evictions        uint64        // Items evicted from this shard to honor the memory, item or namespace limits. Guarded by mutex.
+	evictedUnfetched uint64        // Evicted items that were never read. Guarded by mutex.
+	expiredUnfetched uint64        // Expired items removed without ever being read. Guarded by mutex.
+	rejections       uint64        // New items the eviction policy refused to admit. Guarded by mutex.
+	sweepCursor      *list.Element // Where the expiration sweeper resumes. Guarded by mutex.
+	offloads         uint64        // Values moved to the disk tier instead of being evicted. Guarded by mutex.
+}
+
+// keyLockBits sets the number of key lock stripes to 1<<keyLockBits.
+const keyLockBits = 10
+
+// SimpleKV is the built-in Store. All k/v pairs are split into a power-of-two number of shards so writes to different keys rarely contend.
+// Mutations additionally hold a striped per-key lock. They check the current item under the shard's read lock and copy the new value
+// in holding only the key lock, taking the shard's write lock just to link the item in. Not optimized for space saving.
+type SimpleKV struct {
+	bytes      uint64       // Bytes charged by all stored items across shards. Updated atomically.
+	items      int64        // Items stored across shards. Updated atomically.
+	totalItems uint64       // Items ever stored. Updated atomically.
+	expired    uint64       // Expired items removed, by reads or the sweeper. Updated atomically.
+	sweptItems uint64       // Expired items removed by the sweeper. Updated atomically.
+	sweptBytes uint64       // Bytes reclaimed by the sweeper. Updated atomically.
+	tuning     policyTuning // Runtime settings of the eviction policies, shared by the shards.
+
+	compressedItems    uint64 // Stored items kept compressed. Updated atomically.
+	compressedBytes    uint64 // Compressed size of those items. Updated atomically.
+	compressedRawBytes uint64 // Their size before compression. Updated atomically.
+	epoch              uint32 // Flush epoch. Flush increments it, invalidating all items stored before. Updated atomically.
+	flushMutex         sync.Mutex
+	keyLocks           [1 << keyLockBits]sync.Mutex
+	flushTimer         *time.Timer // Pending delayed flush. Guarded by flushMutex.
+
+	maxMemory   uint64 // Updated atomically, see SetLimits.
+	maxItems    int64  // Updated atomically, see SetLimits.
+	policy      string
+	compressMin int // Values of at least this many bytes are compressed. 0 disables compression.
+	shards      []*simpleShard
+	shardIndex  func(key string) int  // Picks the shard of a key, see Config.ShardHash.
+	slabs       *slabAllocator        // nil when values live on the Go heap.
+	ext         *extStore             // Disk tier, nil if disabled.
+	extMin      int                   // Values of at least this many bytes go straight to the disk tier. 0 only moves evicted items.
+	memFile     string                // Memory file backing the slab pages, empty if none.
+	nsSeparator string                // Separator ending the namespace part of keys. Empty if namespaces are disabled.
+	namespaces  map[string]*namespace // Namespaces with a quota. Never modified after creation.
+	events      *eventQueue           // Calls the eviction, expiration and flush hooks. nil if there are none.
+	log         Logger                // Logger of the settings the store was created with.
+	done        chan struct{}         // Closed to stop the sweeper.
+	closeOnce   sync.Once
+	cas         casCounter
+}
+
+// NewSimpleKV creates a SimpleKV using the MaxMemory, MaxItems, EvictionPolicy, LRU segment, LFU sample, Shards, ShardHash, Slabs, MemoryFile, OffHeap, CompressThreshold, Extstore, Namespace, Sweep and event hook settings of cfg.
+// An unknown eviction policy falls back to lru, an unknown shard hash to fnv. If the disk tier, memory file or off-heap arena can't be opened, the store runs without it.
+// With a SweepInterval, a background sweeper runs until Close is called, as do the maintainer of the segmented LRU and the slab compactor.
+func NewSimpleKV(cfg Config) *SimpleKV {
+	shards := cfg.Shards
+	if shards <= 0 {
+		shards = 4 * runtime.GOMAXPROCS(0)
+	}
+	count := 1
+	for count < shards {
+		count *= 2
+	}
+	if !IsEvictionPolicy(cfg.EvictionPolicy) {
+		cfg.EvictionPolicy = EvictionLRU
+	}
+	kv := &SimpleKV{maxMemory: cfg.MaxMemory, maxItems: int64(cfg.MaxItems), policy: cfg.EvictionPolicy, compressMin: cfg.CompressThreshold, shards: make([]*simpleShard, count), done: make(chan struct{}), cas: newCASCounter()}
+	kv.shardIndex = newShardSelector(cfg.ShardHash, count)
+	kv.log = configLogger(cfg)
+	kv.events = newEventQueue(cfg, kv.done)
+	for i := range kv.shards {
+		policy, _ := newEvictionPolicy(cfg.EvictionPolicy)
+		kv.shards[i] = &simpleShard{items: map[string]*list.Element{}, lru: list.New(), hot: list.New(), warm: list.New(), policy: policy, tuning: &kv.tuning}
+	}
+	defaults := DefaultConfig()
+	if checkSegments(&cfg) != nil {
+		cfg.LRUHotPercent, cfg.LRUWarmPercent = defaults.LRUHotPercent, defaults.LRUWarmPercent
+	}
+	if cfg.LFUSamples < 1 {
+		cfg.LFUSamples = defaults.LFUSamples
+	}
+	kv.SetEvictionTuning(cfg.LRUHotPercent, cfg.LRUWarmPercent, cfg.LFUSamples)
+	if cfg.NamespaceSeparator != "" && len(cfg.NamespaceQuotas) > 0 {
+		kv.nsSeparator, kv.namespaces = cfg.NamespaceSeparator, map[string]*namespace{}
+		for name, quota := range cfg.NamespaceQuotas {
+			kv.namespaces[name] = &namespace{name: name, quota: quota}
+		}
+	}
+	if cfg.EvictionPolicy == EvictionSegmented {
+		go kv.lruMaintainer()
+	}
+	if cfg.Slabs || cfg.MemoryFile != "" || cfg.OffHeap {
+		kv.slabs = newSlabAllocator()
+		if cfg.SlabCompactInterval > 0 {
+			go kv.slabCompactor(cfg.SlabCompactInterval)
+		}
+	}
+	if cfg.MemoryFile != "" {
+		if err := kv.openMemoryFile(cfg.MemoryFile, cfg.MaxMemory); err != nil {
+			kv.log.Error("error opening memory file", "err", err)
+		}
+	} else if cfg.OffHeap {
+		if err := kv.openOffHeap(cfg.MaxMemory); err != nil {
+			kv.log.Error("error mapping off-heap memory", "err", err)
+		}
+	}
+	if cfg.ExtstorePath != "" {
+		ext, err := newExtStore(cfg.ExtstorePath, cfg.ExtstoreSize)
+		if err != nil {
+			kv.log.Error("error opening extstore", "err", err)
+		} else {
+			ext.compact, ext.log = kv.compactExtstore, kv.log
+			kv.ext, kv.extMin = ext, cfg.ExtstoreItemSize
+		}
+	}
+	if cfg.SweepInterval > 0 && cfg.SweepBatch > 0 {
+		go kv.sweeper(cfg.SweepInterval, cfg.SweepBatch)
+	}
+	return kv
+}
+
+// own copies the borrowed value bytes of a request into memory owned by the store, compressing large values.
+func (kv *SimpleKV) own(val SimpleValue) SimpleValue {
+	val.chunk, val.more = slabChunk{}, nil
+	val = kv.compress(val)
+	val.ext = extLoc{}
+	if kv.ext != nil && kv.extMin > 0 && len(val.RawData) >= kv.extMin {
+		if loc, err := kv.ext.write(val.RawData); err == nil {
+			val.RawData, val.ext = nil, loc
+			return val
+		}
+	}
+	if len(val.RawData) > largeChunkSize {
+		return kv.ownChunks(val)
+	}
+	if kv.slabs != nil {
+		if chunk, buf, ok := kv.slabs.alloc(val.RawData); ok {
+			val.RawData = buf
+			val.chunk = chunk
+			return val
+		}
+	}
+	if val.rawSize != 0 {
+		return val // The compressed bytes are freshly allocated already.
+	}
+	buf := make([]byte, len(val.RawData))
+	copy(buf, val.RawData)
+	val.RawData = buf
+	return val
+}
+
+// export prepares a stored value to be handed out. Slab chunks are reused once an item is replaced, so their bytes get copied. Lock must be held.
+// Values on disk are read back, chunked values are reassembled and compressed values are decompressed.
+func (kv *SimpleKV) export(val SimpleValue) (SimpleValue, error) {
+	if val.ext.size != 0 {
+		data, err := kv.ext.read(val.ext)
+		if err != nil {
+			return SimpleValue{}, err
+		}
+		val.RawData, val.ext = data, extLoc{}
+	}
+	if len(val.more) > 0 {
+		val = joinChunks(val)
+	}
+	if val.rawSize != 0 {
+		data, err := decompressValue(val.RawData, val.rawSize)
+		if err != nil {
+			return SimpleValue{}, err
+		}
+		val.RawData, val.rawSize, val.chunk = data, 0, slabChunk{}
+	}
+	if val.chunk.page != nil {
+		val.RawData = append([]byte(nil), val.RawData...)
+		val.chunk = slabChunk{}
+	}
+	return val, nil
+}
+
+// share prepares a stored value to be handed out like export, except that a value held in a single slab chunk keeps it
+// rather than getting a copy, taking a reference the caller gives back with Release. Lock must be held.
+func (kv *SimpleKV) share(val SimpleValue) (SimpleValue, error) {
+	if val.chunk.page == nil || val.ext.size != 0 || len(val.more) > 0 || val.rawSize != 0 {
+		return kv.export(val)
+	}
+	kv.slabs.retain(val.chunk)
+	return val, nil
+}
+
+// discard frees the memory or disk space held by a value that is no longer stored.
+func (kv *SimpleKV) discard(val SimpleValue) {
+	if val.chunk.page != nil {
+		kv.slabs.release(val.chunk)
+	}
+	if val.ext.size != 0 {
+		kv.ext.release(val.ext)
+	}
+	for _, c := range val.more {
+		if c.chunk.page != nil {
+			kv.slabs.release(c.chunk)
+		}
+	}
+}
+
+// fnv32a returns the 32 bit FNV-1a hash of key.
+func fnv32a(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// shardFor selects the shard of a key with the configured shard hash.
+func (kv *SimpleKV) shardFor(key string) *simpleShard {
+	return kv.shards[kv.shardIndex(key)]
+}
+
+// keyLock returns the lock serializing mutations of key. Keys share a lock per stripe, picked by the top bits of a Fibonacci hash,
+// so keys of the same shard spread over all stripes.
+func (kv *SimpleKV) keyLock(key string) *sync.Mutex {
+	return &kv.keyLocks[(fnv32a(key)*0x9e3779b1)>>(32-keyLockBits)]
+}
+
+// fits reports whether an item could be stored at all under the memory limit and the quota of its namespace.
+// Values headed for the disk tier only need room for their metadata.
+func (kv *SimpleKV) fits(key string, val SimpleValue) bool {
+	if kv.ext != nil && kv.extMin > 0 && len(val.RawData) >= kv.extMin {
+		val.RawData = nil
+	}
+	size := itemSize(key, val)
+	if ns := kv.namespaceFor(key); ns != nil && ns.quota.MaxMemory > 0 && size > ns.quota.MaxMemory {
+		return false
+	}
+	max := atomic.LoadUint64(&kv.maxMemory)
+	return max == 0 || size <= max
+}
+
+// overMemory reports whether adding an item of size bytes would exceed the memory limit.
+func (kv *SimpleKV) overMemory(size uint64) bool {
+	max := atomic.LoadUint64(&kv.maxMemory)
+	return max > 0 && atomic.LoadUint64(&kv.bytes)+size > max
+}
+
+// full reports whether adding an item of size bytes would exceed the memory or the item limit.
+func (kv *SimpleKV) full(size uint64) bool {
+	max := atomic.LoadInt64(&kv.maxItems)
+	return kv.overMemory(size) || max > 0 && atomic.LoadInt64(&kv.items) >= max
+}
+
+// SetEvictionTuning changes the shares of the HOT and WARM segments of the segmented LRU and the items sampled by the lfu policy.
+func (kv *SimpleKV) SetEvictionTuning(hotPercent, warmPercent, lfuSamples int) {
+	atomic.StoreInt32(&kv.tuning.hotPercent, int32(hotPercent))
+	atomic.StoreInt32(&kv.tuning.warmPercent, int32(warmPercent))
+	atomic.StoreInt32(&kv.tuning.lfuSamples, int32(lfuSamples))
+}
+
+// SetLimits changes the memory and item limits, 0 meaning no limit. Lowered limits are enforced by evicting items as new ones are
+// stored. Stores keeping their items in memory reserved up front, by a memory file or off-heap, can't change the memory limit.
+func (kv *SimpleKV) SetLimits(maxMemory uint64, maxItems int) error {
+	if maxMemory != atomic.LoadUint64(&kv.maxMemory) && (kv.memFile != "" || kv.slabs != nil && kv.slabs.arena != nil) {
+		return errors.New("the memory limit of a memory file or off-heap memory can't change")
+	}
+	atomic.StoreUint64(&kv.maxMemory, maxMemory)
+	atomic.StoreInt64(&kv.maxItems, int64(maxItems))
+	return nil
+}
+
+// store inserts or replaces the value of key in shard s. While the memory or item limit is exceeded, items of this shard are evicted as chosen by the eviction policy.
+// With a disk tier, the values of victims are moved to disk first while memory is short, and only items already there are evicted.
+// As items hash evenly across shards, evicting from the inserting shard approximates a global policy. Write lock must be held.
+// A new key the policy refuses to admit is not stored; the request still succeeds, as if the item had been evicted right away.
+// Namespace quotas are enforced the same way, evicting the least recently used items of the namespace from the shard; callers
+// make room in the other shards first with makeRoom. If the shard holds no item of the namespace to evict, ErrOutOfMemory is returned.
+func (kv *SimpleKV) store(s *simpleShard, key string, val SimpleValue) error {
+	size := itemSize(key, val)
+	elem, replacing := s.items[key]
+	if replacing {
+		kv.remove(s, elem)
+	}
+	ns := kv.namespaceFor(key)
+	for ns != nil && ns.over(size) {
+		victim := kv.namespaceVictim(s, ns)
+		if victim == nil {
+			kv.discard(val)
+			return ErrOutOfMemory
+		}
+		kv.evictFromNamespace(s, ns, victim)
+	}
+	if atomic.LoadUint64(&kv.maxMemory) > 0 || atomic.LoadInt64(&kv.maxItems) > 0 {
+		for kv.full(size) && len(s.items) > 0 {
+			victim := s.policy.victim(s)
+			if kv.overMemory(size) && kv.offload(s, victim) {
+				s.offloads++
+				continue
+			}
+			if !replacing && !s.policy.admit(key, victim) {
+				s.rejections++
+				kv.discard(val)
+				return nil
+			}
+			if atomic.LoadUint32(&victim.Value.(*simpleEntry).fetches) == 0 {
+				s.evictedUnfetched++
+			}
+			kv.notify(eventEvict, victim.Value.(*simpleEntry))
+			kv.remove(s, victim)
+			s.evictions++
+		}
+	}
+	val.Stored, val.Accessed, val.Fetches = currentTime(), 0, 0
+	entry := &simpleEntry{key: key, val: val, epoch: atomic.LoadUint32(&kv.epoch), accessed: uint32(val.Stored)}
+	if ns != nil {
+		entry.ns, entry.nsEpoch = ns, atomic.LoadUint32(&ns.epoch)
+		ns.charge(size, 1)
+	}
+	s.items[key] = s.policy.insert(s, entry)
+	atomic.AddUint64(&kv.bytes, size)
+	atomic.AddInt64(&kv.items, 1)
+	atomic.AddUint64(&kv.totalItems, 1)
+	kv.accountCompression(val, false)
+	return nil
+}
+
+// remove drops an element from shard s. Write lock must be held.
+func (kv *SimpleKV) remove(s *simpleShard, elem *list.Element) {
+	entry := elem.Value.(*simpleEntry)
+	atomic.AddUint64(&kv.bytes, ^(itemSize(entry.key, entry.val) - 1))
+	if entry.ns != nil {
+		entry.ns.charge(itemSize(entry.key, entry.val), -1)
+	}
+	kv.accountCompression(entry.val, true)
+	kv.discard(entry.val)
+	s.unlink(elem)
+	delete(s.items, entry.key)
+	atomic.AddInt64(&kv.items, -1)
+}
+
+// removeDead drops an element found expired or flushed, counting it if it expired unread. Write lock must be held.
+// Expired items are passed to the OnExpire hook; flushed ones were announced by the flush.
+func (kv *SimpleKV) removeDead(s *simpleShard, elem *list.Element) {
+	entry := elem.Value.(*simpleEntry)
+	if entry.val.expired() {
+		if atomic.LoadUint32(&entry.fetches) == 0 {
+			s.expiredUnfetched++
+		}
+		kv.notify(eventExpire, entry)
+		atomic.AddUint64(&kv.expired, 1)
+	}
+	kv.remove(s, elem)
+}
+
+// meta returns the metadata of an item without its value.
+func (entry *simpleEntry) meta() SimpleValue {
+	return entry.withMeta(SimpleValue{Flag: entry.val.Flag, CAS: entry.val.CAS, TTL: entry.val.TTL, Stored: entry.val.Stored})
+}
+
+// withMeta fills in the access metadata of an item handed out.
+func (entry *simpleEntry) withMeta(val SimpleValue) SimpleValue {
+	val.Accessed, val.Fetches = int(atomic.LoadUint32(&entry.accessed)), atomic.LoadUint32(&entry.fetches)
+	return val
+}
+
+// dead reports whether an item expired or was flushed, along with the store or its namespace.
+func (kv *SimpleKV) dead(entry *simpleEntry) bool {
+	if entry.ns != nil && entry.nsEpoch != atomic.LoadUint32(&entry.ns.epoch) {
+		return true
+	}
+	return entry.val.expired() || entry.epoch != atomic.LoadUint32(&kv.epoch)
+}
 
-// GetFromSimpleKV looks up a key with locking.
-func GetFromSimpleKV(key string) (SimpleValue, bool) {
-	simplekvMutex.RLock()
-	val, ok := simplekvMap[key]
+// lookup returns the live element of key, dropping it if expired or flushed. Write lock must be held.
+func (kv *SimpleKV) lookup(s *simpleShard, key string) (*list.Element, bool) {
+	elem, ok := s.items[key]
+	if ok && kv.dead(elem.Value.(*simpleEntry)) {
+		kv.removeDead(s, elem)
+		return nil, false
+	}
+	return elem, ok
+}
+
+// Get looks up a key with locking.
+func (kv *SimpleKV) Get(key string) (SimpleValue, bool) {
+	return kv.get(key, false)
+}
+
+// get looks up key, sharing the bytes of a slab allocated value if shared is set.
+func (kv *SimpleKV) get(key string, shared bool) (SimpleValue, bool) {
+	s := kv.shardFor(key)
+	s.mutex.RLock()
+	elem, ok := s.items[key]
 	if !ok {
-		simplekvMutex.RUnlock()
+		s.lruMutex.Lock()
+		s.policy.missed(key)
+		s.lruMutex.Unlock()
+		s.mutex.RUnlock()
 		return SimpleValue{}, false
 	}
-	cas := val.CAS
-	simplekvMutex.RUnlock()
-	if val.TTL != 0 && val.TTL < time.Now().Second() {
-		simplekvMutex.Lock()
-		val, ok = simplekvMap[key]
-		if ok && val.CAS == cas {
-			delete(simplekvMap, key)
-			ok = false
-		}
-		simplekvMutex.Unlock()
-		if !ok {
-			return SimpleValue{}, false
+	entry := elem.Value.(*simpleEntry)
+	if kv.dead(entry) {
+		cas := entry.val.CAS
+		s.mutex.RUnlock()
+		s.mutex.Lock()
+		if elem, ok = s.items[key]; ok && elem.Value.(*simpleEntry).val.CAS == cas {
+			kv.removeDead(s, elem)
 		}
+		s.mutex.Unlock()
+		return SimpleValue{}, false
 	}
+	export := kv.export
+	if shared {
+		export = kv.share
+	}
+	val, err := export(entry.val)
+	if err != nil {
+		s.mutex.RUnlock()
+		return SimpleValue{}, false
+	}
+	atomic.StoreUint32(&entry.accessed, uint32(currentTime()))
+	atomic.AddUint32(&entry.fetches, 1)
+	val = entry.withMeta(val)
+	s.lruMutex.Lock()
+	s.policy.touched(s, elem)
+	s.lruMutex.Unlock()
+	s.mutex.RUnlock()
 	return val, true
 }
 
-// AddToSimpleKV will only set a value only when it does not exist yet. Lock is being held during update. CAS value will be bumped.
-func AddToSimpleKV(key string, newVal SimpleValue) (SimpleValue, bool) {
-	simplekvMutex.Lock()
-	defer simplekvMutex.Unlock()
-	_, ok := simplekvMap[key]
-	if ok {
-		// Already exists is a failure case
-		return newVal, false
+// GetBytes looks up a key given as bytes. Get keeps nothing of the key, so it borrows the bytes. A value held in a slab chunk
+// shares it until released.
+func (kv *SimpleKV) GetBytes(key []byte) (SimpleValue, bool) {
+	return kv.get(borrowString(key), true)
+}
+
+// current returns the live item of key, read under the shard's read lock. ok is false if it is missing, expired or flushed.
+// Without data only the metadata is returned, which is all CAS and existence checks need.
+func (kv *SimpleKV) current(s *simpleShard, key string, data bool) (val SimpleValue, ok bool, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	elem, ok := s.items[key]
+	if !ok || kv.dead(elem.Value.(*simpleEntry)) {
+		return SimpleValue{}, false, nil
 	}
-	newVal.CAS = atomic.AddUint64(&casID, 1)
-	if newVal.CAS == 0 {
-		// skip value 0 for CAS value
-		newVal.CAS = atomic.AddUint64(&casID, 1)
+	val = elem.Value.(*simpleEntry).val
+	if !data {
+		return SimpleValue{Flag: val.Flag, CAS: val.CAS, TTL: val.TTL}, true, nil
+	}
+	val, err = kv.export(val)
+	return val, true, err
+}
+
+// Add will only set a value only when it does not exist yet. CAS value will be bumped.
+func (kv *SimpleKV) Add(key string, newVal SimpleValue) (SimpleValue, error) {
+	if !kv.fits(key, newVal) {
+		return newVal, ErrValueTooLarge
+	}
+	m := kv.keyLock(key)
+	m.Lock()
+	defer m.Unlock()
+	s := kv.shardFor(key)
+	if _, ok, _ := kv.current(s, key, false); ok {
+		// Already exists is a failure case
+		return newVal, ErrKeyExists
 	}
-	simplekvMap[key] = newVal
-	return newVal, true
+	newVal.CAS = kv.cas.next()
+	newVal = kv.own(newVal)
+	kv.makeRoom(key, itemSize(key, newVal))
+	s.mutex.Lock()
+	err := kv.store(s, key, newVal)
+	s.mutex.Unlock()
+	return newVal, err
 }
 
-// SetToSimpleKV handles normal set and replace. Replace will fail is a key does not exist. For an existing key, both set and replace will check CAS if it's not 0.
-// Return values are 1. set value, 2. is key missing, 3. is successful.
-func SetToSimpleKV(key string, newVal SimpleValue, cas uint64, replace bool) (SimpleValue, bool, bool) {
-	simplekvMutex.Lock()
-	defer simplekvMutex.Unlock()
-	oldVal, ok := simplekvMap[key]
+// Set handles normal set and replace. Replace will fail is a key does not exist. For an existing key, both set and replace will check CAS if it's not 0.
+// The value is copied in while only the key's lock is held, so large values don't block the other keys of the shard.
+func (kv *SimpleKV) Set(key string, newVal SimpleValue, cas uint64, replace bool) (SimpleValue, error) {
+	if !kv.fits(key, newVal) {
+		return newVal, ErrValueTooLarge
+	}
+	m := kv.keyLock(key)
+	m.Lock()
+	defer m.Unlock()
+	s := kv.shardFor(key)
+	old, ok, _ := kv.current(s, key, false)
 	if !ok && replace {
 		// Replace key not found
-		return newVal, true, false
+		return newVal, ErrKeyNotFound
 	}
-	if ok && cas != 0 && cas != oldVal.CAS {
+	if ok && cas != 0 && cas != old.CAS {
 		// CAS does not match
-		return newVal, false, false
+		return newVal, ErrKeyExists
+	}
+	newVal.CAS = kv.cas.next()
+	newVal = kv.own(newVal)
+	kv.makeRoom(key, itemSize(key, newVal))
+	s.mutex.Lock()
+	err := kv.store(s, key, newVal)
+	s.mutex.Unlock()
+	return newVal, err
+}
+
+// Delete removes a key, checking CAS if it's not 0.
+func (kv *SimpleKV) Delete(key string, cas uint64) error {
+	m := kv.keyLock(key)
+	m.Lock()
+	defer m.Unlock()
+	s := kv.shardFor(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	elem, ok := kv.lookup(s, key)
+	if !ok {
+		return ErrKeyNotFound
+	}
+	if cas != 0 && cas != elem.Value.(*simpleEntry).val.CAS {
+		return ErrKeyExists
+	}
+	kv.remove(s, elem)
+	return nil
+}
+
+// Touch sets a new TTL on an existing key. The CAS value is left unchanged.
+func (kv *SimpleKV) Touch(key string, ttl int) (SimpleValue, bool) {
+	m := kv.keyLock(key)
+	m.Lock()
+	defer m.Unlock()
+	s := kv.shardFor(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	elem, ok := kv.lookup(s, key)
+	if !ok {
+		return SimpleValue{}, false
+	}
+	entry := elem.Value.(*simpleEntry)
+	entry.val.TTL = ttl
+	atomic.StoreUint32(&entry.accessed, uint32(currentTime()))
+	s.policy.touched(s, elem)
+	val, err := kv.export(entry.val)
+	return entry.withMeta(val), err == nil
+}
+
+// UpdateMeta sets the TTL of an item, and its flags unless flags is nil, in place under the shard lock. Unlike Touch it doesn't
+// hand out the value, so it takes the same time for items of any size, wherever their value lives.
+func (kv *SimpleKV) UpdateMeta(key string, ttl int, flags *uint32, cas uint64) (SimpleValue, error) {
+	m := kv.keyLock(key)
+	m.Lock()
+	defer m.Unlock()
+	s := kv.shardFor(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	elem, ok := kv.lookup(s, key)
+	if !ok {
+		return SimpleValue{}, ErrKeyNotFound
+	}
+	entry := elem.Value.(*simpleEntry)
+	if cas != 0 && cas != entry.val.CAS {
+		return SimpleValue{}, ErrKeyExists
+	}
+	entry.val.TTL = ttl
+	if flags != nil {
+		entry.val.Flag, entry.val.CAS = *flags, kv.cas.next()
+	}
+	atomic.StoreUint32(&entry.accessed, uint32(currentTime()))
+	s.policy.touched(s, elem)
+	return entry.meta(), nil
+}
+
+// Incr increments or decrements the decimal number stored at key. Incrementing wraps around at 64 bits.
+func (kv *SimpleKV) Incr(key string, delta uint64, decr bool, initial uint64, create bool, ttl int, cas uint64) (SimpleValue, uint64, error) {
+	m := kv.keyLock(key)
+	m.Lock()
+	defer m.Unlock()
+	s := kv.shardFor(key)
+	current, ok, err := kv.current(s, key, true)
+	if err != nil {
+		return SimpleValue{}, 0, err
+	}
+	val := SimpleValue{Flag: current.Flag, TTL: current.TTL}
+	var n uint64
+	if !ok {
+		if !create {
+			return SimpleValue{}, 0, ErrKeyNotFound
+		}
+		val.TTL = ttl
+		n = initial
+	} else {
+		if cas != 0 && cas != current.CAS {
+			return SimpleValue{}, 0, ErrKeyExists
+		}
+		n, err = strconv.ParseUint(string(current.RawData), 10, 64)
+		if err != nil {
+			return SimpleValue{}, 0, ErrNonNumeric
+		}
+		if !decr {
+			n += delta
+		} else if delta > n {
+			n = 0
+		} else {
+			n -= delta
+		}
+	}
+	val.RawData = []byte(strconv.FormatUint(n, 10))
+	val.CAS = kv.cas.next()
+	val = kv.own(val)
+	kv.makeRoom(key, itemSize(key, val))
+	s.mutex.Lock()
+	err = kv.store(s, key, val)
+	s.mutex.Unlock()
+	if err != nil {
+		return SimpleValue{}, 0, err
+	}
+	val.RawData, val.rawSize, val.chunk, val.ext, val.more = []byte(strconv.FormatUint(n, 10)), 0, slabChunk{}, extLoc{}, nil
+	return val, n, nil
+}
+
+// Flush invalidates all items by moving on to a new epoch, without touching them. Their memory is reclaimed by the sweeper, by eviction or when they are accessed.
+// A flush at a time in the future (see expiration) is delayed until then and replaces an earlier delayed flush.
+func (kv *SimpleKV) Flush(at int) {
+	kv.flushMutex.Lock()
+	defer kv.flushMutex.Unlock()
+	if kv.flushTimer != nil {
+		kv.flushTimer.Stop()
+		kv.flushTimer = nil
+	}
+	delay := at - currentTime()
+	if at == 0 || delay <= 0 {
+		atomic.AddUint32(&kv.epoch, 1)
+		kv.events.push(storeEvent{kind: eventFlush})
+		return
+	}
+	kv.flushTimer = time.AfterFunc(time.Duration(delay)*time.Second, func() {
+		atomic.AddUint32(&kv.epoch, 1)
+		kv.events.push(storeEvent{kind: eventFlush})
+	})
+}
+
+// iterateBatch is how many items Iterate copies out of a shard per lock acquisition.
+const iterateBatch = 256
+
+// Iterate calls fn for every live item. It never holds a lock while calling fn, so slow consumers such as snapshots and dumps don't stall writers.
+// The key list of a shard is copied first, then items are looked up and copied in small batches under the read lock.
+// Items added meanwhile may be missed and items removed meanwhile are skipped, so the result is a fuzzy point in time view.
+func (kv *SimpleKV) Iterate(fn func(key string, val SimpleValue) bool) {
+	type item struct {
+		key string
+		val SimpleValue
+	}
+	batch := make([]item, 0, iterateBatch)
+	for _, s := range kv.shards {
+		s.mutex.RLock()
+		keys := make([]string, 0, len(s.items))
+		for key := range s.items {
+			keys = append(keys, key)
+		}
+		s.mutex.RUnlock()
+		for len(keys) > 0 {
+			n := len(keys)
+			if n > iterateBatch {
+				n = iterateBatch
+			}
+			batch = batch[:0]
+			s.mutex.RLock()
+			for _, key := range keys[:n] {
+				elem, ok := s.items[key]
+				if !ok || kv.dead(elem.Value.(*simpleEntry)) {
+					continue
+				}
+				if val, err := kv.export(elem.Value.(*simpleEntry).val); err == nil {
+					batch = append(batch, item{key, elem.Value.(*simpleEntry).withMeta(val)})
+				}
+			}
+			s.mutex.RUnlock()
+			keys = keys[n:]
+			for _, it := range batch {
+				if !fn(it.key, it.val) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// SlabStats reports per size class counters for "stats slabs". It is empty unless slab allocation is enabled.
+func (kv *SimpleKV) SlabStats() []Stat {
+	if kv.slabs == nil {
+		return nil
+	}
+	return kv.slabs.stats()
+}
+
+// ReassignSlabPage moves a completely free slab page from class src to class dst.
+func (kv *SimpleKV) ReassignSlabPage(src, dst int) error {
+	if kv.slabs == nil {
+		return ErrSlabBadClass
+	}
+	return kv.slabs.reassign(src, dst)
+}
+
+// resetStats zeroes the counters of items ever stored, evicted and expired for "stats reset".
+func (kv *SimpleKV) resetStats() {
+	atomic.StoreUint64(&kv.totalItems, 0)
+	atomic.StoreUint64(&kv.expired, 0)
+	for _, s := range kv.shards {
+		s.mutex.Lock()
+		s.evictions = 0
+		s.mutex.Unlock()
+	}
+}
+
+// Stats reports item, memory and eviction counters.
+func (kv *SimpleKV) Stats() []Stat {
+	items, evictions, rejections, offloads := 0, uint64(0), uint64(0), uint64(0)
+	evictedUnfetched, expiredUnfetched := uint64(0), uint64(0)
+	hot, warm := 0, 0
+	for _, s := range kv.shards {
+		s.mutex.RLock()
+		items += len(s.items)
+		evictions += s.evictions
+		evictedUnfetched += s.evictedUnfetched
+		expiredUnfetched += s.expiredUnfetched
+		rejections += s.rejections
+		offloads += s.offloads
+		hot += s.hot.Len()
+		warm += s.warm.Len()
+		s.mutex.RUnlock()
+	}
+	stats := []Stat{
+		{"curr_items", strconv.Itoa(items)},
+		{"total_items", strconv.FormatUint(atomic.LoadUint64(&kv.totalItems), 10)},
+		{"expired", strconv.FormatUint(atomic.LoadUint64(&kv.expired), 10)},
+		{"bytes", strconv.FormatUint(atomic.LoadUint64(&kv.bytes), 10)},
+		{"limit_maxbytes", strconv.FormatUint(atomic.LoadUint64(&kv.maxMemory), 10)},
+		{"limit_items", strconv.FormatInt(atomic.LoadInt64(&kv.maxItems), 10)},
+		{"eviction_policy", kv.policy},
+		{"evictions", strconv.FormatUint(evictions, 10)},
+		{"evicted_unfetched", strconv.FormatUint(evictedUnfetched, 10)},
+		{"expired_unfetched", strconv.FormatUint(expiredUnfetched, 10)},
+		{"admission_rejections", strconv.FormatUint(rejections, 10)},
+		{"shards", strconv.Itoa(len(kv.shards))},
+	}
+	if kv.policy == EvictionSegmented {
+		stats = append(stats,
+			Stat{"lru_hot_items", strconv.Itoa(hot)},
+			Stat{"lru_warm_items", strconv.Itoa(warm)},
+			Stat{"lru_cold_items", strconv.Itoa(items - hot - warm)},
+		)
+	}
+	stats = append(stats, kv.compressionStats()...)
+	if kv.events != nil {
+		stats = append(stats, kv.events.stats()...)
 	}
-	newVal.CAS = atomic.AddUint64(&casID, 1)
-	if newVal.CAS == 0 {
-		// skip value 0 for CAS value
-		newVal.CAS = atomic.AddUint64(&casID, 1)
+	if kv.ext != nil {
+		stats = append(stats, Stat{"extstore_offloads", strconv.FormatUint(offloads, 10)})
+		stats = append(stats, kv.ext.stats()...)
 	}
-	simplekvMap[key] = newVal
-	return newVal, false, true
+	return append(stats, kv.sweeperStats()...)
 }
@@ -0,0 +1,342 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Slab allocator settings, following memcached's defaults.
+const (
+	slabPageSize     = 1024 * 1024 // Pages are carved into equally sized chunks of one class.
+	slabMinChunk     = 96
+	slabGrowthFactor = 1.25
+)
+
+// Errors of slab page reassignment.
+var (
+	ErrSlabBadClass = errors.New("BADCLASS")
+	ErrSlabNoSpare  = errors.New("NOSPARE")
+	ErrSlabSame     = errors.New("SAME")
+)
+
+// slabPage is one preallocated page owned by a size class.
+type slabPage struct {
+	class *slabClass
+	mem   []byte
+	free  int // Number of free chunks on this page. Guarded by class.mutex.
+	index int // Page number within the memory file, -1 for pages on the Go heap.
+	// refs counts the references to every chunk: one of the item stored in it, plus one per value handed out without copying
+	// its bytes. A chunk is only free once all are released. Updated atomically.
+	refs []int32
+
+	// draining is set while compaction moves the items off this page. Its free chunks are kept off the free list,
+	// and once all are free the page becomes a spare page. Guarded by class.mutex.
+	draining bool
+}
+
+// slabChunk locates a chunk within a page.
+type slabChunk struct {
+	page *slabPage
+	off  int
+}
+
+// refs returns the reference count of the chunk.
+func (chunk slabChunk) refs() *int32 {
+	return &chunk.page.refs[chunk.off/chunk.page.class.chunkSize]
+}
+
+// slabClass hands out chunks of one size.
+type slabClass struct {
+	slabs     *slabAllocator
+	mutex     sync.Mutex
+	id        int
+	chunkSize int
+	pages     []*slabPage
+	free      []slabChunk
+	used      uint64
+}
+
+func (c *slabClass) chunksPerPage() int {
+	return slabPageSize / c.chunkSize
+}
+
+// carve splits a page into chunks of this class and puts them on the free list. Class lock must be held.
+func (c *slabClass) carve(page *slabPage) {
+	page.class = c
+	page.free = c.chunksPerPage()
+	page.refs = make([]int32, c.chunksPerPage())
+	for off := 0; off+c.chunkSize <= slabPageSize; off += c.chunkSize {
+		c.free = append(c.free, slabChunk{page: page, off: off})
+	}
+	c.pages = append(c.pages, page)
+}
+
+// slabAllocator allocates item memory from size classes backed by large pages, so storing an item doesn't allocate from the Go heap.
+type slabAllocator struct {
+	classes []*slabClass
+
+	arenaMutex sync.Mutex
+	arena      []byte      // Memory file or off-heap mapping pages are carved from. nil allocates pages on the heap.
+	arenaPages []*slabPage // Pages taken from the arena, by index. Guarded by arenaMutex.
+	spare      []*slabPage // Pages emptied by compaction, carved again by whichever class needs a page next. Guarded by arenaMutex.
+	moved      uint64      // Pages freed by compaction. Guarded by arenaMutex.
+}
+
+func newSlabAllocator() *slabAllocator {
+	a := &slabAllocator{}
+	size := slabMinChunk
+	for size <= slabPageSize/2 {
+		a.classes = append(a.classes, &slabClass{slabs: a, id: len(a.classes) + 1, chunkSize: size})
+		size = (int(float64(size)*slabGrowthFactor) + 7) &^ 7 // 8 byte aligned
+	}
+	if a.classes[len(a.classes)-1].chunkSize < largeChunkSize {
+		// Chunks of large values fill a class exactly.
+		a.classes = append(a.classes, &slabClass{slabs: a, id: len(a.classes) + 1, chunkSize: largeChunkSize})
+	}
+	a.classes = append(a.classes, &slabClass{slabs: a, id: len(a.classes) + 1, chunkSize: slabPageSize})
+	return a
+}
+
+// alloc returns a chunk holding a copy of data. Data larger than a page is not slab allocated and returns ok false.
+func (a *slabAllocator) alloc(data []byte) (slabChunk, []byte, bool) {
+	var c *slabClass
+	for _, class := range a.classes {
+		if class.chunkSize >= len(data) {
+			c = class
+			break
+		}
+	}
+	if c == nil {
+		return slabChunk{}, nil, false
+	}
+	c.mutex.Lock()
+	if len(c.free) == 0 {
+		page := a.newPage()
+		if page == nil {
+			c.mutex.Unlock()
+			return slabChunk{}, nil, false
+		}
+		c.carve(page)
+	}
+	chunk := c.free[len(c.free)-1]
+	c.free = c.free[:len(c.free)-1]
+	chunk.page.free--
+	c.used++
+	c.mutex.Unlock()
+	atomic.StoreInt32(chunk.refs(), 1)
+	buf := chunk.page.mem[chunk.off : chunk.off+len(data)]
+	copy(buf, data)
+	return chunk, buf, true
+}
+
+// newPage returns a page to carve: a spare page if there is one, else a page taken from the arena if there is one.
+// It returns nil when the arena is used up.
+func (a *slabAllocator) newPage() *slabPage {
+	a.arenaMutex.Lock()
+	defer a.arenaMutex.Unlock()
+	if n := len(a.spare); n > 0 {
+		page := a.spare[n-1]
+		a.spare = a.spare[:n-1]
+		return page
+	}
+	if a.arena == nil {
+		return &slabPage{mem: make([]byte, slabPageSize), index: -1}
+	}
+	index := len(a.arenaPages)
+	if (index+1)*slabPageSize > len(a.arena) {
+		return nil
+	}
+	page := &slabPage{mem: a.arena[index*slabPageSize : (index+1)*slabPageSize : (index+1)*slabPageSize], index: index}
+	a.arenaPages = append(a.arenaPages, page)
+	return page
+}
+
+// retain takes another reference to a chunk, which must be referenced already.
+func (a *slabAllocator) retain(chunk slabChunk) {
+	atomic.AddInt32(chunk.refs(), 1)
+}
+
+// release drops a reference to a chunk. Once the last one is gone the chunk goes back on the free list of its class, and the
+// last chunk of a draining page hands the page over to the spare pages.
+func (a *slabAllocator) release(chunk slabChunk) {
+	if atomic.AddInt32(chunk.refs(), -1) > 0 {
+		return
+	}
+	page := chunk.page
+	c := page.class
+	c.mutex.Lock()
+	page.free++
+	c.used--
+	if !page.draining {
+		c.free = append(c.free, chunk)
+	} else if page.free == c.chunksPerPage() {
+		page.draining = false
+		c.removePage(page)
+		a.arenaMutex.Lock()
+		a.spare = append(a.spare, page)
+		a.moved++
+		a.arenaMutex.Unlock()
+	}
+	c.mutex.Unlock()
+}
+
+// removePage takes page and its free chunks away from the class. Class lock must be held.
+func (c *slabClass) removePage(page *slabPage) {
+	for i, p := range c.pages {
+		if p == page {
+			c.pages = append(c.pages[:i], c.pages[i+1:]...)
+			break
+		}
+	}
+	free := c.free[:0]
+	for _, chunk := range c.free {
+		if chunk.page != page {
+			free = append(free, chunk)
+		}
+	}
+	c.free = free
+}
+
+// drain picks the emptiest page of every class whose free chunks elsewhere can take all its items, and marks it draining.
+// Only classes with at least a page worth of free chunks qualify, and a page that is free already becomes a spare page right away.
+// It returns the pages whose items must be moved.
+func (a *slabAllocator) drain() map[*slabPage]bool {
+	pages := map[*slabPage]bool{}
+	for _, c := range a.classes {
+		c.mutex.Lock()
+		if len(c.free) >= c.chunksPerPage() && len(c.pages) > 1 {
+			var victim *slabPage
+			for _, page := range c.pages {
+				if !page.draining && (victim == nil || page.free > victim.free) {
+					victim = page
+				}
+			}
+			switch {
+			case victim == nil: // All pages are draining already.
+			case victim.free == c.chunksPerPage():
+				c.removePage(victim)
+				a.arenaMutex.Lock()
+				a.spare = append(a.spare, victim)
+				a.moved++
+				a.arenaMutex.Unlock()
+			default:
+				victim.draining = true
+				free := c.free[:0]
+				for _, chunk := range c.free {
+					if chunk.page != victim {
+						free = append(free, chunk)
+					}
+				}
+				c.free = free
+				pages[victim] = true
+			}
+		}
+		c.mutex.Unlock()
+	}
+	return pages
+}
+
+// move copies the bytes of a chunk on a draining page into a fresh chunk of the same class and releases the old one.
+// It returns ok false, keeping the old chunk, if no chunk is available.
+func (a *slabAllocator) move(chunk slabChunk, data []byte) (slabChunk, []byte, bool) {
+	fresh, buf, ok := a.alloc(data)
+	if !ok {
+		return chunk, data, false
+	}
+	a.release(chunk)
+	return fresh, buf, true
+}
+
+// reassign moves a completely free page from class src to class dst, rebalancing memory towards classes in demand.
+func (a *slabAllocator) reassign(src, dst int) error {
+	if src < 1 || src > len(a.classes) || dst < 1 || dst > len(a.classes) {
+		return ErrSlabBadClass
+	}
+	if src == dst {
+		return ErrSlabSame
+	}
+	from, to := a.classes[src-1], a.classes[dst-1]
+	// Lock classes in id order to avoid deadlocks between concurrent reassignments.
+	first, second := from, to
+	if first.id > second.id {
+		first, second = second, first
+	}
+	first.mutex.Lock()
+	defer first.mutex.Unlock()
+	second.mutex.Lock()
+	defer second.mutex.Unlock()
+
+	for _, page := range from.pages {
+		if page.free != from.chunksPerPage() {
+			continue
+		}
+		from.removePage(page)
+		to.carve(page)
+		return nil
+	}
+	return ErrSlabNoSpare
+}
+
+// stats reports memcached style "stats slabs" counters for every class holding pages.
+func (a *slabAllocator) stats() []Stat {
+	var stats []Stat
+	active, malloced := 0, 0
+	for _, c := range a.classes {
+		c.mutex.Lock()
+		pages, free, used := len(c.pages), len(c.free), c.used
+		c.mutex.Unlock()
+		if pages == 0 {
+			continue
+		}
+		active++
+		malloced += pages * slabPageSize
+		prefix := strconv.Itoa(c.id) + ":"
+		stats = append(stats,
+			Stat{prefix + "chunk_size", strconv.Itoa(c.chunkSize)},
+			Stat{prefix + "chunks_per_page", strconv.Itoa(c.chunksPerPage())},
+			Stat{prefix + "total_pages", strconv.Itoa(pages)},
+			Stat{prefix + "total_chunks", strconv.Itoa(pages * c.chunksPerPage())},
+			Stat{prefix + "used_chunks", strconv.FormatUint(used, 10)},
+			Stat{prefix + "free_chunks", strconv.Itoa(free)},
+		)
+	}
+	a.arenaMutex.Lock()
+	spare, moved := len(a.spare), a.moved
+	a.arenaMutex.Unlock()
+	return append(stats,
+		Stat{"active_slabs", strconv.Itoa(active)},
+		Stat{"total_malloced", strconv.Itoa(malloced)},
+		Stat{"spare_pages", strconv.Itoa(spare)},
+		Stat{"slabs_moved", strconv.FormatUint(moved, 10)},
+	)
+}
+
+// TextSlabsHandler handles the "slabs reassign <source class> <dest class>" and "slabs compact" commands.
+var TextSlabsHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	if len(args) == 2 && args[1] == "compact" {
+		s, ok := baseStore(ctx.Store).(interface{ CompactSlabs() int })
+		if !ok {
+			return writeTextLine(ctx, "ERROR")
+		}
+		s.CompactSlabs()
+		return writeTextLine(ctx, "OK")
+	}
+	if len(args) != 4 || args[1] != "reassign" {
+		return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+	}
+	src, err1 := strconv.Atoi(args[2])
+	dst, err2 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil {
+		return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+	}
+	s, ok := baseStore(ctx.Store).(interface{ ReassignSlabPage(src, dst int) error })
+	if !ok {
+		return writeTextLine(ctx, "ERROR")
+	}
+	if err := s.ReassignSlabPage(src, dst); err != nil {
+		return writeTextLine(ctx, "%s", err.Error())
+	}
+	return writeTextLine(ctx, "OK")
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// snapshotMagic starts every snapshot file and versions its format.
+const snapshotMagic = "MCSNAP1\n"
+
+// Errors reading a snapshot.
+var (
+	ErrSnapshotFormat  = errors.New("Not a snapshot file")
+	ErrSnapshotCorrupt = errors.New("Snapshot checksum mismatch")
+)
+
+// itemHeaderLen is the fixed part of a persisted item: key length, flags, CAS, expiration and value length.
+const itemHeaderLen = 2 + 4 + 8 + 8 + 4
+
+// encodeItemHeader fills the fixed part of a persisted item. The expiration is saved as unix time, so it stays correct across restarts.
+func encodeItemHeader(hdr []byte, key string, val SimpleValue) {
+	binary.BigEndian.PutUint16(hdr[0:], uint16(len(key)))
+	binary.BigEndian.PutUint32(hdr[2:], val.Flag)
+	binary.BigEndian.PutUint64(hdr[6:], val.CAS)
+	binary.BigEndian.PutUint64(hdr[14:], uint64(unixExpiration(val.TTL)))
+	binary.BigEndian.PutUint32(hdr[22:], uint32(len(val.RawData)))
+}
+
+// decodeItemHeader parses the fixed part of a persisted item. live is false if the item expired meanwhile.
+func decodeItemHeader(hdr []byte) (keyLen, valLen int, val SimpleValue, live bool) {
+	val = SimpleValue{Flag: binary.BigEndian.Uint32(hdr[2:]), CAS: binary.BigEndian.Uint64(hdr[6:])}
+	val.TTL = ttlFromUnix(int64(binary.BigEndian.Uint64(hdr[14:])))
+	return int(binary.BigEndian.Uint16(hdr[0:])), int(binary.BigEndian.Uint32(hdr[22:])), val, !val.expired()
+}
+
+// restorer is implemented by stores that can insert an item keeping its CAS value, as loading a snapshot requires.
+type restorer interface {
+	Restore(key string, val SimpleValue) error
+}
+
+// Restore inserts an item as is, keeping its CAS. CAS values handed out later are larger than any restored one.
+func (kv *SimpleKV) Restore(key string, val SimpleValue) error {
+	if !kv.fits(key, val) {
+		return ErrValueTooLarge
+	}
+	kv.cas.observe(val.CAS)
+	s := kv.shardFor(key)
+	val = kv.own(val)
+	kv.makeRoom(key, itemSize(key, val))
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return kv.store(s, key, val)
+}
+
+// WriteSnapshot saves all live items of store to path. The file is written next to path and renamed into place, so an existing snapshot is only replaced by a complete one.
+// With an encryption key configured in Settings, the snapshot is encrypted with AES-GCM.
+func WriteSnapshot(store Store, path string) (items int, err error) {
+	aead, err := settingsPersistKey()
+	if err != nil {
+		return 0, err
+	}
+	return writeSnapshot(store, path, aead, nil)
+}
+
+// writeSnapshot implements WriteSnapshot, encrypting the snapshot with aead unless it is nil. beforeRename, if not nil, runs
+// once the new snapshot is complete, just before it replaces the old one.
+func writeSnapshot(store Store, path string, aead cipher.AEAD, beforeRename func() error) (items int, err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	var out io.Writer = tmp
+	var fw *frameWriter
+	if aead != nil {
+		if _, err = tmp.WriteString(encryptedMagic); err != nil {
+			return 0, err
+		}
+		fw = newFrameWriter(tmp, aead)
+		out = fw
+	}
+	crc := crc32.NewIEEE()
+	w := bufio.NewWriter(io.MultiWriter(out, crc))
+	w.WriteString(snapshotMagic)
+	var hdr [itemHeaderLen]byte
+	store.Iterate(func(key string, val SimpleValue) bool {
+		encodeItemHeader(hdr[:], key, val)
+		w.Write(hdr[:])
+		w.WriteString(key)
+		_, err = w.Write(val.RawData)
+		items++
+		return err == nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	// A record with an empty key ends the items. Keys are never empty.
+	w.Write(make([]byte, itemHeaderLen))
+	if err = w.Flush(); err != nil {
+		return 0, err
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	if _, err = out.Write(sum[:]); err != nil {
+		return 0, err
+	}
+	if fw != nil {
+		if err = fw.Close(); err != nil {
+			return 0, err
+		}
+	}
+	if err = tmp.Sync(); err != nil {
+		return 0, err
+	}
+	if err = tmp.Close(); err != nil {
+		return 0, err
+	}
+	if beforeRename != nil {
+		if err = beforeRename(); err != nil {
+			return 0, err
+		}
+	}
+	return items, os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot inserts the items saved in a snapshot file into store, skipping those expired meanwhile.
+// The checksum is verified at the end, so on ErrSnapshotCorrupt the store may hold part of the items.
+// An encrypted snapshot is read with the key configured in Settings.
+func LoadSnapshot(store Store, path string) (items int, err error) {
+	aead, err := settingsPersistKey()
+	if err != nil {
+		return 0, err
+	}
+	return loadSnapshot(store, path, aead)
+}
+
+// loadSnapshot implements LoadSnapshot, decrypting the snapshot with aead.
+func loadSnapshot(store Store, path string, aead cipher.AEAD) (items int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if magic, _ := r.Peek(len(encryptedMagic)); string(magic) == encryptedMagic {
+		if aead == nil {
+			return 0, ErrNoPersistKey
+		}
+		r.Discard(len(encryptedMagic))
+		r = bufio.NewReader(&frameReader{r: r, aead: aead})
+	}
+	crc := crc32.NewIEEE()
+	tr := io.TeeReader(r, crc)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(tr, magic); err != nil {
+		return 0, fmt.Errorf("Reading snapshot: %v", err)
+	}
+	if string(magic) != snapshotMagic {
+		return 0, ErrSnapshotFormat
+	}
+	var hdr [itemHeaderLen]byte
+	for {
+		if _, err := io.ReadFull(tr, hdr[:]); err != nil {
+			return items, fmt.Errorf("Reading snapshot: %v", err)
+		}
+		keyLen, valLen, val, live := decodeItemHeader(hdr[:])
+		if keyLen == 0 {
+			break
+		}
+		buf := make([]byte, keyLen+valLen)
+		if _, err := io.ReadFull(tr, buf); err != nil {
+			return items, fmt.Errorf("Reading snapshot: %v", err)
+		}
+		if !live {
+			continue
+		}
+		val.RawData = buf[keyLen:]
+		if err := restoreItem(store, string(buf[:keyLen]), val); err != nil {
+			continue
+		}
+		items++
+	}
+	var sum [4]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil || binary.BigEndian.Uint32(sum[:]) != crc.Sum32() {
+		return items, ErrSnapshotCorrupt
+	}
+	return items, nil
+}
+
+// restoreItem inserts a loaded item, keeping its CAS if the store supports it.
+func restoreItem(store Store, key string, val SimpleValue) error {
+	if rs, ok := baseStore(store).(restorer); ok {
+		return rs.Restore(key, val)
+	}
+	_, err := store.Set(key, val, 0, false)
+	return err
+}
+
+// startPersistence restores store from a backup, the snapshot and the append-only log, then starts journaling and periodic
+// snapshots. It returns store wrapped by the journaling and change counting decorators, or an error if the encryption key
+// or the append-only log can't be read.
+func (s *Server) startPersistence(store Store) (Store, error) {
+	cfg := s.config
+	if cfg.SnapshotPath == "" && cfg.AOFPath == "" && !cfg.BackupRestore {
+		return store, nil
+	}
+	aead, err := loadPersistKey(cfg.PersistKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading encryption key: %v", err)
+	}
+	s.persistKey = aead
+	if cfg.BackupRestore {
+		key, items, err := restoreLatestBackup(store, cfg, aead)
+		if err != nil {
+			s.logger().Error("error restoring backup", "err", err)
+		} else {
+			s.logger().Info("restored backup", "items", items, "backup", key)
+		}
+	}
+	if cfg.SnapshotPath != "" && (cfg.SnapshotLoad || cfg.AOFPath != "") {
+		items, err := loadSnapshot(store, cfg.SnapshotPath, aead)
+		switch {
+		case os.IsNotExist(err):
+			s.logger().Info("no snapshot to load", "path", cfg.SnapshotPath)
+		case err != nil:
+			s.logger().Error("error loading snapshot", "err", err)
+		default:
+			s.logger().Info("loaded snapshot", "items", items, "path", cfg.SnapshotPath)
+		}
+	}
+	var log *aofLog
+	if cfg.AOFPath != "" {
+		records, err := replayAOF(store, cfg.AOFPath, aead, cfg.NamespaceSeparator, s.logger())
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("replaying append-only log: %v", err)
+		}
+		s.logger().Info("replayed append-only log", "records", records, "path", cfg.AOFPath)
+		if log, err = openAOF(cfg.AOFPath, cfg.AOFFsync, aead); err != nil {
+			return nil, fmt.Errorf("opening append-only log: %v", err)
+		}
+		store = newAOFStore(store, log, cfg.NamespaceSeparator, s.logger())
+	}
+	if cfg.SnapshotPath != "" && (cfg.SnapshotInterval > 0 || cfg.SnapshotChanges > 0) {
+		var changes *uint64
+		if cfg.SnapshotChanges > 0 {
+			counter := newChangeCounter(store, cfg.NamespaceSeparator)
+			store, changes = counter, &counter.changes
+		}
+		go s.snapshotter(store, cfg.SnapshotPath, log, changes)
+	}
+	return store, nil
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// snapshotStatus records the outcome of the scheduled snapshots of a server for "stats snapshots".
+type snapshotStatus struct {
+	sync.Mutex
+	written, failed uint64
+	lastTime        time.Time
+	lastDuration    time.Duration
+	lastItems       int
+	lastSize        int64
+}
+
+// changeCounter counts the successful mutations of the wrapped store, so snapshots can be scheduled after a number of changes.
+type changeCounter struct {
+	Store
+	changes   uint64 // Updated atomically.
+	separator string // NamespaceSeparator of the server.
+}
+
+func newChangeCounter(store Store, separator string) *changeCounter {
+	return &changeCounter{Store: store, separator: separator}
+}
+
+// Unwrap returns the counted store.
+func (c *changeCounter) Unwrap() Store {
+	return c.Store
+}
+
+func (c *changeCounter) GetBytes(key []byte) (SimpleValue, bool) {
+	return getBytes(c.Store, key)
+}
+
+func (c *changeCounter) count(err error) {
+	if err == nil {
+		atomic.AddUint64(&c.changes, 1)
+	}
+}
+
+func (c *changeCounter) Set(key string, val SimpleValue, cas uint64, replace bool) (SimpleValue, error) {
+	val, err := c.Store.Set(key, val, cas, replace)
+	c.count(err)
+	return val, err
+}
+
+func (c *changeCounter) Add(key string, val SimpleValue) (SimpleValue, error) {
+	val, err := c.Store.Add(key, val)
+	c.count(err)
+	return val, err
+}
+
+func (c *changeCounter) Delete(key string, cas uint64) error {
+	err := c.Store.Delete(key, cas)
+	c.count(err)
+	return err
+}
+
+func (c *changeCounter) Touch(key string, ttl int) (SimpleValue, bool) {
+	val, ok := c.Store.Touch(key, ttl)
+	if ok {
+		c.count(nil)
+	}
+	return val, ok
+}
+
+func (c *changeCounter) UpdateMeta(key string, ttl int, flags *uint32, cas uint64) (SimpleValue, error) {
+	val, err := updateMeta(c.Store, key, ttl, flags, cas)
+	c.count(err)
+	return val, err
+}
+
+func (c *changeCounter) Incr(key string, delta uint64, decr bool, initial uint64, create bool, ttl int, cas uint64) (SimpleValue, uint64, error) {
+	val, n, err := c.Store.Incr(key, delta, decr, initial, create, ttl, cas)
+	c.count(err)
+	return val, n, err
+}
+
+func (c *changeCounter) Flush(at int) {
+	c.Store.Flush(at)
+	c.count(nil)
+}
+
+func (c *changeCounter) FlushNamespace(name string) {
+	flushNamespace(c.Store, name, c.separator)
+	c.count(nil)
+}
+
+// retainedSnapshot names the n-th older snapshot kept besides the current one.
+func retainedSnapshot(path string, n int) string {
+	return path + "." + strconv.Itoa(n)
+}
+
+// retainSnapshots shifts older snapshots one generation back and links the current one as path.1, keeping keep snapshots in total.
+// The current snapshot stays in place until the new one is renamed over it.
+func retainSnapshots(path string, keep int) error {
+	if keep <= 1 {
+		return nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	os.Remove(retainedSnapshot(path, keep-1))
+	for n := keep - 2; n >= 1; n-- {
+		if err := os.Rename(retainedSnapshot(path, n), retainedSnapshot(path, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Link(path, retainedSnapshot(path, 1))
+}
+
+// takeSnapshot writes one scheduled snapshot. With an append-only log, the log is rotated first, so it only needs to hold mutations since the last snapshot.
+func (s *Server) takeSnapshot(store Store, path string, log *aofLog) error {
+	if log != nil {
+		if err := log.rotate(); err != nil {
+			return fmt.Errorf("Rotating append-only log: %v", err)
+		}
+	}
+	start := time.Now()
+	items, err := writeSnapshot(store, path, s.persistKey, func() error {
+		return retainSnapshots(path, s.config.SnapshotRetain)
+	})
+	status := &s.snapshots
+	if err != nil {
+		status.Lock()
+		status.failed++
+		status.Unlock()
+		return err
+	}
+	if log != nil {
+		log.dropRotated()
+	}
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+	status.Lock()
+	status.written++
+	status.lastTime, status.lastDuration = start, time.Since(start)
+	status.lastItems, status.lastSize = items, size
+	status.Unlock()
+	s.logger().Info("wrote snapshot", "items", items, "bytes", size, "path", path, "duration", time.Since(start))
+	return nil
+}
+
+// snapshotter writes a snapshot whenever SnapshotInterval passed or, with a changes counter, SnapshotChanges mutations happened
+// since the last one, until s is shut down.
+func (s *Server) snapshotter(store Store, path string, log *aofLog, changes *uint64) {
+	interval, threshold := s.config.SnapshotInterval, uint64(s.config.SnapshotChanges)
+	tick := time.Second
+	if interval > 0 && interval < tick {
+		tick = interval
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	last, lastChanges := time.Now(), uint64(0)
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+		due := interval > 0 && time.Since(last) >= interval
+		var current uint64
+		if changes != nil {
+			current = atomic.LoadUint64(changes)
+			due = due || current-lastChanges >= threshold
+		}
+		if !due {
+			continue
+		}
+		last, lastChanges = time.Now(), current
+		if err := s.takeSnapshot(store, path, log); err != nil {
+			s.logger().Error("error writing snapshot", "err", err)
+		}
+	}
+}
+
+// snapshotStats reports the "stats snapshots" group.
+func snapshotStats(ctx *ConnectionContext) ([]Stat, bool) {
+	status := &ctx.server.snapshots
+	status.Lock()
+	defer status.Unlock()
+	var last int64
+	if !status.lastTime.IsZero() {
+		last = status.lastTime.Unix()
+	}
+	return []Stat{
+		{"snapshots_written", strconv.FormatUint(status.written, 10)},
+		{"snapshots_failed", strconv.FormatUint(status.failed, 10)},
+		{"snapshot_last_time", strconv.FormatInt(last, 10)},
+		{"snapshot_last_duration_us", strconv.FormatInt(status.lastDuration.Microseconds(), 10)},
+		{"snapshot_last_items", strconv.Itoa(status.lastItems)},
+		{"snapshot_last_bytes", strconv.FormatInt(status.lastSize, 10)},
+		{"snapshot_retain", strconv.Itoa(ctx.server.config.SnapshotRetain)},
+	}, true
+}
@@ -0,0 +1,412 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Stat is one name/value pair reported by the stats command.
+type Stat struct {
+	Name  string
+	Value string
+}
+
+// serverStats holds the counters of a server behind "stats" and the binary STAT command. The handlers and connections update
+// them atomically. Item counters, like curr_items and evictions, are kept by the store.
+type serverStats struct {
+	cmdGet             uint64 // Retrieval commands.
+	cmdSet             uint64 // Storage commands, including append, prepend and swap.
+	cmdTouch           uint64
+	getHits            uint64
+	getMisses          uint64
+	touchHits          uint64 // Touch and GAT commands finding their key.
+	touchMisses        uint64
+	deleteHits         uint64
+	deleteMisses       uint64
+	incrHits           uint64
+	incrMisses         uint64
+	decrHits           uint64
+	decrMisses         uint64
+	casHits            uint64 // Storage commands with a CAS value that matched.
+	casMisses          uint64 // Storage commands with a CAS value whose key was missing.
+	casBadval          uint64 // Storage commands with a CAS value that didn't match.
+	bytesRead          uint64 // Bytes read from clients.
+	bytesWritten       uint64 // Bytes sent to clients.
+	currConns          int64
+	totalConns         uint64
+	idleKicks          uint64 // Connections closed for idling longer than IdleTimeout.
+	rejectedConns      uint64 // Connections refused because MaxConns were open.
+	ipConnsRejected    uint64 // Connections refused because MaxConnsPerIP of their IP were open.
+	busyConns          uint64 // Connections refused because all ConnWorkers were busy and the queue was full.
+	queuedConns        int64  // Accepted connections waiting for a ConnWorkers worker.
+	authCmds           uint64 // SASL Auth and Step commands.
+	authErrors         uint64 // Failed authentications.
+	authThrottled      uint64 // Authentications refused as their IP was backing off or banned after failed ones.
+	authBans           uint64 // IPs banned for failing AuthBanThreshold authentications in a row.
+	authBannedConns    uint64 // Connections refused as their IP was banned.
+	sslHandshakeErrors uint64 // Connections of TLS listeners closed as their handshake failed.
+	proxyErrors        uint64 // Connections of PROXY protocol listeners closed for a missing or malformed header.
+	ipAllowMatches     uint64 // Connections admitted for matching IPAllowlist.
+	ipDenyMatches      uint64 // Connections refused for matching IPDenylist.
+	ipUnlisted         uint64 // Connections refused for not matching IPAllowlist.
+	rateLimited        uint64 // Commands exceeding a rate limit.
+	aclDenied          uint64 // Commands refused by an ACL.
+}
+
+// reset zeroes the counters for "stats reset". The gauges curr_connections and queued_connections keep their values.
+func (s *serverStats) reset() {
+	for _, c := range []*uint64{&s.cmdGet, &s.cmdSet, &s.cmdTouch, &s.getHits, &s.getMisses, &s.touchHits, &s.touchMisses,
+		&s.deleteHits, &s.deleteMisses, &s.incrHits, &s.incrMisses, &s.decrHits, &s.decrMisses, &s.casHits, &s.casMisses, &s.casBadval,
+		&s.bytesRead, &s.bytesWritten, &s.totalConns, &s.idleKicks, &s.rejectedConns, &s.ipConnsRejected, &s.busyConns,
+		&s.authCmds, &s.authErrors, &s.authThrottled, &s.authBans, &s.authBannedConns, &s.sslHandshakeErrors, &s.proxyErrors, &s.ipAllowMatches, &s.ipDenyMatches, &s.ipUnlisted, &s.rateLimited, &s.aclDenied} {
+		atomic.StoreUint64(c, 0)
+	}
+}
+
+// resetStats zeroes the stats of s for "stats reset": the counters, the latency histograms of "stats latency", the protocol
+// error counts, the counts per client IP and per user, and the item counters of the store if it keeps any.
+func (s *Server) resetStats() {
+	s.counters.reset()
+	s.latency.reset()
+	s.protocolErrors.reset()
+	s.clients.reset()
+	s.userCounts.reset()
+	if kv, ok := baseStore(s.cache).(interface{ resetStats() }); ok {
+		kv.resetStats()
+	}
+}
+
+// countGet counts a retrieval command and whether it hit.
+func (s *serverStats) countGet(hit bool) {
+	atomic.AddUint64(&s.cmdGet, 1)
+	countHit(&s.getHits, &s.getMisses, hit)
+}
+
+// countHit counts a command of a family with hit and miss counters.
+func countHit(hits, misses *uint64, hit bool) {
+	if hit {
+		atomic.AddUint64(hits, 1)
+	} else {
+		atomic.AddUint64(misses, 1)
+	}
+}
+
+// countResult counts the outcome of a command of a family with hit and miss counters from the error of its store call.
+// Errors other than ErrKeyNotFound are neither.
+func countResult(hits, misses *uint64, err error) {
+	if err == nil || err == ErrKeyNotFound {
+		countHit(hits, misses, err == nil)
+	}
+}
+
+// countCAS counts a storage command carrying a CAS value from the error of its store call.
+func (s *serverStats) countCAS(err error) {
+	switch err {
+	case nil:
+		atomic.AddUint64(&s.casHits, 1)
+	case ErrKeyNotFound:
+		atomic.AddUint64(&s.casMisses, 1)
+	case ErrKeyExists:
+		atomic.AddUint64(&s.casBadval, 1)
+	}
+}
+
+// hitRatio returns the share of retrievals that found their key, 0 before the first retrieval.
+func (s *serverStats) hitRatio() float64 {
+	hits, misses := atomic.LoadUint64(&s.getHits), atomic.LoadUint64(&s.getMisses)
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// itemStats are the stats generalStats takes from the store.
+var itemStats = map[string]bool{"curr_items": true, "total_items": true, "evictions": true, "expired": true}
+
+// generalStats reports the counters of s followed by the stats of store. The item counters are taken from the store if it reports
+// them and are 0 otherwise; other names the counters cover already are left out.
+func (s *Server) generalStats(store Store) []Stat {
+	counters := &s.counters
+	stats := []Stat{
+		{"pid", strconv.Itoa(os.Getpid())},
+		{"uptime", strconv.Itoa(currentTime())},
+		{"time", strconv.FormatInt(clock.Now().Unix(), 10)},
+		{"version", Version},
+		{"curr_connections", strconv.FormatInt(atomic.LoadInt64(&counters.currConns), 10)},
+		{"total_connections", strconv.FormatUint(atomic.LoadUint64(&counters.totalConns), 10)},
+		{"idle_kicks", strconv.FormatUint(atomic.LoadUint64(&counters.idleKicks), 10)},
+		{"max_connections", strconv.Itoa(s.config.MaxConns)},
+		{"rejected_connections", strconv.FormatUint(atomic.LoadUint64(&counters.rejectedConns), 10)},
+		{"max_connections_per_ip", strconv.Itoa(s.maxConnsPerIP())},
+		{"rejected_ip_connections", strconv.FormatUint(atomic.LoadUint64(&counters.ipConnsRejected), 10)},
+		{"queued_connections", strconv.FormatInt(atomic.LoadInt64(&counters.queuedConns), 10)},
+		{"rejected_busy_connections", strconv.FormatUint(atomic.LoadUint64(&counters.busyConns), 10)},
+		{"auth_cmds", strconv.FormatUint(atomic.LoadUint64(&counters.authCmds), 10)},
+		{"auth_errors", strconv.FormatUint(atomic.LoadUint64(&counters.authErrors), 10)},
+		{"auth_throttled", strconv.FormatUint(atomic.LoadUint64(&counters.authThrottled), 10)},
+		{"auth_bans", strconv.FormatUint(atomic.LoadUint64(&counters.authBans), 10)},
+		{"auth_banned_conns", strconv.FormatUint(atomic.LoadUint64(&counters.authBannedConns), 10)},
+		{"ssl_handshake_errors", strconv.FormatUint(atomic.LoadUint64(&counters.sslHandshakeErrors), 10)},
+		{"proxy_header_errors", strconv.FormatUint(atomic.LoadUint64(&counters.proxyErrors), 10)},
+		{"ip_allow_matches", strconv.FormatUint(atomic.LoadUint64(&counters.ipAllowMatches), 10)},
+		{"ip_deny_matches", strconv.FormatUint(atomic.LoadUint64(&counters.ipDenyMatches), 10)},
+		{"ip_unlisted_conns", strconv.FormatUint(atomic.LoadUint64(&counters.ipUnlisted), 10)},
+		{"rate_limited", strconv.FormatUint(atomic.LoadUint64(&counters.rateLimited), 10)},
+		{"acl_denied", strconv.FormatUint(atomic.LoadUint64(&counters.aclDenied), 10)},
+		{"cmd_get", strconv.FormatUint(atomic.LoadUint64(&counters.cmdGet), 10)},
+		{"cmd_set", strconv.FormatUint(atomic.LoadUint64(&counters.cmdSet), 10)},
+		{"cmd_touch", strconv.FormatUint(atomic.LoadUint64(&counters.cmdTouch), 10)},
+		{"get_hits", strconv.FormatUint(atomic.LoadUint64(&counters.getHits), 10)},
+		{"get_misses", strconv.FormatUint(atomic.LoadUint64(&counters.getMisses), 10)},
+		{"hit_ratio", strconv.FormatFloat(counters.hitRatio(), 'f', 4, 64)},
+		{"delete_misses", strconv.FormatUint(atomic.LoadUint64(&counters.deleteMisses), 10)},
+		{"delete_hits", strconv.FormatUint(atomic.LoadUint64(&counters.deleteHits), 10)},
+		{"incr_misses", strconv.FormatUint(atomic.LoadUint64(&counters.incrMisses), 10)},
+		{"incr_hits", strconv.FormatUint(atomic.LoadUint64(&counters.incrHits), 10)},
+		{"decr_misses", strconv.FormatUint(atomic.LoadUint64(&counters.decrMisses), 10)},
+		{"decr_hits", strconv.FormatUint(atomic.LoadUint64(&counters.decrHits), 10)},
+		{"cas_misses", strconv.FormatUint(atomic.LoadUint64(&counters.casMisses), 10)},
+		{"cas_hits", strconv.FormatUint(atomic.LoadUint64(&counters.casHits), 10)},
+		{"cas_badval", strconv.FormatUint(atomic.LoadUint64(&counters.casBadval), 10)},
+		{"touch_hits", strconv.FormatUint(atomic.LoadUint64(&counters.touchHits), 10)},
+		{"touch_misses", strconv.FormatUint(atomic.LoadUint64(&counters.touchMisses), 10)},
+		{"bytes_read", strconv.FormatUint(atomic.LoadUint64(&counters.bytesRead), 10)},
+		{"bytes_written", strconv.FormatUint(atomic.LoadUint64(&counters.bytesWritten), 10)},
+		{"curr_items", "0"},
+		{"total_items", "0"},
+		{"evictions", "0"},
+		{"expired", "0"},
+		{"protocol_errors", strconv.FormatUint(s.protocolErrors.totalCount(), 10)},
+	}
+	stats = append(stats, runtimeStats()...)
+	index := make(map[string]int, len(stats))
+	for i, stat := range stats {
+		index[stat.Name] = i
+	}
+	for _, stat := range store.Stats() {
+		if i, ok := index[stat.Name]; !ok {
+			stats = append(stats, stat)
+		} else if itemStats[stat.Name] {
+			stats[i] = stat
+		}
+	}
+	if s.access != nil {
+		stats = append(stats, s.access.stats()...)
+	}
+	return stats
+}
+
+// settingsStats reports the settings of the server, named as in config files. maxbytes and item_size_max repeat max_memory and
+// max_request_size under their memcached names. Settings holding functions or interfaces, like hooks, are left out.
+func settingsStats(ctx *ConnectionContext) ([]Stat, bool) {
+	s := ctx.server
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	stats := []Stat{
+		{"maxbytes", strconv.FormatUint(s.config.MaxMemory, 10)},
+		{"item_size_max", strconv.Itoa(s.config.MaxRequestSize)},
+	}
+	var names []string
+	for name := range configFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field := reflect.ValueOf(s.config).Field(configFields[name])
+		kind := field.Kind()
+		if kind == reflect.Map {
+			kind = field.Type().Elem().Kind()
+		}
+		if kind == reflect.Func || kind == reflect.Interface || kind == reflect.Struct {
+			continue
+		}
+		stats = append(stats, Stat{name, settingText(field.Interface())})
+	}
+	return stats, true
+}
+
+// settingText formats the value of a setting for "stats settings", writing NULL for empty strings like memcached.
+func settingText(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return "NULL"
+		}
+	case []ListenerConfig:
+		list := make([]string, len(v))
+		for i, lc := range v {
+			list[i] = lc.String()
+		}
+		// Separated like in $MEMCACHED_LISTENERS, as listeners may hold commas.
+		return strings.Join(list, " ")
+	case map[string]CommandACL:
+		var list []string
+		for user, acl := range v {
+			list = append(list, user+"="+acl.String())
+		}
+		sort.Strings(list)
+		return strings.Join(list, " ")
+	case IPNets:
+		if len(v) == 0 {
+			return "NULL"
+		}
+	case []string:
+		if len(v) == 0 {
+			return "NULL"
+		}
+		return strings.Join(v, " ")
+	case map[string]NamespaceQuota:
+		var list []string
+		for name, quota := range v {
+			list = append(list, fmt.Sprintf("%s=%d,%d", name, quota.MaxMemory/(1024*1024), quota.MaxItems))
+		}
+		sort.Strings(list)
+		return strings.Join(list, " ")
+	}
+	return fmt.Sprint(value)
+}
+
+// runtimeStats reports the state of the Go runtime. threads and pointer_size are named like the memcached stats,
+// threads being the number of OS threads running Go code at once.
+func runtimeStats() []Stat {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return []Stat{
+		{"pointer_size", strconv.Itoa(strconv.IntSize)},
+		{"threads", strconv.Itoa(runtime.GOMAXPROCS(0))},
+		{"goroutines", strconv.Itoa(runtime.NumGoroutine())},
+		{"heap_inuse", strconv.FormatUint(mem.HeapInuse, 10)},
+		{"heap_objects", strconv.FormatUint(mem.HeapObjects, 10)},
+		{"gc_count", strconv.FormatUint(uint64(mem.NumGC), 10)},
+		{"gc_pause_total_us", strconv.FormatUint(mem.PauseTotalNs/1e3, 10)},
+	}
+}
+
+// countingConn counts the bytes read from and written to a client connection, in total and for the client's IP.
+type countingConn struct {
+	net.Conn
+	stats   *serverStats // Counters of the server.
+	client  *clientCounters
+	traffic *uint64 // Bytes read and written by the connection.
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.stats.bytesRead, uint64(n))
+	atomic.AddUint64(&c.client.bytesRead, uint64(n))
+	atomic.AddUint64(c.traffic, uint64(n))
+	return n, err
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.stats.bytesWritten, uint64(n))
+	atomic.AddUint64(&c.client.bytesWritten, uint64(n))
+	atomic.AddUint64(c.traffic, uint64(n))
+	return n, err
+}
+
+// statsGroups maps the argument of "stats <group>" to the function reporting the group. ok is false if the group isn't available.
+var statsGroups = map[string]func(ctx *ConnectionContext) (stats []Stat, ok bool){
+	"slabs":           slabStats,
+	"snapshots":       snapshotStats,
+	"namespaces":      namespaceStats,
+	"hotkeys":         hotKeyStats,
+	"topkeys":         topKeyStats,
+	"latency":         latencyStats,
+	"conns":           connStats,
+	"protocol_errors": protocolErrorStats,
+	"clients":         clientStats,
+	"users":           userStats,
+	"settings":        settingsStats,
+}
+
+func slabStats(ctx *ConnectionContext) ([]Stat, bool) {
+	s, ok := baseStore(ctx.Store).(interface{ SlabStats() []Stat })
+	if !ok {
+		return nil, false
+	}
+	return s.SlabStats(), true
+}
+
+// TextStatsHandler handles the "stats", "stats <group>" and "stats reset" commands
+var TextStatsHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	var stats []Stat
+	switch {
+	case len(args) == 1:
+		stats = ctx.server.generalStats(ctx.Store)
+	case len(args) == 2 && args[1] == "reset":
+		ctx.server.resetStats()
+		return writeTextLine(ctx, "RESET")
+	case len(args) == 2:
+		group, ok := statsGroups[args[1]]
+		if ok {
+			stats, ok = group(ctx)
+		}
+		if !ok {
+			return writeTextLine(ctx, "ERROR")
+		}
+	default:
+		return writeTextLine(ctx, "ERROR")
+	}
+	for _, stat := range stats {
+		if err := writeTextLine(ctx, "STAT %s %s", stat.Name, stat.Value); err != nil {
+			return err
+		}
+	}
+	return writeTextLine(ctx, "END")
+}
+
+// StatHandler handles the STAT command. An empty key requests the general stats, a key names a group like "stats <group>".
+// Every stat is sent as a response with the name as key, followed by a response without key and value. The key "reset"
+// zeroes the counters like "stats reset" and only gets the final response.
+var StatHandler HandleFunc = func(header RequestHeader, ctx *ConnectionContext) error {
+	if header.ExtraLength != 0 || header.TotalBodyLength != uint32(header.KeyLength) {
+		return fmt.Errorf("Stat command MUST have key only: keylength %d, extralength: %d, totalbodylength: %d",
+			header.KeyLength, header.ExtraLength, header.TotalBodyLength)
+	}
+	key, err := readBody(header, ctx)
+	if err != nil {
+		return err
+	}
+	var stats []Stat
+	if len(key) == 0 {
+		stats = ctx.server.generalStats(ctx.Store)
+	} else if string(key) == "reset" {
+		ctx.server.resetStats()
+	} else {
+		group, ok := statsGroups[string(key)]
+		if ok {
+			stats, ok = group(ctx)
+		}
+		if !ok {
+			return writeError(header, ErrKeyNotFound, ctx)
+		}
+	}
+	respHeader := ResponseHeader{}
+	respHeader.Magic = MagicResponse
+	respHeader.Opcode = header.Opcode
+	respHeader.Opaque = header.Opaque
+	respHeader.Status = CodeNoError
+	for _, stat := range stats {
+		if err := writeResponse(respHeader, nil, []byte(stat.Name), []byte(stat.Value), ctx.RW); err != nil {
+			return err
+		}
+	}
+	return writeResponse(respHeader, nil, nil, nil, ctx.RW)
+}
+
+func (c countingConn) writeBuffers(bufs *net.Buffers) (int64, error) {
+	n, err := writeBuffers(c.Conn, bufs)
+	atomic.AddUint64(&c.stats.bytesWritten, uint64(n))
+	atomic.AddUint64(&c.client.bytesWritten, uint64(n))
+	atomic.AddUint64(c.traffic, uint64(n))
+	return n, err
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// logStats logs a summary of the server stats every interval until s shuts down: commands per second, the hit ratio and
+// evictions since the previous line, memory in use, items and connections.
+func (s *Server) logStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	commands := s.latency.command.total()
+	hits, misses := atomic.LoadUint64(&s.counters.getHits), atomic.LoadUint64(&s.counters.getMisses)
+	evictions := statValue(s.cache.Stats(), "evictions")
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+		nowCommands := s.latency.command.total()
+		nowHits, nowMisses := atomic.LoadUint64(&s.counters.getHits), atomic.LoadUint64(&s.counters.getMisses)
+		stats := s.cache.Stats()
+		nowEvictions := statValue(stats, "evictions")
+		// Counters may go back after "stats reset"; the interval then starts from zero.
+		if nowHits < hits || nowMisses < misses || nowCommands < commands || nowEvictions < evictions {
+			commands, hits, misses, evictions = 0, 0, 0, 0
+		}
+		ratio := 0.0
+		if gets := nowHits - hits + nowMisses - misses; gets > 0 {
+			ratio = float64(nowHits-hits) / float64(gets)
+		}
+		s.logger().Info("stats",
+			"qps", strconv.FormatFloat(float64(nowCommands-commands)/interval.Seconds(), 'f', 1, 64),
+			"hit_ratio", strconv.FormatFloat(ratio, 'f', 4, 64),
+			"bytes", statValue(stats, "bytes"),
+			"items", statValue(stats, "curr_items"),
+			"connections", atomic.LoadInt64(&s.counters.currConns),
+			"evictions", nowEvictions-evictions)
+		commands, hits, misses, evictions = nowCommands, nowHits, nowMisses, nowEvictions
+	}
+}
+
+// statValue returns the counter name of stats, 0 if it is missing.
+func statValue(stats []Stat, name string) uint64 {
+	for _, stat := range stats {
+		if stat.Name == name {
+			n, _ := strconv.ParseUint(stat.Value, 10, 64)
+			return n
+		}
+	}
+	return 0
+}
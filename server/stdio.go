@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net"
+	"os"
+	"time"
+)
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// stdioConn is a net.Conn reading requests from stdin and writing responses to stdout.
+type stdioConn struct{}
+
+func (stdioConn) Read(b []byte) (int, error)  { return os.Stdin.Read(b) }
+func (stdioConn) Write(b []byte) (int, error) { return os.Stdout.Write(b) }
+func (stdioConn) LocalAddr() net.Addr         { return stdioAddr{} }
+func (stdioConn) RemoteAddr() net.Addr        { return stdioAddr{} }
+
+func (stdioConn) Close() error {
+	os.Stdin.Close()
+	return os.Stdout.Close()
+}
+
+func (stdioConn) SetDeadline(t time.Time) error      { return nil }
+func (stdioConn) SetReadDeadline(t time.Time) error  { return nil }
+func (stdioConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// ServeStdio serves Settings like NewServer(WithConfig(Settings)).ServeStdio().
+//
+// Deprecated: Use NewServer.
+func ServeStdio() {
+	NewServer(WithConfig(Settings)).ServeStdio()
+}
+
+// ServeStdio serves a single session over stdin/stdout and returns once the client quits or stdin is exhausted.
+// When stdin is a socket, as with inetd, the socket is served directly so the remote address is known.
+// Log lines go to stderr in this mode. Like Start, it exits the process if the store can't be opened.
+func (s *Server) ServeStdio() {
+	logOutput = os.Stderr
+	if err := s.openStore(); err != nil {
+		s.logger().Error("error serving", "err", err)
+		os.Exit(1)
+	}
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.FileConn(os.Stdin); err == nil {
+			s.handleConn(conn, ListenerConfig{}, nil)
+			return
+		}
+	}
+	s.handleConn(stdioConn{}, ListenerConfig{}, nil)
+}
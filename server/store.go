@@ -0,0 +1,112 @@
+package server
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Errors reported by Store implementations. Handlers map them to response status codes.
+var (
+	ErrKeyNotFound   = errors.New("Not found")
+	ErrKeyExists     = errors.New("Data exists for key.")
+	ErrValueTooLarge = errors.New("Too large.")
+	ErrNonNumeric    = errors.New("Non-numeric server-side value for incr or decr")
+	ErrNotStored     = errors.New("Not stored.")
+	ErrOutOfMemory   = errors.New("Out of memory")
+)
+
+// Store is the interface of the k/v storage the command handlers operate on.
+// SimpleKV is the built-in implementation; embedders can plug their own backend through Config.Store.
+// Expired items must be reported as missing by all methods.
+// RawData of values passed in is only borrowed for the duration of a call; implementations copy what they keep.
+type Store interface {
+	// Get looks up a key.
+	Get(key string) (SimpleValue, bool)
+	// Set stores a value and assigns it a new CAS. With replace, the key must already exist.
+	// For an existing key a non-zero cas must match the stored one.
+	Set(key string, val SimpleValue, cas uint64, replace bool) (SimpleValue, error)
+	// Add stores a value only when the key does not exist yet.
+	Add(key string, val SimpleValue) (SimpleValue, error)
+	// Delete removes a key. A non-zero cas must match the stored one.
+	Delete(key string, cas uint64) error
+	// Touch sets a new TTL on an existing key and returns the item.
+	Touch(key string, ttl int) (SimpleValue, bool)
+	// Incr adds delta to the decimal number stored at key, or subtracts it with decr, not going below 0.
+	// A missing key is created holding initial and ttl when create is set. A non-zero cas must match the stored one.
+	// Return values are 1. stored item, 2. new number, 3. error.
+	Incr(key string, delta uint64, decr bool, initial uint64, create bool, ttl int, cas uint64) (SimpleValue, uint64, error)
+	// Flush removes all items stored before the time at, given like a TTL (see expiration). 0 flushes right away.
+	Flush(at int)
+	// Stats reports counters of the storage for the stats command.
+	Stats() []Stat
+	// Iterate calls fn for every live item until fn returns false. fn must not call back into the store.
+	Iterate(fn func(key string, val SimpleValue) bool)
+}
+
+// ByteKeyStore is implemented by stores looking up keys given as bytes, which spares GET converting the key of the request
+// to a string, an allocation per command. The key is only valid during the call: what the store keeps of it must be copied.
+// The value may share the memory of the store instead of being a copy, so GET can write it out as is. It stays intact even
+// if the item is replaced meanwhile, until the caller releases it with SimpleValue.Release.
+// Decorators implement it by passing the key on if their Get keeps nothing of it, and leave it out otherwise. Decorators
+// dropping a value they got must release it.
+type ByteKeyStore interface {
+	GetBytes(key []byte) (SimpleValue, bool)
+}
+
+// getBytes looks up key in store, without allocating a string for it if the store is a ByteKeyStore. The value must be
+// released.
+func getBytes(store Store, key []byte) (SimpleValue, bool) {
+	if bs, ok := store.(ByteKeyStore); ok {
+		return bs.GetBytes(key)
+	}
+	return store.Get(string(key))
+}
+
+// borrowString returns a string sharing the bytes of b rather than copying them. It is only valid while b is unchanged, so it
+// must not be kept beyond the call it is passed to.
+func borrowString(b []byte) string {
+	return unsafe.String(unsafe.SliceData(b), len(b))
+}
+
+// casCounter hands out the CAS values of a store. It starts from the creation time in nanoseconds instead of 0, so a restarted server
+// doesn't repeat CAS values clients may still hold; that would take more than one mutation per nanosecond the old process ran.
+type casCounter struct {
+	last uint64 // Last CAS value handed out. Updated atomically.
+}
+
+func newCASCounter() casCounter {
+	return casCounter{last: uint64(time.Now().UnixNano())}
+}
+
+// next returns a new CAS value. Value 0 is skipped as it means "no CAS" in requests.
+func (c *casCounter) next() uint64 {
+	cas := atomic.AddUint64(&c.last, 1)
+	if cas == 0 {
+		cas = atomic.AddUint64(&c.last, 1)
+	}
+	return cas
+}
+
+// observe moves the counter past cas, the CAS value of a restored item, so later values are larger.
+func (c *casCounter) observe(cas uint64) {
+	for {
+		last := atomic.LoadUint64(&c.last)
+		if cas <= last || atomic.CompareAndSwapUint64(&c.last, last, cas) {
+			return
+		}
+	}
+}
+
+// baseStore returns the store wrapped by decorators such as the append-only log, which implement Unwrap.
+// Optional capabilities like SlabStats are looked up on it.
+func baseStore(s Store) Store {
+	for {
+		w, ok := s.(interface{ Unwrap() Store })
+		if !ok {
+			return s
+		}
+		s = w.Unwrap()
+	}
+}
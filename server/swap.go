@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// swapValue stores val at key like a set and returns the item it replaced, with ok false if the key didn't exist.
+// A non-zero cas must match the stored item. The replaced item is exactly the one read, as it's replaced by a Set with its CAS;
+// a concurrent change is retried. Like appendValue, this works with any store.
+func swapValue(store Store, key string, val SimpleValue, cas uint64) (stored, old SimpleValue, ok bool, err error) {
+	for {
+		old, ok = store.Get(key)
+		if !ok {
+			if cas != 0 {
+				return SimpleValue{}, SimpleValue{}, false, ErrKeyNotFound
+			}
+			stored, err = store.Add(key, val)
+			if err == ErrKeyExists {
+				continue
+			}
+			return stored, SimpleValue{}, false, err
+		}
+		if cas != 0 && cas != old.CAS {
+			return SimpleValue{}, SimpleValue{}, false, ErrKeyExists
+		}
+		stored, err = store.Set(key, val, old.CAS, true)
+		if (err == ErrKeyExists || err == ErrKeyNotFound) && cas == 0 {
+			continue
+		}
+		if err != nil {
+			return SimpleValue{}, SimpleValue{}, false, err
+		}
+		return stored, old, true, nil
+	}
+}
+
+// SwapHandler handles the SWAP extension: a SET whose response carries the item it replaced, saving the GET of compare-and-swap
+// style updates. The request is laid out like a SET. The response CAS is the new item's; if the key existed, the extras hold the
+// flags and CAS of the old item and the value its data, otherwise there are no extras.
+var SwapHandler HandleFunc = func(header RequestHeader, ctx *ConnectionContext) error {
+	if header.ExtraLength != 8 || header.KeyLength == 0 {
+		return fmt.Errorf("Swap command MUST have key and extra : keylength %d, extralength: %d, totalbodylength: %d",
+			header.KeyLength, header.ExtraLength, header.TotalBodyLength)
+	}
+	buf, err := readBody(header, ctx)
+	if err != nil {
+		return err
+	}
+	if !ctx.server.validKey(buf[8 : 8+header.KeyLength]) {
+		return writeError(header, ErrInvalidKey, ctx)
+	}
+	val := SimpleValue{
+		RawData: buf[8+header.KeyLength:], // The store copies the value out of the read buffer.
+		Flag:    GetUint32(buf),
+		TTL:     ctx.server.itemExpiration(GetUint32(buf[4:])),
+	}
+	atomic.AddUint64(&ctx.server.counters.cmdSet, 1)
+	stored, old, ok, err := swapValue(ctx.Store, string(buf[8:8+header.KeyLength]), val, header.CAS)
+	if header.CAS != 0 {
+		ctx.server.counters.countCAS(err)
+	}
+	audit(ctx, opcodeName(header.Opcode), string(buf[8:8+header.KeyLength]), len(val.RawData), auditCAS(stored.CAS, header.CAS, err), err)
+	if err != nil {
+		return writeError(header, err, ctx)
+	}
+	respHeader := ResponseHeader{}
+	respHeader.Magic = MagicResponse
+	respHeader.Opcode = header.Opcode
+	respHeader.Opaque = header.Opaque
+	respHeader.Status = CodeNoError
+	respHeader.CAS = stored.CAS
+	if !ok {
+		return writeResponse(respHeader, nil, nil, nil, ctx.RW)
+	}
+	extras := ctx.buffer(12)
+	for pos := 0; pos < 4; pos++ {
+		extras[pos] = GetNthByteFromUint32(old.Flag, pos)
+		extras[4+pos] = GetNthByteFromUint32(uint32(old.CAS>>32), pos)
+		extras[8+pos] = GetNthByteFromUint32(uint32(old.CAS), pos)
+	}
+	return writeResponse(respHeader, extras, nil, old.RawData, ctx.RW)
+}
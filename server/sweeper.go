@@ -0,0 +1,65 @@
+package server
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// sweeper periodically removes expired items, so keys that are never read again don't hold memory forever.
+// Every run examines at most batch items per shard, walking the LRU from its cold end and resuming where the previous run stopped.
+func (kv *SimpleKV) sweeper(interval time.Duration, batch int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-kv.done:
+			return
+		case <-ticker.C:
+			for _, s := range kv.shards {
+				kv.sweepShard(s, batch)
+			}
+		}
+	}
+}
+
+// sweepShard examines up to batch items of shard s and removes the expired and flushed ones.
+func (kv *SimpleKV) sweepShard(s *simpleShard, batch int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	elem := s.sweepCursor
+	if elem == nil {
+		elem = s.lru.Back()
+	}
+	for i := 0; i < batch && elem != nil; i++ {
+		prev := elem.Prev()
+		entry := elem.Value.(*simpleEntry)
+		// Removing an element moves the cursor off it, so elem is stored still; checked all the same, as removing an entry
+		// twice would free its memory twice.
+		if s.items[entry.key] == elem && kv.dead(entry) {
+			atomic.AddUint64(&kv.sweptItems, 1)
+			atomic.AddUint64(&kv.sweptBytes, itemSize(entry.key, entry.val))
+			kv.removeDead(s, elem)
+		}
+		elem = prev
+	}
+	s.sweepCursor = elem
+}
+
+// Close stops the background sweeper and LRU maintainer and closes the disk tier file.
+func (kv *SimpleKV) Close() {
+	kv.closeOnce.Do(func() {
+		close(kv.done)
+		if kv.ext != nil {
+			kv.ext.close()
+		}
+	})
+}
+
+// sweeperStats reports what the sweeper reclaimed.
+func (kv *SimpleKV) sweeperStats() []Stat {
+	return []Stat{
+		{"crawler_reclaimed", strconv.FormatUint(atomic.LoadUint64(&kv.sweptItems), 10)},
+		{"crawler_reclaimed_bytes", strconv.FormatUint(atomic.LoadUint64(&kv.sweptBytes), 10)},
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TextHandler is the interface for all ASCII command handling functions.
+// args holds the whitespace separated tokens of the command line, args[0] being the command name.
+type TextHandler interface {
+	HandleText([]string, *ConnectionContext) error
+}
+
+// TextHandleFunc implements TextHandler interface so ASCII command handling functions can be accessed through TextHandler interface.
+type TextHandleFunc func([]string, *ConnectionContext) error
+
+// HandleText function serves as a proxy to calling its owning function.
+func (f TextHandleFunc) HandleText(args []string, ctx *ConnectionContext) error {
+	return f(args, ctx)
+}
+
+// writeTextLine writes one CRLF terminated response line.
+func writeTextLine(ctx *ConnectionContext, format string, a ...interface{}) error {
+	_, err := fmt.Fprintf(ctx.RW, format+"\r\n", a...)
+	return err
+}
+
+// TextVersionHandler handles the "version" command
+var TextVersionHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	return writeTextLine(ctx, "VERSION %s", Version)
+}
+
+// TextQuitHandler handles the "quit" command
+var TextQuitHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	return io.EOF
+}
+
+// TextFlushAllHandler handles the "flush_all [delay] [noreply]" command
+var TextFlushAllHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	noreply := len(args) > 1 && args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	var exptime uint64
+	if len(args) == 2 {
+		var err error
+		if exptime, err = strconv.ParseUint(args[1], 10, 32); err != nil {
+			return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+		}
+	} else if len(args) > 2 {
+		return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+	}
+	ctx.Store.Flush(expiration(uint32(exptime)))
+	audit(ctx, args[0], "", 0, 0, nil)
+	if noreply {
+		return nil
+	}
+	return writeTextLine(ctx, "OK")
+}
+
+// textOpHandlers returns the map from ASCII command name -> command handler a Server starts with.
+func textOpHandlers() map[string]TextHandler {
+	return map[string]TextHandler{
+		"version":         TextVersionHandler,
+		"quit":            TextQuitHandler,
+		"flush_all":       TextFlushAllHandler,
+		"conns":           TextConnsHandler,
+		"conn":            TextConnHandler,
+		"stats":           TextStatsHandler,
+		"slabs":           TextSlabsHandler,
+		"backup":          TextBackupHandler,
+		"dump":            TextDumpHandler,
+		"lru_crawler":     TextLRUCrawlerHandler,
+		"flush_namespace": TextFlushNamespaceHandler,
+		"lease-get":       TextLeaseGetHandler,
+		"lease-set":       TextLeaseSetHandler,
+		"profile":         TextProfileHandler,
+		"trace_key":       TextTraceKeyHandler,
+		"config":          TextConfigHandler,
+		"health":          TextHealthHandler,
+		"verbosity":       TextVerbosityHandler,
+		"refresh_certs":   TextRefreshCertsHandler,
+	}
+}
+
+func handleTextCommand(context *ConnectionContext) error {
+	line, err := context.RW.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		writeTextLine(context, "CLIENT_ERROR line too long")
+		return protocolErrorf(protoLineTooLong, "command line longer than %d bytes", context.RW.Reader.Size())
+	}
+	if err == io.EOF && len(line) > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	context.countCommand()
+	args := strings.Fields(string(line))
+	if len(args) == 0 {
+		return writeTextLine(context, "ERROR")
+	}
+	handler, ok := context.server.textHandlers[args[0]]
+	if !ok {
+		countProtocolError(context, protoUnknownCommand)
+		return writeTextLine(context, "ERROR")
+	}
+	keyLen := 0
+	if len(args) > 1 {
+		keyLen = len(args[1])
+	}
+	context.trace.startCommand(args[0], false, keyLen, len(line))
+	if keyLen > 0 {
+		context.trace.setKey(args[1])
+	}
+	context.logTextCommand(args)
+	start := time.Now()
+	reason := context.beforeCommand(CommandInfo{Name: args[0], Args: args})
+	if reason == nil && context.User == "" && !authFreeTextCommands[args[0]] && context.authRequired() {
+		reason = ErrAuth
+	}
+	if reason == nil {
+		reason = context.checkACL(args[0])
+	}
+	if reason == nil {
+		reason = context.rateLimit()
+	}
+	if reason == errRateLimitClose || reason == errDraining {
+		return reason
+	}
+	if reason != nil {
+		err = rejectTextCommand(args, reason, context)
+	} else {
+		err = handler.HandleText(args, context)
+	}
+	context.releaseBuffers()
+	took := time.Since(start)
+	context.server.latency.command.observe(took)
+	context.server.latency.text[args[0]].record(took)
+	logSlowCommand(context, args[0], took)
+	return err
+}
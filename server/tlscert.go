@@ -0,0 +1,225 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// certReloader hands the certificate of TLSCertFile and TLSKeyFile, and the authorities of TLSClientCAFile, to TLS handshakes.
+// Reloading it swaps them for new handshakes, while established connections keep the ones they were set up with.
+type certReloader struct {
+	certFile, keyFile string
+	caFile            string       // Empty if client certificates aren't verified.
+	cert              atomic.Value // *tls.Certificate
+	clientCAs         atomic.Value // *x509.CertPool of caFile.
+	mutex             sync.Mutex   // Serializes reloads.
+	modTime           time.Time    // Latest modification time of the files when last loaded. Guarded by mutex.
+}
+
+// newCertReloader loads the certificate in certFile, its key in keyFile, and the certificate authorities in caFile if set.
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// getCertificate is the tls.Config.GetCertificate of encrypted listeners.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load().(*tls.Certificate), nil
+}
+
+// reload loads the files again. The current certificate stays in use if they don't hold a valid pair.
+func (r *certReloader) reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	return r.load(modTime)
+}
+
+// reloadIfChanged reloads the files if either was modified since they were loaded, and reports whether it did.
+func (r *certReloader) reloadIfChanged() (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	modTime, err := r.latestModTime()
+	if err != nil || !modTime.After(r.modTime) {
+		return false, err
+	}
+	return true, r.load(modTime)
+}
+
+func (r *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %v", err)
+	}
+	if r.caFile != "" {
+		pool, err := loadCertPool(r.caFile)
+		if err != nil {
+			return fmt.Errorf("loading TLS client CA: %v", err)
+		}
+		r.clientCAs.Store(pool)
+	}
+	r.cert.Store(&cert)
+	r.modTime = modTime
+	return nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile, r.caFile} {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("loading TLS certificate: %v", err)
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// loadCertPool reads the PEM certificates in path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificate in %s", path)
+	}
+	return pool, nil
+}
+
+// Listener client certificate policies, see ListenerConfig.ClientCert.
+const (
+	ClientCertRequired = "required"
+	ClientCertOptional = "optional"
+)
+
+// Certificate fields naming the user of a client certificate, see Config.TLSIdentity.
+const (
+	TLSIdentityCN  = "cn"
+	TLSIdentitySAN = "san"
+)
+
+// IsTLSIdentity reports whether name is a supported value of Config.TLSIdentity.
+func IsTLSIdentity(name string) bool {
+	return name == TLSIdentityCN || name == TLSIdentitySAN
+}
+
+// tlsHandshakeTimeout bounds the TLS handshake of new connections, which runs before the idle timeout is armed.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// tlsConfig returns the TLS settings of the connections of lc: the certificate of the server, and verification of client
+// certificates as lc asks for.
+func (s *Server) tlsConfig(lc ListenerConfig) *tls.Config {
+	clientAuth := tls.NoClientCert
+	switch lc.ClientCert {
+	case ClientCertRequired:
+		clientAuth = tls.RequireAndVerifyClientCert
+	case ClientCertOptional:
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			// A config per handshake picks up reloaded client authorities.
+			conf := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: s.certs.getCertificate, ClientAuth: clientAuth}
+			if pool, ok := s.certs.clientCAs.Load().(*x509.CertPool); ok {
+				conf.ClientCAs = pool
+			}
+			return conf, nil
+		},
+	}
+}
+
+// tlsHandshake completes the handshake of a TLS connection and returns the user named by its verified client certificate,
+// empty if it sent none.
+func (s *Server) tlsHandshake(conn *tls.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		return "", err
+	}
+	conn.SetDeadline(time.Time{})
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return "", nil
+	}
+	user := certIdentity(state.PeerCertificates[0], s.config.TLSIdentity)
+	if user == "" {
+		return "", errors.New("client certificate names no user")
+	}
+	if sep := s.config.NamespaceSeparator; s.config.IsolateUsers && sep != "" && strings.Contains(user, sep) {
+		// Like in the users file, such a user would get the namespace of another.
+		return "", fmt.Errorf("client certificate user %q contains the namespace separator %q", user, sep)
+	}
+	return user, nil
+}
+
+// certIdentity returns the user named by cert: its subject common name with TLSIdentityCN, or with TLSIdentitySAN its first
+// DNS name, else e-mail address, else URI among the subject alternative names.
+func certIdentity(cert *x509.Certificate, identity string) string {
+	if identity != TLSIdentitySAN {
+		return cert.Subject.CommonName
+	}
+	switch {
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// watchCertificates reloads the certificate whenever its files change, checking them every TLSReloadInterval, until the server
+// is shut down. Files being replaced may be caught half written; the next check retries them.
+func (s *Server) watchCertificates() {
+	ticker := time.NewTicker(s.config.TLSReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if changed, err := s.certs.reloadIfChanged(); err != nil {
+				s.logger().Error("error reloading TLS certificate", "err", err)
+			} else if changed {
+				s.logger().Info("reloaded TLS certificate", "path", s.config.TLSCertFile)
+			}
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// TextRefreshCertsHandler handles the "refresh_certs" command of memcached, reloading the TLS certificate right away.
+var TextRefreshCertsHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	if len(args) != 1 {
+		return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+	}
+	certs := ctx.server.certs
+	if certs == nil {
+		return writeTextLine(ctx, "SERVER_ERROR no TLS certificate")
+	}
+	if err := certs.reload(); err != nil {
+		return writeTextLine(ctx, "SERVER_ERROR %v", err)
+	}
+	ctx.logger().Info("reloaded TLS certificate", "path", ctx.server.config.TLSCertFile)
+	return writeTextLine(ctx, "OK")
+}
@@ -0,0 +1,84 @@
+package server
+
+import "strconv"
+
+// topKeysTop is the number of keys listed by "stats topkeys" for reads and for writes each.
+const topKeysTop = 20
+
+// topKeyStore samples the keys read and written through the wrapped store into separate trackers.
+// Get and Touch count as reads, all other commands naming a key as writes.
+type topKeyStore struct {
+	Store
+	reads, writes *hotKeyTracker
+}
+
+// Unwrap returns the sampled store.
+func (t *topKeyStore) Unwrap() Store {
+	return t.Store
+}
+
+func (t *topKeyStore) Get(key string) (SimpleValue, bool) {
+	t.reads.record(key)
+	return t.Store.Get(key)
+}
+
+func (t *topKeyStore) Touch(key string, ttl int) (SimpleValue, bool) {
+	t.reads.record(key)
+	return t.Store.Touch(key, ttl)
+}
+
+func (t *topKeyStore) Set(key string, val SimpleValue, cas uint64, replace bool) (SimpleValue, error) {
+	t.writes.record(key)
+	return t.Store.Set(key, val, cas, replace)
+}
+
+func (t *topKeyStore) Add(key string, val SimpleValue) (SimpleValue, error) {
+	t.writes.record(key)
+	return t.Store.Add(key, val)
+}
+
+func (t *topKeyStore) Delete(key string, cas uint64) error {
+	t.writes.record(key)
+	return t.Store.Delete(key, cas)
+}
+
+func (t *topKeyStore) UpdateMeta(key string, ttl int, flags *uint32, cas uint64) (SimpleValue, error) {
+	t.writes.record(key)
+	return updateMeta(t.Store, key, ttl, flags, cas)
+}
+
+func (t *topKeyStore) Incr(key string, delta uint64, decr bool, initial uint64, create bool, ttl int, cas uint64) (SimpleValue, uint64, error) {
+	t.writes.record(key)
+	return t.Store.Incr(key, delta, decr, initial, create, ttl, cas)
+}
+
+// trackTopKeys wraps store to sample the keys read and written if enabled by TopKeysSampleRate.
+func (s *Server) trackTopKeys(store Store) Store {
+	if s.config.TopKeysSampleRate <= 0 {
+		return store
+	}
+	rate, window := s.config.TopKeysSampleRate, s.config.TopKeysInterval
+	s.topKeys = &topKeyStore{Store: store, reads: newHotKeyTracker(rate, window), writes: newHotKeyTracker(rate, window)}
+	return s.topKeys
+}
+
+// topKeyStats reports the keys read and written most over the last TopKeysInterval for "stats topkeys", as read:<key> and
+// write:<key> with the estimated number of requests.
+func topKeyStats(ctx *ConnectionContext) ([]Stat, bool) {
+	topKeys := ctx.server.topKeys
+	if topKeys == nil {
+		return nil, false
+	}
+	var stats []Stat
+	for _, k := range topKeys.reads.top(topKeysTop) {
+		if key, ok := ctx.ownKey(k.key); ok {
+			stats = append(stats, Stat{"read:" + key, strconv.FormatUint(k.count, 10)})
+		}
+	}
+	for _, k := range topKeys.writes.top(topKeysTop) {
+		if key, ok := ctx.ownKey(k.key); ok {
+			stats = append(stats, Stat{"write:" + key, strconv.FormatUint(k.count, 10)})
+		}
+	}
+	return stats, true
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// traceSpan is a span of the traces exported when Config.OTLPEndpoint is set.
+type traceSpan interface {
+	child(name string) traceSpan // Starts a span within this one.
+	set(key string, value interface{})
+	fail(err error)
+	end()
+}
+
+// startTraceSpan starts the root span of a connection. It is set by startTracing and nil while tracing is off.
+var startTraceSpan func(name string) traceSpan
+
+// noSpan stands in for spans while only the access log observes commands.
+type noSpan struct{}
+
+func (noSpan) child(name string) traceSpan       { return noSpan{} }
+func (noSpan) set(key string, value interface{}) {}
+func (noSpan) fail(err error)                    {}
+func (noSpan) end()                              {}
+
+// opcodeNames names the binary opcodes in traces.
+var opcodeNames = map[uint8]string{
+	OpGet: "get", OpSet: "set", OpAdd: "add", OpReplace: "replace", OpDelete: "delete", OpIncrement: "incr", OpDecrement: "decr",
+	OpQuit: "quit", OpFlush: "flush", OpGetQ: "getq", OpNoOp: "noop", OpVersion: "version", OpGetK: "getk", OpGetKQ: "getkq",
+	OpAppend: "append", OpPrepend: "prepend", OpStat: "stat", OpSetQ: "setq", OpAddQ: "addq", OpReplaceQ: "replaceq",
+	OpDeleteQ: "deleteq", OpIncrementQ: "incrq", OpDecrementQ: "decrq", OpAppendQ: "appendq", OpPrependQ: "prependq",
+	OpFlushQ: "flushq", OpTouch: "touch", OpGAT: "gat", OpGATQ: "gatq", OpSwap: "swap", OpGetLocked: "getl", OpUnlockKey: "unl",
+	OpVerbosity: "verbosity", OpSASLListMechs: "sasl_list_mechs", OpSASLAuth: "sasl_auth", OpSASLStep: "sasl_step",
+}
+
+// opcodeName returns the name of a binary opcode, or its hex value if it has none.
+func opcodeName(opcode uint8) string {
+	if name, ok := opcodeNames[opcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", opcode)
+}
+
+// retrievalOps are the commands a trace records a hit or miss for.
+var retrievalOps = map[string]bool{
+	"get": true, "getq": true, "getk": true, "getkq": true, "gat": true, "gatq": true, "getl": true, "lease-get": true,
+}
+
+// tracedConn remembers the first bytes of the reply to the command being traced, and counts the bytes written.
+type tracedConn struct {
+	net.Conn
+	reply    [16]byte
+	replyLen int
+	written  int
+}
+
+func (c *tracedConn) Write(b []byte) (int, error) {
+	if c.replyLen == 0 {
+		c.replyLen = copy(c.reply[:], b)
+	}
+	n, err := c.Conn.Write(b)
+	c.written += n
+	return n, err
+}
+
+func (c *tracedConn) writeBuffers(bufs *net.Buffers) (int64, error) {
+	if c.replyLen == 0 && len(*bufs) > 0 {
+		c.replyLen = copy(c.reply[:], (*bufs)[0])
+	}
+	n, err := writeBuffers(c.Conn, bufs)
+	c.written += int(n)
+	return n, err
+}
+
+// connTrace traces a connection and the commands handled on it, for the spans exported by startTracing and for the access log.
+// All methods do nothing on a nil connTrace, which connections get while both are off.
+type connTrace struct {
+	id        uint64
+	span      traceSpan
+	conn      *tracedConn
+	access    *accessLog // Access log of the server, nil if it has none.
+	command   traceSpan  // Span of the command being handled. It ends once its reply was flushed.
+	name      string
+	retrieval bool
+	binary    bool
+	logged    bool   // Whether the access log samples the command.
+	key       string // Key of the command, set if it is logged.
+	reqBytes  int
+	start     time.Time
+}
+
+// traceConn starts the trace of a new connection, returning the connection to serve it on. Both are unchanged while tracing,
+// the access log and hooks following commands are off.
+func traceConn(conn net.Conn, id uint64, access *accessLog, hooked bool) (net.Conn, *connTrace) {
+	if startTraceSpan == nil && access == nil && !hooked {
+		return conn, nil
+	}
+	t := &connTrace{id: id, span: noSpan{}, conn: &tracedConn{Conn: conn}, access: access}
+	if startTraceSpan != nil {
+		t.span = startTraceSpan("connection")
+	}
+	t.span.set("db.system.name", "memcached")
+	t.span.set("memcached.conn_id", id)
+	t.span.set("network.peer.address", conn.RemoteAddr().String())
+	return t.conn, t
+}
+
+// startCommand starts the span of a command with the name of its opcode or text command.
+func (t *connTrace) startCommand(name string, binary bool, keyLen, reqBytes int) {
+	if t == nil {
+		return
+	}
+	t.command = t.span.child(name)
+	t.command.set("db.operation.name", name)
+	t.command.set("memcached.key_length", keyLen)
+	t.command.set("memcached.request_bytes", reqBytes)
+	t.name = name
+	t.retrieval = retrievalOps[name]
+	t.binary = binary
+	t.logged = t.access.sample()
+	t.key = ""
+	t.reqBytes = reqBytes
+	t.conn.replyLen = 0
+	t.conn.written = 0
+	t.start = time.Now()
+}
+
+// setKey records the key of the command for the access log.
+func (t *connTrace) setKey(key string) {
+	if t != nil && t.logged {
+		t.key = key
+	}
+}
+
+// readKey records the key of a binary command from its body.
+func (t *connTrace) readKey(header RequestHeader, body []byte) {
+	if t != nil && t.logged && int(header.ExtraLength)+int(header.KeyLength) <= len(body) {
+		t.key = string(body[header.ExtraLength : int(header.ExtraLength)+int(header.KeyLength)])
+	}
+}
+
+// endCommand ends the span of the command whose reply was just flushed, recording its status and the size of the reply.
+// err is the error ending the connection, if any. It returns the status, as logged by the access log.
+func (t *connTrace) endCommand(err error) string {
+	if t == nil || t.command == nil {
+		return "-"
+	}
+	reply := t.conn.reply[:t.conn.replyLen]
+	hit := false
+	status := "-" // Quiet commands may not reply at all.
+	if t.binary {
+		if len(reply) >= 8 {
+			code := int(reply[6])<<8 | int(reply[7])
+			t.command.set("memcached.status", code)
+			hit = code == int(CodeNoError)
+			status = fmt.Sprintf("0x%04x", code)
+		}
+	} else if len(reply) > 0 {
+		status = string(reply)
+		if i := strings.IndexAny(status, " \r\n"); i >= 0 {
+			status = status[:i]
+		}
+		t.command.set("memcached.reply", status)
+		hit = status == "VALUE"
+	}
+	if t.logged {
+		t.access.push(accessEntry{time: t.start, conn: t.id, op: t.name, key: t.key, status: status,
+			latency: time.Since(t.start), reqBytes: t.reqBytes, respBytes: t.conn.written})
+	}
+	if t.retrieval {
+		t.command.set("memcached.hit", hit)
+	}
+	t.command.set("memcached.response_bytes", t.conn.written)
+	if err != nil {
+		t.command.fail(err)
+	}
+	t.command.end()
+	t.command = nil
+	return status
+}
+
+// end ends the span of the connection.
+func (t *connTrace) end(ctx *ConnectionContext) {
+	if t == nil {
+		return
+	}
+	_, commands, _ := ctx.activity()
+	t.span.set("memcached.commands", commands)
+	t.span.end()
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upgradeEnv lists the names of the listeners a process inherits from the process it replaces, separated by commas. The
+// listeners are the files from fd 3 on, in order. The one named upgradeReady is a pipe to write to once the listeners serve.
+const upgradeEnv = EnvPrefix + "INHERITED_LISTENERS"
+
+const upgradeReady = "ready"
+
+// upgradeTimeout bounds how long Upgrade waits for the new process to serve before killing it and serving on.
+const upgradeTimeout = time.Minute
+
+var (
+	inheritOnce sync.Once
+	inheritMu   sync.Mutex
+	inherited   map[string]*os.File // Files named by upgradeEnv not taken by a listener yet.
+)
+
+// takeInherited returns the file named name inherited from the process this one replaces, nil if there is none. Every file
+// is returned once.
+func takeInherited(name string) *os.File {
+	inheritOnce.Do(func() {
+		names := os.Getenv(upgradeEnv)
+		if names == "" {
+			return
+		}
+		os.Unsetenv(upgradeEnv)
+		inherited = map[string]*os.File{}
+		for i, name := range strings.Split(names, ",") {
+			inherited[name] = os.NewFile(uintptr(3+i), name)
+		}
+	})
+	inheritMu.Lock()
+	defer inheritMu.Unlock()
+	f := inherited[name]
+	delete(inherited, name)
+	return f
+}
+
+// upgrading reports whether the process replaces another one through Upgrade and didn't tell it that it serves yet.
+func upgrading() bool {
+	takeInherited("")
+	inheritMu.Lock()
+	defer inheritMu.Unlock()
+	return inherited[upgradeReady] != nil
+}
+
+// upgraded tells the process this one replaces that it serves, so the old process drains.
+func upgraded() {
+	if f := takeInherited(upgradeReady); f != nil {
+		f.Write([]byte{1})
+		f.Close()
+	}
+}
+
+// openListener returns the listener named name inherited from the process this one replaces, or the one opened by open if
+// there is none. The listener is handed over to the process replacing this one by Upgrade.
+func (s *Server) openListener(name string, open func() (net.Listener, error)) (net.Listener, error) {
+	var l net.Listener
+	var err error
+	if f := takeInherited(name); f != nil {
+		l, err = net.FileListener(f)
+		f.Close()
+		if ul, ok := l.(*net.UnixListener); ok {
+			// Remove the socket at shutdown like a listener opened by this process.
+			ul.SetUnlinkOnClose(true)
+		}
+		if err == nil {
+			s.logger().Info("inherited listener", "addr", l.Addr())
+		}
+	} else {
+		l, err = open()
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	s.handover[name] = l
+	s.mutex.Unlock()
+	return l, nil
+}
+
+// Upgrade replaces the process by a new one running the executable of the process, e.g. after it was replaced by a newer
+// version, with the same arguments. The new process inherits the listeners, so no connection is refused while both start
+// and stop. Once the new process serves, the server shuts down like on SIGTERM and Serve returns; if it fails to start,
+// Upgrade returns an error and the server serves on. The process receiving SIGUSR2 upgrades.
+// Stores in a memory file can't be upgraded, as both processes would share the file.
+func (s *Server) Upgrade() error {
+	if err := s.serving(); err != nil {
+		return err
+	}
+	if s.config.MemoryFile != "" {
+		return errors.New("can't upgrade a server keeping items in a memory file")
+	}
+	s.mutex.Lock()
+	if s.upgrading {
+		s.mutex.Unlock()
+		return errors.New("upgrade in progress")
+	}
+	s.upgrading = true
+	var names []string
+	var files []*os.File
+	for name, l := range s.handover {
+		f, err := l.(interface{ File() (*os.File, error) }).File()
+		if err != nil {
+			s.mutex.Unlock()
+			return s.upgradeFailed(files, fmt.Errorf("listener %s: %v", l.Addr(), err))
+		}
+		names, files = append(names, name), append(files, f)
+	}
+	s.mutex.Unlock()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return s.upgradeFailed(files, err)
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return s.upgradeFailed(files, err)
+	}
+	defer ready.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), upgradeEnv+"="+strings.Join(append(names, upgradeReady), ","))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return s.upgradeFailed(files, err)
+	}
+	s.logger().Info("upgrading", "pid", cmd.Process.Pid)
+
+	ready.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			cmd.Process.Kill()
+			err = fmt.Errorf("new process didn't serve within %v", upgradeTimeout)
+		} else {
+			err = errors.New("new process exited before serving")
+		}
+		go cmd.Wait()
+		return s.upgradeFailed(files, err)
+	}
+	for _, f := range files {
+		f.Close()
+	}
+	s.mutex.Lock()
+	for _, l := range s.handover {
+		if ul, ok := l.(*net.UnixListener); ok {
+			// The new process serves on the socket file.
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	s.mutex.Unlock()
+	s.logger().Info("upgraded, shutting down", "pid", cmd.Process.Pid)
+	close(s.upgraded)
+	return nil
+}
+
+// upgradeFailed closes the listener files duplicated for a failed upgrade, allowing the next one, and returns err.
+func (s *Server) upgradeFailed(files []*os.File, err error) error {
+	for _, f := range files {
+		f.Close()
+	}
+	s.mutex.Lock()
+	s.upgrading = false
+	s.mutex.Unlock()
+	return err
+}
+
+// upgradeOnSignal upgrades the process whenever it receives one of upgradeSignals, until the server is shut down.
+func (s *Server) upgradeOnSignal() {
+	if len(upgradeSignals) == 0 {
+		return
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, upgradeSignals...)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case <-sig:
+			if err := s.Upgrade(); err != nil {
+				s.logger().Error("error upgrading", "err", err)
+			}
+		case <-s.closing:
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// maxStatsUsers bounds the users "stats users" keeps counters for. Users first authenticating once it's full aren't counted.
+const maxStatsUsers = 1024
+
+// userCounters counts the activity of one authenticated user. Updated atomically.
+type userCounters struct {
+	user     string
+	auths    uint64 // Authentications, with SASL or a client certificate.
+	commands uint64 // Commands served while authenticated as the user.
+}
+
+// userCounterTable holds the userCounters of the users that authenticated to a server, by name.
+type userCounterTable struct {
+	mutex  sync.Mutex
+	byUser map[string]*userCounters
+}
+
+// authenticate counts an authentication of user and returns its counters, nil once the table is full.
+func (t *userCounterTable) authenticate(user string) *userCounters {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	u := t.byUser[user]
+	if u == nil {
+		if len(t.byUser) >= maxStatsUsers {
+			return nil
+		}
+		if t.byUser == nil {
+			t.byUser = map[string]*userCounters{}
+		}
+		u = &userCounters{user: user}
+		t.byUser[user] = u
+	}
+	atomic.AddUint64(&u.auths, 1)
+	return u
+}
+
+// reset zeroes the counters of all users for "stats reset", keeping the users tracked.
+func (t *userCounterTable) reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, u := range t.byUser {
+		atomic.StoreUint64(&u.auths, 0)
+		atomic.StoreUint64(&u.commands, 0)
+	}
+}
+
+// authenticated makes ctx count its commands into the counters of its User, none if anonymous.
+func (ctx *ConnectionContext) authenticated() {
+	ctx.userCounts = nil
+	if ctx.User != "" {
+		ctx.userCounts = ctx.server.userCounts.authenticate(ctx.User)
+	}
+}
+
+// userStats reports the activity per user for "stats users", as <user>:<counter>. The busiest users by commands come first.
+// Isolated users only see their own.
+func userStats(ctx *ConnectionContext) ([]Stat, bool) {
+	userCounts := &ctx.server.userCounts
+	userCounts.mutex.Lock()
+	all := make([]*userCounters, 0, len(userCounts.byUser))
+	for _, u := range userCounts.byUser {
+		if _, isolated := ctx.Store.(*userStore); !isolated || u.user == ctx.User {
+			all = append(all, u)
+		}
+	}
+	userCounts.mutex.Unlock()
+	commands := make(map[*userCounters]uint64, len(all))
+	for _, u := range all {
+		commands[u] = atomic.LoadUint64(&u.commands)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if commands[all[i]] != commands[all[j]] {
+			return commands[all[i]] > commands[all[j]]
+		}
+		return all[i].user < all[j].user
+	})
+	var stats []Stat
+	for _, u := range all {
+		stats = append(stats,
+			Stat{u.user + ":auths", strconv.FormatUint(atomic.LoadUint64(&u.auths), 10)},
+			Stat{u.user + ":commands", strconv.FormatUint(commands[u], 10)},
+		)
+	}
+	return stats, true
+}
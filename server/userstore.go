@@ -0,0 +1,100 @@
+package server
+
+import (
+	"strings"
+	"time"
+)
+
+// userStore keeps the keys of an authenticated user in the namespace named after the user, for Config.IsolateUsers: keys are
+// prefixed with the user name and NamespaceSeparator on the way in and stripped on the way out, so the user neither sees nor
+// collides with the keys of others. The quota of the namespace in NamespaceQuotas limits the user, and flushes only remove
+// the items of the user.
+type userStore struct {
+	Store
+	user   string
+	sep    string // NamespaceSeparator of the server.
+	prefix string // user followed by sep.
+}
+
+// newUserStore returns the view of store isolating the keys of user in namespaces separated by sep.
+func newUserStore(store Store, user, sep string) *userStore {
+	return &userStore{Store: store, user: user, sep: sep, prefix: user + sep}
+}
+
+// storeKey returns key as the shared store knows it, which is how the tables of item locks and leases must know it too:
+// prefixed for an isolated user.
+func (ctx *ConnectionContext) storeKey(key string) string {
+	if u, ok := ctx.Store.(*userStore); ok {
+		return u.prefix + key
+	}
+	return key
+}
+
+// ownKey reports whether the client may see key of the shared store, as reported by "stats hotkeys" and the like, and
+// returns it as the client knows it. Isolated users only see their own keys, stripped of their prefix.
+func (ctx *ConnectionContext) ownKey(key string) (string, bool) {
+	u, ok := ctx.Store.(*userStore)
+	if !ok {
+		return key, true
+	}
+	if !strings.HasPrefix(key, u.prefix) {
+		return "", false
+	}
+	return key[len(u.prefix):], true
+}
+
+// Unwrap returns the shared store.
+func (u *userStore) Unwrap() Store {
+	return u.Store
+}
+
+func (u *userStore) Get(key string) (SimpleValue, bool) {
+	return u.Store.Get(u.prefix + key)
+}
+
+func (u *userStore) GetBytes(key []byte) (SimpleValue, bool) {
+	return getBytes(u.Store, append([]byte(u.prefix), key...))
+}
+
+func (u *userStore) Set(key string, val SimpleValue, cas uint64, replace bool) (SimpleValue, error) {
+	return u.Store.Set(u.prefix+key, val, cas, replace)
+}
+
+func (u *userStore) Add(key string, val SimpleValue) (SimpleValue, error) {
+	return u.Store.Add(u.prefix+key, val)
+}
+
+func (u *userStore) Delete(key string, cas uint64) error {
+	return u.Store.Delete(u.prefix+key, cas)
+}
+
+func (u *userStore) Touch(key string, ttl int) (SimpleValue, bool) {
+	return u.Store.Touch(u.prefix+key, ttl)
+}
+
+func (u *userStore) UpdateMeta(key string, ttl int, flags *uint32, cas uint64) (SimpleValue, error) {
+	return updateMeta(u.Store, u.prefix+key, ttl, flags, cas)
+}
+
+func (u *userStore) Incr(key string, delta uint64, decr bool, initial uint64, create bool, ttl int, cas uint64) (SimpleValue, uint64, error) {
+	return u.Store.Incr(u.prefix+key, delta, decr, initial, create, ttl, cas)
+}
+
+// Flush removes the items of the user only. A delayed flush can't be cancelled by a later one, unlike on the shared store.
+func (u *userStore) Flush(at int) {
+	if delay := at - currentTime(); at != 0 && delay > 0 {
+		time.AfterFunc(time.Duration(delay)*time.Second, func() { flushNamespace(u.Store, u.user, u.sep) })
+		return
+	}
+	flushNamespace(u.Store, u.user, u.sep)
+}
+
+// Iterate calls fn for the items of the user, with their keys stripped of the user's prefix.
+func (u *userStore) Iterate(fn func(key string, val SimpleValue) bool) {
+	u.Store.Iterate(func(key string, val SimpleValue) bool {
+		if !strings.HasPrefix(key, u.prefix) {
+			return true
+		}
+		return fn(key[len(u.prefix):], val)
+	})
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfigErrors lists the problems Validate found, one per line.
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Validate checks the settings without serving: values out of range or contradicting each other, listener addresses, files
+// that are read at startup, directories of files that are written, and the TLS certificate. It returns ConfigErrors listing
+// every problem, each starting with the setting named like in config files, or nil if there is none.
+// Ports are not opened, so ports taken by other processes aren't noticed.
+func (c Config) Validate() error {
+	var errs ConfigErrors
+	report := func(name string, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+	}
+
+	// Listeners
+	if len(c.Listeners) == 0 {
+		report("listeners", "no listener")
+	}
+	addrs := map[string]string{}
+	checkAddr := func(name, addr string) {
+		if other, ok := addrs[addr]; ok {
+			report(name, "%s is used by %s too", addr, other)
+			return
+		}
+		addrs[addr] = name
+		if err := checkTCPAddr(addr); err != nil {
+			report(name, "%s: %v", addr, err)
+		}
+	}
+	for _, lc := range c.Listeners {
+		if lc.MaxConns < 0 {
+			report("listeners", "%s: max_conns must not be negative", lc.Addr)
+		}
+		if c.EventLoop && !lc.TLS && lc.IdleTimeout < 0 {
+			report("listeners", "%s: idle_timeout must be positive with event_loop", lc.Addr)
+		}
+		if name := lc.Deny.unknownCommand(); name != "" {
+			report("listeners", "%s: unknown command %q in deny", lc.Addr, name)
+		}
+		network, addr := lc.network()
+		switch {
+		case lc.TLS && c.TLSCertFile == "":
+			report("listeners", "%s: tls needs tls_cert_file and tls_key_file", lc.Addr)
+		case lc.ClientCert != "" && !lc.TLS:
+			report("listeners", "%s: client_cert needs tls", lc.Addr)
+		case lc.ClientCert != "" && c.TLSClientCAFile == "":
+			report("listeners", "%s: client_cert needs tls_client_ca_file", lc.Addr)
+		}
+		if network != "unix" {
+			checkAddr("listeners", addr)
+			continue
+		}
+		if err := checkDir(addr); err != nil {
+			report("listeners", "%s: %v", lc.Addr, err)
+		}
+	}
+	for _, l := range []struct{ name, addr string }{
+		{"web_socket_addr", c.WebSocketAddr}, {"admin_addr", c.AdminAddr}, {"quic_addr", c.QUICAddr},
+	} {
+		if l.addr != "" {
+			checkAddr(l.name, l.addr)
+		}
+	}
+
+	// Choices and numbers
+	var names []string
+	for name := range configChoices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := reflect.ValueOf(c).Field(configFields[name]).String()
+		if choice := configChoices[name]; !choice.valid(value) {
+			report(name, "unknown value %q, expected %s", value, choice.choices)
+		}
+	}
+	if err := checkSegments(&c); err != nil {
+		report("lru_hot_percent", "%v", err)
+	}
+	if err := checkSamples(&c); err != nil {
+		report("lfu_samples", "%v", err)
+	}
+	if c.TTLJitter < 0 || c.TTLJitter > 100 {
+		report("ttl_jitter", "must be a percentage from 0 to 100")
+	}
+	if c.MaxConns < 0 {
+		report("max_conns", "must not be negative")
+	}
+	for _, limit := range []struct {
+		name  string
+		value int
+	}{
+		{"max_conns_per_ip", c.MaxConnsPerIP}, {"auth_ban_threshold", c.AuthBanThreshold},
+		{"event_loop_workers", c.EventLoopWorkers}, {"conn_workers", c.ConnWorkers}, {"conn_queue", c.ConnQueue},
+		{"conn_ops_per_sec", c.ConnOpsPerSec}, {"conn_bytes_per_sec", c.ConnBytesPerSec},
+		{"ip_ops_per_sec", c.IPOpsPerSec}, {"ip_bytes_per_sec", c.IPBytesPerSec},
+	} {
+		if limit.value < 0 {
+			report(limit.name, "must not be negative")
+		}
+	}
+	if c.AuthBackoff < 0 {
+		report("auth_backoff", "must not be negative")
+	}
+	if c.AuthBanThreshold > 0 && c.AuthBanDuration <= 0 {
+		report("auth_ban_duration", "must be positive to ban IPs after auth_ban_threshold failures")
+	}
+	if c.EventLoop && !eventLoopSupported {
+		report("event_loop", "is only supported on Linux")
+	}
+	if err := checkIdleTimeout(&c); err != nil {
+		report("idle_timeout", "%v", err)
+	}
+	if c.ReadBufferSize < 16 {
+		report("read_buffer_size", "must be at least 16 bytes")
+	}
+	if c.MaxRequestSize < 1 {
+		report("max_request_size", "must be at least 1 byte")
+	}
+	if c.AccessLogPath != "" && c.AccessLogSample < 1 {
+		report("access_log_sample", "must be at least 1")
+	}
+	if c.AuditLogPath != "" && c.AuditLogRetain < 1 {
+		report("audit_log_retain", "must be at least 1")
+	}
+	if c.SnapshotPath != "" && c.SnapshotRetain < 1 {
+		report("snapshot_retain", "must be at least 1")
+	}
+	if c.MemoryFile != "" && c.MaxMemory == 0 {
+		report("memory_file", "needs max_memory")
+	}
+	if c.OffHeap && c.MaxMemory == 0 {
+		report("off_heap", "needs max_memory")
+	}
+	if len(c.NamespaceQuotas) > 0 && c.NamespaceSeparator == "" {
+		report("namespace_quotas", "needs namespace_separator")
+	}
+	for user, acl := range c.UserDeny {
+		if name := acl.unknownCommand(); name != "" {
+			report("user_deny", "%s: unknown command %q", user, name)
+		}
+	}
+	if c.IsolateUsers && c.NamespaceSeparator == "" {
+		report("isolate_users", "needs namespace_separator")
+	}
+
+	// Files
+	for _, f := range []struct{ name, path string }{
+		{"access_log_path", c.AccessLogPath}, {"audit_log_path", c.AuditLogPath}, {"memory_file", c.MemoryFile},
+		{"extstore_path", c.ExtstorePath}, {"snapshot_path", c.SnapshotPath}, {"aof_path", c.AOFPath},
+		{"bolt_path", c.BoltPath}, {"pid_file", c.PidFile},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if err := checkDir(f.path); err != nil {
+			report(f.name, "%v", err)
+		}
+	}
+	if c.PidFile != "" {
+		if err := CheckPidFile(c.PidFile); err != nil {
+			report("pid_file", "%v", err)
+		}
+	}
+	if c.ImportDump != "" {
+		if err := checkReadable(c.ImportDump); err != nil {
+			report("import_dump", "%v", err)
+		}
+	}
+	if _, err := loadPersistKey(c.PersistKeyFile); err != nil {
+		report("persist_key_file", "%v", err)
+	}
+
+	// Authentication
+	if c.SASLUsersFile != "" {
+		users, err := loadUsers(c.SASLUsersFile)
+		if err == nil && c.IsolateUsers && c.NamespaceSeparator != "" {
+			err = users.isolatable(c.NamespaceSeparator)
+		}
+		if err != nil {
+			report("sasl_users_file", "%v", err)
+		}
+	} else {
+		if c.RequireAuth {
+			report("require_auth", "needs sasl_users_file")
+		}
+		if c.IsolateUsers {
+			report("isolate_users", "needs sasl_users_file")
+		}
+		for _, lc := range c.Listeners {
+			if lc.Auth == AuthRequired {
+				report("listeners", "%s: auth=required needs sasl_users_file", lc.Addr)
+			}
+		}
+	}
+
+	// TLS
+	if c.TLSClientCAFile != "" {
+		if _, err := loadCertPool(c.TLSClientCAFile); err != nil {
+			report("tls_client_ca_file", "%v", err)
+		}
+	}
+	switch {
+	case c.TLSCertFile == "" && c.TLSKeyFile == "":
+		if c.QUICAddr != "" {
+			report("quic_addr", "needs tls_cert_file and tls_key_file")
+		}
+	case c.TLSCertFile == "":
+		report("tls_cert_file", "missing, tls_key_file is set")
+	case c.TLSKeyFile == "":
+		report("tls_key_file", "missing, tls_cert_file is set")
+	default:
+		if err := checkCertificate(c.TLSCertFile, c.TLSKeyFile); err != nil {
+			report("tls_cert_file", "%v", err)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// checkTCPAddr returns an error unless addr is a host:port address a TCP listener can be opened on.
+func checkTCPAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		if _, err := net.LookupPort("tcp", port); err != nil {
+			return fmt.Errorf("bad port %q", port)
+		}
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDir returns an error unless the directory a file is created in exists.
+func checkDir(path string) error {
+	dir := filepath.Dir(path)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// checkReadable returns an error unless path is a file that can be opened for reading.
+func checkReadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// checkCertificate returns an error unless certFile and keyFile hold a matching pair and the certificate is valid now.
+func checkCertificate(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	now := clock.Now()
+	switch {
+	case now.After(leaf.NotAfter):
+		return fmt.Errorf("certificate expired on %s", leaf.NotAfter.Format("2006-01-02"))
+	case now.Before(leaf.NotBefore):
+		return fmt.Errorf("certificate is not valid before %s", leaf.NotBefore.Format("2006-01-02"))
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Verbosity levels, like the -v flags of memcached. Lines of client activity are logged at info level.
+const (
+	VerbosityQuiet       = 0 // Client activity isn't logged.
+	VerbosityConnections = 1 // Connections opening and closing are logged.
+	VerbosityCommands    = 2 // The header of every command is logged too.
+)
+
+// logConn logs a line about the lifecycle of the connection, at info level from VerbosityConnections on and else at debug level.
+func (ctx *ConnectionContext) logConn(msg string, keyvals ...interface{}) {
+	if ctx.server.verbosity() >= VerbosityConnections {
+		ctx.logger().Info(msg, keyvals...)
+	} else {
+		ctx.logger().Debug(msg, keyvals...)
+	}
+}
+
+// logCommand logs the header of a binary command from VerbosityCommands on.
+func (ctx *ConnectionContext) logCommand(header RequestHeader) {
+	if ctx.server.verbosity() < VerbosityCommands {
+		return
+	}
+	ctx.logger().Info("command", "op", opcodeName(header.Opcode), "key_len", header.KeyLength, "extra_len", header.ExtraLength,
+		"body_len", header.TotalBodyLength, "opaque", header.Opaque, "cas", header.CAS)
+}
+
+// logTextCommand logs the command line of a text command from VerbosityCommands on.
+func (ctx *ConnectionContext) logTextCommand(args []string) {
+	if ctx.server.verbosity() < VerbosityCommands {
+		return
+	}
+	ctx.logger().Info("command", "line", strings.Join(args, " "))
+}
+
+// setVerbosity changes the verbosity of the server for the client of ctx.
+func setVerbosity(level int, ctx *ConnectionContext) error {
+	was, err := ctx.server.setRuntimeSetting("verbosity", reflect.ValueOf(level))
+	if err != nil {
+		return err
+	}
+	ctx.logger().Info("setting changed", "setting", "verbosity", "old", was, "new", level)
+	return nil
+}
+
+func checkVerbosity(c *Config) error {
+	if c.Verbosity < 0 {
+		return fmt.Errorf("verbosity must not be negative")
+	}
+	return nil
+}
+
+// VerbosityHandler handles the VERBOSITY command, whose 4 byte extra holds the new verbosity.
+var VerbosityHandler HandleFunc = func(header RequestHeader, ctx *ConnectionContext) error {
+	if header.KeyLength != 0 || header.ExtraLength != 4 || header.TotalBodyLength != 4 {
+		return fmt.Errorf("Verbosity command MUST have a 4 byte extra only: keylength %d, extralength: %d, totalbodylength: %d",
+			header.KeyLength, header.ExtraLength, header.TotalBodyLength)
+	}
+	buf, err := readBody(header, ctx)
+	if err != nil {
+		return err
+	}
+	if err := setVerbosity(int(GetUint32(buf)), ctx); err != nil {
+		return writeError(header, err, ctx)
+	}
+	respHeader := ResponseHeader{}
+	respHeader.Magic = MagicResponse
+	respHeader.Opcode = header.Opcode
+	respHeader.Opaque = header.Opaque
+	respHeader.Status = CodeNoError
+	return writeResponse(respHeader, nil, nil, nil, ctx.RW)
+}
+
+// TextVerbosityHandler handles the "verbosity <level> [noreply]" command.
+var TextVerbosityHandler TextHandleFunc = func(args []string, ctx *ConnectionContext) error {
+	noreply := len(args) > 1 && args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	if len(args) != 2 {
+		return writeTextLine(ctx, "ERROR")
+	}
+	level, err := strconv.ParseUint(args[1], 10, 16)
+	if err != nil {
+		return writeTextLine(ctx, "CLIENT_ERROR bad command line format")
+	}
+	if err := setVerbosity(int(level), ctx); err != nil {
+		return writeTextLine(ctx, "SERVER_ERROR %v", err)
+	}
+	if noreply {
+		return nil
+	}
+	return writeTextLine(ctx, "OK")
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// WebSocket frame opcodes (RFC 6455).
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsConn turns a WebSocket connection into a plain byte stream carrying binary protocol packets.
+// Incoming binary frames are concatenated, so a packet may span several frames and a frame may hold several packets.
+// Every Write is sent as one binary frame.
+type wsConn struct {
+	net.Conn
+	br        *bufio.Reader // Hijacked reader, may already hold buffered bytes.
+	remaining uint64        // Unread payload bytes of the current frame.
+	mask      [4]byte
+	maskPos   int
+}
+
+// readFrameHeader reads the next frame header, answering control frames in place until a data frame arrives.
+func (c *wsConn) readFrameHeader() error {
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(c.br, hdr[:2]); err != nil {
+			return err
+		}
+		opcode := hdr[0] & 0x0f
+		if hdr[1]&0x80 == 0 {
+			return errors.New("websocket: client frames must be masked")
+		}
+		length := uint64(hdr[1] & 0x7f)
+		switch length {
+		case 126:
+			if _, err := io.ReadFull(c.br, hdr[:2]); err != nil {
+				return err
+			}
+			length = uint64(GetUint16(hdr[:2]))
+		case 127:
+			if _, err := io.ReadFull(c.br, hdr[:8]); err != nil {
+				return err
+			}
+			length = GetUint64(hdr[:8])
+		}
+		if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+			return err
+		}
+		c.maskPos = 0
+
+		switch opcode {
+		case wsOpBinary, wsOpContinuation:
+			c.remaining = length
+			return nil
+		case wsOpPing, wsOpPong, wsOpClose:
+			if length > 125 {
+				return errors.New("websocket: control frame too large")
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(c.br, payload); err != nil {
+				return err
+			}
+			for i := range payload {
+				payload[i] ^= c.mask[i%4]
+			}
+			if opcode == wsOpPing {
+				if err := c.writeFrame(wsOpPong, payload); err != nil {
+					return err
+				}
+			} else if opcode == wsOpClose {
+				c.writeFrame(wsOpClose, payload)
+				return io.EOF
+			}
+		default:
+			// Text frames can't carry binary protocol packets.
+			c.writeFrame(wsOpClose, []byte{0x03, 0xeb}) // 1003: unsupported data
+			return fmt.Errorf("websocket: unsupported frame opcode %x", opcode)
+		}
+	}
+}
+
+// Read reads unmasked payload bytes of data frames.
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.readFrameHeader(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.br.Read(b)
+	for i := 0; i < n; i++ {
+		b[i] ^= c.mask[c.maskPos]
+		c.maskPos = (c.maskPos + 1) % 4
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// Write sends b as a single binary frame.
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	hdr := make([]byte, 2, 10+len(payload))
+	hdr[0] = 0x80 | opcode // FIN
+	l := len(payload)
+	switch {
+	case l < 126:
+		hdr[1] = byte(l)
+	case l <= 0xffff:
+		hdr[1] = 126
+		hdr = append(hdr, GetNthByteFromUint16(uint16(l), 0), GetNthByteFromUint16(uint16(l), 1))
+	default:
+		hdr[1] = 127
+		for pos := 0; pos < 4; pos++ {
+			hdr = append(hdr, GetNthByteFromUint32(uint32(uint64(l)>>32), pos))
+		}
+		for pos := 0; pos < 4; pos++ {
+			hdr = append(hdr, GetNthByteFromUint32(uint32(l), pos))
+		}
+	}
+	_, err := c.Conn.Write(append(hdr, payload...))
+	return err
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowedOrigin tells whether the page a WebSocket upgrade request came from may connect, by WebSocketOrigins.
+func (s *Server) allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(s.config.WebSocketOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range s.config.WebSocketOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleWebSocket upgrades an HTTP request and serves the binary protocol over the resulting connection. Like the connections
+// of the accept loops, it counts against MaxConns and is waited for by Shutdown.
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	if !s.allowedOrigin(r) {
+		s.logger().Debug("WebSocket origin refused", "remote", r.RemoteAddr, "origin", r.Header.Get("Origin"))
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	if max := s.config.MaxConns; max > 0 && atomic.LoadInt64(&s.open) >= int64(max) {
+		atomic.AddUint64(&s.counters.rejectedConns, 1)
+		http.Error(w, "Too many open connections", http.StatusServiceUnavailable)
+		return
+	}
+	// Shutdown waits for active once closing is closed under mutex, so no connection is added after it began waiting.
+	s.mutex.Lock()
+	if s.stopping() {
+		s.mutex.Unlock()
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	atomic.AddInt64(&s.open, 1)
+	s.active.Add(1)
+	s.mutex.Unlock()
+	done := func() {
+		atomic.AddInt64(&s.open, -1)
+		s.active.Done()
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		done()
+		http.Error(w, "WebSocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		done()
+		s.logger().Error("error hijacking WebSocket connection", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		done()
+		return
+	}
+	s.handleConn(&wsConn{Conn: conn, br: brw.Reader}, ListenerConfig{Addr: s.config.WebSocketAddr, Protocol: ProtocolBinary}, done)
+}
+
+// startWebSocket listens for WebSocket connections on addr. It returns once s is shut down, or with the error the listener
+// failed with.
+func (s *Server) startWebSocket(addr string) error {
+	l, err := s.openListener("websocket "+addr, func() (net.Listener, error) { return net.Listen("tcp", addr) })
+	if err != nil {
+		return fmt.Errorf("listening on %s: %v", addr, err)
+	}
+	if !s.track(l, false) {
+		return nil
+	}
+	s.logger().Info("listening", "addr", addr, "protocol", "websocket")
+	err = http.Serve(l, http.HandlerFunc(s.handleWebSocket))
+	if s.stopping() {
+		return nil
+	}
+	return fmt.Errorf("serving WebSocket: %v", err)
+}
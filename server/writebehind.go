@@ -0,0 +1,265 @@
+package server
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Mutation is a change of a cached item reported to a WriteBehind hook.
+type Mutation struct {
+	Key     string
+	Value   SimpleValue // The item as stored. Empty for deletions.
+	Expires int64       // Unix time the item expires at, 0 if never.
+	Delete  bool
+}
+
+// WriteBehind persists a batch of mutations, e.g. to a database, for write-behind caching. On error the batch is retried later.
+// Mutations of the same key are coalesced while queued, so only the latest state of a key is written.
+type WriteBehind func(batch []Mutation) error
+
+// Retry delays of a failing WriteBehind hook. The delay doubles with every failure in a row.
+const (
+	writeBehindMinRetry = time.Second
+	writeBehindMaxRetry = 30 * time.Second
+)
+
+// writeBehindQueue collects the mutations for one hook and feeds them to it in batches from a background goroutine.
+type writeBehindQueue struct {
+	hook    WriteBehind
+	batch   int
+	delay   time.Duration
+	mutex   sync.Mutex
+	pending map[string]Mutation // Latest mutation per key. Guarded by mutex.
+	order   []string            // Keys in pending, oldest first. Guarded by mutex.
+	wake    chan struct{}
+	log     Logger // Reports failing hook calls.
+
+	written uint64 // Mutations the hook accepted. Updated atomically.
+	errors  uint64 // Failed hook calls. Updated atomically.
+}
+
+func newWriteBehindQueue(hook WriteBehind, batch int, delay time.Duration, log Logger) *writeBehindQueue {
+	if batch <= 0 {
+		batch = 1
+	}
+	q := &writeBehindQueue{hook: hook, batch: batch, delay: delay, pending: map[string]Mutation{}, wake: make(chan struct{}, 1),
+		log: log}
+	go q.run()
+	return q
+}
+
+// push queues a mutation, replacing a queued one of the same key.
+func (q *writeBehindQueue) push(m Mutation) {
+	q.mutex.Lock()
+	if _, ok := q.pending[m.Key]; !ok {
+		q.order = append(q.order, m.Key)
+	}
+	q.pending[m.Key] = m
+	full := len(q.order) >= q.batch
+	q.mutex.Unlock()
+	if full {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take removes up to one batch of the oldest mutations from the queue.
+func (q *writeBehindQueue) take() []Mutation {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	n := len(q.order)
+	if n > q.batch {
+		n = q.batch
+	}
+	batch := make([]Mutation, 0, n)
+	for _, key := range q.order[:n] {
+		batch = append(batch, q.pending[key])
+		delete(q.pending, key)
+	}
+	q.order = q.order[n:]
+	return batch
+}
+
+// requeue puts back the mutations of a failed batch, unless a key was changed again meanwhile.
+func (q *writeBehindQueue) requeue(batch []Mutation) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	keys := make([]string, 0, len(batch))
+	for _, m := range batch {
+		if _, ok := q.pending[m.Key]; !ok {
+			q.pending[m.Key] = m
+			keys = append(keys, m.Key)
+		}
+	}
+	q.order = append(keys, q.order...)
+}
+
+// queued returns the number of mutations waiting.
+func (q *writeBehindQueue) queued() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.order)
+}
+
+// run writes a batch whenever one is full or delay passed, backing off while the hook fails.
+func (q *writeBehindQueue) run() {
+	retry := time.Duration(0)
+	for {
+		wait := q.delay
+		if retry > 0 {
+			wait = retry
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-q.wake:
+			if retry > 0 {
+				<-timer.C // Don't hammer a failing backend because the queue filled up.
+			}
+		case <-timer.C:
+		}
+		timer.Stop()
+		for {
+			batch := q.take()
+			if len(batch) == 0 {
+				break
+			}
+			if err := q.hook(batch); err != nil {
+				atomic.AddUint64(&q.errors, 1)
+				q.log.Error("error writing mutations behind", "mutations", len(batch), "err", err)
+				q.requeue(batch)
+				if retry *= 2; retry < writeBehindMinRetry {
+					retry = writeBehindMinRetry
+				} else if retry > writeBehindMaxRetry {
+					retry = writeBehindMaxRetry
+				}
+				break
+			}
+			atomic.AddUint64(&q.written, uint64(len(batch)))
+			retry = 0
+		}
+	}
+}
+
+// writeBehindStore reports the successful mutations of the wrapped store to WriteBehind hooks. Flushes are not reported.
+type writeBehindStore struct {
+	Store
+	all        *writeBehindQueue            // Queue of keys without a hook of their namespace, nil if none.
+	namespaces map[string]*writeBehindQueue // Queues by namespace. A nil queue means the namespace isn't written behind.
+	separator  string
+}
+
+func newWriteBehindStore(store Store, cfg Config, log Logger) *writeBehindStore {
+	w := &writeBehindStore{Store: store, namespaces: map[string]*writeBehindQueue{}, separator: cfg.NamespaceSeparator}
+	if cfg.WriteBehind != nil {
+		w.all = newWriteBehindQueue(cfg.WriteBehind, cfg.WriteBehindBatch, cfg.WriteBehindDelay, log)
+	}
+	for name, hook := range cfg.NamespaceWriteBehind {
+		w.namespaces[name] = nil
+		if hook != nil {
+			w.namespaces[name] = newWriteBehindQueue(hook, cfg.WriteBehindBatch, cfg.WriteBehindDelay, log)
+		}
+	}
+	return w
+}
+
+// Unwrap returns the store written behind.
+func (w *writeBehindStore) Unwrap() Store {
+	return w.Store
+}
+
+func (w *writeBehindStore) GetBytes(key []byte) (SimpleValue, bool) {
+	return getBytes(w.Store, key)
+}
+
+// queue returns the queue of key, or nil if it isn't written behind.
+func (w *writeBehindStore) queue(key string) *writeBehindQueue {
+	if len(w.namespaces) > 0 {
+		if q, ok := w.namespaces[namespaceOf(key, w.separator)]; ok {
+			return q
+		}
+	}
+	return w.all
+}
+
+// stored queues the new state of key. data is the value as sent by the client, which is copied as request buffers are reused.
+func (w *writeBehindStore) stored(key string, val SimpleValue, data []byte) {
+	if q := w.queue(key); q != nil {
+		val.RawData = append([]byte(nil), data...)
+		q.push(Mutation{Key: key, Value: val, Expires: unixExpiration(val.TTL)})
+	}
+}
+
+func (w *writeBehindStore) Set(key string, val SimpleValue, cas uint64, replace bool) (SimpleValue, error) {
+	stored, err := w.Store.Set(key, val, cas, replace)
+	if err == nil {
+		w.stored(key, stored, val.RawData)
+	}
+	return stored, err
+}
+
+func (w *writeBehindStore) Add(key string, val SimpleValue) (SimpleValue, error) {
+	stored, err := w.Store.Add(key, val)
+	if err == nil {
+		w.stored(key, stored, val.RawData)
+	}
+	return stored, err
+}
+
+func (w *writeBehindStore) Delete(key string, cas uint64) error {
+	err := w.Store.Delete(key, cas)
+	if q := w.queue(key); err == nil && q != nil {
+		q.push(Mutation{Key: key, Delete: true})
+	}
+	return err
+}
+
+func (w *writeBehindStore) Touch(key string, ttl int) (SimpleValue, bool) {
+	val, ok := w.Store.Touch(key, ttl)
+	if ok {
+		w.stored(key, val, val.RawData)
+	}
+	return val, ok
+}
+
+// UpdateMeta writes the whole item behind, so its value is read back after the update.
+func (w *writeBehindStore) UpdateMeta(key string, ttl int, flags *uint32, cas uint64) (SimpleValue, error) {
+	val, err := updateMeta(w.Store, key, ttl, flags, cas)
+	if q := w.queue(key); err == nil && q != nil {
+		if full, ok := w.Store.Get(key); ok {
+			w.stored(key, full, full.RawData)
+		}
+	}
+	return val, err
+}
+
+func (w *writeBehindStore) Incr(key string, delta uint64, decr bool, initial uint64, create bool, ttl int, cas uint64) (SimpleValue, uint64, error) {
+	val, n, err := w.Store.Incr(key, delta, decr, initial, create, ttl, cas)
+	if err == nil {
+		w.stored(key, val, val.RawData)
+	}
+	return val, n, err
+}
+
+func (w *writeBehindStore) Stats() []Stat {
+	queued, written, errors := 0, uint64(0), uint64(0)
+	queues := []*writeBehindQueue{w.all}
+	for _, q := range w.namespaces {
+		queues = append(queues, q)
+	}
+	for _, q := range queues {
+		if q != nil {
+			queued += q.queued()
+			written += atomic.LoadUint64(&q.written)
+			errors += atomic.LoadUint64(&q.errors)
+		}
+	}
+	return append(w.Store.Stats(),
+		Stat{"write_behind_queued", strconv.Itoa(queued)},
+		Stat{"write_behind_written", strconv.FormatUint(written, 10)},
+		Stat{"write_behind_errors", strconv.FormatUint(errors, 10)},
+	)
+}